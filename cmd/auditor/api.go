@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+)
+
+func HandleNotFound(w http.ResponseWriter, req *http.Request) {
+	returnFailure(w, req, fmt.Errorf("function not found: "+req.RequestURI), 404)
+}
+
+// Generic failure
+func returnFailure(w http.ResponseWriter, req *http.Request, err error, statusCode int) {
+	resp := make(map[string]interface{})
+	resp["status"] = "failed"
+	resp["err"] = err.Error()
+
+	respJSON, _ := json.Marshal(resp)
+
+	w.WriteHeader(statusCode)
+	w.Write(respJSON)
+	ErrorLogger.Println("Error: " + err.Error())
+}
+
+func returnOK(w http.ResponseWriter, req *http.Request, respData map[string]interface{}) {
+	respData["status"] = "OK"
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// Handle /version request
+func HandlerVersion(w http.ResponseWriter, req *http.Request) {
+	returnOK(w, req, map[string]interface{}{
+		"version": ConfigVersion,
+		"point":   uint64(Auditor.Point),
+	})
+}
+
+// Handle /threshold/register
+// 由运营方提交用户的私钥份额，须带有运营方令牌和用户的签名；已有份额时只接受由原签名公钥签名的替换
+func HandlerRegisterShare(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new " + auditorlib.RegisterShareEndpoint)
+	if !requireOperator(w, req) {
+		return
+	}
+
+	request := new(restfulpayload.AuditorRegisterShareReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	shareBytes, err := base64.StdEncoding.DecodeString(request.Share)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("share parse failed: "+err.Error()), 400)
+		return
+	}
+	share := new(drlwe.ShamirSecretShare)
+	if err = share.UnmarshalBinary(shareBytes); err != nil {
+		returnFailure(w, req, fmt.Errorf("share parse failed: "+err.Error()), 400)
+		return
+	}
+	pkBytes, err := base64.StdEncoding.DecodeString(request.ECDSA_pubkey)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("ecdsa pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+	pk, _, err := key.UnmarshalSigningPublicKey(pkBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("ecdsa pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+	sig, err := base64.StdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("sig parse failed: "+err.Error()), 400)
+		return
+	}
+	if err = checkFreshness(request.Nonce, request.TimeStamp); err != nil {
+		returnFailure(w, req, err, http.StatusUnauthorized)
+		return
+	}
+
+	err = Auditor.ImportSignedShare(&auditorlib.ThresholdShare{
+		UserUUID:   request.UUID,
+		Point:      drlwe.ShamirPublicPoint(request.Point),
+		Threshold:  request.Threshold,
+		Share:      share,
+		SigningKey: pk,
+	}, request.TimeStamp, request.Nonce, sig)
+	if errors.Is(err, auditorlib.ErrShareSignature) {
+		returnFailure(w, req, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	returnOK(w, req, map[string]interface{}{})
+	InfoLogger.Print("Processed new " + auditorlib.RegisterShareEndpoint + ", uuid = " + request.UUID.String())
+}
+
+// Handle /threshold/decrypt
+// 请求须由服务端签名且未过期，并指明密文所属的交易或余额刷新，否则返回 401 并记录调用方
+func HandlerPartialDecrypt(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new " + auditorlib.PartialDecryptEndpoint)
+
+	request := new(restfulpayload.AuditorPartialDecryptReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	verify := func(pk *ecdsa.PublicKey) bool { return auditorlib.VerifyPartialDecrypt(*request, pk) }
+	if !requireServer(w, req, verify, request.Nonce, request.TimeStamp) {
+		return
+	}
+
+	ctBytes, err := base64.StdEncoding.DecodeString(request.CT)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("ct parse failed: "+err.Error()), 400)
+		return
+	}
+	ct, err := misc.UnmarshalCiphertext(ctBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("ct parse failed: "+err.Error()), 400)
+		return
+	}
+
+	actives := make([]drlwe.ShamirPublicPoint, 0, len(request.Actives))
+	for _, p := range request.Actives {
+		actives = append(actives, drlwe.ShamirPublicPoint(p))
+	}
+
+	share, err := Auditor.PartialDecrypt(request.UUID, ct, actives)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	shareBytes, err := share.MarshalBinary()
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	returnOK(w, req, map[string]interface{}{
+		"share": base64.StdEncoding.EncodeToString(shareBytes),
+	})
+	InfoLogger.Printf("Processed new %s from %s, uuid = %v, ref = %v",
+		auditorlib.PartialDecryptEndpoint, req.RemoteAddr, request.UUID, request.Ref)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Handle /pubkey
+// 返回告警签名公钥，格式与 CA 的 /pubkey 相同
+func HandlerPubkey(w http.ResponseWriter, req *http.Request) {
+	pkBytes, err := x509.MarshalPKIXPublicKey(&SigningKey.PublicKey)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	returnOK(w, req, map[string]interface{}{
+		"pubkey": []string{base64.StdEncoding.EncodeToString(pkBytes)},
+	})
+}
+
+// Handle /register/user
+// 单监管者部署时，由运营方提交用户完整的 CKKS 私钥，须带有运营方令牌
+func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new /register/user")
+	if !requireOperator(w, req) {
+		return
+	}
+
+	request := new(restfulpayload.AuditorRegisterUserReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	skBytes, err := base64.RawStdEncoding.DecodeString(request.CKKS_privkey)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("ckks privkey parse failed: "+err.Error()), 400)
+		return
+	}
+	sk := rlwe.NewSecretKey(misc.GetRLWEParams())
+	if err = sk.UnmarshalBinary(skBytes); err != nil {
+		returnFailure(w, req, fmt.Errorf("ckks privkey parse failed: "+err.Error()), 400)
+		return
+	}
+
+	KeyStore.ImportSecretKey(request.UUID, sk)
+
+	returnOK(w, req, map[string]interface{}{})
+	InfoLogger.Print("Processed new /register/user, uuid = " + request.UUID.String())
+}
+
+// Handle /compliance/check
+// 输入交易 UUID，从服务端取回交易，解密后按规则检查，返回签名的告警，须带有运营方令牌
+// 需要挂起的告警同时会被发送给服务端；返回内容不包含解密出的金额
+func HandlerComplianceCheck(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new /compliance/check")
+	if !requireOperator(w, req) {
+		return
+	}
+
+	var request struct {
+		UUID uuid.UUID `json:"uuid"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	tx, err := auditorlib.FetchTransaction(ConfigServerURL, request.UUID)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("fetch transaction failed: "+err.Error()), http.StatusBadGateway)
+		return
+	}
+
+	facts, err := auditorlib.ExtractFacts(tx, KeyStore)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	alerts, err := Engine.Evaluate(facts)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	for _, a := range alerts {
+		InfoLogger.Printf("Alert: transaction = %v, rule = %s, reason = %s", a.TxUUID, a.Rule, a.Reason)
+		if err = auditorlib.SendAlertToServer(ConfigServerURL, a); err != nil {
+			ErrorLogger.Printf("Sending alert %v to server failed: %v", a.UUID, err)
+		}
+	}
+
+	returnOK(w, req, map[string]interface{}{
+		"alerts": alerts,
+	})
+}
+
+// Handle /compliance/release
+// 审查完成后，由运营方放行被挂起的交易，须带有运营方令牌
+func HandlerComplianceRelease(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new /compliance/release")
+	if !requireOperator(w, req) {
+		return
+	}
+
+	var request struct {
+		UUID   uuid.UUID `json:"uuid"`
+		Reason string    `json:"reason"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	alert := auditorlib.NewReleaseAlert(request.UUID, request.Reason)
+	if err := alert.Sign(SigningKey); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	if err := auditorlib.SendAlertToServer(ConfigServerURL, alert); err != nil {
+		returnFailure(w, req, err, http.StatusBadGateway)
+		return
+	}
+
+	returnOK(w, req, map[string]interface{}{
+		"alert": alert,
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+// demo.go: 在本地启动 n 个监管者进程，演示 t-out-of-n 的门限解密
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+)
+
+func runDemo(n, t, basePort int) (err error) {
+	if t < 1 || t > n {
+		return fmt.Errorf("invalid threshold %d for %d auditors", t, n)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "chimata-auditor-demo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// 各监管者共用的运营方令牌，及代替服务端签名部分解密请求的密钥
+	tokenPath := filepath.Join(dir, "operator.token")
+	token, err := loadOrGenerateOperatorToken(tokenPath)
+	if err != nil {
+		return err
+	}
+	serverKeyPath := filepath.Join(dir, "server.pem")
+	serverKey, err := key.LoadOrGenerateECDSAKeyPEM(serverKeyPath)
+	if err != nil {
+		return err
+	}
+
+	// 启动 n 个监管者进程
+	auditors := make(map[drlwe.ShamirPublicPoint]string, n)
+	for i := 0; i < n; i++ {
+		point := drlwe.ShamirPublicPoint(i + 1)
+		port := strconv.Itoa(basePort + i)
+		cmd := exec.Command(self, "serve", "--port", port, "--point", fmt.Sprint(point),
+			"--signing-key", filepath.Join(dir, "auditor-"+port+".pem"),
+			"--operator-token", tokenPath, "--server-pubkey", serverKeyPath+".pub")
+		cmd.Stderr = os.Stderr
+		if err = cmd.Start(); err != nil {
+			return err
+		}
+		defer cmd.Process.Kill()
+		auditors[point] = "http://" + DefaultListenAddr + ":" + port
+	}
+	for _, url := range auditors {
+		if err = waitForAuditor(url); err != nil {
+			return err
+		}
+	}
+	InfoLogger.Printf("Demo: %d auditors up, threshold = %d", n, t)
+
+	// 生成一个用户，并将其私钥拆分给监管者
+	user, err := clientlib.NewUser("demo")
+	if err != nil {
+		return err
+	}
+	pk := user.UserCKKSKeyChain[0].CKKSPublicKey
+	if err = user.RegisterThresholdAuditors(auditors, t, token); err != nil {
+		return err
+	}
+
+	amount := misc.GenRandFloat()
+	ct, err := clientlib.EncryptAmount(amount, pk)
+	if err != nil {
+		return err
+	}
+	// 演示用的交易 ID，实际部署中为密文所属的交易或余额刷新
+	ref := uuid.New()
+	InfoLogger.Printf("Demo: encrypted amount %.2f for user %v", amount, user.UserIdentifier)
+
+	// t 个监管者：可以解密
+	enough := pickAuditors(auditors, t)
+	res, err := auditorlib.ThresholdDecrypt(enough, ref, user.UserIdentifier, ct, serverKey)
+	if err != nil {
+		return err
+	}
+	InfoLogger.Printf("Demo: %d auditors decrypted %.2f", t, res)
+
+	// t-1 个监管者：被拒绝
+	if t > 1 {
+		_, err = auditorlib.ThresholdDecrypt(pickAuditors(auditors, t-1), ref, user.UserIdentifier, ct, serverKey)
+		InfoLogger.Printf("Demo: %d auditors refused: %v", t-1, err)
+	}
+
+	return nil
+}
+
+func pickAuditors(auditors map[drlwe.ShamirPublicPoint]string, k int) map[drlwe.ShamirPublicPoint]string {
+	res := make(map[drlwe.ShamirPublicPoint]string, k)
+	for p := drlwe.ShamirPublicPoint(1); len(res) < k; p++ {
+		if url, ok := auditors[p]; ok {
+			res[p] = url
+		}
+	}
+	return res
+}
+
+func waitForAuditor(url string) error {
+	for i := 0; i < 50; i++ {
+		resp, err := http.Get(url + "/version")
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("auditor %s did not start", url)
+}
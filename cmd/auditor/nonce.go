@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrStaleRequest 表示签名请求的时间戳超出了 request-max-age
+	ErrStaleRequest = errors.New("signed request has expired")
+	// ErrNonceReused 表示签名请求的 nonce 已被使用，即请求被重放
+	ErrNonceReused = errors.New("nonce has already been used")
+)
+
+// usedNonces 记录有效期内已使用的 nonce 及其过期时间
+// 监管者没有数据库，重启后记录丢失，重启前的请求在有效期内可以被重放一次
+var usedNonces = struct {
+	sync.Mutex
+	expires map[uuid.UUID]time.Time
+}{expires: make(map[uuid.UUID]time.Time)}
+
+// checkFreshness 检查签名请求的时间戳（unix 时间）与当前时间相差不超过 ConfigRequestMaxAge，
+// 并记录 nonce，同一 nonce 在有效期内再次出现时返回 ErrNonceReused
+func checkFreshness(nonce uuid.UUID, timestamp int64) error {
+	signedAt := time.Unix(timestamp, 0)
+	if age := time.Since(signedAt); age > ConfigRequestMaxAge || age < -ConfigRequestMaxAge {
+		return fmt.Errorf("%w: signed at %v", ErrStaleRequest, signedAt)
+	}
+
+	usedNonces.Lock()
+	defer usedNonces.Unlock()
+	now := time.Now()
+	for n, expires := range usedNonces.expires {
+		if expires.Before(now) {
+			delete(usedNonces.expires, n)
+		}
+	}
+	if _, ok := usedNonces.expires[nonce]; ok {
+		return ErrNonceReused
+	}
+	usedNonces.expires[nonce] = signedAt.Add(ConfigRequestMaxAge)
+	return nil
+}
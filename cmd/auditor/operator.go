@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/google/uuid"
+)
+
+// OperatorToken 为运营方调用 /register/user、/compliance/release 时须在 Authorization: Bearer 中提供的令牌
+var OperatorToken string
+
+// loadOrGenerateOperatorToken 从 path 读取运营方令牌，文件不存在时生成并保存
+func loadOrGenerateOperatorToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", errors.New("operator token file " + path + " is empty")
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, os.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+// requireOperator 检查请求是否带有运营方令牌，没有时返回 401 并记录调用方
+func requireOperator(w http.ResponseWriter, req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token != auth && subtle.ConstantTimeCompare([]byte(token), []byte(OperatorToken)) == 1 {
+		return true
+	}
+	ErrorLogger.Printf("Rejected unauthenticated %s from %s", req.URL.Path, req.RemoteAddr)
+	returnFailure(w, req, errors.New("operator token required"), http.StatusUnauthorized)
+	return false
+}
+
+// serverPubkey 为服务端的签名公钥，第一次收到服务端请求时从 ConfigServerPubkeyPath 读取
+// 服务端在启用透支检查时才生成签名密钥，因此不在启动时读取
+var serverPubkey struct {
+	sync.Mutex
+	pk *ecdsa.PublicKey
+}
+
+func getServerPubkey() (*ecdsa.PublicKey, error) {
+	serverPubkey.Lock()
+	defer serverPubkey.Unlock()
+	if serverPubkey.pk == nil {
+		pk, err := key.LoadECDSAPublicKeyPEM(ConfigServerPubkeyPath)
+		if err != nil {
+			return nil, err
+		}
+		serverPubkey.pk = pk
+	}
+	return serverPubkey.pk, nil
+}
+
+// requireServer 检查请求是否由服务端签名（verify 以服务端签名公钥验证）且未过期、未被重放，
+// 否则返回 401 并记录调用方
+func requireServer(w http.ResponseWriter, req *http.Request, verify func(*ecdsa.PublicKey) bool, nonce uuid.UUID, timestamp int64) bool {
+	pk, err := getServerPubkey()
+	if err != nil {
+		ErrorLogger.Printf("Rejected %s from %s: server public key not loaded", req.URL.Path, req.RemoteAddr)
+		returnFailure(w, req, errors.New("no server public key configured"), http.StatusServiceUnavailable)
+		return false
+	}
+	if !verify(pk) {
+		ErrorLogger.Printf("Rejected unauthenticated %s from %s", req.URL.Path, req.RemoteAddr)
+		returnFailure(w, req, errors.New("server signature verify failed"), http.StatusUnauthorized)
+		return false
+	}
+	if err = checkFreshness(nonce, timestamp); err != nil {
+		ErrorLogger.Printf("Rejected replayed %s from %s", req.URL.Path, req.RemoteAddr)
+		returnFailure(w, req, err, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+)
+
+// Handle /overdraft/pubkey
+// 返回透支公钥，用户据此生成到监管者的 swk 并注册到服务端
+func HandlerOverdraftPubkey(w http.ResponseWriter, req *http.Request) {
+	pkBytes, err := misc.MarshalCompactPublicKey(OverdraftKey.PublicKey, nil)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	returnOK(w, req, map[string]interface{}{
+		"pubkey": base64.StdEncoding.EncodeToString(pkBytes),
+	})
+}
+
+// Handle /overdraft/check
+// 解密服务端发来的透支指示值，返回 decision，见 auditorlib.OverdraftKey.Decide
+// 请求须由服务端签名且未过期，否则返回 401 并记录调用方
+func HandlerOverdraftCheck(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.AuditorOverdraftCheckReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	verify := func(pk *ecdsa.PublicKey) bool { return auditorlib.VerifyOverdraftCheck(*request, pk) }
+	if !requireServer(w, req, verify, request.Nonce, request.TimeStamp) {
+		return
+	}
+	indBytes, err := base64.StdEncoding.DecodeString(request.Indicator)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("indicator parse failed: "+err.Error()), 400)
+		return
+	}
+	ind, err := misc.UnmarshalCiphertext(indBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("indicator parse failed: "+err.Error()), 400)
+		return
+	}
+
+	decision, err := OverdraftKey.Decide(ind, request.Slots, auditorlib.DefaultOverdraftNoiseFloor)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusUnprocessableEntity)
+		return
+	}
+	InfoLogger.Printf("Overdraft check from %s: transaction = %v, sender = %v, decision = %s",
+		req.RemoteAddr, request.TxUUID, request.UUID, decision)
+
+	returnOK(w, req, map[string]interface{}{
+		"decision": decision,
+	})
+}
+
+// Handle /overdraft/certifySwk
+// 检查用户生成的到透支密钥的 swk 和计算密钥中的重线性化密钥，都正确时返回对 key.AuditorSwkCertMessage 的签名，
+// 服务端只接受有签名的 swk
+func HandlerOverdraftCertifySwk(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.AuditorCertifySwkReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	pkBytes, err := base64.StdEncoding.DecodeString(request.Pubkey)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+	pk, err := misc.UnmarshalPublicKey(pkBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+	swkBytes, err := base64.StdEncoding.DecodeString(request.Swk)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("swk parse failed: "+err.Error()), 400)
+		return
+	}
+	swk, err := misc.UnmarshalSwitchingKey(swkBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("swk parse failed: "+err.Error()), 400)
+		return
+	}
+	if err = misc.CheckSwitchingKey(swk); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	evkBytes, err := base64.StdEncoding.DecodeString(request.EvaluationKey)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("evaluation key parse failed: "+err.Error()), 400)
+		return
+	}
+	evk, err := misc.UnmarshalEvaluationKey(evkBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("evaluation key parse failed: "+err.Error()), 400)
+		return
+	}
+	if err = misc.CheckEvaluationKey(evk, pk); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	sig, err := OverdraftKey.CertifySwk(request.UUID, request.KeyID, pk, swk, swkBytes, evk, evkBytes, SigningKey)
+	if errors.Is(err, auditorlib.ErrSwkMismatch) || errors.Is(err, auditorlib.ErrRlkMismatch) {
+		returnFailure(w, req, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	InfoLogger.Printf("Certified overdraft swk from %s: uuid = %v, keyID = %v", req.RemoteAddr, request.UUID, request.KeyID)
+
+	returnOK(w, req, map[string]interface{}{
+		"sig": base64.StdEncoding.EncodeToString(sig),
+	})
+}
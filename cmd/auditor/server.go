@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrorLogger log.Logger
+	InfoLogger  log.Logger
+	DebugLogger log.Logger
+)
+
+const (
+	DefaultListenPort = "16003"
+	DefaultListenAddr = "127.0.0.1"
+	DefaultVersion    = "indev"
+)
+
+const (
+	DefaultConfigDirPath  string = "/.config/Chimata/"
+	DefaultSigningKeyName string = "auditor.pem"
+	// 透支密钥，见 auditorlib.OverdraftKey
+	DefaultOverdraftKeyName string = "auditor-overdraft.key"
+	// 运营方令牌，见 OperatorToken
+	DefaultOperatorTokenName string = "auditor-operator.token"
+	// 服务端签名公钥，由 chimata-server 在启用透支检查时生成，见 HandlerOverdraftCheck
+	DefaultServerPubkeyName string = "server.pem.pub"
+	DefaultServerURL        string = "http://127.0.0.1:16001"
+	// 服务端签名请求的有效期，见 checkFreshness
+	DefaultRequestMaxAge = 5 * time.Minute
+)
+
+var (
+	homedir, _ = os.UserHomeDir()
+
+	ConfigListenAddr        = DefaultListenAddr
+	ConfigListenPort        = DefaultListenPort
+	ConfigVersion           = DefaultVersion
+	ConfigServerURL         = DefaultServerURL
+	ConfigSigningKeyPath    = homedir + DefaultConfigDirPath + DefaultSigningKeyName
+	ConfigRulesPath         = ""
+	ConfigOverdraftKeyPath  = homedir + DefaultConfigDirPath + DefaultOverdraftKeyName
+	ConfigOperatorTokenPath = homedir + DefaultConfigDirPath + DefaultOperatorTokenName
+	ConfigServerPubkeyPath  = homedir + DefaultConfigDirPath + DefaultServerPubkeyName
+	ConfigRequestMaxAge     = DefaultRequestMaxAge
+)
+
+var (
+	// 本监管者，serve 时初始化
+	Auditor *auditorlib.Auditor
+	// 用户提交的完整私钥，对应 /register/user
+	KeyStore *auditorlib.KeyStore
+	// 合规规则引擎
+	Engine     *auditorlib.RuleEngine
+	SigningKey *ecdsa.PrivateKey
+	// 接收透支指示值的密钥
+	OverdraftKey *auditorlib.OverdraftKey
+)
+
+func loggerInit() {
+	ErrorLogger = *log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	InfoLogger = *log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+	DebugLogger = *log.New(os.Stdout, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
+}
+
+func main() {
+	loggerInit()
+
+	app := cli.App{
+		Name:     "Chimata",
+		HelpName: "Chimata-auditor",
+		Version:  "0.99.indev",
+		Usage:    "CLI Interface of Project Chimata/Auditor.",
+		Commands: []*cli.Command{
+			{
+				Name:  "serve",
+				Usage: "start a threshold auditor",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "addr", Value: DefaultListenAddr},
+					&cli.StringFlag{Name: "port", Value: DefaultListenPort},
+					&cli.Uint64Flag{Name: "point", Usage: "shamir public point of this auditor, non-zero", Value: 1},
+					&cli.StringFlag{Name: "server", Value: DefaultServerURL, Usage: "server to send hold/release instructions to"},
+					&cli.StringFlag{Name: "signing-key", Value: ConfigSigningKeyPath, Usage: "PEM file of the alert signing key, generated if missing"},
+					&cli.StringFlag{Name: "rules", Usage: "JSON file of compliance rules"},
+					&cli.StringFlag{Name: "params", Value: misc.DefaultParamSetID,
+						Usage: fmt.Sprintf("parameter set, same as the server, one of %v", misc.ParamSetIDs())},
+					&cli.StringFlag{Name: "overdraft-key", Value: ConfigOverdraftKeyPath, Usage: "file of the overdraft secret key, generated if missing"},
+					&cli.StringFlag{Name: "operator-token", Value: ConfigOperatorTokenPath, Usage: "file of the operator bearer token for /register/user and /compliance/release, generated if missing"},
+					&cli.StringFlag{Name: "server-pubkey", Value: ConfigServerPubkeyPath, Usage: "PEM file of the server signing public key, required for /overdraft/check"},
+					&cli.DurationFlag{Name: "request-max-age", Value: DefaultRequestMaxAge, Usage: "max clock difference of signed server requests, their nonces are kept for this long"},
+				},
+				Action: func(ctx *cli.Context) error {
+					ConfigListenAddr = ctx.String("addr")
+					ConfigListenPort = ctx.String("port")
+					ConfigServerURL = ctx.String("server")
+					ConfigSigningKeyPath = ctx.String("signing-key")
+					ConfigRulesPath = ctx.String("rules")
+					ConfigOverdraftKeyPath = ctx.String("overdraft-key")
+					ConfigOperatorTokenPath = ctx.String("operator-token")
+					ConfigServerPubkeyPath = ctx.String("server-pubkey")
+					ConfigRequestMaxAge = ctx.Duration("request-max-age")
+					if err := misc.SetParamSet(ctx.String("params")); err != nil {
+						return err
+					}
+					return serve(drlwe.ShamirPublicPoint(ctx.Uint64("point")))
+				},
+			},
+			{
+				Name:  "demo",
+				Usage: "spawn n local auditors and run a t-out-of-n threshold decryption",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "n", Value: 5},
+					&cli.IntFlag{Name: "t", Value: 3},
+					&cli.IntFlag{Name: "base-port", Value: 16100},
+				},
+				Action: func(ctx *cli.Context) error {
+					return runDemo(ctx.Int("n"), ctx.Int("t"), ctx.Int("base-port"))
+				},
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serve(point drlwe.ShamirPublicPoint) (err error) {
+	Auditor = auditorlib.NewAuditor(point)
+	KeyStore = auditorlib.NewKeyStore()
+
+	if SigningKey, err = key.LoadOrGenerateECDSAKeyPEM(ConfigSigningKeyPath); err != nil {
+		return err
+	}
+	conf := new(auditorlib.RuleConfig)
+	if ConfigRulesPath != "" {
+		if conf, err = auditorlib.LoadRuleConfig(ConfigRulesPath); err != nil {
+			return err
+		}
+	}
+	Engine = auditorlib.NewRuleEngine(*conf, SigningKey)
+	if OperatorToken, err = loadOrGenerateOperatorToken(ConfigOperatorTokenPath); err != nil {
+		return err
+	}
+	if OverdraftKey, err = auditorlib.LoadOrGenerateOverdraftKey(ConfigOverdraftKeyPath); err != nil {
+		return err
+	}
+
+	InfoLogger.Printf("Project Chimata Auditor Version %s, point = %d", ConfigVersion, point)
+
+	http.HandleFunc("/", HandleNotFound)
+	http.HandleFunc("/version", HandlerVersion)
+
+	// 门限解密部分
+	http.HandleFunc(auditorlib.RegisterShareEndpoint, HandlerRegisterShare)
+	http.HandleFunc(auditorlib.PartialDecryptEndpoint, HandlerPartialDecrypt)
+
+	// 合规部分
+	http.HandleFunc("/pubkey", HandlerPubkey)
+	http.HandleFunc("/register/user", HandlerRegisterUser)
+	http.HandleFunc("/compliance/check", HandlerComplianceCheck)
+	http.HandleFunc("/compliance/release", HandlerComplianceRelease)
+
+	// 透支检查部分
+	http.HandleFunc(auditorlib.OverdraftPubkeyEndpoint, HandlerOverdraftPubkey)
+	http.HandleFunc(auditorlib.OverdraftCheckEndpoint, HandlerOverdraftCheck)
+	http.HandleFunc(auditorlib.OverdraftCertifySwkEndpoint, HandlerOverdraftCertifySwk)
+
+	InfoLogger.Printf("Listening: %v", ConfigListenAddr+":"+ConfigListenPort)
+	return http.ListenAndServe(ConfigListenAddr+":"+ConfigListenPort, nil)
+}
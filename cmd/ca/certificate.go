@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+)
+
+// Handle /certificate/issue
+// 验证申请者持有签名私钥后签发证书
+func HandlerIssueCertificate(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.CertificateReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	ckksPubkeyBytes, err := base64.RawStdEncoding.DecodeString(request.CKKS_pubkey)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	ckksPubkey, err := key.UnmarshalCKKSPublicKey(ckksPubkeyBytes)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("ckks pubkey parse failed: %v", err), 400)
+		return
+	}
+	ecdsaPubkeyBytes, err := base64.RawStdEncoding.DecodeString(request.ECDSA_pubkey)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	ecdsaPubkey, _, err := key.UnmarshalSigningPublicKeyAs(ecdsaPubkeyBytes, request.ECDSAAlgorithm)
+	if err != nil {
+		returnFailure(w, req, fmt.Errorf("signing pubkey parse failed: %v", err), 400)
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	msg := key.CertificateRequestMessage(request.UUID, request.Name, ecdsaPubkeyBytes, ckksPubkeyBytes)
+	if !key.Verify(ecdsaPubkey, msg, sig) {
+		returnFailure(w, req, fmt.Errorf("certificate request signature verify failed"), http.StatusForbidden)
+		return
+	}
+
+	chain, err := CA.IssueCertificate(request.UUID, request.Name, ecdsaPubkey, ckksPubkey)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+
+	InfoLogger.Printf("Issued certificate %v for user %v", chain[0].Serial, request.UUID)
+	returnOK(w, req, map[string]interface{}{
+		"certificates": chain,
+	})
+}
+
+// issueCACertificate 为下级 CA 签发证书，并将证书链写入 out
+// 下级 CA 以 --chain=out 启动
+func issueCACertificate(pubkeyPath, name, out string) error {
+	pk, err := key.LoadECDSAPublicKeyPEM(pubkeyPath)
+	if err != nil {
+		return err
+	}
+	chain, err := CA.IssueCACertificate(name, pk, ConfigCACertificateValidity)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(chain)
+	if err != nil {
+		return err
+	}
+	InfoLogger.Printf("Issued CA certificate %v for %s", chain[0].Serial, name)
+	return os.WriteFile(out, data, 0644)
+}
+
+func loadChain(path string) (chain []*key.Certificate, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &chain)
+	return
+}
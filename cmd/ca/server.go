@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/calib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrorLogger log.Logger
+	InfoLogger  log.Logger
+)
+
+const (
+	DefaultListenPort     = "16002"
+	DefaultListenAddr     = "127.0.0.1"
+	DefaultVersion        = "indev"
+	DefaultConfigDirPath  = "/.config/Chimata/"
+	DefaultSigningKeyName = "ca.pem"
+	DefaultCRLName        = "ca-crl.json"
+	DefaultRegistryName   = "ca-registry.json"
+
+	DefaultCACertificateValidity = 5 * 365 * 24 * time.Hour
+)
+
+var (
+	homedir, _ = os.UserHomeDir()
+
+	ConfigListenAddr     = DefaultListenAddr
+	ConfigListenPort     = DefaultListenPort
+	ConfigVersion        = DefaultVersion
+	ConfigSigningKeyPath = homedir + DefaultConfigDirPath + DefaultSigningKeyName
+	ConfigCRLPath        = homedir + DefaultConfigDirPath + DefaultCRLName
+	ConfigRegistryPath   = homedir + DefaultConfigDirPath + DefaultRegistryName
+	// 本 CA 的证书链文件，为空时本 CA 即根 CA
+	ConfigChainPath             = ""
+	ConfigCACertificateValidity = DefaultCACertificateValidity
+)
+
+var (
+	CA *calib.CA
+)
+
+func loggerInit() {
+	ErrorLogger = *log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	InfoLogger = *log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+}
+
+func main() {
+	loggerInit()
+
+	commonFlags := []cli.Flag{
+		&cli.StringFlag{Name: "signing-key", Value: ConfigSigningKeyPath, Usage: "PEM file of the CA signing key, generated if missing"},
+		&cli.StringFlag{Name: "crl", Value: ConfigCRLPath, Usage: "JSON file of the revocation list"},
+		&cli.StringFlag{Name: "registry", Value: ConfigRegistryPath, Usage: "JSON file of issued user UUIDs and key fingerprints"},
+		&cli.StringFlag{Name: "chain", Usage: "JSON certificate chain of this CA, issued by the parent CA; empty for a root CA"},
+	}
+
+	app := cli.App{
+		Name:     "Chimata",
+		HelpName: "Chimata-ca",
+		Version:  "0.99.indev",
+		Usage:    "CLI Interface of Project Chimata/CA.",
+		Commands: []*cli.Command{
+			{
+				Name:  "serve",
+				Usage: "start the CA",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "addr", Value: DefaultListenAddr},
+					&cli.StringFlag{Name: "port", Value: DefaultListenPort},
+					&cli.StringFlag{Name: "params", Value: misc.DefaultParamSetID,
+						Usage: fmt.Sprintf("parameter set of the CKKS public keys to certify, same as the server, one of %v", misc.ParamSetIDs())},
+				}, commonFlags...),
+				Action: func(ctx *cli.Context) error {
+					ConfigListenAddr = ctx.String("addr")
+					ConfigListenPort = ctx.String("port")
+					if err := misc.SetParamSet(ctx.String("params")); err != nil {
+						return err
+					}
+					if err := initCA(ctx); err != nil {
+						return err
+					}
+					return serve()
+				},
+			},
+			{
+				Name:  "revoke",
+				Usage: "revoke a key by its fingerprint and re-sign the revocation list",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "key-id", Usage: "fingerprint of the key, see key.ECDSAKeyFingerprint"},
+					&cli.StringFlag{Name: "pubkey", Usage: "PEM file of an ECDSA public key, instead of --key-id"},
+					&cli.StringFlag{Name: "reason", Value: "key compromise"},
+				}, commonFlags...),
+				Action: func(ctx *cli.Context) error {
+					if err := initCA(ctx); err != nil {
+						return err
+					}
+					return revoke(ctx.String("key-id"), ctx.String("pubkey"), ctx.String("reason"))
+				},
+			},
+			{
+				Name:  "issue-ca",
+				Usage: "issue a certificate for a subordinate CA",
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "pubkey", Required: true, Usage: "PEM file of the subordinate CA public key"},
+					&cli.StringFlag{Name: "name", Value: "Chimata subordinate CA"},
+					&cli.StringFlag{Name: "out", Required: true, Usage: "output JSON certificate chain"},
+				}, commonFlags...),
+				Action: func(ctx *cli.Context) error {
+					if err := initCA(ctx); err != nil {
+						return err
+					}
+					return issueCACertificate(ctx.String("pubkey"), ctx.String("name"), ctx.String("out"))
+				},
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func initCA(ctx *cli.Context) error {
+	ConfigSigningKeyPath = ctx.String("signing-key")
+	ConfigCRLPath = ctx.String("crl")
+	sk, err := key.LoadOrGenerateECDSAKeyPEM(ConfigSigningKeyPath)
+	if err != nil {
+		return err
+	}
+	CA = calib.NewCA(sk, ConfigCRLPath)
+	CA.RegistryPath = ctx.String("registry")
+	if ConfigChainPath = ctx.String("chain"); ConfigChainPath != "" {
+		if CA.Chain, err = loadChain(ConfigChainPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revoke(keyID, pubkeyPath, reason string) error {
+	if keyID == "" {
+		if pubkeyPath == "" {
+			return fmt.Errorf("either --key-id or --pubkey is required")
+		}
+		pk, err := key.LoadECDSAPublicKeyPEM(pubkeyPath)
+		if err != nil {
+			return err
+		}
+		keyID = key.ECDSAKeyFingerprint(pk)
+	}
+
+	l, err := CA.Revoke(keyID, reason)
+	if err != nil {
+		return err
+	}
+	InfoLogger.Printf("Revoked %s, revocation list serial = %d", keyID, l.Serial)
+	return nil
+}
+
+func serve() error {
+	InfoLogger.Printf("Project Chimata CA Version %s", ConfigVersion)
+
+	http.HandleFunc("/", HandleNotFound)
+	http.HandleFunc(calib.PubkeyEndpoint, HandlerPubkey)
+	http.HandleFunc(calib.RevocationListEndpoint, HandlerRevocationList)
+	http.HandleFunc(calib.CertificateIssueEndpoint, HandlerIssueCertificate)
+
+	InfoLogger.Printf("Listening: %v", ConfigListenAddr+":"+ConfigListenPort)
+	return http.ListenAndServe(ConfigListenAddr+":"+ConfigListenPort, nil)
+}
+
+func HandleNotFound(w http.ResponseWriter, req *http.Request) {
+	returnFailure(w, req, fmt.Errorf("function not found: "+req.RequestURI), 404)
+}
+
+// Generic failure
+func returnFailure(w http.ResponseWriter, req *http.Request, err error, statusCode int) {
+	resp := make(map[string]interface{})
+	resp["status"] = "failed"
+	resp["err"] = err.Error()
+
+	respJSON, _ := json.Marshal(resp)
+
+	w.WriteHeader(statusCode)
+	w.Write(respJSON)
+	ErrorLogger.Println("Error: " + err.Error())
+}
+
+func returnOK(w http.ResponseWriter, req *http.Request, respData map[string]interface{}) {
+	respData["status"] = "OK"
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// Handle /pubkey
+// pubkey 为 base64 编码的 PKIX 公钥列表
+func HandlerPubkey(w http.ResponseWriter, req *http.Request) {
+	pkBytes, err := x509.MarshalPKIXPublicKey(CA.SigningKey.Public().(*ecdsa.PublicKey))
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	returnOK(w, req, map[string]interface{}{
+		"pubkey": []string{base64.StdEncoding.EncodeToString(pkBytes)},
+	})
+}
+
+// Handle /crl
+func HandlerRevocationList(w http.ResponseWriter, req *http.Request) {
+	l, err := CA.CurrentRevocationList()
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	returnOK(w, req, map[string]interface{}{
+		"crl": l,
+	})
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/google/uuid"
 	"github.com/urfave/cli/v2"
 )
 
@@ -18,6 +23,28 @@ func main() {
 		HelpName: "Chimata-client",
 		Version:  "0.99.indev",
 		Usage:    "CLI Interface of Project Chimata/Client. Please note that the project is designed to run in `go test`",
+		Commands: []*cli.Command{
+			{
+				Name:  "user",
+				Usage: "Manage local users",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "recover",
+						Usage:     "Recover the key chain of a registered user from its mnemonic, read from stdin",
+						UsageText: "echo $MNEMONIC | chimata user recover --uuid $UUID",
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "uuid", Required: true, Usage: "UUID of the user"},
+							&cli.StringFlag{Name: "server", Value: clientlib.DefaultServerURL, Usage: "URL of the server"},
+							&cli.StringFlag{Name: "ca", Value: clientlib.DefaultCAUrl, Usage: "URL of the CA, whose signing key verifies the certificate of the user"},
+							&cli.StringFlag{Name: "database", Value: clientlib.ConfigDatabasePath, Usage: "Path of the client database"},
+							&cli.StringFlag{Name: "mnemonic-passphrase", EnvVars: []string{"CHIMATA_MNEMONIC_PASSPHRASE"}, Usage: "Optional passphrase of the mnemonic"},
+							&cli.StringFlag{Name: "keystore-passphrase", EnvVars: []string{"CHIMATA_KEYSTORE_PASSPHRASE"}, Required: true, Usage: "Passphrase of the local keystore, which is initialized if needed"},
+						},
+						Action: userRecover,
+					},
+				},
+			},
+		},
 	}
 
 	//CryptoInit()
@@ -28,3 +55,59 @@ func main() {
 
 	//debug.NoImpl()
 }
+
+// userRecover 由助记词恢复用户密钥，核对服务端登记的公钥后保存到密钥库
+func userRecover(c *cli.Context) error {
+	id, err := uuid.Parse(c.String("uuid"))
+	if err != nil {
+		return err
+	}
+	mnemonic, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && mnemonic == "" {
+		return fmt.Errorf("failed to read mnemonic: %v", err)
+	}
+
+	caPubkeys, err := clientlib.SyncCASigningKeyWithURL(c.String("ca"))
+	if err != nil {
+		return fmt.Errorf("failed to get CA public key: %v", err)
+	}
+	if len(caPubkeys) == 0 {
+		return fmt.Errorf("CA %s returned no public key", c.String("ca"))
+	}
+	clientlib.CAPubkey = &caPubkeys[0]
+
+	u, err := clientlib.RecoverUser(c.String("server"), id, strings.Join(strings.Fields(mnemonic), " "), c.String("mnemonic-passphrase"))
+	if err != nil {
+		return err
+	}
+
+	clientlib.ConfigDatabasePath = c.String("database")
+	db, err := clientlib.InitDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ks, err := clientlib.OpenKeystore(db)
+	if err != nil {
+		return err
+	}
+	passphrase := []byte(c.String("keystore-passphrase"))
+	if ok, err := ks.Initialized(); err != nil {
+		return err
+	} else if !ok {
+		if err = ks.Init(passphrase); err != nil {
+			return err
+		}
+	}
+	if err = ks.Unlock(passphrase, 0); err != nil {
+		return err
+	}
+	defer ks.Lock()
+	if err = ks.StoreUser(u); err != nil {
+		return err
+	}
+
+	fmt.Printf("Recovered user %v (%s): %d CKKS key, %d signing key(s)\n",
+		u.UserIdentifier, u.UserName, len(u.UserCKKSKeyChain), len(u.UserECDSAKeyChain))
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+)
+
+// Products 为 -product 指定的账户产品，按 ID 索引
+var Products = map[string]serverlib.AccrualProduct{}
+
+// 余额在两次读取之间被转账修改时重新计算的次数
+const accrualAttempts = 3
+
+// initProducts 解析 -product，产品的资产须已注册，计息须使用 CKKS 参数集
+func initProducts(specs []string) (products map[string]serverlib.AccrualProduct, err error) {
+	products = make(map[string]serverlib.AccrualProduct)
+	for _, spec := range specs {
+		p, err := serverlib.ParseAccrualProduct(spec, ConfigAccrualPeriod)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := products[p.ID]; ok {
+			return nil, fmt.Errorf("product %s is defined twice", p.ID)
+		}
+		if _, err = Assets.Get(productAsset(p)); err != nil {
+			return nil, fmt.Errorf("product %s: %v", p.ID, err)
+		}
+		if p.InterestRate != 0 && misc.GetCryptoContext().CKKS() == nil {
+			return nil, fmt.Errorf("product %s: %v", p.ID, transaction.ErrRequiresCKKS)
+		}
+		products[p.ID] = p
+	}
+	return products, nil
+}
+
+func productAsset(p serverlib.AccrualProduct) string {
+	if p.Asset == "" {
+		return misc.DefaultAssetID
+	}
+	return p.Asset
+}
+
+// runAccruals 定期为加入产品的用户计息和收费，每期每种操作只执行一次
+// 已执行的由账本中确定的交易 ID 判断，因此服务端重启或多次检查不会重复计息
+func runAccruals(interval time.Duration) {
+	for {
+		accrueAll(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+func accrueAll(now time.Time) {
+	ids := make([]string, 0, len(Products))
+	for id := range Products {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		p := Products[id]
+		period := p.PeriodAt(now)
+		users, err := db.GetProductAccounts(Database, p.ID)
+		if err != nil {
+			ErrorLogger.Printf("Listing accounts of product %s failed: %v", p.ID, err)
+			continue
+		}
+		for _, user := range users {
+			for _, kind := range p.Kinds() {
+				err := accrue(p, kind, user, period)
+				switch {
+				case errors.Is(err, transaction.ErrNoLevelLeft):
+					// 用户刷新余额后，同一期内的下一次检查会补上
+					WarningLogger.Printf("Skipped %s of product %s for user %v, balance needs a refresh", kind, p.ID, user)
+				case err != nil:
+					ErrorLogger.Printf("Applying %s of product %s for user %v failed: %v", kind, p.ID, user, err)
+				}
+			}
+		}
+	}
+}
+
+// accrue 为用户执行第 period 期的 kind，已执行过的直接返回
+func accrue(p serverlib.AccrualProduct, kind serverlib.AccrualKind, user uuid.UUID, period int64) error {
+	txID := serverlib.AccrualTransactionID(user, p.ID, kind, period)
+	asset, err := Assets.Get(productAsset(p))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < accrualAttempts; i++ {
+		if exists, err := db.TransactionExists(Database, txID); err != nil || exists {
+			return err
+		}
+		balanceBytes, err := db.GetUserBalanceBytes(Database, user)
+		if err != nil {
+			return err
+		}
+		balance, err := misc.UnmarshalCiphertext(balanceBytes)
+		if err != nil {
+			return err
+		}
+		ckksKey, err := db.GetCKKSKeyByUserUUID(Database, user)
+		if err != nil {
+			return err
+		}
+
+		var tx *transaction.Transaction
+		err = CryptoPool.Do(context.Background(), func() (err error) {
+			tx, balance, err = p.Accrue(kind, user, ckksKey.Identifier, ckksKey.CKKSPublicKey, balance, asset.Slot, period)
+			return
+		})
+		if err != nil {
+			return err
+		}
+
+		applied, err := db.ApplyAccrual(Database, user, balanceBytes, balance, tx)
+		if err != nil {
+			return err
+		}
+		if applied {
+			InfoLogger.Printf("Applied %s of product %s for user %v, period %d, tx = %v", kind, p.ID, user, period, txID)
+			return nil
+		}
+	}
+	return fmt.Errorf("balance kept changing during %d attempts", accrualAttempts)
+}
+
+// interestBalanceNeedsRefresh 判断用户加入了计息产品且余额已无法再计息
+func interestBalanceNeedsRefresh(userUUID uuid.UUID, balanceBytes []byte) (bool, error) {
+	products, err := db.GetAccountProducts(Database, userUUID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range products {
+		if Products[id].InterestRate == 0 {
+			continue
+		}
+		balance, err := misc.UnmarshalCiphertext(balanceBytes)
+		if err != nil {
+			return false, err
+		}
+		return balance.Level() == 0, nil
+	}
+	return false, nil
+}
+
+// Handle /products
+// 返回账户产品列表
+func HandlerProducts(w http.ResponseWriter, req *http.Request) {
+	products := make([]serverlib.AccrualProduct, 0, len(Products))
+	for _, p := range Products {
+		products = append(products, p)
+	}
+	sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+
+	respJSON := make(map[string]interface{})
+	respJSON["status"] = "OK"
+	respJSON["products"] = products
+
+	respByte, _ := json.Marshal(respJSON)
+
+	w.Write(respByte)
+}
+
+// Handle /account/enroll
+// 用户加入或退出账户产品，请求须由用户的签名密钥签名，并带有时间戳和 nonce，见 checkFreshness
+// 加入后从下一次检查起按期计息、收费；同一期内退出再加入不会重复计息
+func HandlerAccountEnroll(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new /account/enroll")
+
+	request := new(restfulpayload.EnrollProductReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	if _, ok := Products[request.Product]; !ok {
+		returnFailure(w, req, fmt.Errorf("unknown product %q", request.Product), http.StatusNotFound)
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	signer, err := getSigningKey(request.UUID, request.SignedBy)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ecdsa key %v of user %v not found", request.SignedBy, request.UUID), http.StatusNotFound)
+		return
+	}
+	if err = Revocations.CheckECDSAKey(signer.PublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	msg := key.EnrollProductMessage(request.UUID, request.Product, request.Enrolled, request.TimeStamp, request.Nonce)
+	if !serverlib.ValidateSignatureBase(msg, sig, signer.PublicKey) {
+		returnFailure(w, req,
+			fmt.Errorf("enroll signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+	// 签名有效后才记录 nonce，避免他人用伪造的请求占用
+	if err = checkFreshness("enroll", request.Nonce.String(), request.TimeStamp); err != nil {
+		returnFailure(w, req, err, http.StatusUnauthorized)
+		return
+	}
+
+	if err = db.PutAccountProduct(Database, request.UUID, request.Product, request.Enrolled); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	products, err := db.GetAccountProducts(Database, request.UUID)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["products"] = products
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+	InfoLogger.Print("Processed new /account/enroll, uuid = " + request.UUID.String())
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/x509"
+	"crypto"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
 	"github.com/CamberLoid/Chimata/internal/db"
 	"github.com/CamberLoid/Chimata/internal/key"
 	"github.com/CamberLoid/Chimata/internal/misc"
@@ -17,7 +19,6 @@ import (
 	"github.com/CamberLoid/Chimata/internal/transaction"
 	"github.com/CamberLoid/Chimata/internal/users"
 	"github.com/google/uuid"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
@@ -43,6 +44,14 @@ func returnFailure(w http.ResponseWriter, req *http.Request, err error, statusCo
 	ErrorLogger.Println("Error: " + err.Error())
 }
 
+// orNewUUID 在客户端未指定密钥 ID 时分配新的 ID
+func orNewUUID(id uuid.UUID) uuid.UUID {
+	if id == uuid.Nil {
+		return uuid.New()
+	}
+	return id
+}
+
 // Handle /version request
 func HandlerVersion(w http.ResponseWriter, req *http.Request) {
 	respJSON := make(map[string]interface{})
@@ -54,6 +63,30 @@ func HandlerVersion(w http.ResponseWriter, req *http.Request) {
 	w.Write(respByte)
 }
 
+// Handle /params request
+// 返回服务端使用的 CKKS 参数集，客户端加密前据此校验本地参数
+func HandlerParams(w http.ResponseWriter, req *http.Request) {
+	respJSON := make(map[string]interface{})
+	respJSON["status"] = "OK"
+	respJSON["params"] = misc.GetParamSetInfo()
+
+	respByte, _ := json.Marshal(respJSON)
+
+	w.Write(respByte)
+}
+
+// Handle /assets
+// 返回资产注册表，客户端据此将各资产的金额放入对应槽位
+func HandlerAssets(w http.ResponseWriter, req *http.Request) {
+	respJSON := make(map[string]interface{})
+	respJSON["status"] = "OK"
+	respJSON["assets"] = Assets.Assets
+
+	respByte, _ := json.Marshal(respJSON)
+
+	w.Write(respByte)
+}
+
 // Handle /transaction/create/bySenderPK request
 func HandlerTransactionCreateBySenderPK(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
@@ -73,6 +106,14 @@ func HandlerTransactionCreateBySenderPK(w http.ResponseWriter, req *http.Request
 		returnFailure(w, req,
 			fmt.Errorf("transaction parse failed"+err.Error()), 400)
 	}
+	if err = checkTransactionCiphertexts(tx); err != nil {
+		returnFailure(w, req, err, http.StatusBadRequest)
+		return
+	}
+	if err = checkTransactionAssets(tx); err != nil {
+		returnFailure(w, req, err, http.StatusBadRequest)
+		return
+	}
 
 	// 验证
 	valid, err := VerifyTransaction(tx)
@@ -93,9 +134,9 @@ func HandlerTransactionCreateBySenderPK(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	// 重加密
+	// 重加密，按双方公钥 ID 查找 swk
 	_start = time.Now()
-	swk, err := db.GetSwitchingKeyUserIDInOut(Database, tx.Sender, tx.Receipt)
+	swk, err := getSwitchingKey(tx.CTSenderKeyID, tx.CTReceiptKeyID)
 	if err != nil {
 		returnFailure(w, req, err, http.StatusInternalServerError)
 		return
@@ -103,49 +144,21 @@ func HandlerTransactionCreateBySenderPK(w http.ResponseWriter, req *http.Request
 		DurationDatabaseOpr += time.Since(_start)
 	}
 
-	serverlib.KeySwitchSenderToReceipt(tx, swk)
-
-	// 更新余额
-	_start = time.Now()
-	senderBalance, err := db.GetUserBalance(Database, tx.Sender)
-	if err != nil {
-		returnFailure(w, req, err, 500)
+	if err = doCrypto(req, func() error { return serverlib.KeySwitchSenderToReceipt(tx, swk) }); err != nil {
+		returnCryptoFailure(w, req, fmt.Errorf("re-encryption failed: %w", err), http.StatusInternalServerError)
 		return
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
 	}
 
-	_start = time.Now()
-	receiptBalance, err := db.GetUserBalance(Database, tx.Receipt)
-	if err != nil {
-		returnFailure(w, req, err, 500)
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
-	}
-
-	senderUpdated, receiptUpdated, err := serverlib.GetUpdatedBalance(tx, senderBalance, receiptBalance)
-
-	if err != nil {
-		returnFailure(w, req, err, 500)
-	}
-
-	_start = time.Now()
-	err = db.UpdateBalance(Database, tx.Sender, senderUpdated)
-	if err != nil {
-		returnFailure(w, req, err, 500)
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
-	}
-
-	_start = time.Now()
-	err = db.UpdateBalance(Database, tx.Receipt, receiptUpdated)
-	if err != nil {
-		returnFailure(w, req, err, 500)
+	// 服务端无法检查范围证明中的承诺与密文是否一致，
+	// 默认等待接收方解密 CTReceipt 检查后确认再记账，见 HandlerTransactionConfirm
+	if ConfigSenderPKDirectSettle {
+		if !settleTransaction(w, req, tx) {
+			return
+		}
+		serverlib.FinishTransaction(tx)
 	} else {
-		DurationDatabaseOpr += time.Since(_start)
+		serverlib.AwaitReceiptAcceptance(tx)
 	}
-
-	serverlib.FinishTransaction(tx)
 	_start = time.Now()
 	if err = db.WriteTransaction(Database, tx); err != nil {
 		returnFailure(w, req, err, http.StatusInternalServerError)
@@ -190,6 +203,14 @@ func HandlerTransactionCreateByReceiptPK(w http.ResponseWriter, req *http.Reques
 		returnFailure(w, req,
 			fmt.Errorf("transaction parse failed"+err.Error()), 400)
 	}
+	if err = checkTransactionCiphertexts(tx); err != nil {
+		returnFailure(w, req, err, http.StatusBadRequest)
+		return
+	}
+	if err = checkTransactionAssets(tx); err != nil {
+		returnFailure(w, req, err, http.StatusBadRequest)
+		return
+	}
 
 	// 处理交易信息
 	// 验证
@@ -210,7 +231,7 @@ func HandlerTransactionCreateByReceiptPK(w http.ResponseWriter, req *http.Reques
 
 	// 重加密
 	_start = time.Now()
-	swk, err := db.GetSwitchingKeyUserIDInOut(Database, tx.Receipt, tx.Sender)
+	swk, err := getSwitchingKey(tx.CTReceiptKeyID, tx.CTSenderKeyID)
 	if err != nil {
 		returnFailure(w, req,
 			fmt.Errorf("get re-encryption key failed: "+err.Error()),
@@ -220,10 +241,10 @@ func HandlerTransactionCreateByReceiptPK(w http.ResponseWriter, req *http.Reques
 		DurationDatabaseOpr += time.Since(_start)
 	}
 
-	err = serverlib.KeySwitchReceiptToSender(tx, swk)
+	err = doCrypto(req, func() error { return serverlib.KeySwitchReceiptToSender(tx, swk) })
 	if err != nil {
-		returnFailure(w, req,
-			fmt.Errorf("re-encryption failed: "+err.Error()), 500)
+		returnCryptoFailure(w, req, fmt.Errorf("re-encryption failed: %w", err), 500)
+		return
 	}
 
 	// 写入数据库
@@ -288,9 +309,23 @@ func HandlerTransactionConfirm(w http.ResponseWriter, req *http.Request) {
 		DurationDatabaseOpr += time.Since(_start)
 	}
 
-	// 验证交易
-	tx.SigCTSender = _tx.SigCTSender
-	tx.CTSenderSignedBy = _tx.Receipt
+	// 被监管者挂起的交易在放行前不能确认，已结束的交易不能重复确认
+	if err = serverlib.CheckConfirmable(tx); err != nil {
+		returnFailure(w, req, err, http.StatusConflict)
+		return
+	}
+
+	// 验证交易：接收方对服务端重加密得到的密文签名表示接受，
+	// bySenderPK 交易为 CTReceipt，byReceiptPK 交易为 CTSender
+	if serverlib.IsSenderPKTransaction(tx) {
+		tx.SigCTReceipt = _tx.SigCTReceipt
+		tx.SigCTReceiptKeyID = _tx.SigCTReceiptKeyID
+		tx.CTReceiptSignedBy = tx.Receipt
+	} else {
+		tx.SigCTSender = _tx.SigCTSender
+		tx.SigCTSenderKeyID = _tx.SigCTSenderKeyID
+		tx.CTSenderSignedBy = tx.Receipt
+	}
 
 	valid, err := verifyTransactionConfirmingStage(tx)
 	if err != nil {
@@ -311,48 +346,10 @@ func HandlerTransactionConfirm(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// 更新余额
-	_start = time.Now()
-	senderBalance, err := db.GetUserBalance(Database, tx.Sender)
-	if err != nil {
-		returnFailure(w, req, err, 500)
-		return
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
-	}
-
-	_start = time.Now()
-	receiptBalance, err := db.GetUserBalance(Database, tx.Receipt)
-	if err != nil {
-		returnFailure(w, req, err, 500)
-		return
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
-	}
-
-	senderUpdated, receiptUpdated, err := serverlib.GetUpdatedBalance(tx, senderBalance, receiptBalance)
-	if err != nil {
-		returnFailure(w, req, err, 500)
+	if !settleTransaction(w, req, tx) {
 		return
 	}
 
-	_start = time.Now()
-	err = db.UpdateBalance(Database, tx.Sender, senderUpdated)
-	if err != nil {
-		returnFailure(w, req, err, 500)
-		return
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
-	}
-
-	_start = time.Now()
-	err = db.UpdateBalance(Database, tx.Receipt, receiptUpdated)
-	if err != nil {
-		returnFailure(w, req, err, 500)
-		return
-	} else {
-		DurationDatabaseOpr += time.Since(_start)
-	}
-
 	// 写入交易
 	_start = time.Now()
 	if err = db.WriteTransaction(Database, tx); err != nil {
@@ -442,24 +439,62 @@ func HandlerRegisterSwk(w http.ResponseWriter, req *http.Request) {
 			fmt.Errorf("ckks swk parse failed"+err.Error()), 400)
 		return
 	}
-	ckksSwk := new(rlwe.SwitchingKey)
-	err = ckksSwk.UnmarshalBinary(ckksSwkBytes)
+	// 接受紧凑格式（可带种子）和 MarshalBinary 格式
+	ckksSwk, err := misc.UnmarshalSwitchingKey(ckksSwkBytes)
 	if err != nil {
 		returnFailure(w, req,
-			fmt.Errorf("ckks swk parse failed"+err.Error()), 400)
+			fmt.Errorf("ckks swk parse failed: %w", err), 400)
 		return
 	}
-	DebugLogger.Print("Got swk, size = " + fmt.Sprint(ckksSwk.MarshalBinarySize()) + "From " + request.UserIn.String() + " To " + request.UserOut.String())
+	DebugLogger.Print("Got swk, size = " + fmt.Sprint(len(ckksSwkBytes)) + " From " + request.UserIn.String() + " To " + request.UserOut.String())
+
+	// 只接受当前纪元和下一纪元的 swk
+	currentEpoch := misc.SwkEpoch(time.Now(), ConfigSwkEpochDuration)
+	epoch := request.Epoch
+	if epoch == 0 {
+		epoch = currentEpoch
+	}
+	if epoch < currentEpoch || epoch > currentEpoch+1 {
+		returnFailure(w, req,
+			fmt.Errorf("swk epoch %d is out of range, current epoch is %d", epoch, currentEpoch), 400)
+		return
+	}
+	validity := misc.NewSwkValidity(epoch, ConfigSwkEpochDuration, ConfigSwkGracePeriod)
+
+	// 任一方密钥被吊销时拒绝注册
+	for _, u := range []uuid.UUID{request.UserIn, request.UserOut} {
+		if err = checkUserKeysRevoked(u); err != nil {
+			returnFailure(w, req, err, http.StatusForbidden)
+			return
+		}
+	}
+	// 指明的公钥须属于对应的用户
+	for _, pk := range []struct{ user, keyID uuid.UUID }{
+		{request.UserIn, request.PKIn}, {request.UserOut, request.PKOut},
+	} {
+		if pk.keyID == uuid.Nil {
+			continue
+		}
+		if _, err = db.GetCKKSKeyByID(Database, pk.user, pk.keyID); err != nil {
+			returnFailure(w, req,
+				fmt.Errorf("ckks key %v of user %v not found", pk.keyID, pk.user), http.StatusNotFound)
+			return
+		}
+	}
 
 	err = db.PutSwitchingKeyColumnByUserInUserOut(Database, id,
-		request.UserIn, request.UserOut, ckksSwk)
+		request.UserIn, request.UserOut, request.PKIn, request.PKOut, ckksSwk, validity)
 	if err != nil {
 		returnFailure(w, req, err, http.StatusInternalServerError)
 		return
 	}
+	if err = invalidateSwitchingKey(request.UserIn, request.UserOut, request.PKIn, request.PKOut); err != nil {
+		WarningLogger.Printf("Invalidating cached swk failed: %v", err)
+	}
 
 	respData := make(map[string]interface{})
 	respData["status"] = "OK"
+	respData["validity"] = validity
 
 	respJSON, err := json.Marshal(respData)
 	if err != nil {
@@ -473,7 +508,47 @@ func HandlerRegisterSwk(w http.ResponseWriter, req *http.Request) {
 	InfoLogger.Print("HandlerRegisterSwk took " + time.Since(start).String())
 }
 
+// checkTransactionCiphertexts 检查交易中的密文是否属于服务端的参数集
+func checkTransactionCiphertexts(tx *transaction.Transaction) error {
+	for _, ct := range [][]byte{tx.CTSender, tx.CTReceipt} {
+		if len(ct) == 0 {
+			continue
+		}
+		if err := misc.CheckCiphertext(ct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTransactionAssets 检查交易涉及的资产均已注册
+func checkTransactionAssets(tx *transaction.Transaction) error {
+	for _, id := range tx.GetAssets() {
+		if _, err := Assets.Get(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUserKeysRevoked 检查用户已注册的 ECDSA、CKKS 公钥是否被吊销
+func checkUserKeysRevoked(userUUID uuid.UUID) error {
+	ecdsaKey, err := getSigningKey(userUUID, uuid.Nil)
+	if err != nil {
+		return fmt.Errorf("ecdsa key of user %v not found: %v", userUUID, err)
+	}
+	if err = Revocations.CheckECDSAKey(ecdsaKey.PublicKey); err != nil {
+		return err
+	}
+	ckksKey, err := db.GetCKKSKeyByUserUUID(Database, userUUID)
+	if err != nil {
+		return fmt.Errorf("ckks key of user %v not found: %v", userUUID, err)
+	}
+	return Revocations.CheckCKKSKey(ckksKey.CKKSPublicKey)
+}
+
 // Handle /register/User
+// 请求须带有 CA 签发的证书链，并以其中的签名公钥签名；UUID 已注册时返回 409
 func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	InfoLogger.Print("Received new /register/user")
@@ -500,8 +575,8 @@ func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
 			fmt.Errorf("ckks pubkey parse failed"), 400)
 		return
 	}
-	ckksPubkey := rlwe.NewPublicKey(misc.GetCKKSParams().Parameters)
-	if err = ckksPubkey.UnmarshalBinary(ckksPubkeyBytes); err != nil {
+	ckksPubkey, err := misc.UnmarshalPublicKey(ckksPubkeyBytes)
+	if err != nil {
 		returnFailure(w, req,
 			fmt.Errorf("ckks pubkey parse failed: "+err.Error()), 400)
 		return
@@ -514,16 +589,62 @@ func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
 	}
 	if len(ecdsaPubkeyBytes) == 0 {
 		returnFailure(w, req,
-			fmt.Errorf("ecdsa pubkey parse failed: "+err.Error()), 400)
+			fmt.Errorf("signing pubkey parse failed"), 400)
 		return
 	}
-	var ecdsaPubkey *ecdsa.PublicKey
-	if ecdsaPubkeyAny, err := x509.ParsePKIXPublicKey(ecdsaPubkeyBytes); err != nil {
+	ecdsaPubkey, ecdsaAlg, err := key.UnmarshalSigningPublicKeyAs(ecdsaPubkeyBytes, request.ECDSAAlgorithm)
+	if err != nil {
 		returnFailure(w, req,
-			fmt.Errorf("ecdsa pubkey parse failed: "+err.Error()), 400)
+			fmt.Errorf("signing pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+
+	if err = Revocations.CheckCKKSKey(ckksPubkey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if err = Revocations.CheckECDSAKey(ecdsaPubkey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+
+	// 验证 CA 签发的证书链，证书须绑定该 UUID、用户名和公钥
+	if CAPubkey == nil {
+		returnFailure(w, req,
+			fmt.Errorf("no CA public key configured, cannot verify certificates"), http.StatusServiceUnavailable)
+		return
+	}
+	cert, err := key.VerifyCertificateChain(request.Certificates, CAPubkey, time.Now(), Revocations.IsRevoked)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if err = cert.Matches(userUUID, ecdsaPubkey, ckksPubkey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if cert.Name != userName {
+		returnFailure(w, req,
+			fmt.Errorf("certificate name %q does not match %q", cert.Name, userName), http.StatusForbidden)
+		return
+	}
+
+	// 证书和公钥是公开的，注册者还须以证书中的签名公钥签名，证明持有私钥
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	msg := key.RegisterUserMessage(userUUID, userName, request.CKKSKeyID, request.ECDSAKeyID,
+		ckksPubkeyBytes, ecdsaPubkeyBytes, request.TimeStamp, request.Nonce)
+	if !serverlib.ValidateSignatureBase(msg, sig, ecdsaPubkey) {
+		returnFailure(w, req,
+			fmt.Errorf("registration signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+	if err = checkFreshness("register", request.Nonce.String(), request.TimeStamp); err != nil {
+		returnFailure(w, req, err, http.StatusUnauthorized)
 		return
-	} else {
-		ecdsaPubkey = ecdsaPubkeyAny.(*ecdsa.PublicKey)
 	}
 
 	// 写入数据库
@@ -531,23 +652,30 @@ func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
 	usr := users.NewUserWithUserName(userName)
 	usr.UserIdentifier = userUUID
 	usr.UserCKKSKeyChain = append(usr.UserCKKSKeyChain, key.CKKSKeyChain{
-		Identifier:     uuid.New(),
+		Identifier:     orNewUUID(request.CKKSKeyID),
 		CKKSPublicKey:  ckksPubkey,
 		CKKSPrivateKey: nil,
 	})
 	usr.UserECDSAKeyChain = append(usr.UserECDSAKeyChain, key.ECDSAKeyChain{
-		Identifier:      uuid.New(),
-		ECDSAPublicKey:  ecdsaPubkey,
-		ECDSAPrivateKey: nil,
+		Identifier: orNewUUID(request.ECDSAKeyID),
+		Algorithm:  ecdsaAlg,
+		PublicKey:  ecdsaPubkey,
+		PrivateKey: nil,
+	})
+	var balance *rlwe.Ciphertext
+	err = doCrypto(req, func() (err error) {
+		balance, err = misc.GetAmountScheme().Encrypt(0, ckksPubkey)
+		return err
 	})
-	params := misc.GetCKKSParams()
-	balance := ckks.NewEncryptor(params, ckksPubkey).EncryptNew(
-		ckks.NewEncoder(params).EncodeNew(
-			[]float64{0}, params.MaxLevel(), params.DefaultScale(), params.MaxLogSlots(),
-		),
-	)
-	err = db.PutUserColumn(Database, usr, balance)
 	if err != nil {
+		returnCryptoFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	err = db.InsertUserColumn(Database, usr, balance)
+	if errors.Is(err, db.ErrUserExists) {
+		returnFailure(w, req, fmt.Errorf("user %v: %w", userUUID, err), http.StatusConflict)
+		return
+	} else if err != nil {
 		returnFailure(w, req, err, http.StatusInternalServerError)
 		return
 	}
@@ -567,9 +695,22 @@ func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
 		returnFailure(w, req, err, http.StatusInternalServerError)
 		return
 	}
+	if err = db.PutUserCertificates(Database, usr.UserIdentifier, request.Certificates); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	err = db.SetPrimaryKeys(Database, usr.UserIdentifier,
+		usr.UserCKKSKeyChain[0].Identifier, usr.UserECDSAKeyChain[0].Identifier)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	Keys.InvalidateSigningKeys(usr.UserIdentifier)
 
 	respData := make(map[string]interface{})
 	respData["status"] = "OK"
+	respData["ckksKeyID"] = usr.UserCKKSKeyChain[0].Identifier
+	respData["ecdsaKeyID"] = usr.UserECDSAKeyChain[0].Identifier
 
 	respJSON, err := json.Marshal(respData)
 	if err != nil {
@@ -583,6 +724,42 @@ func HandlerRegisterUser(w http.ResponseWriter, req *http.Request) {
 	InfoLogger.Print("HandlerRegisterUser took " + time.Since(start).String())
 }
 
+// Handle /swk/status
+// 返回某对用户之间最新的 swk 的有效期，以及当前纪元，客户端据此决定是否续期
+func HandlerSwkStatus(w http.ResponseWriter, req *http.Request) {
+	// 复用注册时使用的结构体
+	request := new(restfulpayload.RegisterSwkReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["currentEpoch"] = misc.SwkEpoch(time.Now(), ConfigSwkEpochDuration)
+	respData["epochDuration"] = int64(ConfigSwkEpochDuration / time.Second)
+
+	validity, err := db.GetLatestSwkValidityUserIDInOut(Database, request.UserIn, request.UserOut)
+	switch {
+	case err == sql.ErrNoRows:
+		respData["validity"] = nil
+	case err != nil:
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	default:
+		respData["validity"] = validity
+	}
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
 func HandlerUserGetBalance(w http.ResponseWriter, req *http.Request) {
 	InfoLogger.Print("Received new /user/getBalance request")
 	var err error
@@ -598,22 +775,35 @@ func HandlerUserGetBalance(w http.ResponseWriter, req *http.Request) {
 	userUUID := request.UUID
 
 	// 从数据库中读取
-	balance, err := db.GetUserBalance(Database, userUUID)
+	// 直接返回数据库中的字节，余额刷新以此比较余额是否变化
+	balanceBytes, err := db.GetUserBalanceBytes(Database, userUUID)
 	if err != nil {
 		returnFailure(w, req, err, http.StatusInternalServerError)
 		return
 	}
-	balanceBytes, err := balance.MarshalBinary()
+
+	balanceString := base64.StdEncoding.EncodeToString(balanceBytes)
+
+	// 运算次数超过阈值时，提示用户刷新余额密文
+	ops, err := db.GetUserBalanceOps(Database, userUUID)
 	if err != nil {
 		returnFailure(w, req, err, http.StatusInternalServerError)
 		return
 	}
 
-	balanceString := base64.StdEncoding.EncodeToString(balanceBytes)
+	// 计息消耗余额密文的层数，余额在第 0 层时同样需要刷新
+	levelExhausted, err := interestBalanceNeedsRefresh(userUUID, balanceBytes)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
 
 	respData := make(map[string]interface{})
 	respData["status"] = "OK"
 	respData["balance"] = balanceString
+	respData["operations"] = ops
+	respData["refreshRequired"] = ops >= ConfigBalanceRefreshThreshold || levelExhausted
+	respData["assets"] = Assets.Assets
 
 	respJSON, err := json.Marshal(respData)
 	if err != nil {
@@ -625,3 +815,505 @@ func HandlerUserGetBalance(w http.ResponseWriter, req *http.Request) {
 	w.Write(respJSON)
 	InfoLogger.Print("Processed new /user/getBalance, uuid = " + userUUID.String())
 }
+
+// Handle /user/getCertificate
+// 返回用户注册时提交的证书链，供对方在加密前验证
+func HandlerUserGetCertificate(w http.ResponseWriter, req *http.Request) {
+	// 复用注册时使用的结构体
+	request := new(restfulpayload.RegisterUserReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	chain, err := db.GetUserCertificates(Database, request.UUID)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusNotFound)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["certificates"] = chain
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// Handle /user/getPublicKeys
+// 返回用户的主 CKKS 公钥和全部签名公钥，客户端由助记词恢复密钥时据此核对
+func HandlerUserGetPublicKeys(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.RegisterUserReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	user, err := db.GetUser(Database, request.UUID)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusNotFound)
+		return
+	}
+	ckksPK, err := misc.MarshalCompactPublicKey(user.UserCKKSKeyChain[0].CKKSPublicKey, nil)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	signingKeys, err := db.GetECDSAKeysByUserUUID(Database, request.UUID)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	ecdsaKeys := make([]restfulpayload.SigningPublicKey, len(signingKeys))
+	for i, kc := range signingKeys {
+		ecdsaKeys[i] = restfulpayload.SigningPublicKey{
+			KeyID:          kc.Identifier,
+			ECDSA_pubkey:   base64.RawStdEncoding.EncodeToString(key.MarshalSigningPublicKey(kc.PublicKey)),
+			ECDSAAlgorithm: string(kc.Algorithm),
+		}
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["uuid"] = user.UserIdentifier
+	respData["name"] = user.UserName
+	respData["ckksKeyID"] = user.UserCKKSKeyChain[0].Identifier
+	respData["ckks_pubkey"] = base64.RawStdEncoding.EncodeToString(ckksPK)
+	respData["ecdsaKeys"] = ecdsaKeys
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// --- 监管部分 ---
+
+// Handle /transaction/hold
+// 监管者要求挂起交易，交易进入 "review" 阶段，在放行前无法确认
+func HandlerTransactionHold(w http.ResponseWriter, req *http.Request) {
+	handleAuditorAlert(w, req, auditorlib.AlertActionHold, serverlib.HoldTransaction)
+}
+
+// Handle /transaction/release
+func HandlerTransactionRelease(w http.ResponseWriter, req *http.Request) {
+	handleAuditorAlert(w, req, auditorlib.AlertActionRelease, serverlib.ReleaseTransaction)
+}
+
+func handleAuditorAlert(w http.ResponseWriter, req *http.Request, action string, apply func(*transaction.Transaction) error) {
+	InfoLogger.Print("Received new " + req.URL.Path + " request")
+
+	alert := new(auditorlib.Alert)
+	if err := json.NewDecoder(req.Body).Decode(alert); err != nil {
+		returnFailure(w, req, err, http.StatusBadRequest)
+		return
+	}
+
+	if AuditorPubkey == nil {
+		returnFailure(w, req,
+			fmt.Errorf("no auditor public key configured"), http.StatusForbidden)
+		return
+	}
+	if alert.Action != action || !alert.Verify(AuditorPubkey) {
+		returnFailure(w, req,
+			fmt.Errorf("alert verification failed"), http.StatusUnauthorized)
+		return
+	}
+	if err := checkFreshness("alert", alert.UUID.String(), alert.TimeStamp); err != nil {
+		returnFailure(w, req, err, http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.GetTransaction(Database, alert.TxUUID)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("get transaction failed: "+err.Error()), http.StatusNotFound)
+		return
+	}
+	if err = apply(tx); err != nil {
+		returnFailure(w, req, err, http.StatusConflict)
+		return
+	}
+	if err = db.WriteTransaction(Database, tx); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["transaction"] = tx.CopyToJSONStruct()
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+	InfoLogger.Printf("Processed %s, transaction = %v, rule = %s, reason = %s",
+		req.URL.Path, tx.UUID, alert.Rule, alert.Reason)
+}
+
+// Handle /balance/refresh
+// 用户提交签名的余额刷新声明，服务端验证签名后原子地替换余额密文
+// 若余额在用户解密后又发生变化，返回 409，用户需要重新获取余额
+func HandlerBalanceRefresh(w http.ResponseWriter, req *http.Request) {
+	refresh := new(transaction.BalanceRefresh)
+	if err := json.NewDecoder(req.Body).Decode(refresh); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	if err := misc.CheckCiphertext(refresh.NewBalance); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	pubkey, err := getSigningKey(refresh.User, uuid.Nil)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusNotFound)
+		return
+	}
+	if err = Revocations.CheckECDSAKey(pubkey.PublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if !refresh.Verify(pubkey.PublicKey) {
+		returnFailure(w, req,
+			fmt.Errorf("balance refresh signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+
+	swapped, err := db.RefreshBalance(Database, refresh)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	if !swapped {
+		returnFailure(w, req,
+			fmt.Errorf("balance has changed since it was fetched"), http.StatusConflict)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["uuid"] = refresh.UUID
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// Handle /balance/getRefreshes
+// 返回用户的全部余额刷新声明，供监管者核对
+func HandlerBalanceGetRefreshes(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.RegisterUserReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	refreshes, err := db.GetBalanceRefreshes(Database, request.UUID)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["refreshes"] = refreshes
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// Handle /user/getTransaction
+// 返回用户作为发送方或接收方的交易记录，asset 不为空时只返回涉及该资产的交易
+func HandlerUserGetTransactions(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.UserGetTransactionsReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	if request.Asset != "" {
+		if _, err := Assets.Get(request.Asset); err != nil {
+			returnFailure(w, req, err, 400)
+			return
+		}
+	}
+
+	txs, err := db.GetTransactionsByUser(Database, request.UUID, request.Asset)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	txsJSON := make([]*transaction.TransactionJSON, 0, len(txs))
+	for _, tx := range txs {
+		txsJSON = append(txsJSON, tx.CopyToJSONStruct())
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["transactions"] = txsJSON
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
+
+// --- 密钥轮换 ---
+
+// Handle /user/rotateCKKSKey
+// 用户提交新的 CKKS 公钥及旧私钥到新私钥的 swk，服务端据此重加密余额和待处理交易的密文，
+// 将新公钥设为主密钥，并删除引用旧公钥的 swk，之后与其他用户的 swk 需要重新注册
+// 已结束的交易保持不变，用户需保留旧私钥以解密历史交易
+func HandlerRotateCKKSKey(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	InfoLogger.Print("Received new /user/rotateCKKSKey")
+
+	request := new(restfulpayload.RotateCKKSKeyReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	pkBytes, err := base64.RawStdEncoding.DecodeString(request.CKKS_pubkey)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	newKey, err := misc.UnmarshalPublicKey(pkBytes)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ckks pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+	swkBytes, err := base64.RawStdEncoding.DecodeString(request.Swk)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	swk, err := misc.UnmarshalSwitchingKey(swkBytes)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("swk parse failed: "+err.Error()), 400)
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	usr, err := db.GetUser(Database, request.UUID)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusNotFound)
+		return
+	}
+	ecdsaKey, oldKey := usr.UserECDSAKeyChain[0], usr.UserCKKSKeyChain[0]
+	if err = Revocations.CheckECDSAKey(ecdsaKey.PublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if err = Revocations.CheckCKKSKey(newKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	oldFingerprint := key.CKKSKeyFingerprint(oldKey.CKKSPublicKey)
+	if oldFingerprint == key.CKKSKeyFingerprint(newKey) {
+		returnFailure(w, req, fmt.Errorf("new ckks key is the same as the current one"), 400)
+		return
+	}
+	msg := key.RotateCKKSKeyMessage(request.UUID, request.KeyID, oldFingerprint, pkBytes, swkBytes)
+	if !serverlib.ValidateSignatureBase(msg, sig, ecdsaKey.PublicKey) {
+		returnFailure(w, req,
+			fmt.Errorf("key rotation signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+
+	// 新公钥须有 CA 签发的证书
+	if CAPubkey == nil {
+		returnFailure(w, req,
+			fmt.Errorf("no CA public key configured, cannot verify certificates"), http.StatusServiceUnavailable)
+		return
+	}
+	cert, err := key.VerifyCertificateChain(request.Certificates, CAPubkey, time.Now(), Revocations.IsRevoked)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if err = cert.Matches(request.UUID, ecdsaKey.PublicKey, newKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if cert.Name != usr.UserName {
+		returnFailure(w, req,
+			fmt.Errorf("certificate name %q does not match %q", cert.Name, usr.UserName), http.StatusForbidden)
+		return
+	}
+
+	// 重加密余额和待处理交易
+	rotation := &db.CKKSKeyRotation{
+		User:         request.UUID,
+		OldKeyID:     oldKey.Identifier,
+		NewKeyID:     orNewUUID(request.KeyID),
+		NewKey:       newKey,
+		Certificates: request.Certificates,
+	}
+	if rotation.OldBalance, err = db.GetUserBalanceBytes(Database, request.UUID); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	balance, err := misc.UnmarshalCiphertext(rotation.OldBalance)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	if rotation.Transactions, err = db.GetPendingTransactionsByUser(Database, request.UUID); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	err = doCrypto(req, func() (err error) {
+		if rotation.Balance, err = serverlib.ReEncryptCTWithSwk(balance, swk); err != nil {
+			return err
+		}
+		for _, tx := range rotation.Transactions {
+			if err = serverlib.RotateTransactionCT(tx, request.UUID, swk, oldKey.Identifier, rotation.NewKeyID); err != nil {
+				return fmt.Errorf("transaction %v: %w", tx.UUID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		returnCryptoFailure(w, req, err, 400)
+		return
+	}
+
+	swapped, err := db.RotateCKKSKey(Database, rotation)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	if !swapped {
+		returnFailure(w, req,
+			fmt.Errorf("balance has changed during key rotation, please retry"), http.StatusConflict)
+		return
+	}
+	Keys.InvalidateCKKSKey(request.UUID, oldKey.Identifier)
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["keyID"] = rotation.NewKeyID
+	respData["rotatedTransactions"] = len(rotation.Transactions)
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+	InfoLogger.Print("Processed new /user/rotateCKKSKey, uuid = " + request.UUID.String())
+	InfoLogger.Print("HandlerRotateCKKSKey took " + time.Since(start).String())
+}
+
+// Handle /user/addECDSAKey
+// 为用户添加一个 ECDSA 公钥，例如每台设备各持有一个签名密钥
+// 请求须由该用户已有的 ECDSA 密钥签名；交易中的签名以 sig*KeyID 指明所用的密钥
+// 主 ECDSA 公钥（证书中绑定的公钥）不变
+func HandlerAddECDSAKey(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	InfoLogger.Print("Received new /user/addECDSAKey")
+
+	request := new(restfulpayload.AddECDSAKeyReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	pkBytes, err := base64.RawStdEncoding.DecodeString(request.ECDSA_pubkey)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	pk, _, err := key.UnmarshalSigningPublicKeyAs(pkBytes, request.ECDSAAlgorithm)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("signing pubkey parse failed: "+err.Error()), 400)
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	signer, err := getSigningKey(request.UUID, request.SignedBy)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ecdsa key %v of user %v not found", request.SignedBy, request.UUID), http.StatusNotFound)
+		return
+	}
+	for _, k := range []crypto.PublicKey{signer.PublicKey, pk} {
+		if err = Revocations.CheckECDSAKey(k); err != nil {
+			returnFailure(w, req, err, http.StatusForbidden)
+			return
+		}
+	}
+	keyID := orNewUUID(request.KeyID)
+	if !serverlib.ValidateSignatureBase(key.AddECDSAKeyMessage(request.UUID, request.KeyID, pkBytes), sig, signer.PublicKey) {
+		returnFailure(w, req,
+			fmt.Errorf("add key signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+
+	if err = db.PutECDSAPublicKeyColumn(Database, keyID, request.UUID, pk); err != nil {
+		returnFailure(w, req, err, http.StatusConflict)
+		return
+	}
+	Keys.InvalidateSigningKeys(request.UUID)
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["keyID"] = keyID
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+	InfoLogger.Print("Processed new /user/addECDSAKey, uuid = " + request.UUID.String())
+	InfoLogger.Print("HandlerAddECDSAKey took " + time.Since(start).String())
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"database/sql"
 	"os"
+	"strings"
+	"time"
 
 	database "github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -51,6 +54,9 @@ func initDatabase(path string) (db *sql.DB, err error) {
 		ErrorLogger.Println(err.Error())
 		return nil, err
 	}
+	if err = database.MigrateUserTable(db); err != nil {
+		return nil, err
+	}
 
 	// 建立交易数据表
 	DebugLogger.Println("Database: Initializing Transaction")
@@ -58,6 +64,16 @@ func initDatabase(path string) (db *sql.DB, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = database.MigrateTransactionTable(db); err != nil {
+		return nil, err
+	}
+
+	// 建立资产注册表
+	DebugLogger.Println("Database: Initializing Asset")
+	_, err = db.Exec(database.CreateAssetTable())
+	if err != nil {
+		return nil, err
+	}
 
 	// 建立公钥表
 	DebugLogger.Println("Database: Initializing CKKS PublicKey")
@@ -65,12 +81,18 @@ func initDatabase(path string) (db *sql.DB, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = database.MigrateCKKSKeyTable(db); err != nil {
+		return nil, err
+	}
 
 	DebugLogger.Println("Database: Initializing ECDSA PublicKey")
 	_, err = db.Exec(database.CreateECDSAKeyTable())
 	if err != nil {
 		return nil, err
 	}
+	if err = database.MigrateECDSAKeyTable(db); err != nil {
+		return nil, err
+	}
 
 	// 建立重加密密钥表
 	DebugLogger.Println("Database: Initializing CKKS SwitchingKey")
@@ -78,6 +100,65 @@ func initDatabase(path string) (db *sql.DB, err error) {
 	if err != nil {
 		return nil, err
 	}
+	currentEpoch := misc.SwkEpoch(time.Now(), ConfigSwkEpochDuration)
+	if err = database.MigrateSwitchingKeyTable(db,
+		misc.NewSwkValidity(currentEpoch, ConfigSwkEpochDuration, ConfigSwkGracePeriod)); err != nil {
+		return nil, err
+	}
+	if err = database.MigrateKeyIDs(db); err != nil {
+		return nil, err
+	}
+
+	// 建立余额刷新记录表
+	DebugLogger.Println("Database: Initializing BalanceRefresh")
+	_, err = db.Exec(database.CreateBalanceRefreshTable())
+	if err != nil {
+		return nil, err
+	}
+
+	// 建立已使用 nonce 表
+	DebugLogger.Println("Database: Initializing UsedNonce")
+	_, err = db.Exec(database.CreateUsedNonceTable())
+	if err != nil {
+		return nil, err
+	}
+
+	// 建立账户产品表
+	DebugLogger.Println("Database: Initializing AccountProduct")
+	_, err = db.Exec(database.CreateAccountProductTable())
+	if err != nil {
+		return nil, err
+	}
 
 	return
 }
+
+// initAssets 加载资产注册表，并注册 specs 中尚未注册的资产
+// 默认资产总是位于槽位 0；已分配的槽位不会改变，否则旧的余额密文会错位
+func initAssets(db *sql.DB, specs []string) (r *misc.AssetRegistry, err error) {
+	if r, err = database.GetAssetRegistry(db); err != nil {
+		return nil, err
+	}
+	if len(r.Assets) == 0 {
+		r = misc.NewAssetRegistry()
+		if err = database.PutAsset(db, r.Assets[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, spec := range specs {
+		id, name, _ := strings.Cut(spec, ":")
+		if name == "" {
+			name = id
+		}
+		a, err := r.Add(id, name)
+		if err != nil {
+			return nil, err
+		}
+		if err = database.PutAsset(db, a); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, r.Validate()
+}
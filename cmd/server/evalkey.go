@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/google/uuid"
+)
+
+// Handle /user/registerEvaluationKey
+// 为用户的 CKKS 公钥注册或替换计算密钥，请求须由用户的签名密钥签名
+// 计算密钥属于某一 CKKS 公钥，密钥轮换后须为新公钥重新注册；替换后到监管者的 swk 同样须重新注册
+func HandlerRegisterEvaluationKey(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new /user/registerEvaluationKey")
+
+	request := new(restfulpayload.RegisterEvaluationKeyReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	evkBytes, err := base64.RawStdEncoding.DecodeString(request.EvaluationKey)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	signer, err := getSigningKey(request.UUID, request.SignedBy)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ecdsa key %v of user %v not found", request.SignedBy, request.UUID), http.StatusNotFound)
+		return
+	}
+	if err = Revocations.CheckECDSAKey(signer.PublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if !serverlib.ValidateSignatureBase(key.RegisterEvaluationKeyMessage(request.UUID, request.KeyID, evkBytes), sig, signer.PublicKey) {
+		returnFailure(w, req,
+			fmt.Errorf("evaluation key signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+
+	ckksKey, err := db.GetCKKSKeyByID(Database, request.UUID, request.KeyID)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ckks key %v of user %v not found", request.KeyID, request.UUID), http.StatusNotFound)
+		return
+	}
+	if err = Revocations.CheckCKKSKey(ckksKey.CKKSPublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	evk, err := misc.UnmarshalEvaluationKey(evkBytes)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	galEls := misc.EvaluationKeyGaloisElements(evk)
+	if len(galEls) > ConfigMaxRotationKeys {
+		returnFailure(w, req,
+			fmt.Errorf("too many rotation keys: %d, at most %d", len(galEls), ConfigMaxRotationKeys), 400)
+		return
+	}
+	if err = misc.CheckEvaluationKey(evk, ckksKey.CKKSPublicKey); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	if err = db.PutEvaluationKey(Database, request.UUID, ckksKey.Identifier, evkBytes); err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	Keys.InvalidateEvaluators(request.UUID)
+	Keys.InvalidateSwitchingKey(ckksKey.Identifier, uuid.Nil)
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["keyID"] = ckksKey.Identifier
+	respData["relinearizationKey"] = evk.Rlk != nil
+	respData["galoisElements"] = galEls
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+	InfoLogger.Printf("Processed new /user/registerEvaluationKey, uuid = %v, keyID = %v", request.UUID, ckksKey.Identifier)
+}
+
+// Handle /user/getEvaluationKey
+// 返回用户 CKKS 公钥的计算密钥，未注册时返回 404
+func HandlerGetEvaluationKey(w http.ResponseWriter, req *http.Request) {
+	request := new(restfulpayload.GetEvaluationKeyReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	keyID, evkBytes, err := db.GetEvaluationKeyBytes(Database, request.UUID, request.KeyID)
+	if errors.Is(err, db.ErrNoEvaluationKey) {
+		err = fmt.Errorf("ckks key %v of user %v: %w", keyID, request.UUID, err)
+	}
+	if err != nil {
+		returnFailure(w, req, err, http.StatusNotFound)
+		return
+	}
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["keyID"] = keyID
+	respData["evaluationKey"] = base64.RawStdEncoding.EncodeToString(evkBytes)
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"expvar"
+
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Keys 缓存 swk、签名公钥和用户的求值器，大小由 -swk-cache-bytes 和 -signing-key-cache 指定
+// 命中统计发布在 /debug/vars 的 keyCache 中
+var Keys *serverlib.KeyCache
+
+func initKeyCache() {
+	Keys = serverlib.NewKeyCache(ConfigSwkCacheBytes, ConfigSigningKeyCacheSize)
+	expvar.Publish("keyCache", expvar.Func(func() any { return Keys.Stats() }))
+}
+
+// getSwitchingKey 同 db.GetSwitchingKeyPKInPKOut，优先从缓存读取
+func getSwitchingKey(pkIDIn, pkIDOut uuid.UUID) (*rlwe.SwitchingKey, error) {
+	return Keys.SwitchingKey(pkIDIn, pkIDOut, func() (*rlwe.SwitchingKey, *misc.SwkValidity, error) {
+		return db.GetValidSwitchingKeyPKInPKOut(Database, pkIDIn, pkIDOut)
+	})
+}
+
+// getSigningKey 同 db.GetECDSAKeyByID，优先从缓存读取
+func getSigningKey(userUUID, keyID uuid.UUID) (*key.ECDSAKeyChain, error) {
+	return Keys.SigningKey(userUUID, keyID, func() (*key.ECDSAKeyChain, error) {
+		return db.GetECDSAKeyByID(Database, userUUID, keyID)
+	})
+}
+
+// getUserEvaluator 返回以用户 CKKS 公钥 keyID（零值时为主公钥）的计算密钥构造的求值器，优先从缓存读取
+func getUserEvaluator(userUUID, keyID uuid.UUID) (*serverlib.UserEvaluator, error) {
+	return Keys.UserEvaluator(userUUID, keyID, func() (rlwe.EvaluationKey, error) {
+		_, evk, err := db.GetEvaluationKey(Database, userUUID, keyID)
+		return evk, err
+	})
+}
+
+// invalidateSwitchingKey 使新注册的 swk 对应的缓存失效
+// 注册时未指明公钥的，与 db.PutSwitchingKeyColumnByUserInUserOut 一样取用户的主 CKKS 公钥
+func invalidateSwitchingKey(userIn, userOut, pkIn, pkOut uuid.UUID) error {
+	for _, pk := range []struct {
+		id   *uuid.UUID
+		user uuid.UUID
+	}{{&pkIn, userIn}, {&pkOut, userOut}} {
+		if *pk.id != uuid.Nil {
+			continue
+		}
+		primary, _, err := db.GetPrimaryKeyIDs(Database, pk.user)
+		if err != nil {
+			return err
+		}
+		*pk.id = primary
+	}
+	Keys.InvalidateSwitchingKey(pkIn, pkOut)
+	return nil
+}
+
+// getAuditorSwk 同 db.GetAuditorSwk，keyID 须为实际的 CKKS 公钥 ID，优先从缓存读取
+func getAuditorSwk(userUUID, keyID uuid.UUID) (*rlwe.SwitchingKey, error) {
+	return Keys.AuditorSwk(keyID, func() (*rlwe.SwitchingKey, error) {
+		_, swk, err := db.GetAuditorSwk(Database, userUUID, keyID)
+		return swk, err
+	})
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/db"
+)
+
+// ErrStaleRequest 表示签名请求的时间戳超出了 -signed-request-max-age
+var ErrStaleRequest = errors.New("signed request has expired")
+
+// checkFreshness 检查签名请求的时间戳（unix 时间）与当前时间相差不超过 ConfigSignedRequestMaxAge，
+// 并记录 nonce，同一 nonce 在有效期内再次出现时返回 db.ErrNonceReused
+// scope 区分不同种类的请求，nonce 只需在同一种类中唯一
+func checkFreshness(scope, nonce string, timestamp int64) error {
+	signedAt := time.Unix(timestamp, 0)
+	if age := time.Since(signedAt); age > ConfigSignedRequestMaxAge || age < -ConfigSignedRequestMaxAge {
+		return fmt.Errorf("%w: signed at %v", ErrStaleRequest, signedAt)
+	}
+	return db.ConsumeNonce(Database, scope+"+"+nonce, signedAt.Add(ConfigSignedRequestMaxAge))
+}
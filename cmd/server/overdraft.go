@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+var (
+	// ErrOverdraft 表示监管者判断交易会使发送方的某一资产透支
+	ErrOverdraft = errors.New("transaction rejected: overdraft detected by auditor")
+	// ErrOverdraftUndecided 表示监管者无法判断交易是否透支，见 -overdraft-allow-undecided
+	ErrOverdraftUndecided = errors.New("transaction rejected: overdraft check undecided, balance is within the noise of the amount")
+	// ErrOverdraftUncheckable 表示启用透支检查时无法为交易计算指示值
+	ErrOverdraftUncheckable = errors.New("transaction rejected: overdraft check not possible")
+	// ErrOverdraftTampered 表示监管者解密得到的指示值不可能由正确的计算得到，发送方的计算密钥或 swk 有误
+	ErrOverdraftTampered = errors.New("transaction rejected: overdraft indicator is malformed, the sender's keys do not match")
+)
+
+// OverdraftExempt 为由 -overdraft-exempt 指定、不做透支检查的发送方
+// 透支检查拒绝余额不足的转账，资金只能由这些账户（如发行账户）转出进入系统
+var OverdraftExempt map[uuid.UUID]bool
+
+func parseOverdraftExempt(specs []string) (map[uuid.UUID]bool, error) {
+	exempt := make(map[uuid.UUID]bool)
+	for _, spec := range specs {
+		id, err := uuid.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("-overdraft-exempt %q: %v", spec, err)
+		}
+		exempt[id] = true
+	}
+	return exempt, nil
+}
+
+// checkOverdraft 请求监管者判断 tx 是否使发送方透支，见 serverlib.OverdraftIndicator
+// 未设置 -overdraft-auditor 或发送方在 OverdraftExempt 中时不检查；发送方没有计算密钥或到监管者的 swk、交易金额不是以主公钥加密、
+// 或余额层数不足时无法计算指示值，返回 ErrOverdraftUncheckable
+func checkOverdraft(req *http.Request, tx *transaction.Transaction, senderBalance *rlwe.Ciphertext) error {
+	if ConfigOverdraftAuditorURL == "" {
+		return nil
+	}
+	if OverdraftExempt[tx.Sender] {
+		InfoLogger.Printf("Overdraft check of transaction %v skipped, sender %v is exempt", tx.UUID, tx.Sender)
+		return nil
+	}
+	uncheckable := func(reason error) error {
+		return fmt.Errorf("%w: %v", ErrOverdraftUncheckable, reason)
+	}
+
+	primary, _, err := db.GetPrimaryKeyIDs(Database, tx.Sender)
+	if err != nil {
+		return err
+	}
+	if tx.CTSenderKeyID != uuid.Nil && tx.CTSenderKeyID != primary {
+		return uncheckable(fmt.Errorf("amount is encrypted under ckks key %v, not the primary key", tx.CTSenderKeyID))
+	}
+	eval, err := getUserEvaluator(tx.Sender, primary)
+	if errors.Is(err, db.ErrNoEvaluationKey) {
+		return uncheckable(err)
+	} else if err != nil {
+		return err
+	}
+	swk, err := getAuditorSwk(tx.Sender, primary)
+	if errors.Is(err, db.ErrNoAuditorSwk) {
+		return uncheckable(err)
+	} else if err != nil {
+		return err
+	}
+
+	var slots []int
+	for _, id := range tx.GetAssets() {
+		asset, err := Assets.Get(id)
+		if err != nil {
+			return err
+		}
+		slots = append(slots, asset.Slot)
+	}
+	amount, err := misc.UnmarshalCiphertext(tx.CTSender)
+	if err != nil {
+		return err
+	}
+
+	var ind *rlwe.Ciphertext
+	err = doCrypto(req, func() (err error) {
+		if ind, _, err = eval.OverdraftIndicator(senderBalance, amount, slots, ConfigOverdraftBound); err != nil {
+			return err
+		}
+		ind, err = serverlib.SwitchToAuditor(ind, swk)
+		return err
+	})
+	if errors.Is(err, transaction.ErrNoLevelLeft) {
+		return uncheckable(err)
+	} else if err != nil {
+		return err
+	}
+	indBytes, err := misc.MarshalCompactCiphertext(ind)
+	if err != nil {
+		return err
+	}
+
+	decision, err := auditorlib.RequestOverdraftDecision(ConfigOverdraftAuditorURL, restfulpayload.AuditorOverdraftCheckReq{
+		TxUUID:    tx.UUID,
+		UUID:      tx.Sender,
+		Slots:     slots,
+		Indicator: base64.StdEncoding.EncodeToString(indBytes),
+	}, SigningKey)
+	if err != nil {
+		return fmt.Errorf("overdraft check failed: %w", err)
+	}
+	switch decision {
+	case auditorlib.OverdraftDetected:
+		return ErrOverdraft
+	case auditorlib.OverdraftTampered:
+		WarningLogger.Printf("Overdraft indicator of transaction %v is malformed, sender = %v", tx.UUID, tx.Sender)
+		return ErrOverdraftTampered
+	case auditorlib.OverdraftUndecided:
+		if !ConfigOverdraftAllowUndecided {
+			return ErrOverdraftUndecided
+		}
+		WarningLogger.Printf("Overdraft check of transaction %v undecided, balance is within the noise of the amount", tx.UUID)
+	}
+	return nil
+}
+
+// returnOverdraftFailure 返回 checkOverdraft 的错误，透支或无法判断时为 402，无法检查或指示值有误时为 412
+func returnOverdraftFailure(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrOverdraft), errors.Is(err, ErrOverdraftUndecided):
+		returnFailure(w, req, err, http.StatusPaymentRequired)
+		return
+	case errors.Is(err, ErrOverdraftUncheckable), errors.Is(err, ErrOverdraftTampered):
+		returnFailure(w, req, err, http.StatusPreconditionFailed)
+		return
+	}
+	returnCryptoFailure(w, req, err, http.StatusInternalServerError)
+}
+
+// Handle /user/registerAuditorSwk
+// 为用户的 CKKS 公钥注册或替换到监管者透支密钥的 swk，请求须由用户的签名密钥签名
+// swk 无法在不知道监管者私钥的情况下验证，因此还须带有监管者对该公钥和 swk 的证明，见 auditorlib.OverdraftKey.CertifySwk
+// 证明同时覆盖该公钥已注册的计算密钥，计算透支指示值只使用经过证明的重线性化密钥；计算密钥被替换后须重新注册 swk
+func HandlerRegisterAuditorSwk(w http.ResponseWriter, req *http.Request) {
+	InfoLogger.Print("Received new /user/registerAuditorSwk")
+
+	request := new(restfulpayload.RegisterAuditorSwkReq)
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	swkBytes, err := base64.RawStdEncoding.DecodeString(request.Swk)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(request.Sig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	auditorSig, err := base64.RawStdEncoding.DecodeString(request.AuditorSig)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	signer, err := getSigningKey(request.UUID, request.SignedBy)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ecdsa key %v of user %v not found", request.SignedBy, request.UUID), http.StatusNotFound)
+		return
+	}
+	if err = Revocations.CheckECDSAKey(signer.PublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if !serverlib.ValidateSignatureBase(key.RegisterAuditorSwkMessage(request.UUID, request.KeyID, swkBytes), sig, signer.PublicKey) {
+		returnFailure(w, req,
+			fmt.Errorf("auditor swk signature verify failed"), http.StatusUnauthorized)
+		return
+	}
+
+	ckksKey, err := db.GetCKKSKeyByID(Database, request.UUID, request.KeyID)
+	if err != nil {
+		returnFailure(w, req,
+			fmt.Errorf("ckks key %v of user %v not found", request.KeyID, request.UUID), http.StatusNotFound)
+		return
+	}
+	if err = Revocations.CheckCKKSKey(ckksKey.CKKSPublicKey); err != nil {
+		returnFailure(w, req, err, http.StatusForbidden)
+		return
+	}
+	if AuditorPubkey == nil {
+		returnFailure(w, req,
+			fmt.Errorf("no auditor public key configured"), http.StatusForbidden)
+		return
+	}
+	_, evkBytes, err := db.GetEvaluationKeyBytes(Database, request.UUID, ckksKey.Identifier)
+	if errors.Is(err, db.ErrNoEvaluationKey) {
+		returnFailure(w, req,
+			fmt.Errorf("ckks key %v of user %v: %w", ckksKey.Identifier, request.UUID, err), http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	certMsg := key.AuditorSwkCertMessage(request.UUID, request.KeyID, key.CKKSKeyFingerprint(ckksKey.CKKSPublicKey), swkBytes, evkBytes)
+	if !serverlib.ValidateSignatureBase(certMsg, auditorSig, AuditorPubkey) {
+		returnFailure(w, req,
+			fmt.Errorf("auditor swk certificate verify failed"), http.StatusUnauthorized)
+		return
+	}
+	swk, err := misc.UnmarshalSwitchingKey(swkBytes)
+	if err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+	if err = misc.CheckSwitchingKey(swk); err != nil {
+		returnFailure(w, req, err, 400)
+		return
+	}
+
+	err = db.PutAuditorSwk(Database, request.UUID, ckksKey.Identifier, swkBytes, evkBytes)
+	if errors.Is(err, db.ErrEvaluationKeyChanged) {
+		returnFailure(w, req, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+	Keys.InvalidateSwitchingKey(ckksKey.Identifier, uuid.Nil)
+
+	respData := make(map[string]interface{})
+	respData["status"] = "OK"
+	respData["keyID"] = ckksKey.Identifier
+
+	respJSON, err := json.Marshal(respData)
+	if err != nil {
+		returnFailure(w, req, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(respJSON)
+	InfoLogger.Printf("Processed new /user/registerAuditorSwk, uuid = %v, keyID = %v", request.UUID, ckksKey.Identifier)
+}
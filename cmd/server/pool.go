@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+)
+
+// CryptoPool 执行重加密、余额加减等同态运算，大小由 -crypto-workers 和 -crypto-queue 指定
+// 指标发布在 /debug/vars 的 cryptoPool 中
+var CryptoPool *serverlib.WorkerPool
+
+func initCryptoPool() {
+	CryptoPool = serverlib.NewWorkerPool(ConfigCryptoWorkers, ConfigCryptoQueueSize, ConfigCryptoJobTimeout)
+	expvar.Publish("cryptoPool", expvar.Func(func() any { return CryptoPool.Stats() }))
+}
+
+// doCrypto 在 CryptoPool 中执行 f，请求断开时放弃等待
+func doCrypto(req *http.Request, f func() error) error {
+	return CryptoPool.Do(req.Context(), f)
+}
+
+// returnCryptoFailure 同 returnFailure，工作池繁忙或任务超时时返回 503 并要求客户端稍后重试
+func returnCryptoFailure(w http.ResponseWriter, req *http.Request, err error, statusCode int) {
+	if errors.Is(err, serverlib.ErrPoolBusy) || errors.Is(err, serverlib.ErrJobTimeout) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(ConfigCryptoRetryAfter.Seconds())))
+		statusCode = http.StatusServiceUnavailable
+	}
+	returnFailure(w, req, err, statusCode)
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"crypto/ecdsa"
 	"database/sql"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
+
+	database "github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
 )
 
 var (
@@ -19,12 +29,60 @@ var (
 
 var (
 	Database *sql.DB
+	// 监管者的签名公钥，用于验证挂起/放行指令；为 nil 时不接受监管指令
+	AuditorPubkey *ecdsa.PublicKey
+	// CA 签名公钥，用于验证吊销列表和用户证书；为 nil 时不同步吊销列表，也不接受用户注册
+	CAPubkey *ecdsa.PublicKey
+	// 从 CA 同步的密钥吊销列表
+	Revocations = serverlib.NewRevocationStore()
+	// 资产注册表，启动时从数据库加载，见 initAssets
+	Assets *misc.AssetRegistry
+	// 服务端签名私钥，用于签名发给监管者的透支判断请求；只在启用透支检查时加载
+	SigningKey *ecdsa.PrivateKey
 )
 
 const (
 	DefaultListenPort = "16001"
 	DefaultVersion    = "indev"
 	DefaultListenAddr = "127.0.0.1"
+
+	DefaultSwkEpochDuration = 7 * 24 * time.Hour
+	DefaultSwkGracePeriod   = 24 * time.Hour
+	// 清理过期 swk 的间隔
+	DefaultSwkPurgeInterval = time.Hour
+
+	DefaultCAURL = "http://127.0.0.1:16002"
+	// 同步吊销列表的间隔
+	DefaultRevocationSyncInterval = 10 * time.Minute
+
+	DefaultParamSet = misc.DefaultParamSetID
+
+	// 余额运算次数达到该值后，要求用户刷新余额密文
+	DefaultBalanceRefreshThreshold = 256
+
+	// 同态运算工作池，worker 数为 0 时使用 CPU 核数，见 CryptoPool
+	DefaultCryptoWorkers    = 0
+	DefaultCryptoQueueSize  = 64
+	DefaultCryptoJobTimeout = 30 * time.Second
+	// 工作池繁忙时建议客户端等待的时间
+	DefaultCryptoRetryAfter = time.Second
+
+	// 密钥缓存的容量，见 Keys
+	DefaultSwkCacheBytes       = 256 << 20
+	DefaultSigningKeyCacheSize = 4096
+
+	// 每个计算密钥最多包含的旋转密钥个数，每个旋转密钥与一个 swk 大小相同
+	DefaultMaxRotationKeys = 32
+
+	// 账户产品未指定 period 时的计息周期，及检查是否进入新一期的间隔
+	DefaultAccrualPeriod        = 30 * 24 * time.Hour
+	DefaultAccrualCheckInterval = time.Hour
+
+	// 监管指令等签名请求的有效期，见 checkFreshness
+	DefaultSignedRequestMaxAge = 5 * time.Minute
+
+	// 透支指示值归一化所用的上界，|余额 - 金额| 超过它时指示值没有意义，见 serverlib.OverdraftIndicator
+	DefaultOverdraftBound = 1e6
 )
 
 var (
@@ -32,8 +90,62 @@ var (
 	ConfigListenPort              = DefaultListenPort
 	isIgnoreValidityOfTransaction = true
 	ConfigVersion                 = DefaultVersion
+	// swk 纪元长度与宽限期，见 misc.SwkValidity
+	ConfigSwkEpochDuration = DefaultSwkEpochDuration
+	ConfigSwkGracePeriod   = DefaultSwkGracePeriod
+	// 监管者签名公钥（PEM）的路径，由 chimata-auditor 生成
+	ConfigAuditorPubkeyPath = homedir + DefaultDatabaseDirPath + "auditor.pem.pub"
+	// CA 地址及其签名公钥（PEM）的路径，由 chimata-ca 生成
+	ConfigCAURL        = DefaultCAURL
+	ConfigCAPubkeyPath = homedir + DefaultDatabaseDirPath + "ca.pem.pub"
+	// 服务端签名私钥（PEM）的路径，不存在时生成，公钥写入 .pub 文件供监管者配置
+	ConfigSigningKeyPath = homedir + DefaultDatabaseDirPath + "server.pem"
+	// 参数集及其金额加密方案（CKKS 或 BGV），见 misc.ParamSetIDs；同一数据库中的密文必须使用同一参数集
+	ConfigParamSet = DefaultParamSet
+	// 余额刷新阈值，见 HandlerBalanceRefresh
+	ConfigBalanceRefreshThreshold int64 = DefaultBalanceRefreshThreshold
+	// 启动时注册的资产，格式为 id 或 id:name
+	ConfigAssets assetFlag
+	// 为 true 时拒绝没有范围证明的转账，见 verifyRangeProof
+	ConfigRequireRangeProof = true
+	// 为 true 时 bySenderPK 交易直接记账，不等待接收方检查范围证明与密文一致，见 HandlerTransactionCreateBySenderPK
+	ConfigSenderPKDirectSettle = false
+	// 同态运算工作池的 worker 数、队列长度和单个任务的时限
+	ConfigCryptoWorkers    = DefaultCryptoWorkers
+	ConfigCryptoQueueSize  = DefaultCryptoQueueSize
+	ConfigCryptoJobTimeout = DefaultCryptoJobTimeout
+	ConfigCryptoRetryAfter = DefaultCryptoRetryAfter
+	// swk 缓存的总字节数和签名公钥缓存的个数，为 0 时不缓存
+	ConfigSwkCacheBytes       int64 = DefaultSwkCacheBytes
+	ConfigSigningKeyCacheSize       = DefaultSigningKeyCacheSize
+	ConfigMaxRotationKeys           = DefaultMaxRotationKeys
+
+	// 账户产品及计息，见 accrual.go
+	ConfigProducts             assetFlag
+	ConfigAccrualPeriod        = DefaultAccrualPeriod
+	ConfigAccrualCheckInterval = DefaultAccrualCheckInterval
+
+	ConfigSignedRequestMaxAge = DefaultSignedRequestMaxAge
+
+	// 透支检查，见 overdraft.go；监管者地址为空时不检查，否则拒绝无法检查的交易
+	ConfigOverdraftAuditorURL string
+	ConfigOverdraftBound      = DefaultOverdraftBound
+	// 为 true 时放行监管者判断为 undecided 的交易
+	ConfigOverdraftAllowUndecided = false
+	// 不做透支检查的发送方（如发行账户）的 uuid，见 OverdraftExempt
+	ConfigOverdraftExempt assetFlag
 )
 
+// assetFlag 允许多次指定 -asset，-product、-overdraft-exempt 同理
+type assetFlag []string
+
+func (f *assetFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *assetFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 func loggerInit() {
 	CriticalLogger = *log.New(os.Stderr, "CRITICAL: ", log.Ldate|log.Ltime|log.Lshortfile)
 	ErrorLogger = *log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
@@ -43,7 +155,7 @@ func loggerInit() {
 }
 
 func main() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -56,23 +168,101 @@ func main() {
 	var err error
 	loggerInit()
 
+	flag.StringVar(&ConfigParamSet, "params", DefaultParamSet,
+		fmt.Sprintf("parameter set (selects the CKKS or BGV amount scheme), one of %v", misc.ParamSetIDs()))
+	flag.Var(&ConfigAssets, "asset",
+		"register an asset as id or id:name, may be repeated; slots are assigned in order and persisted")
+	flag.BoolVar(&ConfigRequireRangeProof, "require-range-proof", true,
+		"reject transfers without a range proof on the amounts")
+	flag.BoolVar(&ConfigSenderPKDirectSettle, "sender-pk-direct-settle", false,
+		"settle bySenderPK transfers immediately instead of waiting for the receiver to check the range proof against the ciphertext")
+	flag.IntVar(&ConfigCryptoWorkers, "crypto-workers", DefaultCryptoWorkers,
+		"number of workers for homomorphic operations, 0 for the number of CPUs")
+	flag.IntVar(&ConfigCryptoQueueSize, "crypto-queue", DefaultCryptoQueueSize,
+		"max queued homomorphic operations, further requests get 503 with Retry-After")
+	flag.DurationVar(&ConfigCryptoJobTimeout, "crypto-timeout", DefaultCryptoJobTimeout,
+		"timeout of a single homomorphic operation including queueing, 0 for none")
+	flag.Int64Var(&ConfigSwkCacheBytes, "swk-cache-bytes", DefaultSwkCacheBytes,
+		"max total size of cached switching keys in bytes, 0 to disable")
+	flag.IntVar(&ConfigSigningKeyCacheSize, "signing-key-cache", DefaultSigningKeyCacheSize,
+		"max number of cached signing public keys, 0 to disable")
+	flag.IntVar(&ConfigMaxRotationKeys, "max-rotation-keys", DefaultMaxRotationKeys,
+		"max number of rotation keys in a registered evaluation key")
+	flag.Var(&ConfigProducts, "product",
+		"register an account product as id:interest=RATE,fee=AMOUNT,asset=ID,period=DURATION, may be repeated; "+
+			"enrolled balances accrue interest (CKKS only) and pay the fee once per period")
+	flag.DurationVar(&ConfigAccrualPeriod, "accrual-period", DefaultAccrualPeriod,
+		"default accrual period of products that do not set one")
+	flag.DurationVar(&ConfigAccrualCheckInterval, "accrual-interval", DefaultAccrualCheckInterval,
+		"how often to check for products entering a new period")
+	flag.DurationVar(&ConfigSignedRequestMaxAge, "signed-request-max-age", DefaultSignedRequestMaxAge,
+		"max clock difference of timestamped signed requests such as auditor alerts, their nonces are kept for this long")
+	flag.StringVar(&ConfigOverdraftAuditorURL, "overdraft-auditor", "",
+		"auditor URL to check transfers for overdrafts on encrypted balances (CKKS with at least 4 levels, e.g. PN13QP218), empty to disable")
+	flag.Float64Var(&ConfigOverdraftBound, "overdraft-bound", DefaultOverdraftBound,
+		"upper bound of |balance - amount| for overdraft checks, larger bounds lower the resolution")
+	flag.BoolVar(&ConfigOverdraftAllowUndecided, "overdraft-allow-undecided", false,
+		"accept transfers whose overdraft check is undecided (balance within the noise of the amount) instead of rejecting them")
+	flag.Var(&ConfigOverdraftExempt, "overdraft-exempt",
+		"uuid of a sender whose transfers skip the overdraft check, such as an issuing account, may be repeated")
+	flag.StringVar(&ConfigSigningKeyPath, "signing-key", ConfigSigningKeyPath,
+		"PEM file of the server signing key for overdraft check requests, generated if missing; give the auditor its .pub file")
+	flag.Parse()
+
 	InfoLogger.Printf("Project Chimata Server Version %s", ConfigVersion)
+	if err = misc.SetParamSet(ConfigParamSet); err != nil {
+		CriticalLogger.Fatal(err)
+	}
+	InfoLogger.Printf("Using parameter set %s (%s)", misc.ParamSetID(), misc.GetAmountScheme().Name())
+	if ConfigOverdraftAuditorURL != "" {
+		if err = serverlib.CheckOverdraftParams(); err != nil {
+			CriticalLogger.Fatal(err)
+		}
+		if SigningKey, err = key.LoadOrGenerateECDSAKeyPEM(ConfigSigningKeyPath); err != nil {
+			CriticalLogger.Fatal(err)
+		}
+		if OverdraftExempt, err = parseOverdraftExempt(ConfigOverdraftExempt); err != nil {
+			CriticalLogger.Fatal(err)
+		}
+		InfoLogger.Printf("Overdraft checks by auditor %s, bound %v", ConfigOverdraftAuditorURL, ConfigOverdraftBound)
+	}
+	initCryptoPool()
+	initKeyCache()
+	InfoLogger.Printf("Crypto worker pool: %d workers, queue size %d", CryptoPool.Stats().Workers, ConfigCryptoQueueSize)
 
 	http.HandleFunc("/", HandleNotFound)
 	http.HandleFunc("/version", HandlerVersion)
+	http.HandleFunc("/params", HandlerParams)
+	http.HandleFunc("/assets", HandlerAssets)
+	http.HandleFunc("/products", HandlerProducts)
 
 	// 交易部分
 	http.HandleFunc("/transaction/create/bySenderPK", HandlerTransactionCreateBySenderPK)
 	http.HandleFunc("/transaction/create/byReceiptPK", HandlerTransactionCreateByReceiptPK)
 	http.HandleFunc("/transaction/get", HandlerTransactionGet)
 	http.HandleFunc("/transaction/confirm", HandlerTransactionConfirm)
+	http.HandleFunc("/transaction/hold", HandlerTransactionHold)
+	http.HandleFunc("/transaction/release", HandlerTransactionRelease)
 
 	// 用户部分
 	http.HandleFunc("/user/getBalance", HandlerUserGetBalance)
-	http.HandleFunc("/user/getTransaction", todo)
+	http.HandleFunc("/user/getTransaction", HandlerUserGetTransactions)
+	http.HandleFunc("/user/getCertificate", HandlerUserGetCertificate)
+	http.HandleFunc("/user/getPublicKeys", HandlerUserGetPublicKeys)
+	http.HandleFunc("/user/rotateCKKSKey", HandlerRotateCKKSKey)
+	http.HandleFunc("/user/addECDSAKey", HandlerAddECDSAKey)
+	http.HandleFunc("/user/registerEvaluationKey", HandlerRegisterEvaluationKey)
+	http.HandleFunc("/user/getEvaluationKey", HandlerGetEvaluationKey)
+	http.HandleFunc("/user/registerAuditorSwk", HandlerRegisterAuditorSwk)
+
+	http.HandleFunc("/account/enroll", HandlerAccountEnroll)
 
 	http.HandleFunc("/register/user", HandlerRegisterUser)
 	http.HandleFunc("/register/swk", HandlerRegisterSwk)
+	http.HandleFunc("/swk/status", HandlerSwkStatus)
+
+	http.HandleFunc("/balance/refresh", HandlerBalanceRefresh)
+	http.HandleFunc("/balance/getRefreshes", HandlerBalanceGetRefreshes)
 
 	if Database, err = InitDatabase(); err != nil {
 		CriticalLogger.Fatal(err.Error())
@@ -80,8 +270,66 @@ func main() {
 
 	defer Database.Close()
 
+	if Assets, err = initAssets(Database, ConfigAssets); err != nil {
+		CriticalLogger.Fatal(err.Error())
+	}
+	InfoLogger.Printf("Registered assets: %v", Assets.Assets)
+
+	if Products, err = initProducts(ConfigProducts); err != nil {
+		CriticalLogger.Fatal(err.Error())
+	}
+	if len(Products) != 0 {
+		InfoLogger.Printf("Account products: %v", ConfigProducts)
+		go runAccruals(ConfigAccrualCheckInterval)
+	}
+
+	go purgeExpiredSwitchingKeys(DefaultSwkPurgeInterval)
+
+	if AuditorPubkey, err = key.LoadECDSAPublicKeyPEM(ConfigAuditorPubkeyPath); err != nil {
+		WarningLogger.Printf("Auditor public key not loaded, hold/release disabled: %v", err)
+	}
+
+	if CAPubkey, err = key.LoadECDSAPublicKeyPEM(ConfigCAPubkeyPath); err != nil {
+		WarningLogger.Printf("CA public key not loaded, revocation list and user registration disabled: %v", err)
+	} else {
+		go syncRevocationList(DefaultRevocationSyncInterval)
+	}
+
 	InfoLogger.Printf("Listening: %v", ConfigListenAddr+":"+ConfigListenPort)
 	if err := http.ListenAndServe(ConfigListenAddr+":"+ConfigListenPort, nil); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// purgeExpiredSwitchingKeys 定期清理已过期的 swk
+func purgeExpiredSwitchingKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		deleted, err := database.DeleteExpiredSwitchingKeys(Database, time.Now().Unix())
+		if err != nil {
+			ErrorLogger.Printf("Purging expired swk failed: %v", err)
+			continue
+		}
+		if deleted != 0 {
+			InfoLogger.Printf("Purged %d expired swk", deleted)
+		}
+	}
+}
+
+// syncRevocationList 定期从 CA 同步吊销列表
+// 同步失败时保留上一次的列表
+func syncRevocationList(interval time.Duration) {
+	for {
+		serial := Revocations.Serial()
+		if err := Revocations.Sync(ConfigCAURL, CAPubkey); err != nil {
+			WarningLogger.Printf("Syncing revocation list failed, keeping serial %d: %v", serial, err)
+		} else {
+			DebugLogger.Printf("Synced revocation list, serial = %d", Revocations.Serial())
+			if Revocations.Serial() != serial {
+				Keys.InvalidateRevoked(Revocations.IsRevoked)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -1,26 +1,41 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/serverlib"
 	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 // VerifyTransaction 验证交易的以下性质：
 // - 是否是伪造的？
 // - 金额是否足额？
+// - 金额是否非负？见 verifyRangeProof
 // - 可能的话，验证是否是重复交易
-// 需要去数据库搜索用户对应公钥
+// 需要去数据库搜索用户对应公钥，签名按交易中的密钥 ID 验证，见 resolveTransactionKeys
 func VerifyTransaction(tx *transaction.Transaction) (res bool, err error) {
+	if err = resolveTransactionKeys(tx); err != nil {
+		return false, err
+	}
+
 	// 验证足额
 	res, err = verifyIfValid(tx)
 	if !res || err != nil {
 		return false, err
 	}
 
+	// 验证范围证明
+	if err = verifyRangeProof(tx); err != nil {
+		return false, err
+	}
+
 	// 验证签名
 	// 逻辑：
 	// - 若转出密文由转出者自己签名，则这是一个转出交易
@@ -51,25 +66,33 @@ func VerifyTransaction(tx *transaction.Transaction) (res bool, err error) {
 // 验证
 func verifyTransactionConfirmingStage(tx *transaction.Transaction) (res bool, err error) {
 	DebugLogger.Print("Going in verifyTransactionConfirmingStage")
-	SignerUUID := tx.CTSenderSignedBy
+	// 接收方签名的是服务端重加密得到的密文
+	SignerUUID, ct, sig, keyID := tx.CTSenderSignedBy, tx.CTSender, tx.SigCTSender, &tx.SigCTSenderKeyID
+	if serverlib.IsSenderPKTransaction(tx) {
+		SignerUUID, ct, sig, keyID = tx.CTReceiptSignedBy, tx.CTReceipt, tx.SigCTReceipt, &tx.SigCTReceiptKeyID
+	}
 
 	// 获取公钥
 	_start := time.Now()
-	pubkey, err := db.GetECDSAKeyByUserUUID(Database, SignerUUID)
+	pubkey, err := getSigningKey(SignerUUID, *keyID)
 	if err != nil {
 		return false, err
 	} else {
 		DurationDatabaseOpr += time.Since(_start)
 	}
+	if err = Revocations.CheckECDSAKey(pubkey.PublicKey); err != nil {
+		return false, err
+	}
 
 	// 验证签名
-	res, err = serverlib.ValidateSignatureForAcceptCipherText(tx.CTSender, tx.SigCTSender, pubkey.ECDSAPublicKey)
+	res, err = serverlib.ValidateSignatureForAcceptCipherText(ct, sig, pubkey.PublicKey)
 	if err != nil {
 		return false, err
 	}
 	if !res {
 		return false, fmt.Errorf("signature verify failed")
 	}
+	*keyID = pubkey.Identifier
 
 	return true, nil
 }
@@ -79,14 +102,17 @@ func verifyTransactionSenderPK(tx *transaction.Transaction) (res bool, err error
 	SignerUUID := tx.CTSenderSignedBy
 
 	_start := time.Now()
-	pubkey, err := db.GetECDSAKeyByUserUUID(Database, SignerUUID)
+	pubkey, err := getSigningKey(SignerUUID, tx.SigCTSenderKeyID)
 	if err != nil {
 		return false, err
 	} else {
 		DurationDatabaseOpr += time.Since(_start)
 	}
+	if err = Revocations.CheckECDSAKey(pubkey.PublicKey); err != nil {
+		return false, err
+	}
 
-	res, err = serverlib.ValidateSignatureForCipherText(tx.CTSender, tx.SigCTSender, pubkey.ECDSAPublicKey)
+	res, err = serverlib.ValidateSignatureForCipherText(tx.CTSender, tx.SigCTSender, pubkey.PublicKey)
 
 	if err != nil {
 		return false, err
@@ -94,6 +120,7 @@ func verifyTransactionSenderPK(tx *transaction.Transaction) (res bool, err error
 	if !res {
 		return false, fmt.Errorf("signature verify failed")
 	}
+	tx.SigCTSenderKeyID = pubkey.Identifier
 
 	return true, nil
 }
@@ -103,14 +130,17 @@ func verifyTransactionReceiptPK(tx *transaction.Transaction) (res bool, err erro
 	SignerUUID := tx.CTReceiptSignedBy
 
 	_start := time.Now()
-	pubkey, err := db.GetECDSAKeyByUserUUID(Database, SignerUUID)
+	pubkey, err := getSigningKey(SignerUUID, tx.SigCTReceiptKeyID)
 	if err != nil {
 		return false, fmt.Errorf("internal database error: %v", err)
 	} else {
 		DurationDatabaseOpr += time.Since(_start)
 	}
+	if err = Revocations.CheckECDSAKey(pubkey.PublicKey); err != nil {
+		return false, err
+	}
 
-	res, err = serverlib.ValidateSignatureForCipherText(tx.CTReceipt, tx.SigCTReceipt, pubkey.ECDSAPublicKey)
+	res, err = serverlib.ValidateSignatureForCipherText(tx.CTReceipt, tx.SigCTReceipt, pubkey.PublicKey)
 
 	if err != nil {
 		return false, fmt.Errorf("internal verify error: %v", err)
@@ -118,10 +148,64 @@ func verifyTransactionReceiptPK(tx *transaction.Transaction) (res bool, err erro
 	if !res {
 		return false, fmt.Errorf("signature verify failed")
 	}
+	tx.SigCTReceiptKeyID = pubkey.Identifier
 
 	return true, nil
 }
 
+// verifyRangeProof 验证发送方对其签名密文的范围证明，证明须覆盖资产注册表的全部槽位
+// 服务端无法解密，承诺与密文中金额是否一致由接收方在确认前检查，见 transaction.CheckRangeProofOpening；
+// 因此 bySenderPK 交易默认也要等接收方确认后才记账，除非以 -sender-pk-direct-settle 启动
+func verifyRangeProof(tx *transaction.Transaction) error {
+	if len(tx.RangeProof) == 0 {
+		if ConfigRequireRangeProof {
+			return errors.New("transaction has no range proof")
+		}
+		return nil
+	}
+
+	_start := time.Now()
+	pubkey, err := getSigningKey(tx.Sender, tx.SigRangeProofKeyID)
+	if err != nil {
+		return err
+	} else {
+		DurationDatabaseOpr += time.Since(_start)
+	}
+	if !serverlib.ValidateSignatureBase(tx.RangeProof, tx.SigRangeProof, pubkey.PublicKey) {
+		return fmt.Errorf("range proof signature verify failed")
+	}
+	tx.SigRangeProofKeyID = pubkey.Identifier
+	if err = transaction.VerifyRangeProof(tx.RangeProofCT(), tx.RangeProof, Assets.Len()); err != nil {
+		return fmt.Errorf("range proof verify failed: %w", err)
+	}
+	return nil
+}
+
+// resolveTransactionKeys 检查交易中密文的 CKKS 公钥 ID，并将零值替换为对应用户的主公钥 ID
+// 余额以主公钥加密，计入余额的密文也须以主公钥加密：对方轮换密钥后仍使用旧公钥的交易会被拒绝
+// 由服务端重加密得到的密文以对方的主公钥加密；签名的密钥 ID 在验证签名时确定
+func resolveTransactionKeys(tx *transaction.Transaction) error {
+	for _, c := range []struct {
+		ct    []byte
+		keyID *uuid.UUID
+		user  uuid.UUID
+	}{{tx.CTSender, &tx.CTSenderKeyID, tx.Sender}, {tx.CTReceipt, &tx.CTReceiptKeyID, tx.Receipt}} {
+		primary, _, err := db.GetPrimaryKeyIDs(Database, c.user)
+		if err != nil {
+			return fmt.Errorf("keys of user %v not found: %v", c.user, err)
+		}
+		if len(c.ct) == 0 || *c.keyID == uuid.Nil {
+			*c.keyID = primary
+			continue
+		}
+		if *c.keyID != primary {
+			return fmt.Errorf("ciphertext is encrypted under key %v, but the current key of user %v is %v",
+				*c.keyID, c.user, primary)
+		}
+	}
+	return nil
+}
+
 // 验证是否足额
 // 涉及到与 CA 的交互，暂时忽略
 func verifyIfValid(tx *transaction.Transaction) (res bool, err error) {
@@ -129,3 +213,73 @@ func verifyIfValid(tx *transaction.Transaction) (res bool, err error) {
 	ErrorLogger.Println("CA not implemented yet")
 	return true, nil
 }
+
+// settleAttempts 是结算时余额被并发修改（其他结算、计息、刷新或密钥轮换）后重新计算的次数
+const settleAttempts = 5
+
+// settleTransaction 按交易更新双方余额，失败时已写入错误响应并返回 false
+// 扣款前检查发送方是否透支，见 checkOverdraft
+// 双方余额在一个事务中替换，且仅当余额在计算期间未被修改时才替换，否则重新读取余额后重试，见 db.SettleBalances
+func settleTransaction(w http.ResponseWriter, req *http.Request, tx *transaction.Transaction) bool {
+	if tx.Sender == tx.Receipt {
+		returnFailure(w, req, fmt.Errorf("sender and receipt are the same user"), http.StatusBadRequest)
+		return false
+	}
+	for i := 0; i < settleAttempts; i++ {
+		_start := time.Now()
+		senderBytes, err := db.GetUserBalanceBytes(Database, tx.Sender)
+		if err != nil {
+			returnFailure(w, req, err, 500)
+			return false
+		}
+		receiptBytes, err := db.GetUserBalanceBytes(Database, tx.Receipt)
+		if err != nil {
+			returnFailure(w, req, err, 500)
+			return false
+		}
+		DurationDatabaseOpr += time.Since(_start)
+
+		senderBalance, err := misc.UnmarshalCiphertext(senderBytes)
+		if err != nil {
+			returnFailure(w, req, err, 500)
+			return false
+		}
+		receiptBalance, err := misc.UnmarshalCiphertext(receiptBytes)
+		if err != nil {
+			returnFailure(w, req, err, 500)
+			return false
+		}
+		if err = checkOverdraft(req, tx, senderBalance); err != nil {
+			returnOverdraftFailure(w, req, err)
+			return false
+		}
+
+		var senderUpdated, receiptUpdated *rlwe.Ciphertext
+		err = doCrypto(req, func() (err error) {
+			senderUpdated, receiptUpdated, err = serverlib.GetUpdatedBalance(tx, senderBalance, receiptBalance)
+			return err
+		})
+		if err != nil {
+			returnCryptoFailure(w, req, err, 500)
+			return false
+		}
+
+		_start = time.Now()
+		swapped, err := db.SettleBalances(Database,
+			db.BalanceUpdate{User: tx.Sender, OldBalance: senderBytes, Balance: senderUpdated},
+			db.BalanceUpdate{User: tx.Receipt, OldBalance: receiptBytes, Balance: receiptUpdated},
+		)
+		if err != nil {
+			returnFailure(w, req, err, 500)
+			return false
+		}
+		DurationDatabaseOpr += time.Since(_start)
+		if swapped {
+			return true
+		}
+		WarningLogger.Printf("Balance changed while settling transaction %v, retrying", tx.UUID)
+	}
+	returnFailure(w, req,
+		fmt.Errorf("balance kept changing during %d settlement attempts", settleAttempts), http.StatusConflict)
+	return false
+}
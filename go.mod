@@ -8,10 +8,12 @@ require (
 )
 
 require (
+	github.com/cosmos/go-bip39 v1.0.0
 	github.com/google/uuid v1.3.0
 	github.com/kr/pretty v0.3.1
 	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/pkg/errors v0.9.1
+	golang.org/x/crypto v0.8.0
 )
 
 require (
@@ -20,6 +22,5 @@ require (
 	github.com/rogpeppe/go-internal v1.10.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
-	golang.org/x/crypto v0.8.0 // indirect
 	golang.org/x/sys v0.7.0 // indirect
 )
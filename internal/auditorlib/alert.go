@@ -0,0 +1,91 @@
+package auditorlib
+
+// alert.go 定义了监管者签名的告警，以及挂起/放行交易的指令
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// 告警动作
+	AlertActionNotify  string = "notify"
+	AlertActionHold    string = "hold"
+	AlertActionRelease string = "release"
+)
+
+// Alert 是规则命中后生成的告警
+// Sig 为监管者对其余字段的 ECDSA 签名，服务端据此确认指令来自监管者
+type Alert struct {
+	UUID      uuid.UUID `json:"uuid"`
+	TxUUID    uuid.UUID `json:"txUUID"`
+	Rule      string    `json:"rule"`
+	Reason    string    `json:"reason"`
+	Action    string    `json:"action"`
+	TimeStamp int64     `json:"timestamp"` //unix时间戳
+	Sig       []byte    `json:"sig"`
+}
+
+func NewAlert(f TransactionFacts, rule, reason string, hold bool) *Alert {
+	action := AlertActionNotify
+	if hold {
+		action = AlertActionHold
+	}
+	return &Alert{
+		UUID:      uuid.New(),
+		TxUUID:    f.TxUUID,
+		Rule:      rule,
+		Reason:    reason,
+		Action:    action,
+		TimeStamp: time.Now().Unix(),
+	}
+}
+
+// NewReleaseAlert 生成放行指令，审查完成后由监管者发给服务端
+func NewReleaseAlert(txUUID uuid.UUID, reason string) *Alert {
+	return &Alert{
+		UUID:      uuid.New(),
+		TxUUID:    txUUID,
+		Rule:      "manual-review",
+		Reason:    reason,
+		Action:    AlertActionRelease,
+		TimeStamp: time.Now().Unix(),
+	}
+}
+
+// signedPayload 返回参与签名的字节，即去掉签名后的 JSON
+func (a Alert) signedPayload() ([]byte, error) {
+	a.Sig = nil
+	return json.Marshal(a)
+}
+
+func (a *Alert) Sign(sk *ecdsa.PrivateKey) (err error) {
+	if sk == nil {
+		return errors.New("no signing key found")
+	}
+	msg, err := a.signedPayload()
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(msg)
+	a.Sig, err = ecdsa.SignASN1(rand.Reader, sk, hash[:])
+	return
+}
+
+func (a Alert) Verify(pk *ecdsa.PublicKey) bool {
+	if pk == nil || len(a.Sig) == 0 {
+		return false
+	}
+	msg, err := a.signedPayload()
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(msg)
+	return ecdsa.VerifyASN1(pk, hash[:], a.Sig)
+}
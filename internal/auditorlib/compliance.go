@@ -0,0 +1,167 @@
+package auditorlib
+
+// compliance.go 将解密、规则检查和向服务端下发指令串联起来
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	ServerTransactionGetEndpoint     string = "/transaction/get"
+	ServerTransactionHoldEndpoint    string = "/transaction/hold"
+	ServerTransactionReleaseEndpoint string = "/transaction/release"
+)
+
+// AmountDecrypter 表示监管者解密某个用户密文的方式
+// ref 为密文所属的交易或余额刷新的 UUID，门限解密时随请求签名发给各监管者
+type AmountDecrypter interface {
+	DecryptAmount(ref, userUUID uuid.UUID, ct *rlwe.Ciphertext) (float64, error)
+}
+
+// KeyStore 保存用户提交的完整 CKKS 私钥，对应 AuditorRegisterUserReq
+// 即单监管者、绝对可信的部署方式
+type KeyStore struct {
+	mu   sync.RWMutex
+	keys map[uuid.UUID]*rlwe.SecretKey
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[uuid.UUID]*rlwe.SecretKey)}
+}
+
+func (ks *KeyStore) ImportSecretKey(userUUID uuid.UUID, sk *rlwe.SecretKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[userUUID] = sk
+}
+
+func (ks *KeyStore) DecryptAmount(ref, userUUID uuid.UUID, ct *rlwe.Ciphertext) (float64, error) {
+	ks.mu.RLock()
+	sk, ok := ks.keys[userUUID]
+	ks.mu.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("no secret key found for user %v", userUUID)
+	}
+
+	return misc.GetAmountScheme().Decrypt(ct, sk), nil
+}
+
+// ThresholdDecrypter 通过 t 个远端监管者进行门限解密
+// SigningKey 为服务端的签名私钥，各监管者只接受由它签名的部分解密请求
+type ThresholdDecrypter struct {
+	Auditors   map[drlwe.ShamirPublicPoint]string
+	SigningKey *ecdsa.PrivateKey
+}
+
+func (td ThresholdDecrypter) DecryptAmount(ref, userUUID uuid.UUID, ct *rlwe.Ciphertext) (float64, error) {
+	return ThresholdDecrypt(td.Auditors, ref, userUUID, ct, td.SigningKey)
+}
+
+// ExtractFacts 解密交易金额，得到规则引擎的输入
+// 优先使用发送方密文，没有时使用接收方密文
+func ExtractFacts(tx *transaction.Transaction, dec AmountDecrypter) (f TransactionFacts, err error) {
+	f = TransactionFacts{
+		TxUUID:    tx.UUID,
+		Sender:    tx.Sender,
+		Receipt:   tx.Receipt,
+		TimeStamp: tx.TimeStamp,
+	}
+
+	var (
+		ct    *rlwe.Ciphertext
+		owner uuid.UUID
+	)
+	if len(tx.CTSender) != 0 {
+		ct, err = tx.GetSenderCT()
+		owner = tx.Sender
+	} else {
+		ct, err = tx.GetReceiptCT()
+		owner = tx.Receipt
+	}
+	if err != nil {
+		return f, err
+	}
+
+	f.Amount, err = dec.DecryptAmount(tx.UUID, owner, ct)
+	return
+}
+
+// FetchTransaction 从服务端按 UUID 取回交易
+// 监管者只检查服务端记录的交易，不信任请求方提交的交易内容
+func FetchTransaction(serverURL string, txUUID uuid.UUID) (tx *transaction.Transaction, err error) {
+	jsonData, err := postJSON(serverURL+ServerTransactionGetEndpoint, map[string]interface{}{
+		"uuid": txUUID.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	txBytes, err := json.Marshal(jsonData["transaction"])
+	if err != nil {
+		return nil, err
+	}
+	tx = new(transaction.Transaction)
+	if err = json.Unmarshal(txBytes, tx); err != nil {
+		return nil, err
+	}
+	if tx.UUID != txUUID {
+		return nil, fmt.Errorf("server returned transaction %v, expected %v", tx.UUID, txUUID)
+	}
+	return tx, nil
+}
+
+// SendAlertToServer 将告警下发给服务端
+// hold 告警会使交易进入 "review" 阶段，release 告警会将其放行
+func SendAlertToServer(serverURL string, alert *Alert) error {
+	var endpoint string
+	switch alert.Action {
+	case AlertActionHold:
+		endpoint = ServerTransactionHoldEndpoint
+	case AlertActionRelease:
+		endpoint = ServerTransactionReleaseEndpoint
+	default:
+		return nil
+	}
+
+	_, err := postJSON(serverURL+endpoint, alert)
+	return err
+}
+
+// CheckBalanceRefresh 核对用户的余额刷新声明：签名有效，且新旧余额密文解密后金额相同
+func CheckBalanceRefresh(r *transaction.BalanceRefresh, pk crypto.PublicKey, dec AmountDecrypter) error {
+	if !r.Verify(pk) {
+		return fmt.Errorf("balance refresh %v: signature verify failed", r.UUID)
+	}
+
+	oldCT, err := r.GetOldBalanceCT()
+	if err != nil {
+		return err
+	}
+	newCT, err := r.GetNewBalanceCT()
+	if err != nil {
+		return err
+	}
+	oldAmount, err := dec.DecryptAmount(r.UUID, r.User, oldCT)
+	if err != nil {
+		return err
+	}
+	newAmount, err := dec.DecryptAmount(r.UUID, r.User, newCT)
+	if err != nil {
+		return err
+	}
+
+	if oldAmount != newAmount {
+		return fmt.Errorf("balance refresh %v: balance changed from %.2f to %.2f", r.UUID, oldAmount, newAmount)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package auditorlib_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+)
+
+func TestCheckBalanceRefresh(t *testing.T) {
+	sk, pk := testutil.NewCKKSKeyPair()
+	ecdsaSK, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userUUID := uuid.New()
+	ks := auditorlib.NewKeyStore()
+	ks.ImportSecretKey(userUUID, sk)
+
+	oldBalance, err := testutil.MustEncryptAmount(1234.56, pk).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := transaction.NewBalanceRefresh(userUUID, oldBalance, testutil.MustEncryptAmount(1234.56, pk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Sign(ecdsaSK); err != nil {
+		t.Fatal(err)
+	}
+	if err = auditorlib.CheckBalanceRefresh(r, &ecdsaSK.PublicKey, ks); err != nil {
+		t.Fatalf("valid refresh rejected: %v", err)
+	}
+
+	// 金额被改动的刷新，即使签名有效也应当被发现
+	forged, err := transaction.NewBalanceRefresh(userUUID, oldBalance, testutil.MustEncryptAmount(9999.99, pk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = forged.Sign(ecdsaSK); err != nil {
+		t.Fatal(err)
+	}
+	if err = auditorlib.CheckBalanceRefresh(forged, &ecdsaSK.PublicKey, ks); err == nil {
+		t.Error("refresh changing the balance should be rejected")
+	}
+
+	// 篡改后签名失效
+	r.NewBalance = forged.NewBalance
+	if err = auditorlib.CheckBalanceRefresh(r, &ecdsaSK.PublicKey, ks); err == nil {
+		t.Error("tampered refresh should not verify")
+	}
+}
@@ -0,0 +1,255 @@
+package auditorlib
+
+// overdraft.go 监管者对服务端发来的透支指示值做出判断，指示值的计算见 serverlib.OverdraftIndicator
+// 用户以 misc.GenPublicSwitchingKey 生成到监管者透支密钥的 swk 并注册到服务端，
+// 服务端将指示值重加密后发给监管者；监管者只能解密指示值，得到各槽位上符号函数的近似值，看不到余额和金额
+// swk 和服务端计算指示值所用的重线性化密钥由监管者验证后出具证明（见 CertifySwk），服务端只接受有证明的 swk；
+// 服务端的判断请求须由服务端签名
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	OverdraftPubkeyEndpoint string = "/overdraft/pubkey"
+	OverdraftCheckEndpoint  string = "/overdraft/check"
+	// 为到监管者的 swk 出具证明，见 CertifySwk
+	OverdraftCertifySwkEndpoint string = "/overdraft/certifySwk"
+)
+
+const (
+	OverdraftOK        = "ok"
+	OverdraftDetected  = "overdraft"
+	OverdraftUndecided = "undecided"
+	// OverdraftTampered 表示指示值不可能由正确的计算得到，如计算密钥有误，见 Decide
+	OverdraftTampered = "tampered"
+)
+
+// DefaultOverdraftNoiseFloor 是指示值中噪声的上限，绝对值不超过它的指示值无法判断符号
+// TestOverdraftIndicator 在 PN13QP218 下测得的噪声不超过 2e-5，这里留出 5 倍的余量
+const DefaultOverdraftNoiseFloor = 1e-4
+
+// overdraftOffSlotTolerance 是 Decide 中 slots 以外的槽位允许的最大绝对值
+// CKKS 的编码误差随其他槽位中的值增大，PN13QP218 下其他槽位为 ±0.8 时，为 0 的槽位解密误差约 2e-4，超过 DefaultOverdraftNoiseFloor；
+// 错误的计算密钥得到的是远大于 1 的数，因此这里与 swkCheckTolerance 取相同的量级
+const overdraftOffSlotTolerance = 1e-2
+
+// swkCheckTolerance 是 CertifySwk 中重加密前后的随机向量允许的最大误差
+// PN13QP218 下实测正确的 swk 误差不超过 3e-4，错误的 swk 解密得到的是与原值无关的大数
+const swkCheckTolerance = 1e-2
+
+// swkCheckHeadroomBits 同 serverlib.SwitchToAuditor，随机向量的值在 [-1, 1) 内
+const swkCheckHeadroomBits = 10
+
+var (
+	// ErrSwkMismatch 表示 swk 不能将该公钥下的密文正确重加密到透支密钥下
+	ErrSwkMismatch = errors.New("switching key does not switch the public key to the overdraft key")
+	// ErrRlkMismatch 表示计算密钥中没有重线性化密钥，或其不能正确计算该公钥下密文的乘法
+	ErrRlkMismatch = errors.New("relinearization key does not match the public key")
+)
+
+// OverdraftKey 为监管者接收透支指示值的 CKKS 密钥，与用户的密钥无关
+type OverdraftKey struct {
+	sk        *rlwe.SecretKey
+	PublicKey *rlwe.PublicKey
+}
+
+// LoadOrGenerateOverdraftKey 从 path 读取透支私钥，文件不存在时生成并保存
+// 只保存私钥，公钥在每次读取时重新生成；同一私钥的不同公钥生成的 swk 都可以使用
+func LoadOrGenerateOverdraftKey(path string) (*OverdraftKey, error) {
+	params := misc.GetRLWEParams()
+	kgen := rlwe.NewKeyGenerator(params)
+
+	sk := rlwe.NewSecretKey(params)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err = sk.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("overdraft key %s: %v", path, err)
+		}
+		if sk.Value.Q.N() != params.N() || sk.Value.LevelQ() != params.MaxLevel() {
+			return nil, fmt.Errorf("overdraft key %s: %w", path, misc.ErrParamsMismatch)
+		}
+	case os.IsNotExist(err):
+		sk = kgen.GenSecretKey()
+		if data, err = sk.MarshalBinary(); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return &OverdraftKey{sk: sk, PublicKey: kgen.GenPublicKey(sk)}, nil
+}
+
+// Decide 解密指示值并判断 slots 中是否有槽位透支
+// 有槽位的值低于 -floor 时为 OverdraftDetected；否则有槽位的绝对值不超过 floor 时为 OverdraftUndecided
+// 正确计算的指示值在 slots 中的槽位上不超出 [-1, 1]，其余槽位为 0；slots 中的槽位超出 1 + floor，
+// 或其余槽位超出 overdraftOffSlotTolerance 时为 OverdraftTampered，例如发送方注册了错误的重线性化密钥，
+// 此时解密得到的是与余额无关的大数；|差值| 远超 serverlib.OverdraftIndicator 的 bound 时同样可能出现
+func (k *OverdraftKey) Decide(ind *rlwe.Ciphertext, slots []int, floor float64) (decision string, err error) {
+	s := misc.GetCryptoContext().CKKS()
+	if s == nil {
+		return "", errors.New("overdraft indicators require a CKKS parameter set")
+	}
+	if len(slots) == 0 {
+		return "", errors.New("no slots to decide")
+	}
+	indicator := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if slot < 0 || slot >= s.Slots() {
+			return "", fmt.Errorf("slot %d out of range", slot)
+		}
+		indicator[slot] = true
+	}
+	values := s.DecryptValues(ind, k.sk, s.Slots())
+	for slot, v := range values {
+		if indicator[slot] && math.Abs(v) > 1+floor || !indicator[slot] && math.Abs(v) > overdraftOffSlotTolerance {
+			return OverdraftTampered, nil
+		}
+	}
+
+	decision = OverdraftOK
+	for _, slot := range slots {
+		switch v := values[slot]; {
+		case v < -floor:
+			return OverdraftDetected, nil
+		case math.Abs(v) <= floor:
+			decision = OverdraftUndecided
+		}
+	}
+	return decision, nil
+}
+
+// CertifySwk 检查 swk 能否将 pk 下的密文重加密到透支密钥下，以及 evk 中的重线性化密钥能否正确计算 pk 下密文的乘法，
+// 都能时返回 sk 对 key.AuditorSwkCertMessage 的签名；swkBytes 和 evkBytes 为 swk 和 evk 编码后的字节
+// 检查时用 pk 加密每个槽位为随机值的向量，以 swk 重加密后解密比较；再将其平方后重加密，与随机值的平方比较
+func (k *OverdraftKey) CertifySwk(subject, keyID uuid.UUID, pk *rlwe.PublicKey, swk *rlwe.SwitchingKey, swkBytes []byte, evk rlwe.EvaluationKey, evkBytes []byte, sk *ecdsa.PrivateKey) ([]byte, error) {
+	s := misc.GetCryptoContext().CKKS()
+	if s == nil {
+		return nil, errors.New("overdraft indicators require a CKKS parameter set")
+	}
+	buf := make([]byte, 8*s.Slots())
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	values := make([]float64, s.Slots())
+	for i := range values {
+		values[i] = math.Ldexp(float64(binary.BigEndian.Uint64(buf[8*i:])>>11), -52) - 1
+	}
+
+	ct, err := s.EncryptVector(values, pk)
+	if err != nil {
+		return nil, err
+	}
+	switched, err := s.KeySwitchScaled(ct, swk, swkCheckHeadroomBits)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSwkMismatch, err)
+	}
+	for i, v := range s.DecryptValues(switched, k.sk, len(values)) {
+		if math.Abs(v-values[i]) > swkCheckTolerance {
+			return nil, ErrSwkMismatch
+		}
+	}
+
+	if evk.Rlk == nil {
+		return nil, ErrRlkMismatch
+	}
+	eval := s.NewEvaluator(rlwe.EvaluationKey{Rlk: evk.Rlk})
+	squared := eval.MulRelinNew(ct, ct)
+	if err = eval.Rescale(squared, s.Params.DefaultScale(), squared); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRlkMismatch, err)
+	}
+	if squared, err = s.KeySwitchScaled(squared, swk, swkCheckHeadroomBits); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRlkMismatch, err)
+	}
+	for i, v := range s.DecryptValues(squared, k.sk, len(values)) {
+		if math.Abs(v-values[i]*values[i]) > swkCheckTolerance {
+			return nil, ErrRlkMismatch
+		}
+	}
+	return key.Sign(sk, key.AuditorSwkCertMessage(subject, keyID, key.CKKSKeyFingerprint(pk), swkBytes, evkBytes))
+}
+
+// VerifyOverdraftCheck 验证判断请求的签名是否由 pk 对应的服务端签名私钥生成，不检查时间戳
+func VerifyOverdraftCheck(req restfulpayload.AuditorOverdraftCheckReq, pk *ecdsa.PublicKey) bool {
+	if pk == nil {
+		return false
+	}
+	indBytes, err := base64.StdEncoding.DecodeString(req.Indicator)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(req.Sig)
+	if err != nil {
+		return false
+	}
+	return key.Verify(pk, key.OverdraftCheckMessage(req.TxUUID, req.UUID, req.Slots, indBytes, req.TimeStamp, req.Nonce), sig)
+}
+
+// RequestOverdraftDecision 将重加密后的指示值发给监管者，返回监管者的判断
+// 请求由服务端的签名私钥 sk 签名，并带有时间戳和随机 nonce
+func RequestOverdraftDecision(auditorURL string, req restfulpayload.AuditorOverdraftCheckReq, sk *ecdsa.PrivateKey) (decision string, err error) {
+	indBytes, err := base64.StdEncoding.DecodeString(req.Indicator)
+	if err != nil {
+		return "", err
+	}
+	req.TimeStamp = time.Now().Unix()
+	req.Nonce = uuid.New()
+	sig, err := key.Sign(sk, key.OverdraftCheckMessage(req.TxUUID, req.UUID, req.Slots, indBytes, req.TimeStamp, req.Nonce))
+	if err != nil {
+		return "", err
+	}
+	req.Sig = base64.StdEncoding.EncodeToString(sig)
+
+	jsonData, err := postJSON(auditorURL+OverdraftCheckEndpoint, req)
+	if err != nil {
+		return "", err
+	}
+	decision, _ = jsonData["decision"].(string)
+	switch decision {
+	case OverdraftOK, OverdraftDetected, OverdraftUndecided, OverdraftTampered:
+		return decision, nil
+	}
+	return "", fmt.Errorf("unknown overdraft decision %q", decision)
+}
+
+// FetchOverdraftPublicKey 从监管者获取透支公钥，用于生成到监管者的 swk
+func FetchOverdraftPublicKey(auditorURL string) (*rlwe.PublicKey, error) {
+	jsonData, err := getJSON(auditorURL + OverdraftPubkeyEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	pkString, _ := jsonData["pubkey"].(string)
+	pkBytes, err := base64.StdEncoding.DecodeString(pkString)
+	if err != nil {
+		return nil, err
+	}
+	return misc.UnmarshalPublicKey(pkBytes)
+}
+
+// RequestSwkCertificate 请求监管者为 swk 出具证明，返回监管者对 key.AuditorSwkCertMessage 的签名
+func RequestSwkCertificate(auditorURL string, req restfulpayload.AuditorCertifySwkReq) ([]byte, error) {
+	jsonData, err := postJSON(auditorURL+OverdraftCertifySwkEndpoint, req)
+	if err != nil {
+		return nil, err
+	}
+	sigString, _ := jsonData["sig"].(string)
+	return base64.StdEncoding.DecodeString(sigString)
+}
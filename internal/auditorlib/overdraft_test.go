@@ -0,0 +1,129 @@
+package auditorlib_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func TestOverdraftKeyDecide(t *testing.T) {
+	prev := misc.ParamSetID()
+	if err := misc.SetParamSet("PN13QP218"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { misc.SetParamSet(prev) })
+
+	path := filepath.Join(t.TempDir(), "overdraft.key")
+	generated, err := auditorlib.LoadOrGenerateOverdraftKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重新读取私钥，生成的公钥不同，但用其加密的指示值仍可解密
+	k, err := auditorlib.LoadOrGenerateOverdraftKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 指示值在 slots 以外的槽位上为 0
+	tests := []struct {
+		values []float64
+		slots  []int
+		want   string
+	}{
+		{[]float64{0.9}, []int{0}, auditorlib.OverdraftOK},
+		{[]float64{0.9, 0, 0, 0.5}, []int{0, 3}, auditorlib.OverdraftOK},
+		{[]float64{0, -0.8}, []int{1}, auditorlib.OverdraftDetected},
+		{[]float64{0.9, -0.8, 1e-6}, []int{0, 1, 2}, auditorlib.OverdraftDetected},
+		{[]float64{0, 0, 1e-6}, []int{2}, auditorlib.OverdraftUndecided},
+		{[]float64{0.9, 0, 1e-6}, []int{0, 2}, auditorlib.OverdraftUndecided},
+		// 错误的计算密钥得到的指示值超出 [-1, 1]，或在其他槽位上不为 0
+		{[]float64{37.5}, []int{0}, auditorlib.OverdraftTampered},
+		{[]float64{0.9, -12}, []int{0, 1}, auditorlib.OverdraftTampered},
+		{[]float64{0.9, 0.5}, []int{0}, auditorlib.OverdraftTampered},
+		{[]float64{0.9, 0.05}, []int{0}, auditorlib.OverdraftTampered},
+	}
+	for _, tt := range tests {
+		ind, err := misc.GetCryptoContext().CKKS().EncryptVector(tt.values, generated.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := k.Decide(ind, tt.slots, auditorlib.DefaultOverdraftNoiseFloor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("values %v, slots %v: got %s, expected %s", tt.values, tt.slots, got, tt.want)
+		}
+	}
+
+	ind, err := misc.GetCryptoContext().CKKS().EncryptVector([]float64{0.9}, generated.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k.Decide(ind, nil, auditorlib.DefaultOverdraftNoiseFloor); err == nil {
+		t.Error("deciding without slots should fail")
+	}
+	if _, err = k.Decide(ind, []int{-1}, auditorlib.DefaultOverdraftNoiseFloor); err == nil {
+		t.Error("deciding an out-of-range slot should fail")
+	}
+}
+
+func TestOverdraftKeyCertifySwk(t *testing.T) {
+	testutil.UseParamSet(t, "PN13QP218")
+	k, err := auditorlib.LoadOrGenerateOverdraftKey(filepath.Join(t.TempDir(), "overdraft.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, keyID := uuid.New(), uuid.New()
+
+	sk, pk := testutil.NewCKKSKeyPair()
+	swk, err := misc.GenPublicSwitchingKey(sk, k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swkBytes, err := misc.MarshalCompactSwitchingKey(swk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evk := rlwe.EvaluationKey{Rlk: rlwe.NewKeyGenerator(misc.GetRLWEParams()).GenRelinearizationKey(sk, 1)}
+	evkBytes, err := misc.MarshalEvaluationKey(evk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := k.CertifySwk(subject, keyID, pk, swk, swkBytes, evk, evkBytes, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Verify(&signer.PublicKey, key.AuditorSwkCertMessage(subject, keyID, key.CKKSKeyFingerprint(pk), swkBytes, evkBytes), sig) {
+		t.Error("swk certificate does not verify")
+	}
+
+	// 由其他私钥生成的 swk 不能通过检查
+	otherSk, otherPk := testutil.NewCKKSKeyPair()
+	if _, err = k.CertifySwk(subject, keyID, otherPk, swk, swkBytes, evk, evkBytes, signer); !errors.Is(err, auditorlib.ErrSwkMismatch) {
+		t.Errorf("certifying a swk of another key: got %v, expected ErrSwkMismatch", err)
+	}
+
+	// 由其他私钥生成的重线性化密钥与公钥的维度相同，同样不能通过检查
+	bogus := rlwe.EvaluationKey{Rlk: rlwe.NewKeyGenerator(misc.GetRLWEParams()).GenRelinearizationKey(otherSk, 1)}
+	if _, err = k.CertifySwk(subject, keyID, pk, swk, swkBytes, bogus, evkBytes, signer); !errors.Is(err, auditorlib.ErrRlkMismatch) {
+		t.Errorf("certifying a relinearization key of another key: got %v, expected ErrRlkMismatch", err)
+	}
+	if _, err = k.CertifySwk(subject, keyID, pk, swk, swkBytes, rlwe.EvaluationKey{}, nil, signer); !errors.Is(err, auditorlib.ErrRlkMismatch) {
+		t.Errorf("certifying without a relinearization key: got %v, expected ErrRlkMismatch", err)
+	}
+}
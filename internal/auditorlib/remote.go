@@ -0,0 +1,190 @@
+package auditorlib
+
+// remote.go 包含与远端监管者交互的函数
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	RegisterShareEndpoint  string = "/threshold/register"
+	PartialDecryptEndpoint string = "/threshold/decrypt"
+)
+
+// RegisterShare 将某个用户的份额发送给对应的监管者
+// 份额由用户以 sk（对应 s.SigningKey）签名，请求带有运营方令牌 operatorToken
+func RegisterShare(auditorURL, operatorToken string, s *ThresholdShare, sk crypto.Signer) error {
+	shareBytes, err := s.Share.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	req := restfulpayload.AuditorRegisterShareReq{
+		UUID:         s.UserUUID,
+		Point:        uint64(s.Point),
+		Threshold:    s.Threshold,
+		Share:        base64.StdEncoding.EncodeToString(shareBytes),
+		ECDSA_pubkey: base64.StdEncoding.EncodeToString(key.MarshalSigningPublicKey(s.SigningKey)),
+		TimeStamp:    time.Now().Unix(),
+		Nonce:        uuid.New(),
+	}
+	sig, err := s.Sign(sk, req.TimeStamp, req.Nonce)
+	if err != nil {
+		return err
+	}
+	req.Sig = base64.StdEncoding.EncodeToString(sig)
+
+	_, err = postJSONWithToken(auditorURL+RegisterShareEndpoint, operatorToken, req)
+	return err
+}
+
+// VerifyPartialDecrypt 验证部分解密请求的签名是否由 pk 对应的服务端签名私钥生成，不检查时间戳
+func VerifyPartialDecrypt(req restfulpayload.AuditorPartialDecryptReq, pk *ecdsa.PublicKey) bool {
+	if pk == nil || req.Ref == uuid.Nil {
+		return false
+	}
+	ctBytes, err := base64.StdEncoding.DecodeString(req.CT)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(req.Sig)
+	if err != nil {
+		return false
+	}
+	return key.Verify(pk, key.PartialDecryptMessage(req.Ref, req.UUID, ctBytes, req.Actives, req.TimeStamp, req.Nonce), sig)
+}
+
+// RequestPartialDecryption 向单个监管者请求部分解密份额
+// ref 为密文所属的交易或余额刷新的 UUID，请求由服务端的签名私钥 sk 签名
+func RequestPartialDecryption(auditorURL string, ref, userUUID uuid.UUID, ct *rlwe.Ciphertext, actives []drlwe.ShamirPublicPoint, sk *ecdsa.PrivateKey) (share *drlwe.CKSShare, err error) {
+	ctBytes, err := misc.MarshalCompactCiphertext(ct)
+	if err != nil {
+		return nil, err
+	}
+
+	req := restfulpayload.AuditorPartialDecryptReq{
+		UUID:      userUUID,
+		Ref:       ref,
+		CT:        base64.StdEncoding.EncodeToString(ctBytes),
+		TimeStamp: time.Now().Unix(),
+		Nonce:     uuid.New(),
+	}
+	for _, p := range actives {
+		req.Actives = append(req.Actives, uint64(p))
+	}
+	sig, err := key.Sign(sk, key.PartialDecryptMessage(req.Ref, req.UUID, ctBytes, req.Actives, req.TimeStamp, req.Nonce))
+	if err != nil {
+		return nil, err
+	}
+	req.Sig = base64.StdEncoding.EncodeToString(sig)
+
+	jsonData, err := postJSON(auditorURL+PartialDecryptEndpoint, req)
+	if err != nil {
+		return nil, err
+	}
+
+	shareString, ok := jsonData["share"].(string)
+	if !ok || shareString == "" {
+		return nil, errors.New("share not found")
+	}
+	shareBytes, err := base64.StdEncoding.DecodeString(shareString)
+	if err != nil {
+		return nil, err
+	}
+
+	share = new(drlwe.CKSShare)
+	err = share.UnmarshalBinary(shareBytes)
+	return
+}
+
+// ThresholdDecrypt 向 auditors 中的全部监管者请求部分解密，并合并得到明文
+// auditors 的数量应当等于门限，多出的监管者也会参与；ref 和 sk 同 RequestPartialDecryption
+func ThresholdDecrypt(auditors map[drlwe.ShamirPublicPoint]string, ref, userUUID uuid.UUID, ct *rlwe.Ciphertext, sk *ecdsa.PrivateKey) (amount float64, err error) {
+	actives := make([]drlwe.ShamirPublicPoint, 0, len(auditors))
+	for p := range auditors {
+		actives = append(actives, p)
+	}
+	sort.Slice(actives, func(i, j int) bool { return actives[i] < actives[j] })
+
+	shares := make([]*drlwe.CKSShare, 0, len(actives))
+	for _, p := range actives {
+		s, err := RequestPartialDecryption(auditors[p], ref, userUUID, ct, actives, sk)
+		if err != nil {
+			return 0, fmt.Errorf("auditor %d: %v", p, err)
+		}
+		shares = append(shares, s)
+	}
+
+	return CombinePartialDecryptions(ct, shares)
+}
+
+func postJSON(url string, payload interface{}) (jsonData map[string]interface{}, err error) {
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(resp)
+}
+
+// postJSONWithToken 同 postJSON，带有 Authorization: Bearer 令牌，用于监管者的运营方接口
+func postJSONWithToken(url, token string, payload interface{}) (jsonData map[string]interface{}, err error) {
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(resp)
+}
+
+func getJSON(url string) (jsonData map[string]interface{}, err error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(resp)
+}
+
+func decodeJSON(resp *http.Response) (jsonData map[string]interface{}, err error) {
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(&jsonData); err != nil {
+		return nil, err
+	}
+	if jsonData["status"] != "OK" {
+		errString, _ := jsonData["err"].(string)
+		return nil, errors.New("status is not OK! " + errString)
+	}
+
+	return
+}
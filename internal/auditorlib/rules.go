@@ -0,0 +1,190 @@
+package auditorlib
+
+// rules.go 实现了监管者端的合规规则引擎
+// 监管者解密交易金额后，按照配置的规则进行检查，命中规则时生成签名的告警
+// 可选地，告警可以要求服务端将交易挂起至 "review" 阶段，直至监管者放行
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TransactionFacts 是规则引擎的输入，即解密后的交易信息
+type TransactionFacts struct {
+	TxUUID    uuid.UUID `json:"txUUID"`
+	Sender    uuid.UUID `json:"sender"`
+	Receipt   uuid.UUID `json:"receipt"`
+	Amount    float64   `json:"amount"`
+	TimeStamp int64     `json:"timestamp"` //unix时间戳
+}
+
+// Rule 是单条合规规则
+// history 为该交易发送方此前已检查过的交易，按时间顺序排列
+// reason 会随告警返回给调用方并下发给服务端，不应包含解密出的金额
+type Rule interface {
+	Name() string
+	Evaluate(f TransactionFacts, history []TransactionFacts) (hit bool, reason string)
+}
+
+// AmountThresholdRule 单笔金额超过阈值
+type AmountThresholdRule struct {
+	Threshold float64
+}
+
+func (r AmountThresholdRule) Name() string { return "amount-threshold" }
+
+func (r AmountThresholdRule) Evaluate(f TransactionFacts, _ []TransactionFacts) (bool, string) {
+	if f.Amount > r.Threshold {
+		return true, fmt.Sprintf("amount exceeds threshold %.2f", r.Threshold)
+	}
+	return false, ""
+}
+
+// VelocityRule 发送方 24 小时内的累计金额或笔数超过上限
+// 上限为 0 表示不检查该项
+type VelocityRule struct {
+	MaxAmountPerDay float64
+	MaxCountPerDay  int
+}
+
+func (r VelocityRule) Name() string { return "velocity" }
+
+func (r VelocityRule) Evaluate(f TransactionFacts, history []TransactionFacts) (bool, string) {
+	since := f.TimeStamp - int64((24 * time.Hour).Seconds())
+	total, count := f.Amount, 1
+	for _, h := range history {
+		if h.TimeStamp > since && h.TimeStamp <= f.TimeStamp {
+			total += h.Amount
+			count++
+		}
+	}
+
+	if r.MaxAmountPerDay > 0 && total > r.MaxAmountPerDay {
+		return true, fmt.Sprintf("daily amount exceeds %.2f", r.MaxAmountPerDay)
+	}
+	if r.MaxCountPerDay > 0 && count > r.MaxCountPerDay {
+		return true, fmt.Sprintf("daily count %d exceeds %d", count, r.MaxCountPerDay)
+	}
+	return false, ""
+}
+
+// WatchlistRule 交易任一方在观察名单中
+type WatchlistRule struct {
+	Watchlist map[uuid.UUID]bool
+}
+
+func (r WatchlistRule) Name() string { return "watchlist" }
+
+func (r WatchlistRule) Evaluate(f TransactionFacts, _ []TransactionFacts) (bool, string) {
+	switch {
+	case r.Watchlist[f.Sender]:
+		return true, "sender " + f.Sender.String() + " is on the watchlist"
+	case r.Watchlist[f.Receipt]:
+		return true, "receipt " + f.Receipt.String() + " is on the watchlist"
+	}
+	return false, ""
+}
+
+// RuleConfig 是规则引擎的配置文件格式（JSON）
+// 数值为 0 的规则不启用
+type RuleConfig struct {
+	AmountThreshold   float64     `json:"amountThreshold"`
+	VelocityMaxAmount float64     `json:"velocityMaxAmount"`
+	VelocityMaxCount  int         `json:"velocityMaxCount"`
+	Watchlist         []uuid.UUID `json:"watchlist"`
+	// HoldOnAlert 为真时，命中规则的交易会被要求挂起
+	HoldOnAlert bool `json:"holdOnAlert"`
+}
+
+func LoadRuleConfig(path string) (conf *RuleConfig, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf = new(RuleConfig)
+	err = json.Unmarshal(data, conf)
+	return
+}
+
+// Rules 将配置转换为规则列表
+func (conf RuleConfig) Rules() (rules []Rule) {
+	if conf.AmountThreshold > 0 {
+		rules = append(rules, AmountThresholdRule{conf.AmountThreshold})
+	}
+	if conf.VelocityMaxAmount > 0 || conf.VelocityMaxCount > 0 {
+		rules = append(rules, VelocityRule{conf.VelocityMaxAmount, conf.VelocityMaxCount})
+	}
+	if len(conf.Watchlist) != 0 {
+		watchlist := make(map[uuid.UUID]bool, len(conf.Watchlist))
+		for _, id := range conf.Watchlist {
+			watchlist[id] = true
+		}
+		rules = append(rules, WatchlistRule{watchlist})
+	}
+	return
+}
+
+// RuleEngine 按顺序对交易执行全部规则，并记录发送方的历史
+type RuleEngine struct {
+	Rules       []Rule
+	HoldOnAlert bool
+
+	mu         sync.Mutex
+	history    map[uuid.UUID][]TransactionFacts
+	signingKey *ecdsa.PrivateKey
+}
+
+func NewRuleEngine(conf RuleConfig, signingKey *ecdsa.PrivateKey) *RuleEngine {
+	return &RuleEngine{
+		Rules:       conf.Rules(),
+		HoldOnAlert: conf.HoldOnAlert,
+		history:     make(map[uuid.UUID][]TransactionFacts),
+		signingKey:  signingKey,
+	}
+}
+
+// Evaluate 检查一笔交易，返回已签名的告警
+// 同一笔交易重复检查时不会重复计入历史
+func (e *RuleEngine) Evaluate(f TransactionFacts) (alerts []*Alert, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	history := e.history[f.Sender]
+	for _, h := range history {
+		if h.TxUUID == f.TxUUID {
+			history = removeFacts(history, f.TxUUID)
+			break
+		}
+	}
+
+	for _, r := range e.Rules {
+		hit, reason := r.Evaluate(f, history)
+		if !hit {
+			continue
+		}
+		alert := NewAlert(f, r.Name(), reason, e.HoldOnAlert)
+		if err = alert.Sign(e.signingKey); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+
+	e.history[f.Sender] = append(history, f)
+	return
+}
+
+func removeFacts(history []TransactionFacts, txUUID uuid.UUID) []TransactionFacts {
+	res := make([]TransactionFacts, 0, len(history))
+	for _, h := range history {
+		if h.TxUUID != txUUID {
+			res = append(res, h)
+		}
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+package auditorlib_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/google/uuid"
+)
+
+func newTestRuleEngine(t *testing.T, conf auditorlib.RuleConfig) (*auditorlib.RuleEngine, *ecdsa.PrivateKey) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auditorlib.NewRuleEngine(conf, sk), sk
+}
+
+func newTestFacts(sender, receipt uuid.UUID, amount float64, ts int64) auditorlib.TransactionFacts {
+	return auditorlib.TransactionFacts{
+		TxUUID: uuid.New(), Sender: sender, Receipt: receipt, Amount: amount, TimeStamp: ts,
+	}
+}
+
+func TestRuleEngineAmountThreshold(t *testing.T) {
+	engine, sk := newTestRuleEngine(t, auditorlib.RuleConfig{AmountThreshold: 1000, HoldOnAlert: true})
+	now := time.Now().Unix()
+
+	alerts, err := engine.Evaluate(newTestFacts(uuid.New(), uuid.New(), 999.99, now))
+	if err != nil || len(alerts) != 0 {
+		t.Fatalf("expected no alert, got %v, %v", alerts, err)
+	}
+
+	alerts, err = engine.Evaluate(newTestFacts(uuid.New(), uuid.New(), 1000.01, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Rule != "amount-threshold" || alerts[0].Action != auditorlib.AlertActionHold {
+		t.Fatalf("expected one hold alert, got %+v", alerts)
+	}
+	if !alerts[0].Verify(&sk.PublicKey) {
+		t.Error("alert signature verification failed")
+	}
+	// 告警会返回给调用方，不能带出解密的金额
+	if strings.Contains(alerts[0].Reason, "1000.01") {
+		t.Errorf("alert reason leaks the amount: %q", alerts[0].Reason)
+	}
+
+	// 篡改后签名失效
+	alerts[0].Action = auditorlib.AlertActionRelease
+	if alerts[0].Verify(&sk.PublicKey) {
+		t.Error("tampered alert should not verify")
+	}
+}
+
+func TestRuleEngineVelocity(t *testing.T) {
+	engine, _ := newTestRuleEngine(t, auditorlib.RuleConfig{VelocityMaxAmount: 500, VelocityMaxCount: 3})
+	sender := uuid.New()
+	now := time.Now().Unix()
+
+	// 超过 24 小时的交易不计入
+	if alerts, _ := engine.Evaluate(newTestFacts(sender, uuid.New(), 400, now-int64(25*time.Hour/time.Second))); len(alerts) != 0 {
+		t.Fatalf("unexpected alert %+v", alerts)
+	}
+	if alerts, _ := engine.Evaluate(newTestFacts(sender, uuid.New(), 300, now)); len(alerts) != 0 {
+		t.Fatalf("unexpected alert %+v", alerts)
+	}
+
+	f := newTestFacts(sender, uuid.New(), 300, now)
+	alerts, _ := engine.Evaluate(f)
+	if len(alerts) != 1 || alerts[0].Rule != "velocity" {
+		t.Fatalf("expected velocity alert, got %+v", alerts)
+	}
+
+	// 重复检查同一笔交易不会重复累计
+	alerts, _ = engine.Evaluate(f)
+	if len(alerts) != 1 {
+		t.Fatalf("expected velocity alert on re-check, got %+v", alerts)
+	}
+
+	engine2, _ := newTestRuleEngine(t, auditorlib.RuleConfig{VelocityMaxCount: 2})
+	for i, expected := range []int{0, 0, 1} {
+		alerts, _ := engine2.Evaluate(newTestFacts(sender, uuid.New(), 1, now))
+		if len(alerts) != expected {
+			t.Errorf("transaction %d: expected %d alerts, got %d", i, expected, len(alerts))
+		}
+	}
+}
+
+func TestRuleEngineWatchlist(t *testing.T) {
+	watched := uuid.New()
+	engine, _ := newTestRuleEngine(t, auditorlib.RuleConfig{Watchlist: []uuid.UUID{watched}})
+	now := time.Now().Unix()
+
+	if alerts, _ := engine.Evaluate(newTestFacts(uuid.New(), uuid.New(), 1, now)); len(alerts) != 0 {
+		t.Fatalf("unexpected alert %+v", alerts)
+	}
+	alerts, _ := engine.Evaluate(newTestFacts(uuid.New(), watched, 1, now))
+	if len(alerts) != 1 || alerts[0].Rule != "watchlist" || alerts[0].Action != auditorlib.AlertActionNotify {
+		t.Fatalf("expected watchlist notify alert, got %+v", alerts)
+	}
+}
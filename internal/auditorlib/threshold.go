@@ -0,0 +1,227 @@
+// 包 auditorlib 包含监管者（Auditor）端使用的接口和函数
+package auditorlib
+
+// threshold.go 实现了多监管者之间的门限解密
+// 用户的 CKKS 私钥被拆分为 N 份，分发给 N 个监管者，门限为 t：
+// - 任意 t 个监管者各自给出部分解密份额，合并后即可解密
+// - 少于 t 个监管者无法得到任何关于明文的信息
+// 基于 lattigo 的 drlwe.Thresholdizer/Combiner 以及 CKS 协议实现
+// 份额由运营方提交并带有用户的签名，替换份额须由首次提交时的签名公钥签名；部分解密须由服务端签名请求，见 cmd/auditor
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	// DefaultSmudgingSigma 部分解密时加入的噪声标准差
+	// CKKS 下需要远小于 DefaultScale(2^32) * 0.005，否则会影响到分位精度
+	// BGV 下需要远小于 Q/2T，否则解密结果会出错
+	DefaultSmudgingSigma float64 = 1 << 16
+)
+
+var (
+	// ErrShareExists 表示用户已有份额，只能以 ImportSignedShare 替换
+	ErrShareExists = errors.New("user already has a share on this auditor")
+	// ErrShareSignature 表示份额的签名无效，或替换份额的签名不是由已有份额的签名公钥生成
+	ErrShareSignature = errors.New("share signature verify failed")
+)
+
+// ThresholdShare 是某个监管者持有的、某个用户私钥的一份门限份额
+// SigningKey 为提交份额的用户的签名公钥，替换份额的请求须由它签名
+type ThresholdShare struct {
+	UserUUID   uuid.UUID
+	Point      drlwe.ShamirPublicPoint
+	Threshold  int
+	Share      *drlwe.ShamirSecretShare
+	SigningKey crypto.PublicKey
+}
+
+func (s *ThresholdShare) message(timestamp int64, nonce uuid.UUID) ([]byte, error) {
+	shareBytes, err := s.Share.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return key.RegisterShareMessage(s.UserUUID, uint64(s.Point), s.Threshold, shareBytes,
+		key.MarshalSigningPublicKey(s.SigningKey), timestamp, nonce), nil
+}
+
+// Sign 由用户以 SigningKey 对应的私钥签名份额，见 key.RegisterShareMessage
+func (s *ThresholdShare) Sign(sk crypto.Signer, timestamp int64, nonce uuid.UUID) ([]byte, error) {
+	msg, err := s.message(timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(sk, msg)
+}
+
+// Verify 检查份额的签名是否由 pk 生成
+func (s *ThresholdShare) Verify(pk crypto.PublicKey, timestamp int64, nonce uuid.UUID, sig []byte) bool {
+	if pk == nil {
+		return false
+	}
+	msg, err := s.message(timestamp, nonce)
+	if err != nil {
+		return false
+	}
+	return key.Verify(pk, msg, sig)
+}
+
+// SplitSecretKey 将用户的 CKKS 私钥拆分为 len(points) 份，门限为 threshold
+// 由用户在本地执行，随后将份额分别发送给对应的监管者
+func SplitSecretKey(sk *rlwe.SecretKey, points []drlwe.ShamirPublicPoint, threshold int) (shares map[drlwe.ShamirPublicPoint]*drlwe.ShamirSecretShare, err error) {
+	if threshold > len(points) {
+		return nil, fmt.Errorf("threshold %d is larger than the number of auditors %d", threshold, len(points))
+	}
+
+	thr := drlwe.NewThresholdizer(misc.GetRLWEParams())
+	poly, err := thr.GenShamirPolynomial(threshold, sk)
+	if err != nil {
+		return nil, err
+	}
+
+	shares = make(map[drlwe.ShamirPublicPoint]*drlwe.ShamirSecretShare, len(points))
+	for _, p := range points {
+		if p == 0 {
+			return nil, fmt.Errorf("shamir public point cannot be 0")
+		}
+		if _, ok := shares[p]; ok {
+			return nil, fmt.Errorf("duplicated shamir public point %d", p)
+		}
+		shares[p] = thr.AllocateThresholdSecretShare()
+		thr.GenShamirSecretShare(p, poly, shares[p])
+	}
+
+	return
+}
+
+// Auditor 表示门限方案中的单个监管者
+// 一个监管者只有一个公开点，但可以持有多个用户的份额
+type Auditor struct {
+	Point drlwe.ShamirPublicPoint
+
+	mu     sync.Mutex
+	shares map[uuid.UUID]*ThresholdShare
+	cks    *drlwe.CKSProtocol
+}
+
+func NewAuditor(point drlwe.ShamirPublicPoint) *Auditor {
+	return &Auditor{
+		Point:  point,
+		shares: make(map[uuid.UUID]*ThresholdShare),
+		cks:    drlwe.NewCKSProtocol(misc.GetRLWEParams(), DefaultSmudgingSigma),
+	}
+}
+
+// ImportShare 导入某个用户的私钥份额，用户已有份额时返回 ErrShareExists
+func (a *Auditor) ImportShare(s *ThresholdShare) error {
+	if s.Point != a.Point {
+		return fmt.Errorf("share is issued to point %d, this auditor is %d", s.Point, a.Point)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.shares[s.UserUUID]; ok {
+		return ErrShareExists
+	}
+	a.shares[s.UserUUID] = s
+	return nil
+}
+
+// ImportSignedShare 导入带有用户签名的份额，见 ThresholdShare.Sign
+// 用户没有份额时签名须由 s.SigningKey 生成；已有份额时视为替换，签名须由已有份额的 SigningKey 生成
+// 时间戳和 nonce 由调用方检查
+func (a *Auditor) ImportSignedShare(s *ThresholdShare, timestamp int64, nonce uuid.UUID, sig []byte) error {
+	if s.Point != a.Point {
+		return fmt.Errorf("share is issued to point %d, this auditor is %d", s.Point, a.Point)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	signer := s.SigningKey
+	if old, ok := a.shares[s.UserUUID]; ok {
+		signer = old.SigningKey
+	}
+	if !s.Verify(signer, timestamp, nonce, sig) {
+		return ErrShareSignature
+	}
+	a.shares[s.UserUUID] = s
+	return nil
+}
+
+// PartialDecrypt 生成部分解密份额
+// actives 为本次参与解密的监管者的公开点，必须包含本监管者且数量不少于门限
+// 份额本身加入了 smudging 噪声，单独的份额不会泄露私钥或明文
+func (a *Auditor) PartialDecrypt(userUUID uuid.UUID, ct *rlwe.Ciphertext, actives []drlwe.ShamirPublicPoint) (share *drlwe.CKSShare, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.shares[userUUID]
+	if !ok {
+		return nil, fmt.Errorf("no share found for user %v", userUUID)
+	}
+	if len(actives) < s.Threshold {
+		return nil, fmt.Errorf("not enough active auditors, got %d, threshold is %d", len(actives), s.Threshold)
+	}
+	if !containsPoint(actives, a.Point) {
+		return nil, fmt.Errorf("auditor %d is not in the active set", a.Point)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			share = nil
+			err = fmt.Errorf("partial decryption failed, got panic: %v", p)
+		}
+	}()
+
+	params := misc.GetRLWEParams()
+	combiner := drlwe.NewCombiner(params, a.Point, actives, s.Threshold)
+	additive := rlwe.NewSecretKey(params)
+	combiner.GenAdditiveShare(actives, a.Point, s.Share, additive)
+
+	// 将密文从 additive 切换到全零私钥，合并后 c0 即为明文
+	share = a.cks.AllocateShare(ct.Level())
+	a.cks.GenShare(additive, rlwe.NewSecretKey(params), ct, share)
+	return
+}
+
+// CombinePartialDecryptions 合并 t 个部分解密份额，得到金额明文
+func CombinePartialDecryptions(ct *rlwe.Ciphertext, shares []*drlwe.CKSShare) (amount float64, err error) {
+	if len(shares) == 0 {
+		return 0, fmt.Errorf("no partial decryption share found")
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("combining shares failed, got panic: %v", p)
+		}
+	}()
+
+	params := misc.GetRLWEParams()
+	cks := drlwe.NewCKSProtocol(params, DefaultSmudgingSigma)
+	combined := cks.AllocateShare(ct.Level())
+	for _, s := range shares {
+		cks.AggregateShares(combined, s, combined)
+	}
+
+	ctOut := rlwe.NewCiphertext(params, 1, ct.Level())
+	cks.KeySwitch(ct, combined, ctOut)
+
+	// 切换后的密文在全零私钥下解密
+	return misc.GetAmountScheme().Decrypt(ctOut, rlwe.NewSecretKey(params)), nil
+}
+
+func containsPoint(points []drlwe.ShamirPublicPoint, p drlwe.ShamirPublicPoint) bool {
+	for _, v := range points {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
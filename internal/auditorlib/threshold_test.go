@@ -0,0 +1,193 @@
+package auditorlib_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	testAuditorN         = 5
+	testAuditorThreshold = 3
+)
+
+func makeTestAuditors(sk *rlwe.SecretKey, userUUID uuid.UUID) (auditors []*auditorlib.Auditor, err error) {
+	points := make([]drlwe.ShamirPublicPoint, testAuditorN)
+	for i := range points {
+		points[i] = drlwe.ShamirPublicPoint(i + 1)
+	}
+	shares, err := auditorlib.SplitSecretKey(sk, points, testAuditorThreshold)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range points {
+		a := auditorlib.NewAuditor(p)
+		if err = a.ImportShare(&auditorlib.ThresholdShare{
+			UserUUID: userUUID, Point: p, Threshold: testAuditorThreshold, Share: shares[p],
+		}); err != nil {
+			return nil, err
+		}
+		auditors = append(auditors, a)
+	}
+	return
+}
+
+func TestThresholdDecrypt(t *testing.T) {
+	sk, pk := testutil.NewCKKSKeyPair()
+	userUUID := uuid.New()
+	amount := misc.GenRandFloat()
+	ct := testutil.MustEncryptAmount(amount, pk)
+
+	auditors, err := makeTestAuditors(sk, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 任选 t 个监管者
+	actives := []drlwe.ShamirPublicPoint{2, 4, 5}
+	var shares []*drlwe.CKSShare
+	for _, p := range actives {
+		s, err := auditors[p-1].PartialDecrypt(userUUID, ct, actives)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, s)
+	}
+
+	res, err := auditorlib.CombinePartialDecryptions(ct, shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(res-amount) > 0.01 {
+		t.Errorf("threshold decryption failed, got %f, expected %f", res, amount)
+	}
+}
+
+func TestThresholdDecryptRejectsTooFewAuditors(t *testing.T) {
+	sk, pk := testutil.NewCKKSKeyPair()
+	userUUID := uuid.New()
+	ct := testutil.MustEncryptAmount(misc.GenRandFloat(), pk)
+
+	auditors, err := makeTestAuditors(sk, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actives := []drlwe.ShamirPublicPoint{1, 2}
+	if _, err = auditors[0].PartialDecrypt(userUUID, ct, actives); err == nil {
+		t.Error("partial decryption with t-1 active auditors should fail")
+	}
+}
+
+// 任意 t-1 个合谋的监管者以 t 个公开点（补上一个不参与的监管者）通过门限检查，合并各自的份额也无法解密
+func TestThresholdDecryptCollusionBelowThreshold(t *testing.T) {
+	sk, pk := testutil.NewCKKSKeyPair()
+	userUUID := uuid.New()
+	amount := misc.GenRandFloat()
+	ct := testutil.MustEncryptAmount(amount, pk)
+
+	auditors, err := makeTestAuditors(sk, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= testAuditorN; i++ {
+		for j := i + 1; j <= testAuditorN; j++ {
+			colluders := []drlwe.ShamirPublicPoint{drlwe.ShamirPublicPoint(i), drlwe.ShamirPublicPoint(j)}
+			for absent := drlwe.ShamirPublicPoint(1); absent <= testAuditorN; absent++ {
+				if absent == colluders[0] || absent == colluders[1] {
+					continue
+				}
+				actives := append([]drlwe.ShamirPublicPoint{absent}, colluders...)
+				var partials []*drlwe.CKSShare
+				for _, p := range colluders {
+					s, err := auditors[p-1].PartialDecrypt(userUUID, ct, actives)
+					if err != nil {
+						t.Fatal(err)
+					}
+					partials = append(partials, s)
+				}
+				res, err := auditorlib.CombinePartialDecryptions(ct, partials)
+				if err == nil && math.Abs(res-amount) < 0.01 {
+					t.Errorf("auditors %v should not be able to decrypt without %d, got %f", colluders, absent, res)
+				}
+			}
+		}
+	}
+}
+
+func TestImportSignedShare(t *testing.T) {
+	sk, _ := testutil.NewCKKSKeyPair()
+	userUUID := uuid.New()
+	shares, err := auditorlib.SplitSecretKey(sk, []drlwe.ShamirPublicPoint{1, 2, 3}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newShare := func(signer *ecdsa.PrivateKey) (*auditorlib.ThresholdShare, int64, uuid.UUID, []byte) {
+		s := &auditorlib.ThresholdShare{
+			UserUUID: userUUID, Point: 1, Threshold: 2, Share: shares[1], SigningKey: &signer.PublicKey,
+		}
+		timestamp, nonce := time.Now().Unix(), uuid.New()
+		sig, err := s.Sign(signer, timestamp, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, timestamp, nonce, sig
+	}
+
+	a := auditorlib.NewAuditor(1)
+	s, timestamp, nonce, sig := newShare(owner)
+	if err = a.ImportSignedShare(s, timestamp, uuid.New(), sig); !errors.Is(err, auditorlib.ErrShareSignature) {
+		t.Errorf("share with a mismatched signature: got %v, expected ErrShareSignature", err)
+	}
+	if err = a.ImportSignedShare(s, timestamp, nonce, sig); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ImportShare(s); !errors.Is(err, auditorlib.ErrShareExists) {
+		t.Errorf("unsigned overwrite: got %v, expected ErrShareExists", err)
+	}
+	// 替换份额须由原签名公钥签名
+	if err = a.ImportSignedShare(newShare(attacker)); !errors.Is(err, auditorlib.ErrShareSignature) {
+		t.Errorf("rotation signed by another key: got %v, expected ErrShareSignature", err)
+	}
+	if err = a.ImportSignedShare(newShare(owner)); err != nil {
+		t.Errorf("rotation signed by the owner: %v", err)
+	}
+}
+
+func BenchmarkPartialDecrypt(b *testing.B) {
+	sk, pk := testutil.NewCKKSKeyPair()
+	userUUID := uuid.New()
+	ct := testutil.MustEncryptAmount(misc.GenRandFloat(), pk)
+	auditors, err := makeTestAuditors(sk, userUUID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	actives := []drlwe.ShamirPublicPoint{1, 2, 3}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = auditors[0].PartialDecrypt(userUUID, ct, actives); err != nil {
+			b.Error(err)
+		}
+	}
+}
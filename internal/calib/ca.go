@@ -0,0 +1,189 @@
+// 包 calib 包含 CA 端使用的接口和函数，以及各方与 CA 交互用的函数
+package calib
+
+// ca.go 实现了 CA 对密钥吊销列表的维护，以及证书的签发
+// 吊销列表保存在 JSON 文件中，每次吊销后序号加一并重新签名
+// 已签发的用户 UUID 与 ECDSA 公钥指纹的对应关系同样保存在 JSON 文件中
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	// 吊销列表的有效期，超过后 CA 会重新签发（序号不变）
+	DefaultRevocationListValidity = 24 * time.Hour
+	// 用户证书的有效期
+	DefaultCertificateValidity = 365 * 24 * time.Hour
+)
+
+type CA struct {
+	SigningKey *ecdsa.PrivateKey
+	// 吊销列表文件路径
+	RevocationListPath string
+	// 已签发证书登记文件路径，为空时不检查 UUID 是否已被绑定
+	RegistryPath string
+	// 本 CA 的证书链，由上级 CA 签发；为空时本 CA 即根 CA
+	Chain []*key.Certificate
+
+	mu sync.Mutex
+}
+
+func NewCA(sk *ecdsa.PrivateKey, revocationListPath string) *CA {
+	return &CA{SigningKey: sk, RevocationListPath: revocationListPath}
+}
+
+// CurrentRevocationList 返回当前已签名的吊销列表
+// 列表不存在或已超过下次更新时间时，重新签发并保存
+func (ca *CA) CurrentRevocationList() (l *key.RevocationList, err error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if l, err = ca.load(); err != nil {
+		return nil, err
+	}
+	if len(l.Sig) != 0 && !l.IsStale(time.Now()) {
+		return l, nil
+	}
+	return l, ca.signAndSave(l)
+}
+
+// Revoke 吊销密钥，keyID 为密钥指纹
+// 返回新的吊销列表
+func (ca *CA) Revoke(keyID, reason string) (l *key.RevocationList, err error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if l, err = ca.load(); err != nil {
+		return nil, err
+	}
+	if !l.Add(keyID, reason) {
+		return l, nil
+	}
+	return l, ca.signAndSave(l)
+}
+
+func (ca *CA) load() (l *key.RevocationList, err error) {
+	l = new(key.RevocationList)
+	data, err := os.ReadFile(ca.RevocationListPath)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, l)
+	return
+}
+
+func (ca *CA) signAndSave(l *key.RevocationList) (err error) {
+	if err = l.Sign(ca.SigningKey, DefaultRevocationListValidity); err != nil {
+		return err
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ca.RevocationListPath, data, 0644)
+}
+
+// IssueCertificate 为用户签发证书，返回包含本 CA 证书链的完整证书链
+// 调用方需先验证申请者持有签名私钥，签名密钥的算法见 key.SupportedSigAlgorithms
+// 同一 UUID 已绑定其他未吊销的签名公钥时拒绝签发
+func (ca *CA) IssueCertificate(subject uuid.UUID, name string, ecdsaPK crypto.PublicKey, ckksPK *rlwe.PublicKey) (chain []*key.Certificate, err error) {
+	if _, err = key.SigAlgorithmOf(ecdsaPK); err != nil {
+		return nil, err
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	fp := key.ECDSAKeyFingerprint(ecdsaPK)
+	crl, err := ca.load()
+	if err != nil {
+		return nil, err
+	}
+	if crl.IsRevoked(fp) || crl.IsRevoked(key.CKKSKeyFingerprint(ckksPK)) {
+		return nil, fmt.Errorf("key of user %v has been revoked", subject)
+	}
+
+	registry, err := ca.loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	if old, ok := registry[subject]; ok && old != fp && !crl.IsRevoked(old) {
+		return nil, fmt.Errorf("user %v is already bound to another key", subject)
+	}
+
+	now := time.Now()
+	cert := &key.Certificate{
+		Serial:         uuid.New(),
+		Subject:        subject,
+		Name:           name,
+		ECDSAPublicKey: key.MarshalSigningPublicKey(ecdsaPK),
+		CKKSKeyHash:    key.CKKSKeyFingerprint(ckksPK),
+		NotBefore:      now.Unix(),
+		NotAfter:       now.Add(DefaultCertificateValidity).Unix(),
+	}
+	if err = cert.Sign(ca.SigningKey); err != nil {
+		return nil, err
+	}
+
+	if ca.RegistryPath != "" {
+		registry[subject] = fp
+		if err = ca.saveRegistry(registry); err != nil {
+			return nil, err
+		}
+	}
+	return append([]*key.Certificate{cert}, ca.Chain...), nil
+}
+
+// IssueCACertificate 为下级 CA 签发证书
+func (ca *CA) IssueCACertificate(name string, pk *ecdsa.PublicKey, validFor time.Duration) (chain []*key.Certificate, err error) {
+	now := time.Now()
+	cert := &key.Certificate{
+		Serial:         uuid.New(),
+		Name:           name,
+		IsCA:           true,
+		ECDSAPublicKey: key.MarshalECDSAPublicKey(pk),
+		NotBefore:      now.Unix(),
+		NotAfter:       now.Add(validFor).Unix(),
+	}
+	if err = cert.Sign(ca.SigningKey); err != nil {
+		return nil, err
+	}
+	return append([]*key.Certificate{cert}, ca.Chain...), nil
+}
+
+func (ca *CA) loadRegistry() (registry map[uuid.UUID]string, err error) {
+	registry = make(map[uuid.UUID]string)
+	if ca.RegistryPath == "" {
+		return
+	}
+	data, err := os.ReadFile(ca.RegistryPath)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &registry)
+	return
+}
+
+func (ca *CA) saveRegistry(registry map[uuid.UUID]string) error {
+	data, err := json.Marshal(registry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(ca.RegistryPath, data, 0644)
+}
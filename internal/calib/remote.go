@@ -0,0 +1,98 @@
+package calib
+
+// remote.go 包含服务端、客户端向 CA 请求数据的函数
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+)
+
+const (
+	PubkeyEndpoint           string = "/pubkey"
+	RevocationListEndpoint   string = "/crl"
+	CertificateIssueEndpoint string = "/certificate/issue"
+)
+
+// FetchRevocationList 从 CA 获取吊销列表，并使用 CA 公钥验证
+// 序号低于 minSerial 的列表会被拒绝，以防回滚
+// 返回 Like：
+/*
+{
+	"status": "OK",
+	"crl": key.RevocationList
+}
+*/
+func FetchRevocationList(caURL string, caPubkey *ecdsa.PublicKey, minSerial int64) (l *key.RevocationList, err error) {
+	resp, err := http.Get(caURL + RevocationListEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string              `json:"status"`
+		Err    string              `json:"err"`
+		CRL    *key.RevocationList `json:"crl"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+	if respJSON.CRL == nil {
+		return nil, errors.New("no revocation list found")
+	}
+
+	l = respJSON.CRL
+	if err = l.Verify(caPubkey); err != nil {
+		return nil, err
+	}
+	if l.Serial < minSerial {
+		return nil, fmt.Errorf("revocation list serial %d is older than known serial %d", l.Serial, minSerial)
+	}
+	return
+}
+
+// RequestCertificate 向 CA 申请证书
+// 返回 Like：
+/*
+{
+	"status": "OK",
+	"certificates": []key.Certificate
+}
+*/
+func RequestCertificate(caURL string, req *restfulpayload.CertificateReq) (chain []*key.Certificate, err error) {
+	jsonBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(caURL+CertificateIssueEndpoint, "application/json", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status       string             `json:"status"`
+		Err          string             `json:"err"`
+		Certificates []*key.Certificate `json:"certificates"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+	if len(respJSON.Certificates) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return respJSON.Certificates, nil
+}
@@ -0,0 +1,162 @@
+package clientlib
+
+// asset.go 包含多资产的加解密、余额与交易记录查询
+// 资产到槽位的映射由服务端的资产注册表决定，见 misc.AssetRegistry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+var (
+	// 从服务端同步的资产注册表，未同步时只包含默认资产
+	Assets       = misc.NewAssetRegistry()
+	assetsServer string
+	assetsMu     sync.RWMutex
+)
+
+// FetchAssets 请求服务端的资产注册表
+func FetchAssets(server string) (r *misc.AssetRegistry, err error) {
+	resp, err := http.Get(server + AssetsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string       `json:"status"`
+		Err    string       `json:"err"`
+		Assets []misc.Asset `json:"assets"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("fetching assets failed: " + respJSON.Err)
+	}
+
+	r = &misc.AssetRegistry{Assets: respJSON.Assets}
+	if err = r.Validate(); err != nil {
+		return nil, fmt.Errorf("asset registry of %s: %w", server, err)
+	}
+	return r, nil
+}
+
+// SyncAssets 获取服务端的资产注册表并替换本地的注册表
+func SyncAssets(server string) error {
+	r, err := FetchAssets(server)
+	if err != nil {
+		return err
+	}
+	assetsMu.Lock()
+	defer assetsMu.Unlock()
+	Assets, assetsServer = r, server
+	return nil
+}
+
+// EnsureAssets 在加密前调用，每个服务端只同步一次
+func EnsureAssets(server string) error {
+	assetsMu.RLock()
+	synced := assetsServer == server
+	assetsMu.RUnlock()
+	if synced {
+		return nil
+	}
+	return SyncAssets(server)
+}
+
+func getAssets() *misc.AssetRegistry {
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	return Assets
+}
+
+// EncryptAssets 将各资产的金额加密到同一密文的对应槽位
+// 输出：密文，涉及的资产 ID（用于 Transaction.Assets）
+func EncryptAssets(amounts map[string]float64, pk *rlwe.PublicKey) (ct *rlwe.Ciphertext, ids []string, err error) {
+	r := getAssets()
+	vec, err := r.Vector(amounts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ct, err = misc.GetAmountScheme().EncryptVector(vec, pk); err != nil {
+		return nil, nil, err
+	}
+	return ct, r.IDs(amounts), nil
+}
+
+// DecryptAssets 解密密文中全部已注册资产的金额
+func DecryptAssets(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) map[string]float64 {
+	r := getAssets()
+	return r.Amounts(misc.GetAmountScheme().DecryptVector(ct, sk, r.Len()))
+}
+
+func (u User) DecryptAssetsFromCT(ct *rlwe.Ciphertext) (amounts map[string]float64, err error) {
+	if len(u.UserCKKSKeyChain) == 0 || u.UserCKKSKeyChain[0].CKKSPrivateKey == nil {
+		return nil, errors.New("No CKKS Private Key found!")
+	}
+	return DecryptAssets(ct, u.UserCKKSKeyChain[0].CKKSPrivateKey), nil
+}
+
+// GetBalances 获取并解密用户全部资产的余额
+func (u User) GetBalances() (balances map[string]float64, err error) {
+	if err = EnsureAssets(ConfigServerURL); err != nil {
+		return nil, err
+	}
+	b, err := ServerGetBalance(ConfigServerURL, u.UserIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return u.DecryptAssetsFromCT(b)
+}
+
+// GetTransactionHistory 获取用户的交易记录，asset 不为空时只返回涉及该资产的交易
+func (u User) GetTransactionHistory(asset string) ([]*transaction.Transaction, error) {
+	return ServerGetTransactions(ConfigServerURL, restfulpayload.UserGetTransactionsReq{
+		UUID:  u.UserIdentifier,
+		Asset: asset,
+	})
+}
+
+// ServerGetTransactions 从服务端获取交易记录，按时间倒序排列
+func ServerGetTransactions(server string, req restfulpayload.UserGetTransactionsReq) (txs []*transaction.Transaction, err error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(server+UserTransactionsEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status       string                         `json:"status"`
+		Err          string                         `json:"err"`
+		Transactions []*transaction.TransactionJSON `json:"transactions"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+
+	for _, txj := range respJSON.Transactions {
+		tx, err := txj.CopyToStruct()
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
@@ -0,0 +1,50 @@
+package clientlib
+
+// auditor.go 包含客户端和监管者交互用的接口函数
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/tuneinsight/lattigo/v4/drlwe"
+)
+
+// RegisterThresholdAuditors 将用户的 CKKS 私钥拆分为 len(auditors) 份，
+// 并分别发送给各个监管者，之后需要任意 threshold 个监管者合作才能解密
+// 输入：公开点 -> 监管者地址，门限，监管者的运营方令牌
+// 份额由 UserECDSAKeyChain[0] 签名，之后替换份额须由同一签名密钥签名
+func (u User) RegisterThresholdAuditors(auditors map[drlwe.ShamirPublicPoint]string, threshold int, operatorToken string) error {
+	if u.UserCKKSKeyChain == nil || u.UserCKKSKeyChain[0].CKKSPrivateKey == nil {
+		return errors.New("No CKKS Private Key found!")
+	}
+	if err := u.checkSignAvailability(); err != nil {
+		return err
+	}
+	signer := u.UserECDSAKeyChain[0]
+
+	points := make([]drlwe.ShamirPublicPoint, 0, len(auditors))
+	for p := range auditors {
+		points = append(points, p)
+	}
+
+	shares, err := auditorlib.SplitSecretKey(u.UserCKKSKeyChain[0].CKKSPrivateKey, points, threshold)
+	if err != nil {
+		return err
+	}
+
+	for p, url := range auditors {
+		err = auditorlib.RegisterShare(url, operatorToken, &auditorlib.ThresholdShare{
+			UserUUID:   u.UserIdentifier,
+			Point:      p,
+			Threshold:  threshold,
+			Share:      shares[p],
+			SigningKey: signer.PublicKey,
+		}, signer.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("register share to auditor %d failed: %v", p, err)
+		}
+	}
+
+	return nil
+}
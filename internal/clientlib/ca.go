@@ -7,27 +7,45 @@ package clientlib
 // - [ ] 请求最新的 CA 认证公钥
 //   - [x] SyncCASigningKey
 //     - [ ] TestSyncCASigningKey
+// - [x] 同步吊销列表，转账前检查对方密钥是否被吊销
 // - [ ] 请求 CA 向服务端发送 swk
-//   进一步：考虑 Time-based swk
+//   - [x] Time-based swk：按纪元轮换，见 swk.go
 
 import (
 	"crypto/ecdsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
+	"github.com/CamberLoid/Chimata/internal/calib"
+	"github.com/CamberLoid/Chimata/internal/key"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 const (
 	// 默认的 CA 接口，测试就用这个了
 	DefaultCAUrl string = "http://localhost:16002"
+	// 吊销列表的默认同步间隔，见 SyncRevocationListIfStale
+	DefaultRevocationSyncInterval = 10 * time.Minute
 )
 
 const (
-	CAPubkeyEndpoint string = "/pubkey"
+	CAPubkeyEndpoint string = calib.PubkeyEndpoint
+)
+
+var (
+	// 最近一次同步成功的吊销列表，见 SyncRevocationList
+	RevocationList *key.RevocationList
+	revocationMu   sync.RWMutex
+	// 最近一次同步成功的时间
+	revocationSyncedAt time.Time
+
+	ConfigRevocationSyncInterval = DefaultRevocationSyncInterval
 )
 
 func RequestAuthorize(rlwe.SecretKey, rlwe.PublicKey) ([]string, error) {
@@ -39,7 +57,7 @@ func RequestNewKeyFromCA() (rlwe.SecretKey, rlwe.PublicKey) {
 }
 
 func SyncCASigningKey() ([]ecdsa.PublicKey, error) {
-	return syncCASignPublicKey(DefaultServerURL)
+	return syncCASignPublicKey(DefaultCAUrl + CAPubkeyEndpoint)
 }
 
 func SyncCASigningKeyWithURL(caUrl string) ([]ecdsa.PublicKey, error) {
@@ -71,11 +89,10 @@ func syncCASignPublicKey(url string) (pk []ecdsa.PublicKey, err error) {
 
 	// 考虑增加认证？
 	resp, err = http.Get(url)
-	defer resp.Body.Close()
-
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	// 对返回 JSON 进行解码
 	err = json.NewDecoder(resp.Body).Decode(&jsonData)
@@ -95,8 +112,11 @@ func syncCASignPublicKey(url string) (pk []ecdsa.PublicKey, err error) {
 	}
 
 	for _, s := range pubkeys {
-		_s := s.(string)
-		_pk, err := x509.ParsePKIXPublicKey([]byte(_s))
+		_s, err := base64.StdEncoding.DecodeString(s.(string))
+		if err != nil {
+			return nil, err
+		}
+		_pk, err := x509.ParsePKIXPublicKey(_s)
 		if err != nil {
 			return nil, err
 		}
@@ -106,6 +126,63 @@ func syncCASignPublicKey(url string) (pk []ecdsa.PublicKey, err error) {
 	return
 }
 
+// SyncRevocationList 从 CA 获取吊销列表，使用 CA 签名公钥验证后保存
+// 序号低于已有列表的会被拒绝
+func SyncRevocationList(caUrl string, caPubkey *ecdsa.PublicKey) error {
+	if caUrl == "" {
+		caUrl = DefaultCAUrl
+	}
+
+	revocationMu.Lock()
+	defer revocationMu.Unlock()
+
+	var minSerial int64
+	if RevocationList != nil {
+		minSerial = RevocationList.Serial
+	}
+	l, err := calib.FetchRevocationList(caUrl, caPubkey, minSerial)
+	if err != nil {
+		return err
+	}
+	RevocationList = l
+	revocationSyncedAt = time.Now()
+	return nil
+}
+
+// SyncRevocationListIfStale 在距上次同步超过 ConfigRevocationSyncInterval 时重新同步吊销列表
+// 使用 ConfigCAUrl 和 CAPubkey，没有配置 CA 公钥时无法验证吊销列表，返回错误
+func SyncRevocationListIfStale() error {
+	if CAPubkey == nil {
+		return errors.New("no CA public key configured, revocation list not synced")
+	}
+	revocationMu.RLock()
+	fresh := RevocationList != nil && time.Since(revocationSyncedAt) < ConfigRevocationSyncInterval
+	revocationMu.RUnlock()
+	if fresh {
+		return nil
+	}
+	return SyncRevocationList(ConfigCAUrl, CAPubkey)
+}
+
+// CheckCounterpartyRevocation 检查对方的公钥是否出现在吊销列表中
+// 返回警告信息，没有同步过吊销列表时不做检查
+func CheckCounterpartyRevocation(r *User) (warnings []string) {
+	revocationMu.RLock()
+	defer revocationMu.RUnlock()
+
+	for _, k := range r.User.UserECDSAKeyChain {
+		if k.PublicKey != nil && RevocationList.IsRevoked(key.ECDSAKeyFingerprint(k.PublicKey)) {
+			warnings = append(warnings, "ecdsa key "+k.Identifier.String()+" of user "+r.UserIdentifier.String()+" has been revoked")
+		}
+	}
+	for _, k := range r.User.UserCKKSKeyChain {
+		if k.CKKSPublicKey != nil && RevocationList.IsRevoked(key.CKKSKeyFingerprint(k.CKKSPublicKey)) {
+			warnings = append(warnings, "ckks key "+k.Identifier.String()+" of user "+r.UserIdentifier.String()+" has been revoked")
+		}
+	}
+	return
+}
+
 // 真的要在这个阶段写么
 func (u User) AuthSwitchingKey() error {
 	panic("Not implemented yet!")
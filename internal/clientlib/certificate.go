@@ -0,0 +1,117 @@
+package clientlib
+
+// certificate.go 包含证书的申请、获取与验证
+// 向对方的 CKKS 公钥加密前，需先验证对方的证书链
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/calib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+)
+
+const (
+	GetCertificateEndpoint string = "/user/getCertificate"
+)
+
+var (
+	ConfigCAUrl string = DefaultCAUrl
+	// 信任的根 CA 公钥，可以由 SyncCASigningKey 获取后设置
+	CAPubkey *ecdsa.PublicKey
+)
+
+// RequestCertificate 向 CA 申请绑定本用户 UUID、用户名和公钥的证书
+// 申请由用户的 ECDSA 私钥签名
+func (u *User) RequestCertificate(caUrl string) (err error) {
+	if err = u.checkSignAvailability(); err != nil {
+		return err
+	}
+	if len(u.UserCKKSKeyChain) == 0 {
+		return errors.New("No CKKS KeyChain found!")
+	}
+
+	ckksPK, err := u.UserCKKSKeyChain[0].MarshalPublicKey()
+	if err != nil {
+		return err
+	}
+	ecdsaPK := key.MarshalSigningPublicKey(u.UserECDSAKeyChain[0].PublicKey)
+	sig, err := signByte(key.CertificateRequestMessage(u.UserIdentifier, u.UserName, ecdsaPK, ckksPK),
+		u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	u.Certificates, err = calib.RequestCertificate(caUrl, &restfulpayload.CertificateReq{
+		UUID:           u.UserIdentifier,
+		Name:           u.UserName,
+		CKKS_pubkey:    base64.RawStdEncoding.EncodeToString(ckksPK),
+		ECDSA_pubkey:   base64.RawStdEncoding.EncodeToString(ecdsaPK),
+		ECDSAAlgorithm: string(u.UserECDSAKeyChain[0].Algorithm),
+		Sig:            base64.RawStdEncoding.EncodeToString(sig),
+	})
+	return
+}
+
+// VerifyCertificate 验证用户的证书链是否由信任的 CA 签发，且绑定了该用户的 UUID 和公钥
+// 没有证书时从服务端获取
+func (u *User) VerifyCertificate() (err error) {
+	if CAPubkey == nil {
+		return errors.New("no CA public key configured")
+	}
+	if len(u.Certificates) == 0 {
+		if u.Certificates, err = ServerGetCertificates(ConfigServerURL, u.UserIdentifier); err != nil {
+			return fmt.Errorf("failed to get certificate of user %v: %v", u.UserIdentifier, err)
+		}
+	}
+	if len(u.UserCKKSKeyChain) == 0 || len(u.UserECDSAKeyChain) == 0 {
+		return fmt.Errorf("no public key found for user %v", u.UserIdentifier)
+	}
+
+	cert, err := key.VerifyCertificateChain(u.Certificates, CAPubkey, time.Now(), isRevoked)
+	if err != nil {
+		return err
+	}
+	return cert.Matches(u.UserIdentifier,
+		u.UserECDSAKeyChain[0].PublicKey, u.UserCKKSKeyChain[0].CKKSPublicKey)
+}
+
+func isRevoked(keyID string) bool {
+	revocationMu.RLock()
+	defer revocationMu.RUnlock()
+	return RevocationList.IsRevoked(keyID)
+}
+
+// ServerGetCertificates 从服务端获取用户注册时提交的证书链
+func ServerGetCertificates(server string, target uuid.UUID) (chain []*key.Certificate, err error) {
+	payload, err := json.Marshal(restfulpayload.RegisterUserReq{UUID: target})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(server+GetCertificateEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status       string             `json:"status"`
+		Err          string             `json:"err"`
+		Certificates []*key.Certificate `json:"certificates"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+	return respJSON.Certificates, nil
+}
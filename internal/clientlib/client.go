@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
 
 	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/transaction"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
@@ -22,23 +24,48 @@ func NewClient(dbPath string, mainUser User) (c *Client, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{db, mainUser}, err
+	// 启动时同步吊销列表，CA 不可用时仅打印警告，转账前会再次尝试
+	if err = SyncRevocationListIfStale(); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	return &Client{db, mainUser}, nil
 }
 
-// 转账任务
+// 转账任务，金额属于默认资产
 func (c Client) TransferViaUser(u *User, amount float64, method string) (err error) {
+	return c.TransferAssetsViaUser(u, map[string]float64{misc.DefaultAssetID: amount}, method)
+}
+
+// TransferAssetsViaUser 一次转出多种资产
+// 转账前按需同步吊销列表，对方密钥被吊销时仅打印警告
+func (c Client) TransferAssetsViaUser(u *User, amounts map[string]float64, method string) (err error) {
+	if err = SyncRevocationListIfStale(); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	for _, w := range CheckCounterpartyRevocation(u) {
+		log.Printf("WARNING: %s", w)
+	}
+	// 加密前确认与服务端使用同一参数集和资产注册表
+	if err = EnsureParams(ConfigServerURL); err != nil {
+		return err
+	}
+	if err = EnsureAssets(ConfigServerURL); err != nil {
+		return err
+	}
+
 	switch method {
 	case "sender", "Sender":
-		return c.transferViaUserViaSenderPK(u, amount)
+		return c.transferViaUserViaSenderPK(u, amounts)
 	case "receipt", "Receipt":
-		return c.transferViaUserViaReceiptPK(u, amount)
+		return c.transferViaUserViaReceiptPK(u, amounts)
 	}
 
 	return nil
 }
 
-func (c Client) transferViaUserViaSenderPK(r *User, amount float64) (err error) {
-	tx, err := c.MainUser.TransferBySenderPK(r, amount)
+func (c Client) transferViaUserViaSenderPK(r *User, amounts map[string]float64) (err error) {
+	c.renewSwk(r)
+	tx, err := c.MainUser.TransferAssetsBySenderPK(r, amounts)
 	if err != nil {
 		return err
 	}
@@ -50,8 +77,27 @@ func (c Client) transferViaUserViaSenderPK(r *User, amount float64) (err error)
 	return
 }
 
-func (c Client) transferViaUserViaReceiptPK(r *User, amount float64) (err error) {
-	tx, err := c.MainUser.TransferByReceiptPK(r, amount)
+// renewSwk 在本地同时持有双方私钥时，按纪元续期 MainUser -> r 的 swk
+// 只持有对方公钥时无法生成 swk，由持有双方私钥的一方负责续期
+// 续期失败仅打印警告，旧 swk 在宽限期内仍然有效
+func (c Client) renewSwk(r *User) {
+	if len(c.MainUser.UserCKKSKeyChain) == 0 || len(r.UserCKKSKeyChain) == 0 {
+		return
+	}
+	skIn, skOut := c.MainUser.UserCKKSKeyChain[0].CKKSPrivateKey, r.UserCKKSKeyChain[0].CKKSPrivateKey
+	if skIn == nil || skOut == nil {
+		return
+	}
+	epoch, err := RenewSwkIfNeeded(c.MainUser.UserIdentifier, r.UserIdentifier, skIn, skOut)
+	if err != nil {
+		log.Printf("WARNING: failed to renew swk to %v: %v", r.UserIdentifier, err)
+	} else if epoch != 0 {
+		log.Printf("renewed swk to %v for epoch %d", r.UserIdentifier, epoch)
+	}
+}
+
+func (c Client) transferViaUserViaReceiptPK(r *User, amounts map[string]float64) (err error) {
+	tx, err := c.MainUser.TransferAssetsByReceiptPK(r, amounts)
 	if err != nil {
 		return err
 	}
@@ -64,6 +110,10 @@ func (c Client) transferViaUserViaReceiptPK(r *User, amount float64) (err error)
 }
 
 func (c Client) ConfirmTransaction(t *transaction.Transaction) (err error) {
+	// 范围证明须覆盖服务端资产注册表的全部槽位
+	if err = EnsureAssets(ConfigServerURL); err != nil {
+		return err
+	}
 	_, err = c.MainUser.AcceptTransactionByTransaction(t)
 	if err != nil {
 		return
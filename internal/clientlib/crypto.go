@@ -2,67 +2,40 @@
 
 package clientlib
 
-/*  CKKS编解码器初始化
+/*  金额的加密和解密
+ *  具体方案（CKKS 或 BGV）由当前参数集决定，见 misc.AmountScheme
  */
 
 import (
-	"crypto/elliptic"
-
 	"github.com/CamberLoid/Chimata/internal/misc"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
-// CKKS 安全参数和公用结构体
+// 新用户签名密钥的算法见 key.UserSigAlgorithm
 var (
-	CKKSEncoder ckks.Encoder
-	CKKSParams  ckks.Parameters
-	// 方案中使用 P-256 作为曲线参数
-	ECDSACurve elliptic.Curve = elliptic.P256()
+	// 为 true 时，转账密文在发送前丢弃不需要的高层模数，见 misc.CompactLevel
+	// 余额与低层密文运算后层数随之降低，需要高层数的功能（如批量重加密）不宜开启
+	ConfigDropCiphertextModuli bool = false
 )
 
-// 对参数等进行初始化
-func CryptoInit() (err error) {
-	// 参数初始化
-	CKKSParams, err = ckks.NewParametersFromLiteral(ckks.PN12QP109)
-
-	if err != nil {
-		return
-	}
-
-	// 编码器初始化
-	CKKSEncoder = ckks.NewEncoder(CKKSParams)
-
-	return
-}
-
-// CKKSEncryptAmount 对数字（交易金额）进行基于 CKKS 的加密
+// EncryptAmount 对数字（交易金额）进行加密
 // 输入：金额，公钥
 // 输出：密文（rlwe.ct）
-func CKKSEncryptAmount(amount float64, pk *rlwe.PublicKey) *rlwe.Ciphertext {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	encoder := ckks.NewEncoder(params)
-	amountSlice := []float64{amount}
-	pt := encoder.EncodeNew(
-		amountSlice,
-		params.MaxLevel(),
-		params.DefaultScale(),
-		params.LogSlots())
-	ct := ckks.NewEncryptor(params, pk).EncryptNew(pt)
-
-	return ct
+func EncryptAmount(amount float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error) {
+	return misc.GetAmountScheme().Encrypt(amount, pk)
 }
 
-// CKKSDecryptAmountFromCT 从密文中提取加密的金额
+// DecryptAmount 从密文中提取加密的金额
 // 输入：密文（ct），私钥
-// 输出：金额（float64）
-func CKKSDecryptAmountFromCT(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) float64 {
-	params := misc.GetCKKSParams()
-	encoder := ckks.NewEncoder(params)
-	decryptor := ckks.NewDecryptor(params, sk)
-
-	pt := decryptor.DecryptNew(ct)
-	amount := encoder.Decode(pt, params.LogSlots())
+// 输出：金额（float64），精确到分
+func DecryptAmount(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) float64 {
+	return misc.GetAmountScheme().Decrypt(ct, sk)
+}
 
-	return roundToCent(real(amount[0]))
+// compactCiphertext 在开启 ConfigDropCiphertextModuli 时丢弃密文的高层模数
+func compactCiphertext(ct *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	if !ConfigDropCiphertextModuli || misc.GetAmountScheme().Name() != misc.SchemeCKKS {
+		return ct, nil
+	}
+	return misc.DropLevel(ct, misc.CompactLevel())
 }
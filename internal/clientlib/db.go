@@ -58,6 +58,15 @@ func initDatabase(path string) (db *sql.DB, err error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = database.MigrateECDSAKeyTable(db); err != nil {
+		return nil, err
+	}
+
+	// 建立密钥库表，私钥加密保存，见 Keystore
+	_, err = db.Exec(database.CreateKeystoreTable())
+	if err != nil {
+		return nil, err
+	}
 
 	return
 }
@@ -0,0 +1,126 @@
+package clientlib
+
+// evalkey.go 包含计算密钥（重线性化与旋转密钥）的生成和注册
+// 注册后服务端可以对以该 CKKS 公钥加密的密文做密文乘法和旋转，见 serverlib.UserEvaluator
+// 计算密钥属于某一 CKKS 公钥，密钥轮换后须重新注册
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	RegisterEvaluationKeyEndpoint string = "/user/registerEvaluationKey"
+	GetEvaluationKeyEndpoint      string = "/user/getEvaluationKey"
+)
+
+// GenEvaluationKey 以私钥 sk 生成计算密钥，relin 为 true 时包含重线性化密钥，rotations 为需要的旋转步数
+func GenEvaluationKey(sk *rlwe.SecretKey, relin bool, rotations []int) (evk rlwe.EvaluationKey) {
+	kgen := rlwe.NewKeyGenerator(misc.GetRLWEParams())
+	if relin {
+		evk.Rlk = kgen.GenRelinearizationKey(sk, 1)
+	}
+	if len(rotations) != 0 {
+		evk.Rtks = kgen.GenRotationKeysForRotations(rotations, false, sk)
+	}
+	return
+}
+
+// RegisterEvaluationKey 为用户当前的主 CKKS 公钥生成并注册计算密钥，已注册的计算密钥被替换
+// 请求由 UserECDSAKeyChain[0] 签名
+func (u User) RegisterEvaluationKey(relin bool, rotations []int) error {
+	if err := u.checkSignAvailability(); err != nil {
+		return err
+	}
+	if len(u.UserCKKSKeyChain) == 0 || u.UserCKKSKeyChain[0].CKKSPrivateKey == nil {
+		return errors.New("No CKKS Private Key found!")
+	}
+	ckks := u.UserCKKSKeyChain[0]
+	evkBytes, err := misc.MarshalEvaluationKey(GenEvaluationKey(ckks.CKKSPrivateKey, relin, rotations))
+	if err != nil {
+		return err
+	}
+	sig, err := signByte(key.RegisterEvaluationKeyMessage(u.UserIdentifier, ckks.Identifier, evkBytes),
+		u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	return ServerRegisterEvaluationKey(ConfigServerURL, &restfulpayload.RegisterEvaluationKeyReq{
+		UUID:          u.UserIdentifier,
+		KeyID:         ckks.Identifier,
+		EvaluationKey: base64.RawStdEncoding.EncodeToString(evkBytes),
+		SignedBy:      u.UserECDSAKeyChain[0].Identifier,
+		Sig:           base64.RawStdEncoding.EncodeToString(sig),
+	})
+}
+
+// ServerRegisterEvaluationKey 向服务端提交注册计算密钥的请求
+func ServerRegisterEvaluationKey(server string, req *restfulpayload.RegisterEvaluationKeyReq) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(server+RegisterEvaluationKeyEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string `json:"status"`
+		Err    string `json:"err"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return err
+	}
+	if respJSON.Status != "OK" {
+		return fmt.Errorf("registering evaluation key rejected (%s): %s", resp.Status, respJSON.Err)
+	}
+	return nil
+}
+
+// ServerGetEvaluationKey 从服务端获取用户 CKKS 公钥 keyID 的计算密钥，keyID 为零值时为主公钥
+func ServerGetEvaluationKey(server string, user, keyID uuid.UUID) (evk rlwe.EvaluationKey, err error) {
+	evkBytes, err := ServerGetEvaluationKeyBytes(server, user, keyID)
+	if err != nil {
+		return evk, err
+	}
+	return misc.UnmarshalEvaluationKey(evkBytes)
+}
+
+// ServerGetEvaluationKeyBytes 同 ServerGetEvaluationKey，返回服务端保存的编码后的计算密钥
+func ServerGetEvaluationKeyBytes(server string, user, keyID uuid.UUID) ([]byte, error) {
+	payload, err := json.Marshal(restfulpayload.GetEvaluationKeyReq{UUID: user, KeyID: keyID})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(server+GetEvaluationKeyEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status        string `json:"status"`
+		Err           string `json:"err"`
+		EvaluationKey string `json:"evaluationKey"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, fmt.Errorf("fetching evaluation key failed (%s): %s", resp.Status, respJSON.Err)
+	}
+	return base64.RawStdEncoding.DecodeString(respJSON.EvaluationKey)
+}
@@ -0,0 +1,328 @@
+package clientlib
+
+// export.go 包含用户密钥链的导出和导入
+// 导出文件为一个 PEM 块（CHIMATA KEYCHAIN），正文以口令加密：
+//   - 头部明文记录格式版本、参数集、用户 UUID 及 argon2id、XChaCha20-Poly1305 的参数，头部作为附加数据参与认证
+//   - 正文解密后为若干 PEM 块，依次为 CHIMATA USER（JSON：用户名、参数集、证书链），
+//     CKKS 密钥（CKKS SECRET KEY、CKKS PUBLIC KEY）和签名密钥（PRIVATE KEY，PKCS #8；只有公钥时为 PUBLIC KEY，PKIX），
+//     每个密钥块的头部记录 Key-Id，签名密钥另记录 Algorithm；同类密钥中第一个为主密钥
+//
+// 导入时检查版本和参数集，参数集与当前不一致时返回 misc.ErrParamsMismatch
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/users"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// KeyChainFileVersion 为当前导出文件的格式版本
+	KeyChainFileVersion int = 1
+
+	keyChainPEMType     string = "CHIMATA KEYCHAIN"
+	keyChainUserPEMType string = "CHIMATA USER"
+	ckksSecretKeyPEM    string = "CKKS SECRET KEY"
+	ckksPublicKeyPEM    string = "CKKS PUBLIC KEY"
+	signingPrivatePEM   string = "PRIVATE KEY"
+	signingPublicPEM    string = "PUBLIC KEY"
+	keyChainFileCipher  string = "xchacha20-poly1305"
+
+	// 头部的 argon2id 参数在认证前使用，超出上限的文件直接拒绝，避免派生密钥时耗尽内存
+	keyChainFileMaxKDFTime    uint32 = 16
+	keyChainFileMaxKDFMemory  uint32 = 1024 * 1024 // KiB
+	keyChainFileMaxKDFThreads uint8  = 16
+)
+
+var ErrKeyChainFileVersion = errors.New("unsupported key chain file version")
+
+// keyChainFileUser 为 CHIMATA USER 块的内容
+type keyChainFileUser struct {
+	UUID         uuid.UUID          `json:"uuid"`
+	Name         string             `json:"name"`
+	Params       string             `json:"params"`
+	Certificates []*key.Certificate `json:"certificates,omitempty"`
+}
+
+// ExportKeyChain 以口令加密导出用户的全部密钥
+func (u User) ExportKeyChain(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	plaintext, err := u.marshalKeyChain()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+
+	salt := make([]byte, keystoreSaltSize)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	for _, b := range [][]byte{salt, nonce} {
+		if _, err = rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+	block := &pem.Block{
+		Type: keyChainPEMType,
+		Headers: map[string]string{
+			"Version":    strconv.Itoa(KeyChainFileVersion),
+			"User":       u.UserIdentifier.String(),
+			"Params":     misc.ParamSetID(),
+			"Kdf":        keystoreKDF,
+			"Kdf-Params": fmt.Sprintf("t=%d,m=%d,p=%d", DefaultKeystoreKDFTime, DefaultKeystoreKDFMemory, DefaultKeystoreKDFThreads),
+			"Salt":       hex.EncodeToString(salt),
+			"Cipher":     keyChainFileCipher,
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+	}
+	aead, err := keyChainFileAEAD(block.Headers, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	block.Bytes = aead.Seal(nil, nonce, plaintext, keyChainFileAD(block.Headers))
+	return pem.EncodeToMemory(block), nil
+}
+
+// ExportKeyChainToFile 将 ExportKeyChain 的结果写入 path，仅所有者可读写
+func (u User) ExportKeyChainToFile(path string, passphrase []byte) error {
+	data, err := u.ExportKeyChain(passphrase)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// ImportKeyChain 以口令解密导出文件，还原用户及其全部密钥
+func ImportKeyChain(data, passphrase []byte) (*User, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != keyChainPEMType {
+		return nil, errors.New("not a chimata key chain file")
+	}
+	if v, err := strconv.Atoi(block.Headers["Version"]); err != nil || v != KeyChainFileVersion {
+		return nil, fmt.Errorf("%w: %q", ErrKeyChainFileVersion, block.Headers["Version"])
+	}
+	if err := checkKeyChainParams(block.Headers["Params"]); err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, errors.New("invalid nonce in key chain file")
+	}
+	aead, err := keyChainFileAEAD(block.Headers, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, keyChainFileAD(block.Headers))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	defer wipe(plaintext)
+
+	u, err := unmarshalKeyChain(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if u.UserIdentifier.String() != block.Headers["User"] {
+		return nil, fmt.Errorf("key chain file header names user %s, content is user %v", block.Headers["User"], u.UserIdentifier)
+	}
+	return u, nil
+}
+
+// ImportCKKSKeychainFromFile 从 ExportKeyChainToFile 导出的文件中导入用户的密钥链
+func ImportCKKSKeychainFromFile(path string, passphrase []byte) (*User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ImportKeyChain(data, passphrase)
+}
+
+func checkKeyChainParams(id string) error {
+	if id != misc.ParamSetID() {
+		return fmt.Errorf("%w: key chain uses %q, current parameter set is %q", misc.ErrParamsMismatch, id, misc.ParamSetID())
+	}
+	return nil
+}
+
+// keyChainFileAEAD 按头部记录的参数由口令派生加密密钥
+func keyChainFileAEAD(h map[string]string, passphrase []byte) (aead cipher.AEAD, err error) {
+	if h["Kdf"] != keystoreKDF || h["Cipher"] != keyChainFileCipher {
+		return nil, fmt.Errorf("unsupported kdf %q or cipher %q", h["Kdf"], h["Cipher"])
+	}
+	var (
+		t, m uint32
+		p    uint8
+	)
+	if _, err = fmt.Sscanf(h["Kdf-Params"], "t=%d,m=%d,p=%d", &t, &m, &p); err != nil || t == 0 || m == 0 || p == 0 {
+		return nil, fmt.Errorf("invalid kdf params %q", h["Kdf-Params"])
+	}
+	if t > keyChainFileMaxKDFTime || m > keyChainFileMaxKDFMemory || p > keyChainFileMaxKDFThreads {
+		return nil, fmt.Errorf("kdf params %q exceed the limit t=%d,m=%d,p=%d",
+			h["Kdf-Params"], keyChainFileMaxKDFTime, keyChainFileMaxKDFMemory, keyChainFileMaxKDFThreads)
+	}
+	salt, err := hex.DecodeString(h["Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid salt in key chain file")
+	}
+	k := argon2.IDKey(passphrase, salt, t, m, p, chacha20poly1305.KeySize)
+	defer wipe(k)
+	return chacha20poly1305.NewX(k)
+}
+
+// keyChainFileAD 返回头部的规范编码，作为附加数据
+func keyChainFileAD(h map[string]string) []byte {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(keyChainPEMType + "\n")
+	for _, name := range names {
+		sb.WriteString(name + ": " + h[name] + "\n")
+	}
+	return []byte(sb.String())
+}
+
+func (u User) marshalKeyChain() ([]byte, error) {
+	if len(u.UserCKKSKeyChain) == 0 || len(u.UserECDSAKeyChain) == 0 {
+		return nil, fmt.Errorf("user %v has no key chain", u.UserIdentifier)
+	}
+	userJSON, err := json.Marshal(keyChainFileUser{
+		UUID:         u.UserIdentifier,
+		Name:         u.UserName,
+		Params:       misc.ParamSetID(),
+		Certificates: u.Certificates,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := pem.EncodeToMemory(&pem.Block{Type: keyChainUserPEMType, Bytes: userJSON})
+
+	for _, kc := range u.UserCKKSKeyChain {
+		h := map[string]string{"Key-Id": kc.Identifier.String()}
+		pk, err := kc.MarshalPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: ckksPublicKeyPEM, Headers: h, Bytes: pk})...)
+		if kc.CKKSPrivateKey != nil {
+			sk, err := kc.CKKSPrivateKey.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pem.EncodeToMemory(&pem.Block{Type: ckksSecretKeyPEM, Headers: h, Bytes: sk})...)
+			wipe(sk)
+		}
+	}
+	for _, kc := range u.UserECDSAKeyChain {
+		alg, err := key.SigAlgorithmOf(kc.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		h := map[string]string{"Key-Id": kc.Identifier.String(), "Algorithm": string(alg)}
+		if kc.PrivateKey == nil {
+			out = append(out, pem.EncodeToMemory(&pem.Block{Type: signingPublicPEM, Headers: h, Bytes: key.MarshalSigningPublicKey(kc.PublicKey)})...)
+			continue
+		}
+		sk, err := key.MarshalSigningPrivateKey(kc.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: signingPrivatePEM, Headers: h, Bytes: sk})...)
+		wipe(sk)
+	}
+	return out, nil
+}
+
+func unmarshalKeyChain(data []byte) (*User, error) {
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != keyChainUserPEMType {
+		return nil, errors.New("key chain file has no user block")
+	}
+	var info keyChainFileUser
+	if err := json.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, err
+	}
+	if err := checkKeyChainParams(info.Params); err != nil {
+		return nil, err
+	}
+	u := &User{User: users.User{UserIdentifier: info.UUID, UserName: info.Name}, Certificates: info.Certificates}
+
+	ckks := make(map[uuid.UUID]int)
+	for {
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		id, err := uuid.Parse(block.Headers["Key-Id"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key id in %s block: %v", block.Type, err)
+		}
+		switch block.Type {
+		case ckksPublicKeyPEM:
+			pk, err := misc.UnmarshalPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ckks[id] = len(u.UserCKKSKeyChain)
+			u.UserCKKSKeyChain = append(u.UserCKKSKeyChain, key.CKKSKeyChain{Identifier: id, CKKSPublicKey: pk})
+		case ckksSecretKeyPEM:
+			i, ok := ckks[id]
+			if !ok {
+				return nil, fmt.Errorf("ckks secret key %v has no public key", id)
+			}
+			kc := &u.UserCKKSKeyChain[i]
+			kc.CKKSPrivateKey = rlwe.NewSecretKey(misc.GetRLWEParams())
+			if err = kc.CKKSPrivateKey.UnmarshalBinary(block.Bytes); err != nil {
+				return nil, fmt.Errorf("%w: ckks secret key %v: %v", misc.ErrParamsMismatch, id, err)
+			}
+			if err = checkCKKSKeyPair(kc.CKKSPrivateKey, kc.CKKSPublicKey); err != nil {
+				return nil, fmt.Errorf("ckks key %v: %v", id, err)
+			}
+			kc.CKKSEvaluationKey = key.NewLocalKeyGenerator().GenEvaluationKey(kc.CKKSPrivateKey)
+		case signingPrivatePEM, signingPublicPEM:
+			kc := key.SigningKeyChain{Identifier: id}
+			if block.Type == signingPrivatePEM {
+				if kc.PrivateKey, err = key.UnmarshalSigningPrivateKey(block.Bytes); err != nil {
+					return nil, err
+				}
+				kc.PublicKey = kc.PrivateKey.Public()
+			} else if kc.PublicKey, _, err = key.UnmarshalSigningPublicKey(block.Bytes); err != nil {
+				return nil, err
+			}
+			if kc.Algorithm, err = key.SigAlgorithmOf(kc.PublicKey); err != nil {
+				return nil, err
+			}
+			if a := block.Headers["Algorithm"]; a != "" && key.SigAlgorithm(a) != kc.Algorithm {
+				return nil, fmt.Errorf("signing key %v is %s, declared as %q", id, kc.Algorithm, a)
+			}
+			u.UserECDSAKeyChain = append(u.UserECDSAKeyChain, kc)
+		default:
+			return nil, fmt.Errorf("unknown block %q in key chain file", block.Type)
+		}
+	}
+	if len(u.UserCKKSKeyChain) == 0 || len(u.UserECDSAKeyChain) == 0 {
+		return nil, errors.New("key chain file has no key")
+	}
+	return u, nil
+}
+
+// checkCKKSKeyPair 检查私钥与公钥是否匹配，见 key.CheckCKKSKeyPair
+func checkCKKSKeyPair(sk *rlwe.SecretKey, pk *rlwe.PublicKey) error {
+	return key.CheckCKKSKeyPair(misc.GetRLWEParams(), sk, pk)
+}
@@ -0,0 +1,95 @@
+package clientlib_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+)
+
+func TestExportImportKeyChain(t *testing.T) {
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		clientlib.DefaultKeystoreKDFTime, clientlib.DefaultKeystoreKDFMemory = 1, 1024
+		user := makeNewRandomUser("Alice")
+		device, err := key.LocalKeyGenerator{SigAlgorithm: key.SigEd25519}.GenerateUserECDSAKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, *device)
+
+		path := filepath.Join(t.TempDir(), "alice.keychain")
+		if err = user.ExportKeyChainToFile(path, []byte("passphrase")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = clientlib.ImportCKKSKeychainFromFile(path, []byte("wrong")); !errors.Is(err, clientlib.ErrWrongPassphrase) {
+			t.Errorf("importing with a wrong passphrase: %v", err)
+		}
+		got, err := clientlib.ImportCKKSKeychainFromFile(path, []byte("passphrase"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.UserIdentifier != user.UserIdentifier || got.UserName != user.UserName || len(got.Certificates) != len(user.Certificates) {
+			t.Errorf("user mismatch: %v %q", got.UserIdentifier, got.UserName)
+		}
+		want, _ := user.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+		sk, _ := got.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+		if got.UserCKKSKeyChain[0].Identifier != user.UserCKKSKeyChain[0].Identifier || !bytes.Equal(sk, want) {
+			t.Error("ckks key mismatch")
+		}
+		if len(got.UserECDSAKeyChain) != 2 {
+			t.Fatalf("expected 2 signing keys, got %d", len(got.UserECDSAKeyChain))
+		}
+		for i, kc := range got.UserECDSAKeyChain {
+			sig, err := key.Sign(kc.PrivateKey, []byte("msg"))
+			if err != nil || kc.Identifier != user.UserECDSAKeyChain[i].Identifier ||
+				!key.Verify(user.UserECDSAKeyChain[i].PublicKey, []byte("msg"), sig) {
+				t.Errorf("signing key %d mismatch: %v", i, err)
+			}
+		}
+		if got.UserECDSAKeyChain[1].Algorithm != key.SigEd25519 {
+			t.Errorf("expected ed25519 device key, got %s", got.UserECDSAKeyChain[1].Algorithm)
+		}
+
+		data, _ := user.ExportKeyChain([]byte("passphrase"))
+		// 修改明文头部后认证失败
+		tampered := bytes.Replace(data, []byte("Version: 1"), []byte("Version: 2"), 1)
+		if _, err = clientlib.ImportKeyChain(tampered, []byte("passphrase")); !errors.Is(err, clientlib.ErrKeyChainFileVersion) {
+			t.Errorf("importing an unknown version: %v", err)
+		}
+		tampered = bytes.Replace(data, []byte(user.UserIdentifier.String()), []byte(userReceipt.UserIdentifier.String()), 1)
+		if _, err = clientlib.ImportKeyChain(tampered, []byte("passphrase")); err == nil {
+			t.Error("tampered header should be rejected")
+		}
+		// 超出上限的 argon2id 参数在派生密钥前被拒绝
+		for _, params := range []string{"t=1,m=4294967295,p=4", "t=4294967295,m=1024,p=4", "t=1,m=1024,p=255"} {
+			tampered = bytes.Replace(data, []byte("t=1,m=1024,p=4"), []byte(params), 1)
+			if _, err = clientlib.ImportKeyChain(tampered, []byte("passphrase")); err == nil || !strings.Contains(err.Error(), "exceed") {
+				t.Errorf("kdf params %s: %v", params, err)
+			}
+		}
+
+		// 参数集不一致
+		current := misc.ParamSetID()
+		for _, id := range misc.ParamSetIDs() {
+			if id == current {
+				continue
+			}
+			if err = misc.SetParamSet(id); err != nil {
+				t.Fatal(err)
+			}
+			_, err = clientlib.ImportKeyChain(data, []byte("passphrase"))
+			misc.SetParamSet(current)
+			if !errors.Is(err, misc.ErrParamsMismatch) {
+				t.Errorf("importing under %s: %v", id, err)
+			}
+			break
+		}
+	})
+}
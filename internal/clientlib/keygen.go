@@ -0,0 +1,24 @@
+package clientlib
+
+// keygen.go 包含生成用户及其密钥链的函数
+
+import (
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/users"
+)
+
+// NewUser 在本地生成一个带有完整密钥链的新用户
+func NewUser(name string) (*User, error) {
+	return NewUserWithKeyGenerator(name, key.NewLocalKeyGenerator())
+}
+
+// NewUserWithKeyGenerator 使用给定的密钥生成器生成新用户
+func NewUserWithKeyGenerator(name string, g key.UserKeyGenerator) (u *User, err error) {
+	kc, err := key.GenerateUserKeyChain(g)
+	if err != nil {
+		return nil, err
+	}
+	u = &User{User: *users.NewUserWithUserName(name)}
+	u.ImportKeyChain(kc)
+	return u, nil
+}
@@ -0,0 +1,135 @@
+package clientlib
+
+// keys.go 包含用户多个密钥的管理
+// 交易中的每个密文和签名都记录了所用密钥的 ID：
+//   - CKKS：密钥轮换后旧私钥保留在 UserCKKSKeyChain 中，按 ID 选择解密历史交易所用的私钥
+//   - 签名密钥：除注册时的主密钥外，可以为每台设备添加各自的签名密钥，见 AddECDSAKey，算法可以与主密钥不同
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	AddECDSAKeyEndpoint string = "/user/addECDSAKey"
+)
+
+// CKKSKeyChainByID 返回标识符为 id 的 CKKS 密钥链，id 为零值时返回当前的主密钥
+func (u User) CKKSKeyChainByID(id uuid.UUID) (*key.CKKSKeyChain, error) {
+	if len(u.UserCKKSKeyChain) == 0 {
+		return nil, errors.New("No CKKS KeyChain found!")
+	}
+	if id == uuid.Nil {
+		return &u.UserCKKSKeyChain[0], nil
+	}
+	for i := range u.UserCKKSKeyChain {
+		if u.UserCKKSKeyChain[i].Identifier == id {
+			return &u.UserCKKSKeyChain[i], nil
+		}
+	}
+	return nil, fmt.Errorf("ckks key %v not found", id)
+}
+
+// transactionCT 返回交易中以该用户公钥加密的密文，及解密所用的私钥
+func (u User) transactionCT(t *transaction.Transaction) (ct *rlwe.Ciphertext, sk *rlwe.SecretKey, err error) {
+	keyID := t.CTSenderKeyID
+	if u.UserIdentifier == t.Receipt {
+		ct, err = t.GetReceiptCT()
+		keyID = t.CTReceiptKeyID
+	} else {
+		ct, err = t.GetSenderCT()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	kc, err := u.CKKSKeyChainByID(keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if kc.CKKSPrivateKey == nil {
+		return nil, nil, errors.New("No CKKS Private Key found!")
+	}
+	return ct, kc.CKKSPrivateKey, nil
+}
+
+// DecryptTransactionAmount 解密交易中以该用户公钥加密的金额（默认资产）
+// 按交易记录的密钥 ID 选择私钥，因此密钥轮换前的交易仍可解密
+func (u User) DecryptTransactionAmount(t *transaction.Transaction) (amount float64, err error) {
+	ct, sk, err := u.transactionCT(t)
+	if err != nil {
+		return 0, err
+	}
+	return DecryptAmount(ct, sk), nil
+}
+
+// AddECDSAKey 在服务端为用户添加一个 ECDSA 公钥，请求由当前的 UserECDSAKeyChain[0] 签名
+// 成功后 kc 的标识符即为服务端记录的 ID；在该设备上将 kc 置于 UserECDSAKeyChain[0] 即可用其签名
+func (u User) AddECDSAKey(kc *key.ECDSAKeyChain) error {
+	if err := u.checkSignAvailability(); err != nil {
+		return err
+	}
+	pkBytes, err := x509.MarshalPKIXPublicKey(kc.PublicKey)
+	if err != nil {
+		return err
+	}
+	if kc.Algorithm == "" {
+		if kc.Algorithm, err = key.SigAlgorithmOf(kc.PublicKey); err != nil {
+			return err
+		}
+	}
+	if kc.Identifier == uuid.Nil {
+		kc.Identifier = uuid.New()
+	}
+	sig, err := signByte(key.AddECDSAKeyMessage(u.UserIdentifier, kc.Identifier, pkBytes),
+		u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = ServerAddECDSAKey(ConfigServerURL, &restfulpayload.AddECDSAKeyReq{
+		UUID:           u.UserIdentifier,
+		KeyID:          kc.Identifier,
+		ECDSA_pubkey:   base64.RawStdEncoding.EncodeToString(pkBytes),
+		ECDSAAlgorithm: string(kc.Algorithm),
+		SignedBy:       u.UserECDSAKeyChain[0].Identifier,
+		Sig:            base64.RawStdEncoding.EncodeToString(sig),
+	})
+	return err
+}
+
+// ServerAddECDSAKey 向服务端提交添加 ECDSA 公钥的请求，返回公钥的 ID
+func ServerAddECDSAKey(server string, req *restfulpayload.AddECDSAKeyReq) (keyID uuid.UUID, err error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	resp, err := http.Post(server+AddECDSAKeyEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string    `json:"status"`
+		Err    string    `json:"err"`
+		KeyID  uuid.UUID `json:"keyID"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return uuid.Nil, err
+	}
+	if respJSON.Status != "OK" {
+		return uuid.Nil, fmt.Errorf("adding key rejected (%s): %s", resp.Status, respJSON.Err)
+	}
+	return respJSON.KeyID, nil
+}
@@ -0,0 +1,391 @@
+package clientlib
+
+// keystore.go 包含客户端数据库中私钥的加密保存
+// CKKSKeyChains、ECDSAKeyChains 表的 privateKey 列只保存密文，不会写入原始的 rlwe.SecretKey 字节
+//
+// 两层密钥：
+//   - 口令经 argon2id 派生出口令密钥，用于加密随机生成的数据密钥（wrappedKey）
+//   - 数据密钥以 XChaCha20-Poly1305 加密各个私钥，附加数据绑定用户 UUID 和密钥 ID，私钥不能在行之间挪用
+//
+// 修改口令只需重新加密数据密钥；解锁后数据密钥只保存在内存中，Lock 或会话到期后清除
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	database "github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/users"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	keystoreKDF         string = "argon2id"
+	keystoreSealVersion byte   = 1
+	keystoreSaltSize    int    = 16
+)
+
+var (
+	// 新建密钥库或修改口令时使用的 argon2id 参数，已有密钥库使用其记录的参数
+	DefaultKeystoreKDFTime    uint32 = 3
+	DefaultKeystoreKDFMemory  uint32 = 64 * 1024 // KiB
+	DefaultKeystoreKDFThreads uint8  = 4
+
+	// Unlock 未指定会话时长时使用的时长
+	DefaultKeystoreSession time.Duration = 15 * time.Minute
+)
+
+var (
+	ErrKeystoreLocked         = errors.New("keystore is locked")
+	ErrKeystoreNotInitialized = errors.New("keystore is not initialized")
+	ErrKeystoreInitialized    = errors.New("keystore is already initialized")
+	ErrWrongPassphrase        = errors.New("wrong passphrase")
+)
+
+// Keystore 管理客户端数据库中加密保存的私钥
+type Keystore struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	dataKey []byte
+	expires time.Time
+}
+
+// OpenKeystore 在客户端数据库上打开密钥库，需要时建立相关的表
+func OpenKeystore(db *sql.DB) (*Keystore, error) {
+	for _, stmt := range []string{
+		database.CreateUserTable(),
+		database.CreateCKKSKeyTable(),
+		database.CreateECDSAKeyTable(),
+		database.CreateKeystoreTable(),
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	if err := database.MigrateECDSAKeyTable(db); err != nil {
+		return nil, err
+	}
+	return &Keystore{db: db}, nil
+}
+
+// Initialized 返回密钥库是否已设置口令
+func (ks *Keystore) Initialized() (bool, error) {
+	_, err := database.GetKeystore(ks.db)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Init 以口令初始化密钥库，生成新的数据密钥，初始化后密钥库处于解锁状态
+func (ks *Keystore) Init(passphrase []byte) error {
+	dataKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	r, err := wrapDataKey(passphrase, dataKey)
+	if err != nil {
+		return err
+	}
+	written, err := database.PutKeystore(ks.db, r, false)
+	if err != nil {
+		return err
+	}
+	if !written {
+		return ErrKeystoreInitialized
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.setDataKey(dataKey, DefaultKeystoreSession)
+	return nil
+}
+
+// Unlock 以口令解锁密钥库，d 为会话时长，为 0 时使用 DefaultKeystoreSession
+func (ks *Keystore) Unlock(passphrase []byte, d time.Duration) error {
+	dataKey, err := ks.openDataKey(passphrase)
+	if err != nil {
+		return err
+	}
+	if d == 0 {
+		d = DefaultKeystoreSession
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.setDataKey(dataKey, d)
+	return nil
+}
+
+// Lock 清除内存中的数据密钥
+func (ks *Keystore) Lock() {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.setDataKey(nil, 0)
+}
+
+// Locked 返回密钥库是否处于锁定状态，会话到期视为锁定
+func (ks *Keystore) Locked() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.currentDataKey() == nil
+}
+
+// ChangePassphrase 修改口令，已加密的私钥不变
+func (ks *Keystore) ChangePassphrase(old, new []byte) error {
+	dataKey, err := ks.openDataKey(old)
+	if err != nil {
+		return err
+	}
+	defer wipe(dataKey)
+	r, err := wrapDataKey(new, dataKey)
+	if err != nil {
+		return err
+	}
+	_, err = database.PutKeystore(ks.db, r, true)
+	return err
+}
+
+// StoreUser 保存用户及其全部密钥，私钥加密后写入，需要先解锁
+// UserCKKSKeyChain[0]、UserECDSAKeyChain[0] 记为主密钥
+func (ks *Keystore) StoreUser(u *User) (err error) {
+	if len(u.UserCKKSKeyChain) == 0 || len(u.UserECDSAKeyChain) == 0 {
+		return fmt.Errorf("user %v has no key chain", u.UserIdentifier)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	dataKey := ks.currentDataKey()
+	if dataKey == nil {
+		return ErrKeystoreLocked
+	}
+
+	if err = database.PutUserColumn(ks.db, &u.User, nil); err != nil {
+		return err
+	}
+	for _, kc := range u.UserCKKSKeyChain {
+		var sealed []byte
+		if kc.CKKSPrivateKey != nil {
+			skBytes, err := kc.CKKSPrivateKey.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			sealed, err = sealKey(dataKey, "ckks", u.UserIdentifier, kc.Identifier, skBytes)
+			wipe(skBytes)
+			if err != nil {
+				return err
+			}
+		}
+		err = database.PutSealedCKKSKey(ks.db, kc.Identifier, u.UserIdentifier, kc.CKKSPublicKey, kc.CKKSPublicKeySeed, sealed)
+		if err != nil {
+			return err
+		}
+	}
+	for _, kc := range u.UserECDSAKeyChain {
+		var sealed []byte
+		if kc.PrivateKey != nil {
+			skBytes, err := key.MarshalSigningPrivateKey(kc.PrivateKey)
+			if err != nil {
+				return err
+			}
+			sealed, err = sealKey(dataKey, "signing", u.UserIdentifier, kc.Identifier, skBytes)
+			wipe(skBytes)
+			if err != nil {
+				return err
+			}
+		}
+		if err = database.PutSealedSigningKey(ks.db, kc.Identifier, u.UserIdentifier, kc.PublicKey, sealed); err != nil {
+			return err
+		}
+	}
+	if len(u.Certificates) != 0 {
+		if err = database.PutUserCertificates(ks.db, u.UserIdentifier, u.Certificates); err != nil {
+			return err
+		}
+	}
+	return database.SetPrimaryKeys(ks.db, u.UserIdentifier,
+		u.UserCKKSKeyChain[0].Identifier, u.UserECDSAKeyChain[0].Identifier)
+}
+
+// LoadUser 读取用户及其全部密钥并解密私钥，需要先解锁
+func (ks *Keystore) LoadUser(id uuid.UUID) (u *User, err error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	dataKey := ks.currentDataKey()
+	if dataKey == nil {
+		return nil, ErrKeystoreLocked
+	}
+
+	u = &User{User: users.User{UserIdentifier: id}}
+	err = ks.db.QueryRow(`SELECT userName FROM Users WHERE uuid = ?`, id.String()).Scan(&u.UserName)
+	if err != nil {
+		return nil, fmt.Errorf("user %v not found in keystore: %v", id, err)
+	}
+	if u.Certificates, err = database.GetUserCertificates(ks.db, id); err != nil {
+		u.Certificates = nil
+	}
+
+	ckksKeys, err := database.GetSealedKeys(ks.db, "CKKSKeyChains", id)
+	if err != nil {
+		return nil, err
+	}
+	g := key.NewLocalKeyGenerator()
+	for _, k := range ckksKeys {
+		kc := key.CKKSKeyChain{Identifier: k.Identifier}
+		if kc.CKKSPublicKey, err = misc.UnmarshalPublicKey(k.PublicKey); err != nil {
+			return nil, err
+		}
+		if len(k.PrivateKey) != 0 {
+			skBytes, err := openKey(dataKey, "ckks", id, k.Identifier, k.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			kc.CKKSPrivateKey = rlwe.NewSecretKey(g.Params)
+			err = kc.CKKSPrivateKey.UnmarshalBinary(skBytes)
+			wipe(skBytes)
+			if err != nil {
+				return nil, err
+			}
+			kc.CKKSEvaluationKey = g.GenEvaluationKey(kc.CKKSPrivateKey)
+		}
+		u.UserCKKSKeyChain = append(u.UserCKKSKeyChain, kc)
+	}
+
+	signingKeys, err := database.GetSealedKeys(ks.db, "ECDSAKeyChains", id)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range signingKeys {
+		kc := key.SigningKeyChain{Identifier: k.Identifier}
+		if kc.PublicKey, kc.Algorithm, err = key.UnmarshalSigningPublicKeyAs(k.PublicKey, k.Algorithm); err != nil {
+			return nil, err
+		}
+		if len(k.PrivateKey) != 0 {
+			skBytes, err := openKey(dataKey, "signing", id, k.Identifier, k.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			kc.PrivateKey, err = key.UnmarshalSigningPrivateKey(skBytes)
+			wipe(skBytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		u.UserECDSAKeyChain = append(u.UserECDSAKeyChain, kc)
+	}
+	if len(u.UserCKKSKeyChain) == 0 || len(u.UserECDSAKeyChain) == 0 {
+		return nil, fmt.Errorf("no key chain of user %v found in keystore", id)
+	}
+	return u, nil
+}
+
+// setDataKey 替换内存中的数据密钥，需持有 ks.mu
+func (ks *Keystore) setDataKey(dataKey []byte, d time.Duration) {
+	wipe(ks.dataKey)
+	ks.dataKey, ks.expires = dataKey, time.Now().Add(d)
+}
+
+// currentDataKey 返回未到期的数据密钥，到期时清除，需持有 ks.mu
+func (ks *Keystore) currentDataKey() []byte {
+	if ks.dataKey != nil && time.Now().After(ks.expires) {
+		ks.setDataKey(nil, 0)
+	}
+	return ks.dataKey
+}
+
+// openDataKey 以口令解密数据密钥
+func (ks *Keystore) openDataKey(passphrase []byte) ([]byte, error) {
+	r, err := database.GetKeystore(ks.db)
+	if err == sql.ErrNoRows {
+		return nil, ErrKeystoreNotInitialized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.KDF != keystoreKDF {
+		return nil, fmt.Errorf("unsupported keystore kdf %q", r.KDF)
+	}
+	kek := argon2.IDKey(passphrase, r.Salt, r.Time, r.Memory, r.Threads, chacha20poly1305.KeySize)
+	defer wipe(kek)
+	dataKey, err := openKey(kek, "wrap", uuid.Nil, uuid.Nil, r.WrappedKey)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return dataKey, nil
+}
+
+// wrapDataKey 以新的盐和当前的默认参数派生口令密钥，并加密数据密钥
+func wrapDataKey(passphrase, dataKey []byte) (*database.KeystoreRecord, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	r := &database.KeystoreRecord{
+		KDF:     keystoreKDF,
+		Salt:    make([]byte, keystoreSaltSize),
+		Time:    DefaultKeystoreKDFTime,
+		Memory:  DefaultKeystoreKDFMemory,
+		Threads: DefaultKeystoreKDFThreads,
+	}
+	if _, err := rand.Read(r.Salt); err != nil {
+		return nil, err
+	}
+	kek := argon2.IDKey(passphrase, r.Salt, r.Time, r.Memory, r.Threads, chacha20poly1305.KeySize)
+	defer wipe(kek)
+	var err error
+	r.WrappedKey, err = sealKey(kek, "wrap", uuid.Nil, uuid.Nil, dataKey)
+	return r, err
+}
+
+// keystoreAD 返回加密的附加数据，绑定用途、用户和密钥 ID
+func keystoreAD(kind string, userID, keyID uuid.UUID) []byte {
+	ad := bytes.NewBufferString("Chimata-Keystore+" + kind + "+")
+	ad.Write(userID[:])
+	ad.Write(keyID[:])
+	return ad.Bytes()
+}
+
+// sealKey 加密 plaintext，输出为 版本 || nonce || 密文
+func sealKey(k []byte, kind string, userID, keyID uuid.UUID, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(k)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out[0] = keystoreSealVersion
+	if _, err = rand.Read(out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plaintext, keystoreAD(kind, userID, keyID)), nil
+}
+
+// openKey 解密 sealKey 的输出
+func openKey(k []byte, kind string, userID, keyID uuid.UUID, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 1+aead.NonceSize() || sealed[0] != keystoreSealVersion {
+		return nil, fmt.Errorf("invalid sealed key %v", keyID)
+	}
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[1+aead.NonceSize():], keystoreAD(kind, userID, keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key %v: %v", keyID, err)
+	}
+	return plaintext, nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,99 @@
+package clientlib_test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+)
+
+func newTestKeystore(t *testing.T) (*clientlib.Keystore, *sql.DB) {
+	// 测试中降低 argon2id 的开销
+	clientlib.DefaultKeystoreKDFTime, clientlib.DefaultKeystoreKDFMemory = 1, 1024
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "client.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ks, err := clientlib.OpenKeystore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks, db
+}
+
+func TestKeystore(t *testing.T) {
+	ks, db := newTestKeystore(t)
+	user := makeNewRandomUser("Alice")
+
+	if err := ks.StoreUser(&user); !errors.Is(err, clientlib.ErrKeystoreLocked) {
+		t.Fatalf("storing into an uninitialized keystore: %v", err)
+	}
+	if err := ks.Init([]byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Init([]byte("another")); !errors.Is(err, clientlib.ErrKeystoreInitialized) {
+		t.Errorf("second init: %v", err)
+	}
+	if err := ks.StoreUser(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	// 数据库中不出现原始私钥
+	skBytes, _ := user.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	var stored []byte
+	if err := db.QueryRow(`SELECT privateKey FROM CKKSKeyChains`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) == 0 || bytes.Contains(stored, skBytes[len(skBytes)-64:]) {
+		t.Error("ckks secret key is not encrypted")
+	}
+
+	ks.Lock()
+	if _, err := ks.LoadUser(user.UserIdentifier); !errors.Is(err, clientlib.ErrKeystoreLocked) {
+		t.Errorf("loading from a locked keystore: %v", err)
+	}
+	if err := ks.Unlock([]byte("wrong"), 0); !errors.Is(err, clientlib.ErrWrongPassphrase) {
+		t.Errorf("unlocking with a wrong passphrase: %v", err)
+	}
+	if err := ks.ChangePassphrase([]byte("correct horse"), []byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock([]byte("correct horse"), 0); !errors.Is(err, clientlib.ErrWrongPassphrase) {
+		t.Errorf("unlocking with the old passphrase: %v", err)
+	}
+	if err := ks.Unlock([]byte("battery staple"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := ks.LoadUser(user.UserIdentifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.UserName != user.UserName || len(loaded.Certificates) != len(user.Certificates) {
+		t.Errorf("user mismatch: %q, %d certificates", loaded.UserName, len(loaded.Certificates))
+	}
+	got, _ := loaded.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	if loaded.UserCKKSKeyChain[0].Identifier != user.UserCKKSKeyChain[0].Identifier || !bytes.Equal(got, skBytes) {
+		t.Error("ckks secret key mismatch")
+	}
+	sig, err := key.Sign(loaded.UserECDSAKeyChain[0].PrivateKey, []byte("msg"))
+	if err != nil || !key.Verify(user.UserECDSAKeyChain[0].PublicKey, []byte("msg"), sig) {
+		t.Errorf("signing key mismatch: %v", err)
+	}
+
+	// 会话到期后自动锁定
+	if err = ks.Unlock([]byte("battery staple"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !ks.Locked() {
+		t.Error("keystore should be locked after the session expires")
+	}
+}
@@ -4,39 +4,79 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
 
+	"github.com/CamberLoid/Chimata/internal/calib"
 	"github.com/CamberLoid/Chimata/internal/clientlib"
 	"github.com/CamberLoid/Chimata/internal/key"
-	"github.com/CamberLoid/Chimata/internal/users"
-	"github.com/google/uuid"
-	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/CamberLoid/Chimata/internal/misc"
 )
 
 var (
 	userSender  clientlib.User
 	userReceipt clientlib.User
+
+	testCA *calib.CA
 )
 
+// 与方案相关的测试默认在 testutil.DefaultSchemeParamSets 的每个参数集下以子测试运行，见 testutil.ForEachScheme
+// 设置 CHIMATA_TEST_PARAMS 时只在该参数集（如 BGV-PN12QP109）下运行，其他测试也使用该参数集；
+// 需要服务端的测试要求服务端以相同的 -params 启动
+func TestMain(m *testing.M) {
+	if id := os.Getenv("CHIMATA_TEST_PARAMS"); id != "" {
+		if err := misc.SetParamSet(id); err != nil {
+			panic(err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "chimata-clientlib-test")
+	if err != nil {
+		panic(err)
+	}
+	if testCA, err = newTestCA(dir); err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestCA 返回测试用的 CA，吊销列表保存在 dir 下，并将其公钥设为客户端信任的 CA 公钥
+// 默认使用新生成的 CA 私钥；需要服务端验证测试用户的证书时，
+// 设置 CHIMATA_TEST_CA_KEY 为服务端信任的 CA 私钥（chimata-ca 生成的 ca.pem）路径
+func newTestCA(dir string) (*calib.CA, error) {
+	var (
+		sk  *ecdsa.PrivateKey
+		err error
+	)
+	if path := os.Getenv("CHIMATA_TEST_CA_KEY"); path != "" {
+		if _, err = os.Stat(path); err != nil {
+			return nil, fmt.Errorf("CHIMATA_TEST_CA_KEY: %v", err)
+		}
+		sk, err = key.LoadOrGenerateECDSAKeyPEM(path)
+	} else {
+		sk, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	clientlib.CAPubkey = &sk.PublicKey
+	return calib.NewCA(sk, filepath.Join(dir, "crl.json")), nil
+}
+
 func makeNewRandomUser(name string) (user clientlib.User) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	keygen := ckks.NewKeyGenerator(params)
-	user = clientlib.User{
-		*users.NewUser(),
-		"",
+	u, err := clientlib.NewUser(name)
+	if err != nil {
+		panic(err)
 	}
-	userCKKSKeyChain := new(key.CKKSKeyChain)
-	userCKKSKeyChain.Identifier = uuid.New()
-	userCKKSKeyChain.CKKSPrivateKey = keygen.GenSecretKey()
-	userCKKSKeyChain.CKKSPublicKey = keygen.GenPublicKey(userCKKSKeyChain.CKKSPrivateKey)
-	user.UserCKKSKeyChain = append(userSender.UserCKKSKeyChain, *userCKKSKeyChain)
-
-	userECDSAKeyChain := new(key.ECDSAKeyChain)
-	userECDSAKeyChain.Identifier = uuid.New()
-	userECDSAKeyChain.ECDSAPrivateKey, _ = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
-	userECDSAKeyChain.ECDSAPublicKey = &userECDSAKeyChain.ECDSAPrivateKey.PublicKey
-	user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, *userECDSAKeyChain)
-
-	user.UserName = name
+	user = *u
+
+	user.Certificates, _ = testCA.IssueCertificate(user.UserIdentifier, name,
+		user.UserECDSAKeyChain[0].PublicKey, user.UserCKKSKeyChain[0].CKKSPublicKey)
 
 	return
 }
@@ -0,0 +1,104 @@
+package clientlib
+
+// overdraft.go 包含到监管者透支密钥的 swk 的生成和注册
+// 注册后服务端可以将该用户的透支指示值重加密给监管者，见 serverlib.SwitchToAuditor；
+// 服务端还需要该公钥的重线性化密钥，见 RegisterEvaluationKey
+// swk 和服务端保存的重线性化密钥须先由监管者验证并签名，服务端不接受没有监管者签名的 swk，
+// 因此须先注册计算密钥，替换计算密钥后须重新注册 swk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+)
+
+const RegisterAuditorSwkEndpoint string = "/user/registerAuditorSwk"
+
+// RegisterAuditorSwk 从监管者获取透支公钥，为用户当前的主 CKKS 公钥生成到该公钥的 swk，
+// 连同服务端保存的该公钥的计算密钥经监管者验证签名后注册到服务端，已注册的被替换；请求由 UserECDSAKeyChain[0] 签名
+func (u User) RegisterAuditorSwk(auditorURL string) error {
+	if err := u.checkSignAvailability(); err != nil {
+		return err
+	}
+	if len(u.UserCKKSKeyChain) == 0 || u.UserCKKSKeyChain[0].CKKSPrivateKey == nil {
+		return errors.New("No CKKS Private Key found!")
+	}
+	ckks := u.UserCKKSKeyChain[0]
+	auditorPk, err := auditorlib.FetchOverdraftPublicKey(auditorURL)
+	if err != nil {
+		return fmt.Errorf("fetching auditor overdraft key failed: %w", err)
+	}
+	swk, err := misc.GenPublicSwitchingKey(ckks.CKKSPrivateKey, auditorPk)
+	if err != nil {
+		return err
+	}
+	swkBytes, err := misc.MarshalCompactSwitchingKey(swk, nil)
+	if err != nil {
+		return err
+	}
+	pkBytes, err := misc.MarshalCompactPublicKey(ckks.CKKSPublicKey, nil)
+	if err != nil {
+		return err
+	}
+	evkBytes, err := ServerGetEvaluationKeyBytes(ConfigServerURL, u.UserIdentifier, ckks.Identifier)
+	if err != nil {
+		return err
+	}
+	auditorSig, err := auditorlib.RequestSwkCertificate(auditorURL, restfulpayload.AuditorCertifySwkReq{
+		UUID:          u.UserIdentifier,
+		KeyID:         ckks.Identifier,
+		Pubkey:        base64.StdEncoding.EncodeToString(pkBytes),
+		Swk:           base64.StdEncoding.EncodeToString(swkBytes),
+		EvaluationKey: base64.StdEncoding.EncodeToString(evkBytes),
+	})
+	if err != nil {
+		return fmt.Errorf("auditor swk certification failed: %w", err)
+	}
+	sig, err := signByte(key.RegisterAuditorSwkMessage(u.UserIdentifier, ckks.Identifier, swkBytes),
+		u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	return ServerRegisterAuditorSwk(ConfigServerURL, &restfulpayload.RegisterAuditorSwkReq{
+		UUID:       u.UserIdentifier,
+		KeyID:      ckks.Identifier,
+		Swk:        base64.RawStdEncoding.EncodeToString(swkBytes),
+		SignedBy:   u.UserECDSAKeyChain[0].Identifier,
+		Sig:        base64.RawStdEncoding.EncodeToString(sig),
+		AuditorSig: base64.RawStdEncoding.EncodeToString(auditorSig),
+	})
+}
+
+// ServerRegisterAuditorSwk 向服务端提交注册到监管者的 swk 的请求
+func ServerRegisterAuditorSwk(server string, req *restfulpayload.RegisterAuditorSwkReq) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(server+RegisterAuditorSwkEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string `json:"status"`
+		Err    string `json:"err"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return err
+	}
+	if respJSON.Status != "OK" {
+		return fmt.Errorf("registering auditor swk rejected (%s): %s", resp.Status, respJSON.Err)
+	}
+	return nil
+}
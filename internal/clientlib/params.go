@@ -0,0 +1,82 @@
+package clientlib
+
+// params.go 从服务端获取参数集，加密前与本地参数集保持一致
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+)
+
+var (
+	// 已同步参数集的服务端地址，避免每次加密前都请求 /params
+	paramsSyncedServer string
+	paramsMu           sync.Mutex
+)
+
+// FetchParams 请求服务端使用的参数集，并检查与本地注册的同名参数集一致
+func FetchParams(server string) (info misc.ParamSetInfo, err error) {
+	resp, err := http.Get(server + ParamsEndpoint)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string            `json:"status"`
+		Err    string            `json:"err"`
+		Params misc.ParamSetInfo `json:"params"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return info, err
+	}
+	if respJSON.Status != "OK" {
+		return info, errors.New("fetching parameters failed: " + respJSON.Err)
+	}
+
+	info = respJSON.Params
+	err = info.Validate()
+	return
+}
+
+// SyncParams 获取服务端参数集并切换本地参数集
+func SyncParams(server string) error {
+	info, err := FetchParams(server)
+	if err != nil {
+		return err
+	}
+	return misc.SetParamSet(info.ID)
+}
+
+// EnsureParams 在加密前调用，每个服务端只同步一次
+func EnsureParams(server string) error {
+	paramsMu.Lock()
+	defer paramsMu.Unlock()
+	if paramsSyncedServer == server {
+		return nil
+	}
+	if err := SyncParams(server); err != nil {
+		return fmt.Errorf("parameters of %s: %w", server, err)
+	}
+	paramsSyncedServer = server
+	return nil
+}
+
+// checkUserKeyParams 检查用户的 CKKS 公钥是否属于当前参数集
+func (u User) checkUserKeyParams() error {
+	if len(u.UserCKKSKeyChain) == 0 {
+		return errors.New("no ckks key found")
+	}
+	pk, err := u.UserCKKSKeyChain[0].CKKSPublicKey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err = misc.CheckPublicKey(pk); err != nil {
+		return fmt.Errorf("ckks key of user %s: %w", u.UserName, err)
+	}
+	return nil
+}
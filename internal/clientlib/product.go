@@ -0,0 +1,98 @@
+package clientlib
+
+// product.go 包含账户产品的查询和加入
+// 加入产品后服务端按期对余额计息、收费，每笔记为一条交易，见 serverlib.AccrualProduct
+// 计息消耗余额密文的层数，GetBalance 返回 refreshRequired 时应刷新余额
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+)
+
+const (
+	ProductsEndpoint      string = "/products"
+	EnrollProductEndpoint string = "/account/enroll"
+)
+
+// Product 为服务端 /products 返回的账户产品，字段同 serverlib.AccrualProduct
+type Product struct {
+	ID           string        `json:"id"`
+	InterestRate float64       `json:"interestRate,omitempty"`
+	Fee          float64       `json:"fee,omitempty"`
+	Asset        string        `json:"asset,omitempty"`
+	Period       time.Duration `json:"period"`
+}
+
+// FetchProducts 请求服务端的账户产品列表
+func FetchProducts(server string) (products []Product, err error) {
+	resp, err := http.Get(server + ProductsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status   string    `json:"status"`
+		Err      string    `json:"err"`
+		Products []Product `json:"products"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, fmt.Errorf("fetching products failed: %s", respJSON.Err)
+	}
+	return respJSON.Products, nil
+}
+
+// EnrollProduct 加入（enrolled 为 true）或退出产品 product，请求由 UserECDSAKeyChain[0] 签名
+// 返回用户当前加入的全部产品
+func (u User) EnrollProduct(product string, enrolled bool) (products []string, err error) {
+	if err = u.checkSignAvailability(); err != nil {
+		return nil, err
+	}
+	timestamp, nonce := time.Now().Unix(), uuid.New()
+	sig, err := signByte(key.EnrollProductMessage(u.UserIdentifier, product, enrolled, timestamp, nonce),
+		u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(&restfulpayload.EnrollProductReq{
+		UUID:      u.UserIdentifier,
+		Product:   product,
+		Enrolled:  enrolled,
+		TimeStamp: timestamp,
+		Nonce:     nonce,
+		SignedBy:  u.UserECDSAKeyChain[0].Identifier,
+		Sig:       base64.RawStdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(ConfigServerURL+EnrollProductEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status   string   `json:"status"`
+		Err      string   `json:"err"`
+		Products []string `json:"products"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, fmt.Errorf("enrolling product rejected (%s): %s", resp.Status, respJSON.Err)
+	}
+	return respJSON.Products, nil
+}
@@ -0,0 +1,199 @@
+package clientlib
+
+// recover.go 包含由助记词生成和恢复用户密钥
+// 私钥由助记词确定性地派生，见 key.SeedKeyGenerator
+// 恢复时从服务端获取用户已注册的公钥，逐个序号派生私钥并核对，再以 CA 签发的证书链验证主公钥，
+// 服务端不能以其他用户的公钥冒充
+//
+// 由助记词派生的用户轮换 CKKS 密钥时派生下一个序号的密钥，轮换不超过 ConfigRecoverMaxIndex 次时仍可恢复
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/users"
+	"github.com/google/uuid"
+)
+
+const (
+	GetPublicKeysEndpoint string = "/user/getPublicKeys"
+
+	// 恢复时尝试的最大密钥序号
+	DefaultRecoverMaxIndex uint32 = 16
+)
+
+var (
+	ConfigRecoverMaxIndex uint32 = DefaultRecoverMaxIndex
+
+	ErrMnemonicMismatch = errors.New("keys derived from the mnemonic do not match the registered public keys")
+)
+
+// NewUserFromMnemonic 生成新用户，私钥由助记词 mnemonic 和口令 passphrase 派生
+func NewUserFromMnemonic(name, mnemonic, passphrase string) (*User, error) {
+	seed, err := key.SeedFromMnemonic(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	g := key.NewSeedKeyGenerator(seed)
+	u, err := NewUserWithKeyGenerator(name, g)
+	if err != nil {
+		return nil, err
+	}
+	u.SeedKeyGenerator = g
+	return u, nil
+}
+
+// RecoverUser 由助记词恢复用户 id 的密钥链
+// 服务端的主 CKKS 公钥和主签名公钥必须由该助记词派生，否则返回 ErrMnemonicMismatch；
+// 其余不是由助记词派生的签名公钥（例如其他设备上随机生成的密钥）被忽略
+// 恢复的主公钥须与用户的证书链一致，需先设置 CAPubkey
+func RecoverUser(server string, id uuid.UUID, mnemonic, passphrase string) (*User, error) {
+	seed, err := key.SeedFromMnemonic(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if err = EnsureParams(server); err != nil {
+		return nil, err
+	}
+	registered, err := ServerGetPublicKeys(server, id)
+	if err != nil {
+		return nil, err
+	}
+	if registered.UserIdentifier != id {
+		return nil, fmt.Errorf("server returned public keys of user %v, expected %v", registered.UserIdentifier, id)
+	}
+	g := key.NewSeedKeyGenerator(seed)
+
+	u := &User{User: users.User{UserIdentifier: registered.UserIdentifier, UserName: registered.UserName}}
+	ckks, err := recoverCKKSKey(g, registered.UserCKKSKeyChain[0])
+	if err != nil {
+		return nil, err
+	}
+	u.UserCKKSKeyChain = append(u.UserCKKSKeyChain, *ckks)
+
+	for i, kc := range registered.UserECDSAKeyChain {
+		sk, err := recoverSigningKey(g, kc)
+		if err != nil {
+			return nil, err
+		}
+		if sk == nil {
+			// 主签名公钥在前
+			if i == 0 {
+				return nil, fmt.Errorf("%w: signing key %v", ErrMnemonicMismatch, kc.Identifier)
+			}
+			continue
+		}
+		kc.PrivateKey = sk
+		u.UserECDSAKeyChain = append(u.UserECDSAKeyChain, kc)
+	}
+
+	if u.Certificates, err = ServerGetCertificates(server, id); err != nil {
+		return nil, fmt.Errorf("failed to get certificate of user %v: %v", id, err)
+	}
+	if err = u.VerifyCertificate(); err != nil {
+		return nil, err
+	}
+	// 用户名以证书为准
+	u.UserName = u.Certificates[0].Name
+	// recoverCKKSKey 之后 g.CKKSIndex 为主 CKKS 密钥的序号
+	u.SeedKeyGenerator = g
+	return u, nil
+}
+
+func recoverCKKSKey(g *key.SeedKeyGenerator, registered key.CKKSKeyChain) (*key.CKKSKeyChain, error) {
+	for g.CKKSIndex = 0; g.CKKSIndex < ConfigRecoverMaxIndex; g.CKKSIndex++ {
+		sk, err := g.CKKSSecretKey()
+		if err != nil {
+			return nil, err
+		}
+		if checkCKKSKeyPair(sk, registered.CKKSPublicKey) != nil {
+			continue
+		}
+		registered.CKKSPrivateKey = sk
+		registered.CKKSEvaluationKey = g.GenEvaluationKey(sk)
+		return &registered, nil
+	}
+	return nil, fmt.Errorf("%w: CKKS key %v", ErrMnemonicMismatch, registered.Identifier)
+}
+
+// recoverSigningKey 返回与 registered 公钥一致的派生私钥，没有时返回 nil
+func recoverSigningKey(g *key.SeedKeyGenerator, registered key.ECDSAKeyChain) (crypto.Signer, error) {
+	pk, ok := registered.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", key.ErrUnsupportedSigAlgorithm, registered.PublicKey)
+	}
+	for g.SigIndex = 0; g.SigIndex < ConfigRecoverMaxIndex; g.SigIndex++ {
+		sk, err := g.SigningKey(registered.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if pk.Equal(sk.Public()) {
+			return sk, nil
+		}
+	}
+	return nil, nil
+}
+
+// ServerGetPublicKeys 从服务端获取用户的主 CKKS 公钥和全部签名公钥，主签名公钥在前
+func ServerGetPublicKeys(server string, target uuid.UUID) (*users.User, error) {
+	payload, err := json.Marshal(restfulpayload.RegisterUserReq{UUID: target})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(server+GetPublicKeysEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status      string                            `json:"status"`
+		Err         string                            `json:"err"`
+		UUID        uuid.UUID                         `json:"uuid"`
+		Name        string                            `json:"name"`
+		CKKSKeyID   uuid.UUID                         `json:"ckksKeyID"`
+		CKKS_pubkey string                            `json:"ckks_pubkey"`
+		ECDSAKeys   []restfulpayload.SigningPublicKey `json:"ecdsaKeys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+	if len(respJSON.ECDSAKeys) == 0 {
+		return nil, fmt.Errorf("no signing key found for user %v", target)
+	}
+
+	u := &users.User{UserIdentifier: respJSON.UUID, UserName: respJSON.Name}
+	pkBytes, err := base64.RawStdEncoding.DecodeString(respJSON.CKKS_pubkey)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := misc.UnmarshalPublicKey(pkBytes)
+	if err != nil {
+		return nil, err
+	}
+	u.UserCKKSKeyChain = []key.CKKSKeyChain{{Identifier: respJSON.CKKSKeyID, CKKSPublicKey: pk}}
+
+	for _, k := range respJSON.ECDSAKeys {
+		data, err := base64.RawStdEncoding.DecodeString(k.ECDSA_pubkey)
+		if err != nil {
+			return nil, err
+		}
+		pk, alg, err := key.UnmarshalSigningPublicKeyAs(data, k.ECDSAAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		u.UserECDSAKeyChain = append(u.UserECDSAKeyChain, key.ECDSAKeyChain{Identifier: k.KeyID, Algorithm: alg, PublicKey: pk})
+	}
+	return u, nil
+}
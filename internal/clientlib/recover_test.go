@@ -0,0 +1,195 @@
+package clientlib_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+)
+
+func TestMnemonicKeyDerivation(t *testing.T) {
+	mnemonic, err := key.NewMnemonic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = key.SeedFromMnemonic(mnemonic+" abandon", ""); !errors.Is(err, key.ErrInvalidMnemonic) {
+		t.Errorf("invalid mnemonic: %v", err)
+	}
+
+	a, err := clientlib.NewUserFromMnemonic("Alice", mnemonic, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := clientlib.NewUserFromMnemonic("Alice", mnemonic, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := clientlib.NewUserFromMnemonic("Alice", mnemonic, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skA, _ := a.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	skB, _ := b.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	skC, _ := c.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	if !bytes.Equal(skA, skB) || a.UserCKKSKeyChain[0].Identifier != b.UserCKKSKeyChain[0].Identifier {
+		t.Error("CKKS key derivation is not deterministic")
+	}
+	if bytes.Equal(skA, skC) {
+		t.Error("different passphrases derived the same CKKS key")
+	}
+	pkA := key.MarshalSigningPublicKey(a.UserECDSAKeyChain[0].PublicKey)
+	if !bytes.Equal(pkA, key.MarshalSigningPublicKey(b.UserECDSAKeyChain[0].PublicKey)) ||
+		a.UserECDSAKeyChain[0].Identifier != b.UserECDSAKeyChain[0].Identifier {
+		t.Error("signing key derivation is not deterministic")
+	}
+
+	// 派生的私钥与公钥匹配，且可以正常加解密
+	params := misc.GetRLWEParams()
+	if err = key.CheckCKKSKeyPair(params, a.UserCKKSKeyChain[0].CKKSPrivateKey, b.UserCKKSKeyChain[0].CKKSPublicKey); err != nil {
+		t.Error(err)
+	}
+	if err = key.CheckCKKSKeyPair(params, c.UserCKKSKeyChain[0].CKKSPrivateKey, a.UserCKKSKeyChain[0].CKKSPublicKey); err == nil {
+		t.Error("mismatched key pair passed the check")
+	}
+	if ok, err := testEncryptAndDecryptAmount(a.UserCKKSKeyChain[0].CKKSPrivateKey, a.UserCKKSKeyChain[0].CKKSPublicKey); !ok {
+		t.Errorf("derived key failed to decrypt: %v", err)
+	}
+
+	g := key.NewSeedKeyGenerator(nil)
+	for _, alg := range key.SupportedSigAlgorithms {
+		g.SigAlgorithm = alg
+		kc, err := g.GenerateUserECDSAKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := key.Sign(kc.PrivateKey, []byte("msg"))
+		if err != nil || !key.Verify(kc.PublicKey, []byte("msg"), sig) {
+			t.Errorf("%s: derived key failed to sign: %v", alg, err)
+		}
+	}
+}
+
+func TestRecoverUser(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	mnemonic, _ := key.NewMnemonic()
+	u, err := clientlib.NewUserFromMnemonic("Carol", mnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.RegisterUser(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 第二个派生的设备密钥可以恢复，随机生成的设备密钥被忽略
+	g := key.NewSeedKeyGenerator(mustSeed(t, mnemonic))
+	g.SigIndex, g.SigAlgorithm = 1, key.SigEd25519
+	derived, err := g.GenerateUserECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random, err := key.LocalKeyGenerator{}.GenerateUserECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kc := range []*key.ECDSAKeyChain{derived, random} {
+		if err = u.AddECDSAKey(kc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := clientlib.RecoverUser(clientlib.ConfigServerURL, u.UserIdentifier, mnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserName != "Carol" || got.UserCKKSKeyChain[0].Identifier != u.UserCKKSKeyChain[0].Identifier {
+		t.Errorf("recovered %q with CKKS key %v", got.UserName, got.UserCKKSKeyChain[0].Identifier)
+	}
+	want, _ := u.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	sk, _ := got.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	if !bytes.Equal(sk, want) {
+		t.Error("recovered CKKS secret key differs")
+	}
+	if len(got.UserECDSAKeyChain) != 2 || got.UserECDSAKeyChain[0].Identifier != u.UserECDSAKeyChain[0].Identifier ||
+		got.UserECDSAKeyChain[1].Identifier != derived.Identifier {
+		t.Fatalf("recovered %d signing keys", len(got.UserECDSAKeyChain))
+	}
+	if balance, err := got.GetBalance(); err != nil || balance != 0 {
+		t.Errorf("recovered user got balance %f: %v", balance, err)
+	}
+	for i, want := range []*key.ECDSAKeyChain{&u.UserECDSAKeyChain[0], derived} {
+		sig, err := key.Sign(got.UserECDSAKeyChain[i].PrivateKey, []byte("msg"))
+		if err != nil || !key.Verify(want.PublicKey, []byte("msg"), sig) {
+			t.Errorf("recovered signing key %d failed to sign: %v", i, err)
+		}
+	}
+
+	// 服务端返回的公钥属于其他 UUID
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != clientlib.GetPublicKeysEndpoint {
+			httputil.NewSingleHostReverseProxy(mustParseURL(t, clientlib.ConfigServerURL)).ServeHTTP(w, req)
+			return
+		}
+		resp, err := http.Post(clientlib.ConfigServerURL+req.URL.Path, "application/json", req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		body["uuid"] = uuid.New()
+		json.NewEncoder(w).Encode(body)
+	}))
+	defer fake.Close()
+	if _, err = clientlib.RecoverUser(fake.URL, u.UserIdentifier, mnemonic, ""); err == nil {
+		t.Error("public keys of another user accepted")
+	}
+
+	// 轮换后的 CKKS 密钥由种子派生，仍可恢复
+	if err = u.RotateCKKSKey(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = clientlib.RecoverUser(clientlib.ConfigServerURL, u.UserIdentifier, mnemonic, ""); err != nil {
+		t.Fatal(err)
+	}
+	want, _ = u.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	sk, _ = got.UserCKKSKeyChain[0].CKKSPrivateKey.MarshalBinary()
+	if !bytes.Equal(sk, want) || got.SeedKeyGenerator.CKKSIndex != 1 {
+		t.Errorf("rotated CKKS key not recovered, index %d", got.SeedKeyGenerator.CKKSIndex)
+	}
+
+	other, _ := key.NewMnemonic()
+	defer func(n uint32) { clientlib.ConfigRecoverMaxIndex = n }(clientlib.ConfigRecoverMaxIndex)
+	clientlib.ConfigRecoverMaxIndex = 2
+	if _, err = clientlib.RecoverUser(clientlib.ConfigServerURL, u.UserIdentifier, other, ""); !errors.Is(err, clientlib.ErrMnemonicMismatch) {
+		t.Errorf("recovering with another mnemonic: %v", err)
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func mustSeed(t *testing.T, mnemonic string) []byte {
+	seed, err := key.SeedFromMnemonic(mnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seed
+}
@@ -0,0 +1,114 @@
+package clientlib
+
+// refresh.go 包含余额密文的刷新
+// 服务端在余额运算次数超过阈值后要求刷新，用户解密后重新加密，并签名声明金额不变
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+)
+
+// RefreshBalance 获取余额密文，解密后重新加密并提交签名的刷新声明
+// 若提交前余额发生变化，服务端会拒绝，此时返回错误，可以稍后重试
+func (u User) RefreshBalance() (r *transaction.BalanceRefresh, err error) {
+	status, err := ServerGetBalanceStatus(ConfigServerURL, u.UserIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return u.refreshBalance(status)
+}
+
+// RefreshBalanceIfRequired 仅在服务端要求时刷新余额，未刷新时返回 nil
+func (u User) RefreshBalanceIfRequired() (r *transaction.BalanceRefresh, err error) {
+	status, err := ServerGetBalanceStatus(ConfigServerURL, u.UserIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	if !status.RefreshRequired {
+		return nil, nil
+	}
+	return u.refreshBalance(status)
+}
+
+func (u User) refreshBalance(status *BalanceStatus) (r *transaction.BalanceRefresh, err error) {
+	if err = u.checkSignAvailability(); err != nil {
+		return nil, err
+	}
+	amount, err := u.DecryptAmountFromCT(status.Balance)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := EncryptAmount(amount, u.UserCKKSKeyChain[0].CKKSPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if r, err = transaction.NewBalanceRefresh(u.UserIdentifier, status.Raw, ct); err != nil {
+		return nil, err
+	}
+	if err = r.Sign(u.UserECDSAKeyChain[0].PrivateKey); err != nil {
+		return nil, err
+	}
+
+	if err = ServerRefreshBalance(ConfigServerURL, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ServerRefreshBalance 向服务端提交余额刷新声明
+func ServerRefreshBalance(server string, r *transaction.BalanceRefresh) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(server+BalanceRefreshEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string `json:"status"`
+		Err    string `json:"err"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return err
+	}
+	if respJSON.Status != "OK" {
+		return fmt.Errorf("balance refresh rejected (%s): %s", resp.Status, respJSON.Err)
+	}
+	return nil
+}
+
+// ServerGetBalanceRefreshes 获取用户的全部余额刷新声明
+func ServerGetBalanceRefreshes(server string, target uuid.UUID) (refreshes []*transaction.BalanceRefresh, err error) {
+	payload, err := json.Marshal(GetBalanceJSON{UserUUID: target})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(server+BalanceRefreshesEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status    string                        `json:"status"`
+		Err       string                        `json:"err"`
+		Refreshes []*transaction.BalanceRefresh `json:"refreshes"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+	return respJSON.Refreshes, nil
+}
@@ -0,0 +1,127 @@
+package clientlib
+
+// rotation.go 包含 CKKS 密钥轮换
+// 用户生成新的 CKKS 密钥对，向 CA 申请新证书，并提交旧私钥到新私钥的 swk，
+// 服务端据此重加密余额和待处理交易的密文
+//
+// 轮换后：
+//   - UserCKKSKeyChain[0] 为新密钥，旧密钥保留在其后，用于解密历史交易
+//   - 服务端删除引用旧公钥的 swk，与其他用户之间的 swk 需要重新注册
+//   - 持有旧私钥的监管者需要重新登记新私钥
+//
+// 由助记词派生的用户以种子派生下一个序号的新密钥，仍可由助记词恢复；其他用户生成随机密钥
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+)
+
+const (
+	RotateCKKSKeyEndpoint string = "/user/rotateCKKSKey"
+)
+
+// RotateCKKSKey 轮换用户的 CKKS 密钥
+// 若提交前余额发生变化，服务端会拒绝，此时返回错误，本地密钥不变，可以稍后重试
+func (u *User) RotateCKKSKey() error {
+	if err := u.checkSignAvailability(); err != nil {
+		return err
+	}
+	if len(u.UserCKKSKeyChain) == 0 || u.UserCKKSKeyChain[0].CKKSPrivateKey == nil {
+		return fmt.Errorf("no CKKS private key found")
+	}
+	old := u.UserCKKSKeyChain[0]
+
+	var (
+		gen     key.UserKeyGenerator = key.NewLocalKeyGenerator()
+		derived *key.SeedKeyGenerator
+	)
+	if u.SeedKeyGenerator != nil {
+		g := *u.SeedKeyGenerator
+		g.CKKSIndex++
+		gen, derived = &g, &g
+	}
+	newKey, err := gen.GenerateUserCKKSKey()
+	if err != nil {
+		return err
+	}
+	swk, seed, err := misc.GenSeededSwitchingKey(old.CKKSPrivateKey, newKey.CKKSPrivateKey)
+	if err != nil {
+		return err
+	}
+	swkBytes, err := misc.MarshalCompactSwitchingKey(swk, seed)
+	if err != nil {
+		return err
+	}
+	pkBytes, err := newKey.MarshalPublicKey()
+	if err != nil {
+		return err
+	}
+
+	// 以新密钥向 CA 申请证书，成功前不修改本地密钥
+	next := *u
+	next.UserCKKSKeyChain = append([]key.CKKSKeyChain{*newKey}, u.UserCKKSKeyChain...)
+	next.Certificates = nil
+	if err = next.RequestCertificate(ConfigCAUrl); err != nil {
+		return err
+	}
+
+	msg := key.RotateCKKSKeyMessage(u.UserIdentifier, newKey.Identifier, key.CKKSKeyFingerprint(old.CKKSPublicKey), pkBytes, swkBytes)
+	sig, err := signByte(msg, u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	keyID, err := ServerRotateCKKSKey(ConfigServerURL, &restfulpayload.RotateCKKSKeyReq{
+		UUID:         u.UserIdentifier,
+		KeyID:        newKey.Identifier,
+		CKKS_pubkey:  base64.RawStdEncoding.EncodeToString(pkBytes),
+		Swk:          base64.RawStdEncoding.EncodeToString(swkBytes),
+		Certificates: next.Certificates,
+		Sig:          base64.RawStdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return err
+	}
+
+	next.UserCKKSKeyChain[0].Identifier = keyID
+	u.UserCKKSKeyChain = next.UserCKKSKeyChain
+	u.Certificates = next.Certificates
+	if derived != nil {
+		u.SeedKeyGenerator = derived
+	}
+	return nil
+}
+
+// ServerRotateCKKSKey 向服务端提交密钥轮换请求，返回新公钥的 ID
+func ServerRotateCKKSKey(server string, req *restfulpayload.RotateCKKSKeyReq) (keyID uuid.UUID, err error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	resp, err := http.Post(server+RotateCKKSKeyEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		Status string    `json:"status"`
+		Err    string    `json:"err"`
+		KeyID  uuid.UUID `json:"keyID"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return uuid.Nil, err
+	}
+	if respJSON.Status != "OK" {
+		return uuid.Nil, fmt.Errorf("key rotation rejected (%s): %s", resp.Status, respJSON.Err)
+	}
+	return respJSON.KeyID, nil
+}
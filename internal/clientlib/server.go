@@ -11,7 +11,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/restfulpayload"
 	"github.com/CamberLoid/Chimata/internal/transaction"
 	"github.com/google/uuid"
@@ -26,6 +29,12 @@ const (
 	GetBalanceEndpoint         string = "/user/getBalance"
 	RegisterUserEndpoint       string = "/register/user"
 	RegisterSwkEndpoint        string = "/register/swk"
+	SwkStatusEndpoint          string = "/swk/status"
+	ParamsEndpoint             string = "/params"
+	BalanceRefreshEndpoint     string = "/balance/refresh"
+	BalanceRefreshesEndpoint   string = "/balance/getRefreshes"
+	AssetsEndpoint             string = "/assets"
+	UserTransactionsEndpoint   string = "/user/getTransaction"
 )
 
 var (
@@ -38,7 +47,16 @@ type HTTPRequestJSON struct {
 }
 
 type GetBalanceJSON struct {
-	UserUUID [16]byte `json:"useruuid"`
+	UserUUID uuid.UUID `json:"uuid"`
+}
+
+// BalanceStatus 是 /user/getBalance 的返回内容
+// Raw 为服务端保存的余额密文，刷新余额时需要原样提交
+type BalanceStatus struct {
+	Balance         *rlwe.Ciphertext
+	Raw             []byte
+	Operations      int64
+	RefreshRequired bool
 }
 
 // --- 注册部分 ---
@@ -51,16 +69,48 @@ func (u *User) RegisterUser() error {
 	}
 	request.UUID = u.UserIdentifier
 	request.Name = u.UserName
-	pk, err := u.UserCKKSKeyChain[0].CKKSPublicKey.MarshalBinary()
+	request.CKKSKeyID = u.UserCKKSKeyChain[0].Identifier
+	request.ECDSAKeyID = u.UserECDSAKeyChain[0].Identifier
+
+	// 密钥须与服务端参数集一致
+	if err = EnsureParams(ConfigServerURL); err != nil {
+		return err
+	}
+	if err = u.checkUserKeyParams(); err != nil {
+		return err
+	}
+	pk, err := u.UserCKKSKeyChain[0].MarshalPublicKey()
 	if err != nil {
 		return err
 	}
 	request.CKKS_pubkey = base64.RawStdEncoding.EncodeToString(pk)
-	epk, err := x509.MarshalPKIXPublicKey(u.UserECDSAKeyChain[0].ECDSAPublicKey)
+	epk, err := x509.MarshalPKIXPublicKey(u.UserECDSAKeyChain[0].PublicKey)
 	if err != nil {
 		return err
 	}
 	request.ECDSA_pubkey = base64.RawStdEncoding.EncodeToString(epk)
+	request.ECDSAAlgorithm = string(u.UserECDSAKeyChain[0].Algorithm)
+
+	// 没有证书时向 CA 申请
+	if len(u.Certificates) == 0 {
+		if err = u.RequestCertificate(ConfigCAUrl); err != nil {
+			return err
+		}
+	}
+	request.Certificates = u.Certificates
+
+	// 以证书中的签名公钥签名，证明持有私钥
+	if err = u.checkSignAvailability(); err != nil {
+		return err
+	}
+	request.TimeStamp = time.Now().Unix()
+	request.Nonce = uuid.New()
+	sig, err := signByte(key.RegisterUserMessage(request.UUID, request.Name, request.CKKSKeyID, request.ECDSAKeyID,
+		pk, epk, request.TimeStamp, request.Nonce), u.UserECDSAKeyChain[0].PrivateKey)
+	if err != nil {
+		return err
+	}
+	request.Sig = base64.RawStdEncoding.EncodeToString(sig)
 
 	jsonBytes, err := json.Marshal(request)
 	if err != nil {
@@ -77,9 +127,29 @@ func (u *User) RegisterUser() error {
 	return nil
 }
 
+// RegisterSwk 注册当前纪元的 swk
 func RegisterSwk(userIn, userOut uuid.UUID, swk *rlwe.SwitchingKey) error {
+	return RegisterSwkWithEpoch(userIn, userOut, swk, 0)
+}
+
+// RegisterSwkWithEpoch 注册指定纪元的 swk，epoch 为 0 时表示当前纪元
+// 服务端只接受当前纪元和下一纪元
+func RegisterSwkWithEpoch(userIn, userOut uuid.UUID, swk *rlwe.SwitchingKey, epoch int64) error {
+	return RegisterSeededSwkWithEpoch(userIn, userOut, swk, nil, epoch)
+}
+
+// RegisterSeededSwkWithEpoch 与 RegisterSwkWithEpoch 相同，seed 为 misc.GenSeededSwitchingKey 返回的种子
+// 带种子时只上传 swk 的一半，seed 为 nil 时上传完整的 swk
+func RegisterSeededSwkWithEpoch(userIn, userOut uuid.UUID, swk *rlwe.SwitchingKey, seed []byte, epoch int64) error {
+	return RegisterSwkForKeys(userIn, userOut, uuid.Nil, uuid.Nil, swk, seed, epoch)
+}
+
+// RegisterSwkForKeys 与 RegisterSeededSwkWithEpoch 相同，并指明 swk 两端的 CKKS 公钥 ID
+// pkIn、pkOut 为零值时服务端使用双方当前的主公钥；
+// 指明公钥 ID 可以避免对方轮换密钥后，以旧公钥生成的 swk 被登记到新公钥上
+func RegisterSwkForKeys(userIn, userOut, pkIn, pkOut uuid.UUID, swk *rlwe.SwitchingKey, seed []byte, epoch int64) error {
 	req := new(restfulpayload.RegisterSwkReq)
-	swkBytes, err := swk.MarshalBinary()
+	swkBytes, err := misc.MarshalCompactSwitchingKey(swk, seed)
 	if err != nil {
 		return err
 	}
@@ -89,6 +159,9 @@ func RegisterSwk(userIn, userOut uuid.UUID, swk *rlwe.SwitchingKey) error {
 	req.UserIn = userIn
 	req.UserOut = userOut
 	req.Swk = swkBase64
+	req.Epoch = epoch
+	req.PKIn = pkIn
+	req.PKOut = pkOut
 
 	jsonBytes, err := json.Marshal(req)
 	if err != nil {
@@ -143,11 +216,10 @@ func (u *User) createTransferJob(t *transaction.Transaction, server string) (new
 
 	// 将 JSON 格式的交易信息发送到服务端
 	resp, err := http.Post(server, "application/json", bytes.NewBuffer(payload))
-	defer resp.Body.Close()
-
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
 	newT, err = UnmarshalTransactionFromResponse(resp)
 
@@ -165,48 +237,61 @@ func (u *User) CreateReceiveJob(target User) error {
 // "status": "OK", "Failed"
 // "balance" : rlwe.ciphertext
 func ServerGetBalance(server string, target uuid.UUID) (balance *rlwe.Ciphertext, err error) {
-	var (
-		jsonData map[string]interface{}
-	)
-
-	server, err = url.JoinPath(server, GetBalanceEndpoint)
+	status, err := ServerGetBalanceStatus(server, target)
 	if err != nil {
 		return nil, err
 	}
+	return status.Balance, nil
+}
+
+// ServerGetBalanceStatus 获取余额密文以及余额自上次加密以来的运算次数
+func ServerGetBalanceStatus(server string, target uuid.UUID) (status *BalanceStatus, err error) {
+	var jsonData struct {
+		Status          string `json:"status"`
+		Err             string `json:"err"`
+		Balance         string `json:"balance"`
+		Operations      int64  `json:"operations"`
+		RefreshRequired bool   `json:"refreshRequired"`
+	}
 
-	payload, err := json.Marshal(GetBalanceJSON{UserUUID: target})
+	server, err = url.JoinPath(server, GetBalanceEndpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := http.NewRequest("GET", server, bytes.NewBuffer(payload))
-
+	payload, err := json.Marshal(GetBalanceJSON{UserUUID: target})
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&jsonData)
+	resp, err := http.Post(server, "application/json", bytes.NewBuffer(payload))
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if err = CheckIfOK(jsonData); err != nil {
+	if err = json.NewDecoder(resp.Body).Decode(&jsonData); err != nil {
 		return nil, err
 	}
-
-	balanceString := jsonData["balance"].(string)
-	if balanceString == "" {
+	if jsonData.Status != "OK" {
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status, jsonData.Err)
+	}
+	if jsonData.Balance == "" {
 		return nil, errors.New("balance not found")
 	}
 
-	balance = new(rlwe.Ciphertext)
-	balanceBytes, err := base64.StdEncoding.DecodeString(balanceString)
-	if err != nil {
+	status = &BalanceStatus{
+		Operations:      jsonData.Operations,
+		RefreshRequired: jsonData.RefreshRequired,
+	}
+	if status.Raw, err = base64.StdEncoding.DecodeString(jsonData.Balance); err != nil {
+		return nil, err
+	}
+	if status.Balance, err = misc.UnmarshalCiphertext(status.Raw); err != nil {
 		return nil, err
 	}
-	err = balance.UnmarshalBinary(balanceBytes)
 
-	return
+	return status, nil
 }
 
 // --- 接受转账 （Accept Transaction）部分 ---
@@ -1,23 +1,34 @@
 package clientlib_test
 
 import (
+	"encoding/base64"
 	"fmt"
 	"math"
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/CamberLoid/Chimata/internal/auditorlib"
 	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/key"
 	"github.com/CamberLoid/Chimata/internal/misc"
-	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
+// checkServerAvailabilities 在服务端可用时同步其资产注册表，范围证明须覆盖全部已注册的槽位
 func checkServerAvailabilities() bool {
 	resp, err := http.Get("http://127.0.0.1:16001/version")
 	if err != nil {
 		return false
 	}
-	return resp.Status == "200 OK"
+	if resp.Status != "200 OK" {
+		return false
+	}
+	return clientlib.SyncAssets(clientlib.ConfigServerURL) == nil
 }
 
 func testCreateTransferJobBySenderPK() error {
@@ -27,11 +38,24 @@ func testCreateTransferJobBySenderPK() error {
 	if err != nil {
 		return err
 	}
-	_, err = userSender.CreateTransferJob(tx)
+	_, err = settleBySenderPK(&userSender, &userReceipt, tx)
+	return err
+}
+
+// settleBySenderPK 提交 bySenderPK 交易，由接收方检查范围证明后确认记账
+// 服务端以 -sender-pk-direct-settle 启动时交易已直接记账
+func settleBySenderPK(from, to *clientlib.User, tx *transaction.Transaction) (*transaction.Transaction, error) {
+	pending, err := from.CreateTransferJob(tx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if pending.ConfirmingPhase == "confirmed" {
+		return pending, nil
+	}
+	if _, err = to.AcceptTransactionByTransaction(pending); err != nil {
+		return nil, err
+	}
+	return pending, to.CreateConfirmTransactionTask(pending)
 }
 
 func testCreateTransferJobByReceiptPK() error {
@@ -49,8 +73,7 @@ func testCreateTransferJobByReceiptPK() error {
 	}
 
 	// Check if amount is correct
-	ctSender := new(rlwe.Ciphertext)
-	err = ctSender.UnmarshalBinary(txNew.CTSender)
+	ctSender, err := misc.UnmarshalCiphertext(txNew.CTSender)
 	if err != nil {
 		return err
 	}
@@ -86,6 +109,35 @@ func TestCreateTransferJobBySenderPK(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+
+	// 接收方确认前不记账，且同一交易不能重复确认
+	tx, err := userSender.TransferBySenderPK(&userReceipt, 12.34)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := userSender.CreateTransferJob(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.ConfirmingPhase == "confirmed" {
+		t.Skip("server settles bySenderPK transfers directly")
+	}
+	before, _ := userReceipt.GetBalance()
+	if _, err = userReceipt.AcceptTransactionByTransaction(pending); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := userReceipt.GetBalance(); b != before {
+		t.Errorf("balance changed before confirming: %v -> %v", before, b)
+	}
+	if err = userReceipt.CreateConfirmTransactionTask(pending); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := userReceipt.GetBalance(); math.Abs(b-before-12.34) > 0.01 {
+		t.Errorf("expected balance %v after confirming, got %v", before+12.34, b)
+	}
+	if err = userReceipt.CreateConfirmTransactionTask(pending); err == nil {
+		t.Error("confirming a transaction twice should be rejected")
+	}
 }
 
 func TestCreateTransferJobByReceiptPK(t *testing.T) {
@@ -120,7 +172,26 @@ func TestRegisterUser(t *testing.T) {
 	}
 	err := testRegisterUser()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	// 已注册的 UUID 不能再次注册，否则他人可以用公开的证书重置其余额
+	if err = userSender.RegisterUser(); err == nil {
+		t.Error("registering an existing user again should be rejected")
+	}
+
+	// 签名私钥与证书中的公钥不符
+	carol := makeNewRandomUser("Carol")
+	if err = carol.RequestCertificate(clientlib.ConfigCAUrl); err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := key.NewLocalKeyGenerator().GenerateUserECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol.UserECDSAKeyChain[0].PrivateKey = stranger.PrivateKey
+	if err = carol.RegisterUser(); err == nil {
+		t.Error("registration signed by a key other than the certified one should be rejected")
 	}
 }
 
@@ -131,17 +202,20 @@ func testRegisterSwk() error {
 		return err
 	}
 
-	params := misc.GetCKKSParams()
-	keygen := ckks.NewKeyGenerator(params)
-	swk1 := keygen.GenSwitchingKey(userSender.UserCKKSKeyChain[0].CKKSPrivateKey,
+	// 一个方向使用带种子的紧凑格式，另一个方向使用完整的 swk
+	swk1, seed, err := misc.GenSeededSwitchingKey(userSender.UserCKKSKeyChain[0].CKKSPrivateKey,
 		userReceipt.UserCKKSKeyChain[0].CKKSPrivateKey)
-	err = clientlib.RegisterSwk(userSender.UserIdentifier,
+	if err != nil {
+		return err
+	}
+	err = clientlib.RegisterSeededSwkWithEpoch(userSender.UserIdentifier,
 		userReceipt.UserIdentifier,
-		swk1)
+		swk1, seed, 0)
 	if err != nil {
 		return err
 	}
 
+	keygen := rlwe.NewKeyGenerator(misc.GetRLWEParams())
 	swk2 := keygen.GenSwitchingKey(userReceipt.UserCKKSKeyChain[0].CKKSPrivateKey,
 		userSender.UserCKKSKeyChain[0].CKKSPrivateKey)
 	err = clientlib.RegisterSwk(userReceipt.UserIdentifier,
@@ -214,3 +288,530 @@ func BenchmarkCreateTransferJobByReceiptPK(b *testing.B) {
 		}
 	}
 }
+
+func TestRefreshBalance(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	if err := testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testCreateTransferJobBySenderPK(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := clientlib.ServerGetBalanceStatus(clientlib.ConfigServerURL, userSender.UserIdentifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Operations == 0 {
+		t.Error("expected balance operations to be counted")
+	}
+	amount, err := userSender.DecryptAmountFromCT(before.Balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := userSender.RefreshBalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := clientlib.ServerGetBalanceStatus(clientlib.ConfigServerURL, userSender.UserIdentifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Operations != 0 || after.RefreshRequired {
+		t.Errorf("expected operations to be reset, got %d", after.Operations)
+	}
+	if newAmount, _ := userSender.DecryptAmountFromCT(after.Balance); newAmount != amount {
+		t.Errorf("balance changed after refresh: %v -> %v", amount, newAmount)
+	}
+
+	// 基于旧余额的刷新应当被拒绝
+	if err = clientlib.ServerRefreshBalance(clientlib.ConfigServerURL, r); err == nil {
+		t.Error("stale balance refresh should be rejected")
+	}
+
+	refreshes, err := clientlib.ServerGetBalanceRefreshes(clientlib.ConfigServerURL, userSender.UserIdentifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refreshes) != 1 || refreshes[0].UUID != r.UUID {
+		t.Errorf("expected the refresh to be recorded, got %d records", len(refreshes))
+	}
+}
+
+// 需要服务端以 -asset 注册除默认资产外的资产
+func TestTransferAssets(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	if err := clientlib.SyncAssets(clientlib.ConfigServerURL); err != nil {
+		t.Fatal(err)
+	}
+	if len(clientlib.Assets.Assets) < 2 {
+		t.Skip("server has no asset other than the default one")
+	}
+	other := clientlib.Assets.Assets[1].ID
+	if err := testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+
+	amounts := map[string]float64{misc.DefaultAssetID: 12.34, other: 56.78}
+	tx, err := userSender.TransferAssetsBySenderPK(&userReceipt, amounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = settleBySenderPK(&userSender, &userReceipt, tx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user clientlib.User
+		sign float64
+	}{{userSender, -1}, {userReceipt, 1}} {
+		balances, err := c.user.GetBalances()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, amount := range amounts {
+			if balances[id] != c.sign*amount {
+				t.Errorf("balance of %s for %s: got %v, expected %v", id, c.user.UserName, balances[id], c.sign*amount)
+			}
+		}
+	}
+
+	history, err := userSender.GetTransactionHistory(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !history[0].HasAsset(other) {
+		t.Errorf("expected one %s transaction in history, got %d", other, len(history))
+	}
+	if history, _ = userSender.GetTransactionHistory(""); len(history) != 1 {
+		t.Errorf("expected one transaction in history, got %d", len(history))
+	}
+}
+
+func TestRotateCKKSKey(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	if err := testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testCreateTransferJobBySenderPK(); err != nil {
+		t.Fatal(err)
+	}
+	// 一笔待接收方接受的交易
+	pending, err := userSender.TransferByReceiptPK(&userReceipt, 1.23)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, err = userSender.CreateTransferJob(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := userReceipt.GetBalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := userReceipt.UserCKKSKeyChain[0]
+	if err = userReceipt.RotateCKKSKey(); err != nil {
+		t.Fatal(err)
+	}
+	if len(userReceipt.UserCKKSKeyChain) != 2 || userReceipt.UserCKKSKeyChain[1].CKKSPrivateKey != oldKey.CKKSPrivateKey {
+		t.Fatal("old key should be kept after rotation")
+	}
+
+	after, err := userReceipt.GetBalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(after-before) > 0.01 {
+		t.Errorf("balance changed after rotation: %v -> %v", before, after)
+	}
+
+	// 待处理交易的密文已重加密到新公钥
+	history, err := userReceipt.GetTransactionHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tx *transaction.Transaction
+	for _, h := range history {
+		if h.UUID == pending.UUID {
+			tx = h
+			continue
+		}
+		// 轮换前已完成的交易按其密钥 ID 以旧私钥解密
+		if h.CTReceiptKeyID != oldKey.Identifier {
+			t.Errorf("finished transaction should keep the old key ID, got %v", h.CTReceiptKeyID)
+		}
+		if amount, err := userReceipt.DecryptTransactionAmount(h); err != nil || math.Abs(amount-before) > 0.01 {
+			t.Errorf("history should be decrypted with the old key, got %v, %v", amount, err)
+		}
+	}
+	if tx == nil {
+		t.Fatal("pending transaction not found in history")
+	}
+	if tx.CTReceiptKeyID != userReceipt.UserCKKSKeyChain[0].Identifier || tx.SenderSignedCTKeyID != oldKey.Identifier {
+		t.Error("key IDs of the pending transaction should be updated")
+	}
+	ct, err := misc.UnmarshalCiphertext(tx.CTReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount, _ := userReceipt.DecryptAmountFromCT(ct); math.Abs(amount-1.23) > 0.01 {
+		t.Errorf("pending transaction not rotated, decrypted %v", amount)
+	}
+	if _, err = userReceipt.AcceptTransactionByTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = userReceipt.CreateConfirmTransactionTask(tx); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := userReceipt.GetBalance(); math.Abs(b-after-1.23) > 0.01 {
+		t.Errorf("expected balance %v after confirming, got %v", after+1.23, b)
+	}
+
+	// 引用旧公钥的 swk 已失效，重新注册前以 bySenderPK 转入会失败
+	if err = testCreateTransferJobBySenderPK(); err == nil {
+		t.Error("swk of the old key should be invalidated")
+	}
+}
+
+func TestDeviceECDSAKey(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	if err := testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+
+	deviceKey, err := key.NewLocalKeyGenerator().GenerateUserECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = userSender.AddECDSAKey(deviceKey); err != nil {
+		t.Fatal(err)
+	}
+	device := userSender
+	device.UserECDSAKeyChain = append([]key.ECDSAKeyChain{*deviceKey}, userSender.UserECDSAKeyChain...)
+
+	tx, err := device.TransferBySenderPK(&userReceipt, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := device.CreateTransferJob(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.SigCTSenderKeyID != deviceKey.Identifier || done.CTSenderKeyID != userSender.UserCKKSKeyChain[0].Identifier {
+		t.Errorf("unexpected key IDs %v, %v", done.SigCTSenderKeyID, done.CTSenderKeyID)
+	}
+
+	// 签名与指明的密钥不符
+	if tx, err = device.TransferBySenderPK(&userReceipt, 1); err != nil {
+		t.Fatal(err)
+	}
+	tx.SigCTSenderKeyID = userSender.UserECDSAKeyChain[0].Identifier
+	if _, err = device.CreateTransferJob(tx); err == nil {
+		t.Error("signature made with another key should be rejected")
+	}
+
+	// 密文以未知的公钥加密
+	if tx, err = userSender.TransferBySenderPK(&userReceipt, 1); err != nil {
+		t.Fatal(err)
+	}
+	tx.CTSenderKeyID = uuid.New()
+	if _, err = userSender.CreateTransferJob(tx); err == nil {
+		t.Error("ciphertext under an unknown key should be rejected")
+	}
+
+	// 只能由已有的密钥添加
+	stranger, _ := key.NewLocalKeyGenerator().GenerateUserECDSAKey()
+	other := userSender
+	other.UserECDSAKeyChain = []key.ECDSAKeyChain{*stranger}
+	if err = other.AddECDSAKey(deviceKey); err == nil {
+		t.Error("adding a key signed by an unknown key should be rejected")
+	}
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	defer func(alg key.SigAlgorithm) { key.UserSigAlgorithm = alg }(key.UserSigAlgorithm)
+
+	for i, alg := range key.SupportedSigAlgorithms {
+		key.UserSigAlgorithm = alg
+		if err := testRegisterSwk(); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if got := userSender.UserECDSAKeyChain[0].Algorithm; got != alg {
+			t.Fatalf("expected %s key, got %s", alg, got)
+		}
+		if err := testCreateTransferJobBySenderPK(); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+		if err := testCreateTransferJobByReceiptPK(); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+
+		// 设备密钥可以使用与主密钥不同的算法
+		other := key.SupportedSigAlgorithms[(i+1)%len(key.SupportedSigAlgorithms)]
+		deviceKey, err := key.LocalKeyGenerator{SigAlgorithm: other}.GenerateUserECDSAKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = userSender.AddECDSAKey(deviceKey); err != nil {
+			t.Fatalf("%s device key: %v", other, err)
+		}
+		device := userSender
+		device.UserECDSAKeyChain = append([]key.ECDSAKeyChain{*deviceKey}, userSender.UserECDSAKeyChain...)
+		tx, err := device.TransferBySenderPK(&userReceipt, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = device.CreateTransferJob(tx); err != nil {
+			t.Errorf("%s device key: %v", other, err)
+		}
+	}
+}
+
+// 需要服务端以 -product 注册只收费的产品，并以较短的 -accrual-interval 检查
+func TestEnrollProduct(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	products, err := clientlib.FetchProducts(clientlib.ConfigServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var product *clientlib.Product
+	for i, p := range products {
+		if p.InterestRate == 0 && p.Fee != 0 && (p.Asset == "" || p.Asset == misc.DefaultAssetID) {
+			product = &products[i]
+		}
+	}
+	if product == nil {
+		t.Skip("server has no fee-only product")
+	}
+	if err = testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := userSender.GetBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrolled, err := userSender.EnrollProduct(product.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enrolled) != 1 || enrolled[0] != product.ID {
+		t.Errorf("expected to be enrolled in %s, got %v", product.ID, enrolled)
+	}
+
+	// 等待服务端收取本期的费用
+	var fee *transaction.Transaction
+	for i := 0; i < 50 && fee == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		history, err := userSender.GetTransactionHistory("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tx := range history {
+			if tx.Sender == userSender.UserIdentifier && tx.Receipt == uuid.Nil {
+				fee = tx
+			}
+		}
+	}
+	if fee == nil {
+		t.Fatal("fee was not charged")
+	}
+	if amount, err := userSender.DecryptTransactionAmount(fee); err != nil || math.Abs(amount-product.Fee) > 0.01 {
+		t.Errorf("fee transaction: got %v (%v), expected %v", amount, err, product.Fee)
+	}
+	after, err := userSender.GetBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := after[misc.DefaultAssetID], before[misc.DefaultAssetID]-product.Fee; math.Abs(got-want) > 0.01 {
+		t.Errorf("balance after fee: got %v, expected %v", got, want)
+	}
+
+	if enrolled, err = userSender.EnrollProduct(product.ID, false); err != nil || len(enrolled) != 0 {
+		t.Errorf("leaving %s: %v, still enrolled in %v", product.ID, err, enrolled)
+	}
+	if _, err = userSender.EnrollProduct("no-such-product", true); err == nil {
+		t.Error("enrolling an unknown product should be rejected")
+	}
+	stranger, _ := key.NewLocalKeyGenerator().GenerateUserECDSAKey()
+	other := userSender
+	other.UserECDSAKeyChain = []key.ECDSAKeyChain{*stranger}
+	if _, err = other.EnrollProduct(product.ID, true); err == nil {
+		t.Error("enrolling with a request signed by an unknown key should be rejected")
+	}
+}
+
+func TestEvaluationKey(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	if err := testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clientlib.ServerGetEvaluationKey(clientlib.ConfigServerURL, userReceipt.UserIdentifier, uuid.Nil); err == nil {
+		t.Error("expected no evaluation key before registration")
+	}
+	if err := userReceipt.RegisterEvaluationKey(true, []int{1, -1}); err != nil {
+		t.Fatal(err)
+	}
+	evk, err := clientlib.ServerGetEvaluationKey(clientlib.ConfigServerURL, userReceipt.UserIdentifier, uuid.Nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evk.Rlk == nil || evk.Rtks == nil || len(evk.Rtks.Keys) != 2 {
+		t.Errorf("unexpected evaluation key %+v", evk)
+	}
+
+	// 替换为只有旋转密钥的计算密钥
+	if err = userReceipt.RegisterEvaluationKey(false, []int{2}); err != nil {
+		t.Fatal(err)
+	}
+	evk, err = clientlib.ServerGetEvaluationKey(clientlib.ConfigServerURL, userReceipt.UserIdentifier, userReceipt.UserCKKSKeyChain[0].Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evk.Rlk != nil || evk.Rtks == nil || len(evk.Rtks.Keys) != 1 {
+		t.Errorf("evaluation key was not replaced: %+v", evk)
+	}
+
+	stranger, _ := key.NewLocalKeyGenerator().GenerateUserECDSAKey()
+	other := userReceipt
+	other.UserECDSAKeyChain = []key.ECDSAKeyChain{*stranger}
+	if err = other.RegisterEvaluationKey(true, nil); err == nil {
+		t.Error("evaluation key signed by an unknown key should be rejected")
+	}
+}
+
+// TestOverdraftCheck 需要监管者以与服务端相同的参数集运行在 16003 端口，服务端以 -overdraft-auditor 指向它
+// 这样的服务端拒绝余额不足及无法检查的转账，其他测试依赖余额可以为负，应以 -run TestOverdraftCheck 单独运行
+func TestOverdraftCheck(t *testing.T) {
+	if !checkServerAvailabilities() {
+		t.Skip("server is not available")
+	}
+	if serverlib.CheckOverdraftParams() != nil {
+		t.Skip("parameter set does not support overdraft checks")
+	}
+	const auditorURL = "http://127.0.0.1:16003"
+	if _, err := auditorlib.FetchOverdraftPublicKey(auditorURL); err != nil {
+		t.Skip("auditor is not available")
+	}
+	if err := testRegisterSwk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := userSender.RegisterEvaluationKey(true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := userSender.RegisterAuditorSwk(auditorURL); err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := func(from, to *clientlib.User, amount float64) error {
+		tx, err := from.TransferBySenderPK(to, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = settleBySenderPK(from, to, tx)
+		return err
+	}
+
+	// 新用户余额为 0
+	if err := transfer(&userSender, &userReceipt, 50); err == nil {
+		t.Error("transfer from an empty balance should be rejected")
+	}
+	// 接收方没有注册 swk，无法检查，同样拒绝
+	if err := transfer(&userReceipt, &userSender, 100); err == nil {
+		t.Error("transfer from a sender without auditor swk should be rejected")
+	}
+	for _, u := range []*clientlib.User{&userSender, &userReceipt} {
+		if balance, err := u.GetBalance(); err != nil {
+			t.Fatal(err)
+		} else if balance != 0 {
+			t.Errorf("rejected transfers should not change the balance, got %v", balance)
+		}
+	}
+
+	ckks, signer := userReceipt.UserCKKSKeyChain[0], userReceipt.UserECDSAKeyChain[0]
+
+	// 以其他私钥生成的重线性化密钥维度正确，服务端可以接受，但监管者拒绝为其出具证明
+	other, err := key.NewLocalKeyGenerator().GenerateUserCKKSKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bogusBytes, err := misc.MarshalEvaluationKey(clientlib.GenEvaluationKey(other.CKKSPrivateKey, true, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bogusSig, err := key.Sign(signer.PrivateKey, key.RegisterEvaluationKeyMessage(userReceipt.UserIdentifier, ckks.Identifier, bogusBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clientlib.ServerRegisterEvaluationKey(clientlib.ConfigServerURL, &restfulpayload.RegisterEvaluationKeyReq{
+		UUID:          userReceipt.UserIdentifier,
+		KeyID:         ckks.Identifier,
+		EvaluationKey: base64.RawStdEncoding.EncodeToString(bogusBytes),
+		SignedBy:      signer.Identifier,
+		Sig:           base64.RawStdEncoding.EncodeToString(bogusSig),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = userReceipt.RegisterAuditorSwk(auditorURL); err == nil {
+		t.Error("auditor swk should not be certified together with a bogus relinearization key")
+	}
+
+	// 由用户自己而非监管者签名证明的 swk 不被接受
+	if err = userReceipt.RegisterEvaluationKey(true, nil); err != nil {
+		t.Fatal(err)
+	}
+	evkBytes, err := clientlib.ServerGetEvaluationKeyBytes(clientlib.ConfigServerURL, userReceipt.UserIdentifier, ckks.Identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditorPk, err := auditorlib.FetchOverdraftPublicKey(auditorURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swk, err := misc.GenPublicSwitchingKey(ckks.CKKSPrivateKey, auditorPk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swkBytes, err := misc.MarshalCompactSwitchingKey(swk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := key.Sign(signer.PrivateKey, key.RegisterAuditorSwkMessage(userReceipt.UserIdentifier, ckks.Identifier, swkBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := key.Sign(signer.PrivateKey,
+		key.AuditorSwkCertMessage(userReceipt.UserIdentifier, ckks.Identifier, key.CKKSKeyFingerprint(ckks.CKKSPublicKey), swkBytes, evkBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clientlib.ServerRegisterAuditorSwk(clientlib.ConfigServerURL, &restfulpayload.RegisterAuditorSwkReq{
+		UUID:       userReceipt.UserIdentifier,
+		KeyID:      ckks.Identifier,
+		Swk:        base64.RawStdEncoding.EncodeToString(swkBytes),
+		SignedBy:   signer.Identifier,
+		Sig:        base64.RawStdEncoding.EncodeToString(sig),
+		AuditorSig: base64.RawStdEncoding.EncodeToString(forged),
+	})
+	if err == nil {
+		t.Error("auditor swk without the auditor's certificate should be rejected")
+	}
+}
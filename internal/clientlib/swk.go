@@ -0,0 +1,101 @@
+package clientlib
+
+// swk.go 包含 swk 有效期查询与续期相关的函数
+// swk 按纪元轮换，客户端应当在当前纪元结束前注册下一纪元的 swk
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/restfulpayload"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	// 纪元结束前多久开始续期
+	DefaultSwkRenewBefore = 24 * time.Hour
+)
+
+// SwkStatus 为服务端 /swk/status 的返回
+// Validity 为 nil 表示没有注册过带有效期的 swk
+type SwkStatus struct {
+	CurrentEpoch  int64             `json:"currentEpoch"`
+	EpochDuration int64             `json:"epochDuration"`
+	Validity      *misc.SwkValidity `json:"validity"`
+}
+
+// GetSwkStatus 查询 userIn -> userOut 的 swk 状态
+func GetSwkStatus(userIn, userOut uuid.UUID) (status *SwkStatus, err error) {
+	payload, err := json.Marshal(restfulpayload.RegisterSwkReq{UserIn: userIn, UserOut: userOut})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(ConfigServerURL+SwkStatusEndpoint, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var respJSON struct {
+		SwkStatus
+		Status string `json:"status"`
+		Err    string `json:"err"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&respJSON); err != nil {
+		return nil, err
+	}
+	if respJSON.Status != "OK" {
+		return nil, errors.New("status is not OK! " + respJSON.Err)
+	}
+
+	return &respJSON.SwkStatus, nil
+}
+
+// NextSwkEpochToRegister 根据 swk 状态决定需要注册哪个纪元的 swk
+// 返回 0 表示暂时不需要续期
+func (s SwkStatus) NextSwkEpochToRegister(now time.Time, renewBefore time.Duration) int64 {
+	// 没有 swk，或最新的 swk 已经落后于当前纪元：立即注册当前纪元
+	if s.Validity == nil || s.Validity.Epoch < s.CurrentEpoch {
+		return s.CurrentEpoch
+	}
+	// 已经注册了下一纪元
+	if s.Validity.Epoch > s.CurrentEpoch {
+		return 0
+	}
+	// 当前纪元即将结束：注册下一纪元
+	epochEnd := (s.CurrentEpoch + 1) * s.EpochDuration
+	if epochEnd-now.Unix() <= int64(renewBefore/time.Second) {
+		return s.CurrentEpoch + 1
+	}
+	return 0
+}
+
+// RenewSwkIfNeeded 在需要时生成并注册新纪元的 swk
+// 旧的 swk 在宽限期内仍然有效，因此续期不会中断正在进行的转账
+// 返回注册的纪元，没有续期时返回 0
+func RenewSwkIfNeeded(userIn, userOut uuid.UUID, skIn, skOut *rlwe.SecretKey) (epoch int64, err error) {
+	status, err := GetSwkStatus(userIn, userOut)
+	if err != nil {
+		return 0, err
+	}
+
+	epoch = status.NextSwkEpochToRegister(time.Now(), DefaultSwkRenewBefore)
+	if epoch == 0 {
+		return 0, nil
+	}
+
+	swk, seed, err := misc.GenSeededSwitchingKey(skIn, skOut)
+	if err != nil {
+		return 0, err
+	}
+	if err = RegisterSeededSwkWithEpoch(userIn, userOut, swk, seed, epoch); err != nil {
+		return 0, err
+	}
+	return epoch, nil
+}
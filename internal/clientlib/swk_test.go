@@ -0,0 +1,44 @@
+package clientlib_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+)
+
+func TestNextSwkEpochToRegister(t *testing.T) {
+	const d = 7 * 24 * time.Hour
+	now := time.Now()
+	current := misc.SwkEpoch(now, d)
+	epochEnd := time.Unix((current+1)*int64(d/time.Second), 0)
+	validity := func(epoch int64) *misc.SwkValidity {
+		v := misc.NewSwkValidity(epoch, d, 24*time.Hour)
+		return &v
+	}
+
+	cases := []struct {
+		name     string
+		validity *misc.SwkValidity
+		now      time.Time
+		expected int64
+	}{
+		{"no swk", nil, now, current},
+		{"expired swk", validity(current - 1), now, current},
+		{"next epoch registered", validity(current + 1), now, 0},
+		{"early in epoch", validity(current), epochEnd.Add(-3 * 24 * time.Hour), 0},
+		{"epoch ending", validity(current), epochEnd.Add(-time.Hour), current + 1},
+	}
+	for _, c := range cases {
+		s := clientlib.SwkStatus{CurrentEpoch: current, EpochDuration: int64(d / time.Second), Validity: c.validity}
+		if got := s.NextSwkEpochToRegister(c.now, clientlib.DefaultSwkRenewBefore); got != c.expected {
+			t.Errorf("%s: expected epoch %d, got %d", c.name, c.expected, got)
+		}
+	}
+
+	// 相邻纪元的有效期互相重叠
+	if !validity(current).IsValidAt(epochEnd.Add(time.Hour)) {
+		t.Error("swk should still be valid in the grace period")
+	}
+}
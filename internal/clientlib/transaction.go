@@ -5,7 +5,9 @@ package clientlib
 import (
 	"errors"
 	"fmt"
+	"math"
 
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/transaction"
 	"github.com/google/uuid"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
@@ -21,10 +23,69 @@ func (u User) NewOutgoingTransaction(receipt *User) (t *transaction.Transaction,
 	return t, nil
 }
 
+// encryptTransfer 将各资产的金额加密到对应槽位，并在保留槽位写入范围证明的 nonce
+// 金额先取整到分，使解密结果与范围证明中的承诺一致
+// 输出：密文，各槽位的金额，nonce，涉及的资产 ID
+func encryptTransfer(amounts map[string]float64, pk *rlwe.PublicKey) (ct *rlwe.Ciphertext, vec []float64, nonce []byte, ids []string, err error) {
+	r := getAssets()
+	if vec, err = r.Vector(amounts); err != nil {
+		return
+	}
+	for i, amount := range vec {
+		if math.IsNaN(amount) || amount < 0 {
+			return nil, nil, nil, nil, fmt.Errorf("transfer amount %v is negative", amount)
+		}
+		vec[i] = math.Round(amount*misc.AmountMinorUnits) / misc.AmountMinorUnits
+	}
+	if nonce, err = transaction.NewRangeProofNonce(); err != nil {
+		return
+	}
+	full, err := transaction.WithRangeProofNonce(vec, nonce)
+	if err != nil {
+		return
+	}
+	if ct, err = misc.GetAmountScheme().EncryptVector(full, pk); err != nil {
+		return
+	}
+	return ct, vec, nonce, r.IDs(amounts), nil
+}
+
+// attachRangeProof 为发送方签名的密文生成范围证明，并对证明签名
+func (u User) attachRangeProof(t *transaction.Transaction, vec []float64, nonce []byte) (err error) {
+	if t.RangeProof, err = transaction.ProveAmounts(t.RangeProofCT(), vec, nonce); err != nil {
+		return err
+	}
+	t.SigRangeProof, err = u.Sign(t.RangeProof)
+	t.SigRangeProofKeyID = u.UserECDSAKeyChain[0].Identifier
+	return err
+}
+
 // TransferBySenderPK 使用发送方的密钥链对金额进行加密并签名，
+// 金额属于默认资产
 // 输出：一个新的 Transaction
 func (u User) TransferBySenderPK(receipt *User, amount float64) (t *transaction.Transaction, err error) {
-	ct, sig, err := u.makeTransferWithCKKS(u.User.UserCKKSKeyChain[0].CKKSPublicKey, amount)
+	ct, vec, nonce, _, err := encryptTransfer(map[string]float64{misc.DefaultAssetID: amount}, u.User.UserCKKSKeyChain[0].CKKSPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return u.newSenderPKTransaction(receipt, ct, vec, nonce, nil)
+}
+
+// TransferAssetsBySenderPK 与 TransferBySenderPK 相同，但一次转出多种资产
+// 输入：接收用户，各资产的金额明文，资产注册表见 EnsureAssets
+func (u User) TransferAssetsBySenderPK(receipt *User, amounts map[string]float64) (t *transaction.Transaction, err error) {
+	ct, vec, nonce, ids, err := encryptTransfer(amounts, u.User.UserCKKSKeyChain[0].CKKSPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return u.newSenderPKTransaction(receipt, ct, vec, nonce, ids)
+}
+
+func (u User) newSenderPKTransaction(receipt *User, ct *rlwe.Ciphertext, vec []float64, nonce []byte, assets []string) (t *transaction.Transaction, err error) {
+	if ct, err = compactCiphertext(ct); err != nil {
+		return nil, err
+	}
+	sig, err := u.Sign(*ct)
 	if err != nil {
 		return nil, err
 	}
@@ -33,22 +94,57 @@ func (u User) TransferBySenderPK(receipt *User, amount float64) (t *transaction.
 	if err != nil {
 		return nil, err
 	}
-	t.CTSender, err = ct.MarshalBinary()
+	t.CTSender, err = misc.MarshalCompactCiphertext(ct)
 	if err != nil {
 		return nil, err
 	}
 
 	t.SigCTSender = sig
 	t.CTSenderSignedBy = u.UserIdentifier
+	t.CTSenderKeyID = u.UserCKKSKeyChain[0].Identifier
+	t.SigCTSenderKeyID = u.UserECDSAKeyChain[0].Identifier
+	t.Assets = assets
 
+	if err = u.attachRangeProof(t, vec, nonce); err != nil {
+		return nil, err
+	}
 	return
 }
 
-// TransferBySenderPK 使用发送方的密钥链对金额进行加密并签名，
-// 输入：接收用户，金额明文
+// TransferByReceiptPK 使用接收方的公钥对金额进行加密并签名，
+// 输入：接收用户，金额明文（默认资产）
 // 输出：一个新的Transaction
 func (u User) TransferByReceiptPK(receipt *User, amount float64) (t *transaction.Transaction, err error) {
-	ct, sig, err := u.makeTransferWithCKKS(receipt.User.UserCKKSKeyChain[0].CKKSPublicKey, amount)
+	// 加密前验证对方的证书
+	if err = receipt.VerifyCertificate(); err != nil {
+		return nil, err
+	}
+
+	ct, vec, nonce, _, err := encryptTransfer(map[string]float64{misc.DefaultAssetID: amount}, receipt.User.UserCKKSKeyChain[0].CKKSPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return u.newReceiptPKTransaction(receipt, ct, vec, nonce, nil)
+}
+
+// TransferAssetsByReceiptPK 与 TransferByReceiptPK 相同，但一次转出多种资产
+func (u User) TransferAssetsByReceiptPK(receipt *User, amounts map[string]float64) (t *transaction.Transaction, err error) {
+	if err = receipt.VerifyCertificate(); err != nil {
+		return nil, err
+	}
+
+	ct, vec, nonce, ids, err := encryptTransfer(amounts, receipt.User.UserCKKSKeyChain[0].CKKSPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return u.newReceiptPKTransaction(receipt, ct, vec, nonce, ids)
+}
+
+func (u User) newReceiptPKTransaction(receipt *User, ct *rlwe.Ciphertext, vec []float64, nonce []byte, assets []string) (t *transaction.Transaction, err error) {
+	if ct, err = compactCiphertext(ct); err != nil {
+		return nil, err
+	}
+	sig, err := u.Sign(*ct)
 	if err != nil {
 		return nil, err
 	}
@@ -58,28 +154,21 @@ func (u User) TransferByReceiptPK(receipt *User, amount float64) (t *transaction
 		return nil, err
 	}
 
-	t.CTReceipt, err = ct.MarshalBinary()
+	t.CTReceipt, err = misc.MarshalCompactCiphertext(ct)
 	if err != nil {
 		return nil, err
 	}
 
 	t.SigCTReceipt = sig
 	t.CTReceiptSignedBy = u.UserIdentifier
+	t.CTReceiptKeyID = receipt.UserCKKSKeyChain[0].Identifier
+	t.SigCTReceiptKeyID = u.UserECDSAKeyChain[0].Identifier
 	t.ConfirmingPhase = "unconfirmed"
+	t.Assets = assets
 
-	// err = u.CreateTransferJob(t)
-
-	return
-}
-
-// 私有方法 makeTransferWithCKKS 将金额 amount 加密，然后签名。
-// 输入：目标公钥，金额明文
-// 输出：金额密文，签名，错误
-func (u User) makeTransferWithCKKS(pk *rlwe.PublicKey, amount float64) (ct *rlwe.Ciphertext, sig []byte, err error) {
-	// 将金额转换为 CKKS 密文
-	ct = CKKSEncryptAmount(amount, pk)
-	sig, err = u.Sign(*ct)
-
+	if err = u.attachRangeProof(t, vec, nonce); err != nil {
+		return nil, err
+	}
 	return
 }
 
@@ -95,6 +184,8 @@ func (u User) VerifyAmountIsMoreThanBalance(amount float64) (result bool, err er
 // 在服务端处理接收了转账请求后，如果需要接收方接收转账，需要提前进行重加密
 // 即，CTSender 此时被赋值为 KeySwitch(CTReceipt, swk)
 // 需要接收方对密文进行签名 "ACCEPT" + CTSender
+// bySenderPK 交易则由服务端将 CTSender 重加密为 CTReceipt，接收方对 CTReceipt 签名
+// 签名前接收方解密 CTReceipt，检查发送方的范围证明与金额一致，见 CheckTransactionRangeProof
 
 func (u User) AcceptTransaction(t interface{}) (sig []byte, err error) {
 	errText := "unrecognized transaction type, accept Transaction or [16]byte"
@@ -116,22 +207,58 @@ func (u User) AcceptTransaction(t interface{}) (sig []byte, err error) {
 }
 
 func (u User) AcceptTransactionByTransaction(t *transaction.Transaction) (sig []byte, err error) {
-	if len(t.CTSender) == 0 {
-		return nil, fmt.Errorf("CTSender is empty, please check the transaction")
+	if len(t.CTSender) == 0 || len(t.CTReceipt) == 0 {
+		return nil, fmt.Errorf("CTSender or CTReceipt is empty, please check the transaction")
+	}
+	if err = u.CheckTransactionRangeProof(t); err != nil {
+		return nil, err
+	}
+
+	// bySenderPK 交易中 CTSender 已由发送方签名
+	if t.CTSenderSignedBy == t.Sender {
+		if sig, err = signByte(t.CTReceipt, u.UserECDSAKeyChain[0].PrivateKey); err != nil {
+			return nil, err
+		}
+		t.CTReceiptSignedBy = u.UserIdentifier
+		t.SigCTReceipt = sig
+		t.SigCTReceiptKeyID = u.UserECDSAKeyChain[0].Identifier
+		return
 	}
 
 	// 生成签名
-	sig, err = signByte((t.CTSender), u.UserECDSAKeyChain[0].ECDSAPrivateKey)
+	sig, err = signByte((t.CTSender), u.UserECDSAKeyChain[0].PrivateKey)
 	if err != nil {
 		return nil, err
 	}
 
 	t.CTSenderSignedBy = u.UserIdentifier
 	t.SigCTSender = sig
+	t.SigCTSenderKeyID = u.UserECDSAKeyChain[0].Identifier
 
 	return
 }
 
+// CheckTransactionRangeProof 验证交易的范围证明，
+// 并解密交易中以该用户公钥加密的密文，检查证明中的承诺与密文中的金额一致
+// 重加密不改变明文，因此接收方解密 CTReceipt 即可检查发送方密文对应的证明
+// 与服务端一样要求证明覆盖资产注册表的全部槽位，调用前应先以 EnsureAssets 同步注册表
+func (u User) CheckTransactionRangeProof(t *transaction.Transaction) error {
+	if len(t.RangeProof) == 0 {
+		return errors.New("transaction has no range proof")
+	}
+	if err := transaction.VerifyRangeProof(t.RangeProofCT(), t.RangeProof, getAssets().Len()); err != nil {
+		return err
+	}
+
+	ct, sk, err := u.transactionCT(t)
+	if err != nil {
+		return err
+	}
+	scheme := misc.GetAmountScheme()
+	vec := scheme.DecryptVector(ct, sk, scheme.Slots())
+	return transaction.CheckRangeProofOpening(t.RangeProof, vec)
+}
+
 func (u User) AcceptTransactionByUUID(uuid uuid.UUID) (sig []byte, err error) {
 	// todo
 	t := new(transaction.Transaction)
@@ -1,14 +1,19 @@
 package clientlib_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
+	"path/filepath"
 	"testing"
 
+	"github.com/CamberLoid/Chimata/internal/calib"
 	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/testutil"
 	"github.com/CamberLoid/Chimata/internal/transaction"
-	"github.com/tuneinsight/lattigo/v4/ckks"
-	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 func checkIfSenderAndReceiptCorrect(t *transaction.Transaction) bool {
@@ -16,10 +21,12 @@ func checkIfSenderAndReceiptCorrect(t *transaction.Transaction) bool {
 }
 
 func TestTransferBySenderPK(t *testing.T) {
-	err := testTransferBySenderPK()
-	if err != nil {
-		t.Error(err)
-	}
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		err := testTransferBySenderPK()
+		if err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 func BenchmarkTransferBySenderPK(b *testing.B) {
@@ -72,10 +79,12 @@ func testTransferBySenderPK() error {
 }
 
 func TestTransferByReceiptPK(t *testing.T) {
-	err := testTransferByReceiptPK()
-	if err != nil {
-		t.Error(err)
-	}
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		err := testTransferByReceiptPK()
+		if err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 func BenchmarkTransferByReceiptPK(b *testing.B) {
@@ -119,18 +128,14 @@ func testTransferByReceiptPK() (err error) {
 
 func genUnconfirmedTransaction(amount float64) (tx *transaction.Transaction) {
 	//amount := misc.GenRandFloat()
-	params := misc.GetCKKSParams()
-	keyGen := ckks.NewKeyGenerator(params)
-	evl := ckks.NewEvaluator(params, rlwe.EvaluationKey{})
-
-	swk := keyGen.GenSwitchingKey(
+	swk := misc.GenerateSwitchingKey(
 		userReceipt.UserCKKSKeyChain[0].CKKSPrivateKey,
 		userSender.UserCKKSKeyChain[0].CKKSPrivateKey,
 	)
 
 	tx, _ = userSender.TransferByReceiptPK(&userReceipt, amount)
 	ctReceipt, _ := tx.GetReceiptCT()
-	ctSender := evl.SwitchKeysNew(ctReceipt, swk)
+	ctSender, _ := misc.GetAmountScheme().KeySwitch(ctReceipt, swk)
 	tx.CTSender, _ = ctSender.MarshalBinary()
 
 	return
@@ -165,10 +170,12 @@ func testAcceptTransactionByTransaction() (err error) {
 }
 
 func TestAcceptTransactionByTransaction(t *testing.T) {
-	err := testAcceptTransactionByTransaction()
-	if err != nil {
-		t.Error(err)
-	}
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		err := testAcceptTransactionByTransaction()
+		if err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 func BenchmarkAcceptTransactionByTransaction(b *testing.B) {
@@ -178,3 +185,94 @@ func BenchmarkAcceptTransactionByTransaction(b *testing.B) {
 		}
 	}
 }
+
+func TestTransferByReceiptPKRejectsInvalidCertificate(t *testing.T) {
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		initTestRandomUser()
+
+		// 证书绑定的是另一个用户
+		forged := userReceipt
+		forged.Certificates = makeNewRandomUser("Mallory").Certificates
+		if _, err := userSender.TransferByReceiptPK(&forged, 1); err == nil {
+			t.Error("certificate of another user accepted")
+		}
+
+		// 证书由不受信任的 CA 签发
+		sk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		untrusted := calib.NewCA(sk, filepath.Join(t.TempDir(), "crl.json"))
+		forged.Certificates, _ = untrusted.IssueCertificate(userReceipt.UserIdentifier, userReceipt.UserName,
+			userReceipt.UserECDSAKeyChain[0].PublicKey, userReceipt.UserCKKSKeyChain[0].CKKSPublicKey)
+		if _, err := userSender.TransferByReceiptPK(&forged, 1); err == nil {
+			t.Error("certificate issued by an untrusted CA accepted")
+		}
+	})
+}
+
+func TestTransferRangeProof(t *testing.T) {
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		initTestRandomUser()
+
+		tx, err := userSender.TransferByReceiptPK(&userReceipt, 12.34)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = transaction.VerifyRangeProof(tx.RangeProofCT(), tx.RangeProof, 1); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := userSender.VerifySignature(tx.RangeProof, tx.SigRangeProof); !ok {
+			t.Error("range proof is not signed by the sender")
+		}
+		if err = userReceipt.CheckTransactionRangeProof(tx); err != nil {
+			t.Fatal(err)
+		}
+
+		// 证明不能移用到其他密文
+		other, _ := userSender.TransferByReceiptPK(&userReceipt, 12.34)
+		swapped := *tx
+		swapped.CTReceipt = other.CTReceipt
+		if err = transaction.VerifyRangeProof(swapped.RangeProofCT(), swapped.RangeProof, 1); err == nil {
+			t.Error("range proof of another ciphertext accepted")
+		}
+
+		if _, err = userSender.TransferBySenderPK(&userReceipt, -1); err == nil {
+			t.Error("negative amount should be rejected")
+		}
+
+		// 加密负数金额，却对正数金额给出证明：证明本身有效，但与密文不一致
+		nonce, _ := transaction.NewRangeProofNonce()
+		vec, _ := transaction.WithRangeProofNonce([]float64{-5}, nonce)
+		ct, err := misc.GetAmountScheme().EncryptVector(vec, userReceipt.UserCKKSKeyChain[0].CKKSPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged := *tx
+		forged.CTReceipt, _ = misc.MarshalCompactCiphertext(ct)
+		if forged.RangeProof, err = transaction.ProveAmounts(forged.CTReceipt, []float64{5}, nonce); err != nil {
+			t.Fatal(err)
+		}
+		if err = transaction.VerifyRangeProof(forged.RangeProofCT(), forged.RangeProof, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err = userReceipt.CheckTransactionRangeProof(&forged); !errors.Is(err, transaction.ErrRangeProofMismatch) {
+			t.Errorf("forged range proof should be detected, got %v", err)
+		}
+		forged.CTSender = forged.CTReceipt
+		if _, err = userReceipt.AcceptTransactionByTransaction(&forged); err == nil {
+			t.Error("transaction with a forged range proof should not be accepted")
+		}
+
+		// 只证明槽位 0，在没有证明的槽位中加密负数金额
+		vec, _ = transaction.WithRangeProofNonce([]float64{5, -5}, nonce)
+		if ct, err = misc.GetAmountScheme().EncryptVector(vec, userReceipt.UserCKKSKeyChain[0].CKKSPublicKey); err != nil {
+			t.Fatal(err)
+		}
+		unproven := *tx
+		unproven.CTReceipt, _ = misc.MarshalCompactCiphertext(ct)
+		if unproven.RangeProof, err = transaction.ProveAmounts(unproven.CTReceipt, []float64{5}, nonce); err != nil {
+			t.Fatal(err)
+		}
+		if err = userReceipt.CheckTransactionRangeProof(&unproven); !errors.Is(err, transaction.ErrRangeProofMismatch) {
+			t.Errorf("nonzero unproven slot should be detected, got %v", err)
+		}
+	})
+}
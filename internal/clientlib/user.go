@@ -1,12 +1,12 @@
 package clientlib
 
 import (
-	"crypto/ecdsa"
-	"crypto/rand"
-	"crypto/sha256"
+	"crypto"
 	"errors"
 	"fmt"
 
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/users"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
@@ -18,12 +18,13 @@ type User struct {
 
 	// 服务端认证，现阶段不考虑
 	OAuth string
-}
 
-// ImportCKKSKeychainFromFile 从文件中导入 CKKS 密钥链
-// 目前不考虑
-func ImportCKKSKeychainFromFile() {
-	panic("Not implemented yet!")
+	// CA 签发的证书链，第一张为该用户的证书
+	Certificates []*key.Certificate
+
+	// 由助记词生成或恢复的用户持有种子派生器，CKKSIndex 为当前 CKKS 密钥的序号，见 RotateCKKSKey
+	// 不随密钥链导出或保存到密钥库
+	SeedKeyGenerator *key.SeedKeyGenerator
 }
 
 // --- 签名部分 ---
@@ -33,7 +34,7 @@ func (u User) Sign(ct interface{}) (sig []byte, e error) {
 	case rlwe.Ciphertext:
 		return u.SignCipherText(ct.(rlwe.Ciphertext))
 	case []byte:
-		return signByte(ct.([]byte), u.UserECDSAKeyChain[0].ECDSAPrivateKey)
+		return signByte(ct.([]byte), u.UserECDSAKeyChain[0].PrivateKey)
 	default:
 		return nil, errors.New("unknown type. Accept rlwe.Ciphertext or []byte only.")
 	}
@@ -47,50 +48,47 @@ func (u User) SignAcceptTransactionCT(ct rlwe.Ciphertext) (sig []byte, e error)
 		return nil, e
 	}
 
-	acceptCT, e := ct.MarshalBinary()
+	acceptCT, e := misc.MarshalCompactCiphertext(&ct)
 	if e != nil {
 		return nil, e
 	}
 
 	acceptCT = append([]byte("Accept+"), acceptCT...)
 
-	sig, e = signByte(acceptCT, u.UserECDSAKeyChain[0].ECDSAPrivateKey)
+	sig, e = signByte(acceptCT, u.UserECDSAKeyChain[0].PrivateKey)
 	return
 }
 
-// 对密文进行签名
+// 对密文进行签名，签名的对象为密文的紧凑格式
 func (u User) SignCipherText(ct rlwe.Ciphertext) (sig []byte, e error) {
 	// 检查是否可以签名
 	if e = u.checkSignAvailability(); e != nil {
 		return nil, e
 	}
 
-	msg, err := ct.MarshalBinary()
+	msg, err := misc.MarshalCompactCiphertext(&ct)
 
 	if err != nil {
 		panic(err)
 	}
 
-	sig, e = signByte(msg, u.UserECDSAKeyChain[0].ECDSAPrivateKey)
+	sig, e = signByte(msg, u.UserECDSAKeyChain[0].PrivateKey)
 	return
 }
 
-// signByte() 是一个 Low-level 签名方法
-func signByte(msg []byte, key *ecdsa.PrivateKey) (sig []byte, e error) {
-	hash := sha256.Sum256(msg)
-	sig, e = ecdsa.SignASN1(rand.Reader, key, hash[:])
-
-	return
+// signByte() 是一个 Low-level 签名方法，算法由私钥类型决定，见 key.Sign
+func signByte(msg []byte, sk crypto.Signer) (sig []byte, e error) {
+	return key.Sign(sk, msg)
 }
 
 // checkSignAvailability() 检查是否可以签名
 func (u User) checkSignAvailability() (e error) {
 	if u.UserECDSAKeyChain == nil {
-		return errors.New("No ECDSA KeyChain found!")
+		return errors.New("No Signing KeyChain found!")
 	}
 
-	if u.UserECDSAKeyChain[0].ECDSAPrivateKey == nil {
-		return errors.New("No ECDSA Private Key found!")
+	if u.UserECDSAKeyChain[0].PrivateKey == nil {
+		return errors.New("No Signing Private Key found!")
 	}
 	return nil
 }
@@ -100,7 +98,7 @@ func (u User) VerifyCTSignature(ct *rlwe.Ciphertext, sig []byte) (bool, error) {
 	if ct == nil {
 		return false, fmt.Errorf("no ciphertext found")
 	}
-	ctBytes, err := ct.MarshalBinary()
+	ctBytes, err := misc.MarshalCompactCiphertext(ct)
 	if err != nil {
 		return false, err
 	}
@@ -109,8 +107,7 @@ func (u User) VerifyCTSignature(ct *rlwe.Ciphertext, sig []byte) (bool, error) {
 
 // Low-level 验证签名方法
 func (u User) VerifySignature(payload []byte, sig []byte) (bool, error) {
-	hash := sha256.Sum256(payload)
-	return ecdsa.VerifyASN1(u.UserECDSAKeyChain[0].ECDSAPublicKey, hash[:], sig), nil
+	return key.Verify(u.UserECDSAKeyChain[0].PublicKey, payload, sig), nil
 }
 
 // --- 解密部分 ---
@@ -123,13 +120,13 @@ func (u User) DecryptAmountFromCT(ct *rlwe.Ciphertext) (amount float64, err erro
 		return 0, errors.New("No CKKS Private Key found!")
 	}
 
-	return CKKSDecryptAmountFromCT(ct, u.UserCKKSKeyChain[0].CKKSPrivateKey), nil
+	return DecryptAmount(ct, u.UserCKKSKeyChain[0].CKKSPrivateKey), nil
 }
 
 func (u User) GetBalance() (balance float64, err error) {
-	b, err := ServerGetBalance(DefaultServerURL, u.UserIdentifier)
+	b, err := ServerGetBalance(ConfigServerURL, u.UserIdentifier)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	return u.DecryptAmountFromCT(b)
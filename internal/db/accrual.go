@@ -0,0 +1,113 @@
+package db
+
+// accrual.go 包含账户产品和计息、收费记录的读写，计算见 serverlib.AccrualProduct
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// PutAccountProduct 使用户加入（enrolled 为 true）或退出产品 product
+func PutAccountProduct(db *sql.DB, userID uuid.UUID, product string, enrolled bool) (err error) {
+	if !enrolled {
+		_, err = db.Exec(`DELETE FROM AccountProducts WHERE user = ? AND product = ?`, userID.String(), product)
+		return
+	}
+	_, err = db.Exec(`
+		INSERT INTO AccountProducts (user, product, since) VALUES (?, ?, ?)
+		ON CONFLICT (user, product) DO NOTHING
+	`, userID.String(), product, time.Now().Unix())
+	return
+}
+
+// GetAccountProducts 查询用户加入的全部产品
+func GetAccountProducts(db *sql.DB, userID uuid.UUID) (products []string, err error) {
+	rows, err := db.Query(`SELECT product FROM AccountProducts WHERE user = ? ORDER BY product`, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p string
+		if err = rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+// GetProductAccounts 查询加入了产品 product 的全部用户
+func GetProductAccounts(db *sql.DB, product string) (users []uuid.UUID, err error) {
+	rows, err := db.Query(`SELECT user FROM AccountProducts WHERE product = ? ORDER BY since`, product)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u uuid.UUID
+		if err = rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// TransactionExists 查询交易 txUUID 是否已写入
+func TransactionExists(db *sql.DB, txUUID uuid.UUID) (exists bool, err error) {
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Transactions WHERE uuid = ?)`, txUUID.String()).Scan(&exists)
+	return
+}
+
+// ApplyAccrual 在一个事务中写入计息或收费的账本交易 tx，并将用户余额替换为 balance
+// 仅当 tx 尚未写入且当前余额与 oldBalance 一致时才写入，否则返回 applied = false，
+// 调用者可重新读取余额后重试；tx 的 ID 对每期是确定的，因此重试不会重复计息
+// 结算同样比较原余额（见 SettleBalances），因此计息后的余额不会被并发的结算覆盖，账本与余额保持一致
+func ApplyAccrual(db *sql.DB, userID uuid.UUID, oldBalance []byte, balance *rlwe.Ciphertext, tx *transaction.Transaction) (applied bool, err error) {
+	balanceBytes, err := misc.MarshalCompactCiphertext(balance)
+	if err != nil {
+		return false, err
+	}
+
+	dbTx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !applied {
+			dbTx.Rollback()
+		}
+	}()
+
+	var exists bool
+	if err = dbTx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Transactions WHERE uuid = ?)`, tx.UUID.String()).Scan(&exists); err != nil || exists {
+		return false, err
+	}
+
+	res, err := dbTx.Exec(`
+		UPDATE Users SET balance = ?, balanceOps = COALESCE(balanceOps, 0) + 1
+		WHERE uuid = ? AND balance = ?
+	`, balanceBytes, userID.String(), oldBalance)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if err = writeTransaction(dbTx, tx); err != nil {
+		return false, err
+	}
+
+	applied = true
+	err = dbTx.Commit()
+	return
+}
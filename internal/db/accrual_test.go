@@ -0,0 +1,102 @@
+package db_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+)
+
+// 计息在结算读取余额之后、写入之前完成，结算不能覆盖计息后的余额
+func TestSettleAfterAccrual(t *testing.T) {
+	database := newTestDatabase(t)
+	sk, pk := testutil.NewCKKSKeyPair()
+	sender := newTestAccount(t, database, pk, 100)
+	receipt := newTestAccount(t, database, pk, 0)
+
+	oldSender, oldReceipt := mustBalanceBytes(t, database, sender), mustBalanceBytes(t, database, receipt)
+
+	accrualTx := &transaction.Transaction{UUID: uuid.New(), Receipt: sender, ConfirmingPhase: "confirmed"}
+	applied, err := db.ApplyAccrual(database, sender, oldSender, mustAdd(t, oldSender, 1, pk), accrualTx)
+	if err != nil || !applied {
+		t.Fatalf("accrual not applied: %v", err)
+	}
+	accrued := mustBalanceBytes(t, database, sender)
+
+	swapped, err := db.SettleBalances(database,
+		db.BalanceUpdate{User: sender, OldBalance: oldSender, Balance: mustAdd(t, oldSender, -30, pk)},
+		db.BalanceUpdate{User: receipt, OldBalance: oldReceipt, Balance: mustAdd(t, oldReceipt, 30, pk)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Fatal("settlement based on the balance before accrual should not be applied")
+	}
+	if !bytes.Equal(mustBalanceBytes(t, database, sender), accrued) {
+		t.Error("settlement overwrote the accrued balance")
+	}
+	if !bytes.Equal(mustBalanceBytes(t, database, receipt), oldReceipt) {
+		t.Error("receipt balance changed although the settlement was not applied")
+	}
+
+	// 重新读取余额后结算
+	swapped, err = db.SettleBalances(database,
+		db.BalanceUpdate{User: sender, OldBalance: accrued, Balance: mustAdd(t, accrued, -30, pk)},
+		db.BalanceUpdate{User: receipt, OldBalance: oldReceipt, Balance: mustAdd(t, oldReceipt, 30, pk)},
+	)
+	if err != nil || !swapped {
+		t.Fatalf("settlement not applied: %v", err)
+	}
+	for user, want := range map[uuid.UUID]float64{sender: 71, receipt: 30} {
+		balance, err := db.GetUserBalance(database, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := misc.GetAmountScheme().Decrypt(balance, sk); got < want-0.01 || got > want+0.01 {
+			t.Errorf("balance of %v: got %v, expected %v", user, got, want)
+		}
+	}
+}
+
+// 结算在计息读取余额之后、写入之前完成，计息不被写入，可以重试
+func TestAccrualAfterSettle(t *testing.T) {
+	database := newTestDatabase(t)
+	_, pk := testutil.NewCKKSKeyPair()
+	sender := newTestAccount(t, database, pk, 100)
+	receipt := newTestAccount(t, database, pk, 0)
+
+	oldSender, oldReceipt := mustBalanceBytes(t, database, sender), mustBalanceBytes(t, database, receipt)
+
+	swapped, err := db.SettleBalances(database,
+		db.BalanceUpdate{User: sender, OldBalance: oldSender, Balance: mustAdd(t, oldSender, -30, pk)},
+		db.BalanceUpdate{User: receipt, OldBalance: oldReceipt, Balance: mustAdd(t, oldReceipt, 30, pk)},
+	)
+	if err != nil || !swapped {
+		t.Fatalf("settlement not applied: %v", err)
+	}
+	settled := mustBalanceBytes(t, database, sender)
+
+	accrualTx := &transaction.Transaction{UUID: uuid.New(), Receipt: sender, ConfirmingPhase: "confirmed"}
+	applied, err := db.ApplyAccrual(database, sender, oldSender, mustAdd(t, oldSender, 1, pk), accrualTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied {
+		t.Fatal("accrual based on the balance before settlement should not be applied")
+	}
+	if !bytes.Equal(mustBalanceBytes(t, database, sender), settled) {
+		t.Error("accrual overwrote the settled balance")
+	}
+	// 账本中没有计息交易，重试时仍会计息
+	if exists, err := db.TransactionExists(database, accrualTx.UUID); err != nil || exists {
+		t.Errorf("accrual transaction written although the balance was not: %v", err)
+	}
+	if applied, err = db.ApplyAccrual(database, sender, settled, mustAdd(t, settled, 1, pk), accrualTx); err != nil || !applied {
+		t.Errorf("retried accrual not applied: %v", err)
+	}
+}
@@ -2,6 +2,10 @@
 package db
 
 import (
+	"database/sql"
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -24,6 +28,17 @@ func CreateTransactionTable() string {
             ct_receipt_signed_by BLOB,
             timestamp INTEGER,
             is_valid INTEGER,
+            assets TEXT,
+            range_proof BLOB,
+            sig_range_proof BLOB,
+            sender_signed_ct BLOB,
+            ct_sender_key_id TEXT,
+            ct_receipt_key_id TEXT,
+            sender_signed_ct_key_id TEXT,
+            sig_ct_sender_key_id TEXT,
+            sig_ct_receipt_key_id TEXT,
+            sig_range_proof_key_id TEXT,
+            held_phase TEXT,
 			FOREIGN KEY(sender) REFERENCES Users(uuid)
 			FOREIGN KEY(receipt) REFERENCES Users(uuid)
         );
@@ -33,8 +48,9 @@ func CreateTransactionTable() string {
 // table Users:
 // uuid TEXT PRIMARY KEY,
 // userName TEXT
-// balance BLOB <- []byte 被 rlwe.CipherText.Marshall编码
+// balance BLOB <- []byte 被 misc.MarshalCompactCiphertext 编码，旧数据为 rlwe.CipherText.Marshall 编码
 // primary{ECDSA, CKKS}Key <- uuid, TEXT
+// certificates BLOB <- JSON 编码的 CA 证书链，见 key.Certificate
 func CreateUserTable() string {
 	return `
 		CREATE TABLE IF NOT EXISTS Users (
@@ -42,7 +58,9 @@ func CreateUserTable() string {
 			userName TEXT,
 			balance BLOB,
 			primaryCKKSKeyID TEXT,
-			primaryECDSAKeyID TEXT
+			primaryECDSAKeyID TEXT,
+			certificates BLOB,
+			balanceOps INTEGER DEFAULT 0
 		);
 	`
 }
@@ -52,7 +70,8 @@ func CreateUserTable() string {
 // userIn TEXT, as FOREIGN KEY Users(uuid)
 // userOut TEXT, as FOREIGN KEY to Users(uuid)
 // pkIn, pkOut BLOB, as FOREIGN KEY to CKKSKeyChains(uuid)
-// SwitchingKey BLOB
+// SwitchingKey BLOB <- 紧凑格式，见 misc.MarshalCompactSwitchingKey
+// epoch INTEGER, notBefore/notAfter INTEGER <- unix 时间戳，见 misc.SwkValidity
 func CreateSwitchingKeyTable() string {
 	return `
 		CREATE TABLE IF NOT EXISTS SwitchingKeys(
@@ -62,6 +81,9 @@ func CreateSwitchingKeyTable() string {
 			pkIn TEXT,
 			pkOut TEXT,
 			SwitchingKey BLOB NOT NULL,
+			epoch INTEGER,
+			notBefore INTEGER,
+			notAfter INTEGER,
 			FOREIGN KEY (userIn) REFERENCES Users(uuid),
 			FOREIGN KEY (userOut) REFERENCES Users(uuid),
 			FOREIGN KEY (pkIn) REFERENCES CKKSKeyChains(uuid),
@@ -73,8 +95,9 @@ func CreateSwitchingKeyTable() string {
 // table CKKSKeyChains
 // uuid TEXT 作为主键
 // user TEXT 作为指向 Users(uuid) 的外键, cannot be null
-// publicKey blob, cannot be null
-// evaluationKey blob, which may be null
+// publicKey blob, cannot be null, 紧凑格式，见 misc.MarshalCompactPublicKey
+// evaluationKey blob, which may be null, 重线性化与旋转密钥，见 misc.MarshalEvaluationKey
+// auditorSwk blob, which may be null, 到监管者透支密钥的 swk，见 serverlib.SwitchToAuditor
 // isMain integer, which would be boolean in golang, and for each user they can only have one column tagged isMain = true
 
 // CreateCKKSKeyTable 新的 CKKS 公钥表
@@ -85,6 +108,7 @@ func CreateCKKSKeyTable() string {
 			user TEXT NOT NULL REFERENCES Users(uuid),
 			publicKey BLOB NOT NULL,
 			evaluationKey BLOB,
+			auditorSwk BLOB,
 			privateKey BLOB
 		);
 	`
@@ -94,15 +118,201 @@ func CreateCKKSKeyTable() string {
 // uuid TEXT
 // user TEXT as FOREIGN KEY
 // publicKey BLOB
+// algorithm TEXT，签名算法，见 key.SigAlgorithm
 
-// createECDSAKeyChainsTable 创建新的ECDSA公钥表
+// createECDSAKeyChainsTable 创建新的签名公钥表
+// 表名沿用最初只支持 ECDSA 时的名称
 func CreateECDSAKeyTable() string {
 	return `
 		CREATE TABLE IF NOT EXISTS ECDSAKeyChains (
 			uuid TEXT PRIMARY KEY,
 			user TEXT NOT NULL REFERENCES Users(uuid),
 			publicKey BLOB NOT NULL,
-			privateKey BLOB
+			privateKey BLOB,
+			algorithm TEXT
+		);
+	`
+}
+
+// table Keystore，仅客户端使用
+// 只有一行（id = 1），记录口令派生参数和被口令派生密钥加密的数据密钥，见 clientlib.Keystore
+// kdf TEXT, salt BLOB, time/memory/threads INTEGER <- argon2id 参数
+// wrappedKey BLOB <- 加密的数据密钥，CKKSKeyChains、ECDSAKeyChains 的 privateKey 列由数据密钥加密
+func CreateKeystoreTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS Keystore (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			kdf TEXT NOT NULL,
+			salt BLOB NOT NULL,
+			time INTEGER NOT NULL,
+			memory INTEGER NOT NULL,
+			threads INTEGER NOT NULL,
+			wrappedKey BLOB NOT NULL
+		);
+	`
+}
+
+// table BalanceRefreshes
+// 用户提交的余额刷新声明，供监管者核对
+func CreateBalanceRefreshTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS BalanceRefreshes (
+			uuid TEXT PRIMARY KEY,
+			user TEXT NOT NULL REFERENCES Users(uuid),
+			oldBalance BLOB NOT NULL,
+			newBalance BLOB NOT NULL,
+			timestamp INTEGER,
+			sig BLOB NOT NULL
+		);
+	`
+}
+
+// table UsedNonces
+// 已使用的签名请求 nonce，在 expires（unix 时间）之前拒绝重放，见 ConsumeNonce
+func CreateUsedNonceTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS UsedNonces (
+			nonce TEXT PRIMARY KEY,
+			expires INTEGER NOT NULL
 		);
 	`
 }
+
+// table AccountProducts
+// 用户加入的账户产品，服务端按产品定期计息和收费，见 serverlib.AccrualProduct
+// 产品由服务端配置，这里只记录产品 ID
+func CreateAccountProductTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS AccountProducts (
+			user TEXT NOT NULL REFERENCES Users(uuid),
+			product TEXT NOT NULL,
+			since INTEGER,
+			PRIMARY KEY (user, product)
+		);
+	`
+}
+
+// table Assets
+// 资产注册表，slot 为资产在余额密文中的槽位，一经分配不再改变
+func CreateAssetTable() string {
+	return `
+		CREATE TABLE IF NOT EXISTS Assets (
+			id TEXT PRIMARY KEY,
+			name TEXT,
+			slot INTEGER UNIQUE NOT NULL
+		);
+	`
+}
+
+// --- 迁移：为旧数据库补充新增的列 ---
+
+// MigrateSwitchingKeyTable 为旧版本的 SwitchingKeys 表补充有效期相关的列
+// 旧的 swk 没有有效期，视为属于 validity 对应的纪元（通常为迁移时的当前纪元），
+// 否则会被 DeleteExpiredSwitchingKeys 当作过期删除
+func MigrateSwitchingKeyTable(db *sql.DB, validity misc.SwkValidity) (err error) {
+	for _, col := range []string{"epoch", "notBefore", "notAfter"} {
+		if err = AddColumnIfNotExists(db, "SwitchingKeys", col, "INTEGER"); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`
+		UPDATE SwitchingKeys SET epoch = ?, notBefore = ?, notAfter = ?
+		WHERE epoch IS NULL OR notBefore IS NULL OR notAfter IS NULL
+	`, validity.Epoch, validity.NotBefore, validity.NotAfter)
+	return err
+}
+
+// MigrateECDSAKeyTable 为旧版本的 ECDSAKeyChains 表补充算法列
+// 旧的公钥没有算法列，读取时由公钥类型得出
+func MigrateECDSAKeyTable(db *sql.DB) (err error) {
+	return AddColumnIfNotExists(db, "ECDSAKeyChains", "algorithm", "TEXT")
+}
+
+// MigrateCKKSKeyTable 为旧版本的 CKKSKeyChains 表补充监管者 swk 列
+func MigrateCKKSKeyTable(db *sql.DB) (err error) {
+	return AddColumnIfNotExists(db, "CKKSKeyChains", "auditorSwk", "BLOB")
+}
+
+// MigrateUserTable 为旧版本的 Users 表补充证书列和余额运算次数列
+func MigrateUserTable(db *sql.DB) (err error) {
+	if err = AddColumnIfNotExists(db, "Users", "certificates", "BLOB"); err != nil {
+		return err
+	}
+	return AddColumnIfNotExists(db, "Users", "balanceOps", "INTEGER DEFAULT 0")
+}
+
+// MigrateTransactionTable 为旧版本的 Transactions 表补充资产列、范围证明列、原始密文列、密钥 ID 列和挂起前阶段列
+// 旧的交易没有资产列，视为默认资产；没有密钥 ID 的视为用户的主密钥
+func MigrateTransactionTable(db *sql.DB) (err error) {
+	if err = AddColumnIfNotExists(db, "Transactions", "assets", "TEXT"); err != nil {
+		return err
+	}
+	if err = AddColumnIfNotExists(db, "Transactions", "range_proof", "BLOB"); err != nil {
+		return err
+	}
+	if err = AddColumnIfNotExists(db, "Transactions", "sig_range_proof", "BLOB"); err != nil {
+		return err
+	}
+	if err = AddColumnIfNotExists(db, "Transactions", "sender_signed_ct", "BLOB"); err != nil {
+		return err
+	}
+	for _, col := range []string{
+		"ct_sender_key_id", "ct_receipt_key_id", "sender_signed_ct_key_id",
+		"sig_ct_sender_key_id", "sig_ct_receipt_key_id", "sig_range_proof_key_id", "held_phase",
+	} {
+		if err = AddColumnIfNotExists(db, "Transactions", col, "TEXT"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateKeyIDs 为旧数据补充主密钥 ID 和 swk 的公钥 ID
+// 旧版本每个用户只有一对密钥，因此将唯一的密钥设为主密钥，swk 的 pkIn、pkOut 设为双方的主 CKKS 公钥
+// 需要在 CKKSKeyChains、ECDSAKeyChains、SwitchingKeys 表建立后调用
+func MigrateKeyIDs(db *sql.DB) (err error) {
+	for _, stmt := range []string{
+		`UPDATE Users SET primaryCKKSKeyID = (SELECT uuid FROM CKKSKeyChains WHERE user = Users.uuid LIMIT 1)
+			WHERE primaryCKKSKeyID IS NULL`,
+		`UPDATE Users SET primaryECDSAKeyID = (SELECT uuid FROM ECDSAKeyChains WHERE user = Users.uuid LIMIT 1)
+			WHERE primaryECDSAKeyID IS NULL`,
+		`UPDATE SwitchingKeys SET pkIn = (SELECT primaryCKKSKeyID FROM Users WHERE uuid = userIn)
+			WHERE pkIn IS NULL`,
+		`UPDATE SwitchingKeys SET pkOut = (SELECT primaryCKKSKeyID FROM Users WHERE uuid = userOut)
+			WHERE pkOut IS NULL`,
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddColumnIfNotExists 在表 table 中不存在列 column 时添加该列
+func AddColumnIfNotExists(db *sql.DB, table, column, decl string) (err error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, decl))
+	return
+}
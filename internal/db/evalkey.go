@@ -0,0 +1,66 @@
+package db
+
+// evalkey.go 包含用户计算密钥的读写，计算密钥保存在对应 CKKS 公钥的 evaluationKey 列中
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// ErrNoEvaluationKey 表示 CKKS 公钥存在，但尚未注册计算密钥
+var ErrNoEvaluationKey = errors.New("no evaluation key registered")
+
+// PutEvaluationKey 为用户标识符为 keyID 的 CKKS 公钥注册计算密钥，已有的计算密钥被替换
+// data 为 misc.MarshalEvaluationKey 的结果，调用者须先检查其与公钥一致
+// 到监管者的 swk 的证明覆盖原有的计算密钥，因此同时被删除，见 PutAuditorSwk
+func PutEvaluationKey(db *sql.DB, userID, keyID uuid.UUID, data []byte) error {
+	res, err := db.Exec(`UPDATE CKKSKeyChains SET evaluationKey = ?, auditorSwk = NULL WHERE user = ? AND uuid = ?`,
+		data, userID.String(), keyID.String())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("ckks key %v of user %v not found", keyID, userID)
+	}
+	return nil
+}
+
+// GetEvaluationKeyBytes 查询用户标识符为 keyID 的 CKKS 公钥的计算密钥，keyID 为零值时为主公钥
+// 同时返回实际的 keyID；公钥存在但没有计算密钥时返回 ErrNoEvaluationKey
+func GetEvaluationKeyBytes(db *sql.DB, userID, keyID uuid.UUID) (ckksKeyID uuid.UUID, data []byte, err error) {
+	row := db.QueryRow(`
+		SELECT uuid, evaluationKey
+		FROM CKKSKeyChains
+		WHERE user = ?1 AND (uuid = ?2 OR ?2 IS NULL)
+		ORDER BY uuid = (SELECT primaryCKKSKeyID FROM Users WHERE uuid = ?1) DESC
+		LIMIT 1;
+		`, userID.String(), nullableUUID(keyID),
+	)
+	if err = row.Scan(&ckksKeyID, &data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil, fmt.Errorf("ckks key %v of user %v not found", keyID, userID)
+		}
+		return uuid.Nil, nil, err
+	}
+	if data == nil {
+		return ckksKeyID, nil, ErrNoEvaluationKey
+	}
+	return ckksKeyID, data, nil
+}
+
+// GetEvaluationKey 同 GetEvaluationKeyBytes，返回反序列化后的计算密钥
+func GetEvaluationKey(db *sql.DB, userID, keyID uuid.UUID) (ckksKeyID uuid.UUID, evk rlwe.EvaluationKey, err error) {
+	ckksKeyID, data, err := GetEvaluationKeyBytes(db, userID, keyID)
+	if err != nil {
+		return ckksKeyID, evk, err
+	}
+	evk, err = misc.UnmarshalEvaluationKey(data)
+	return ckksKeyID, evk, err
+}
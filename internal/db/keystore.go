@@ -0,0 +1,128 @@
+package db
+
+// keystore.go 包含客户端密钥库的读写
+// 这里只存取已加密的私钥，加密和解密见 clientlib.Keystore
+
+import (
+	"crypto"
+	"database/sql"
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// KeystoreRecord 对应 Keystore 表的唯一一行
+type KeystoreRecord struct {
+	KDF        string
+	Salt       []byte
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	WrappedKey []byte
+}
+
+// SealedKey 为密钥表中的一行，PrivateKey 为加密后的私钥，可以为空
+type SealedKey struct {
+	Identifier uuid.UUID
+	PublicKey  []byte
+	PrivateKey []byte
+	Algorithm  string
+}
+
+// GetKeystore 读取密钥库的口令派生参数，未初始化时返回 sql.ErrNoRows
+func GetKeystore(db *sql.DB) (r *KeystoreRecord, err error) {
+	r = new(KeystoreRecord)
+	err = db.QueryRow(`SELECT kdf, salt, time, memory, threads, wrappedKey FROM Keystore WHERE id = 1`).
+		Scan(&r.KDF, &r.Salt, &r.Time, &r.Memory, &r.Threads, &r.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// PutKeystore 写入密钥库的口令派生参数
+// replace 为 false 时只在密钥库未初始化时写入，返回是否写入
+func PutKeystore(db *sql.DB, r *KeystoreRecord, replace bool) (written bool, err error) {
+	stmt := `INSERT INTO Keystore (id, kdf, salt, time, memory, threads, wrappedKey) VALUES (1, ?, ?, ?, ?, ?, ?)`
+	if replace {
+		stmt += ` ON CONFLICT (id) DO UPDATE SET
+			kdf = excluded.kdf, salt = excluded.salt, time = excluded.time,
+			memory = excluded.memory, threads = excluded.threads, wrappedKey = excluded.wrappedKey`
+	} else {
+		stmt += ` ON CONFLICT (id) DO NOTHING`
+	}
+	res, err := db.Exec(stmt, r.KDF, r.Salt, r.Time, r.Memory, r.Threads, r.WrappedKey)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// PutSealedCKKSKey 写入或更新 CKKS 密钥行，sealed 为加密后的私钥
+func PutSealedCKKSKey(db *sql.DB, keyID, userID uuid.UUID, pk *rlwe.PublicKey, seed, sealed []byte) (err error) {
+	pkBytes, err := key.CKKSKeyChain{CKKSPublicKey: pk, CKKSPublicKeySeed: seed}.MarshalPublicKey()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO CKKSKeyChains (uuid, user, publicKey, privateKey)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (uuid) DO UPDATE SET
+			publicKey = excluded.publicKey,
+			privateKey = excluded.privateKey
+	`, keyID.String(), userID.String(), pkBytes, sealed)
+	return
+}
+
+// PutSealedSigningKey 写入或更新签名密钥行，sealed 为加密后的私钥
+func PutSealedSigningKey(db *sql.DB, keyID, userID uuid.UUID, pk crypto.PublicKey, sealed []byte) (err error) {
+	alg, err := key.SigAlgorithmOf(pk)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO ECDSAKeyChains (uuid, user, publicKey, privateKey, algorithm)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (uuid) DO UPDATE SET
+			publicKey = excluded.publicKey,
+			privateKey = excluded.privateKey,
+			algorithm = excluded.algorithm
+	`, keyID.String(), userID.String(), key.MarshalSigningPublicKey(pk), sealed, string(alg))
+	return
+}
+
+// GetSealedKeys 读取用户在 table（CKKSKeyChains 或 ECDSAKeyChains）中的全部密钥，主密钥在前
+func GetSealedKeys(db *sql.DB, table string, userID uuid.UUID) (keys []SealedKey, err error) {
+	var query string
+	switch table {
+	case "CKKSKeyChains":
+		query = `SELECT uuid, publicKey, privateKey, '' FROM CKKSKeyChains WHERE user = ?
+			ORDER BY uuid = (SELECT primaryCKKSKeyID FROM Users WHERE uuid = ?) DESC, rowid`
+	case "ECDSAKeyChains":
+		query = `SELECT uuid, publicKey, privateKey, algorithm FROM ECDSAKeyChains WHERE user = ?
+			ORDER BY uuid = (SELECT primaryECDSAKeyID FROM Users WHERE uuid = ?) DESC, rowid`
+	default:
+		return nil, fmt.Errorf("unknown key table %q", table)
+	}
+	rows, err := db.Query(query, userID.String(), userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			k         SealedKey
+			algorithm sql.NullString
+		)
+		if err = rows.Scan(&k.Identifier, &k.PublicKey, &k.PrivateKey, &algorithm); err != nil {
+			return nil, err
+		}
+		k.Algorithm = algorithm.String
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
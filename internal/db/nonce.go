@@ -0,0 +1,31 @@
+package db
+
+// nonce.go 记录已使用的签名请求 nonce，防止监管指令、加入产品等签名请求被重放
+// 请求同时带有时间戳，超过有效期的请求直接被拒绝，因此 nonce 只需保存到有效期结束
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrNonceReused 表示 nonce 已被使用过，请求为重放
+var ErrNonceReused = errors.New("nonce has already been used")
+
+// ConsumeNonce 记录 nonce 在 expires 之前已被使用，nonce 已存在时返回 ErrNonceReused
+// 同时清理已过期的 nonce
+func ConsumeNonce(db *sql.DB, nonce string, expires time.Time) error {
+	if _, err := db.Exec(`DELETE FROM UsedNonces WHERE expires < ?`, time.Now().Unix()); err != nil {
+		return err
+	}
+	res, err := db.Exec(`INSERT OR IGNORE INTO UsedNonces (nonce, expires) VALUES (?, ?)`, nonce, expires.Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNonceReused
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package db
+
+// overdraft.go 包含用户到监管者透支密钥的 swk 的读写，swk 保存在对应 CKKS 公钥的 auditorSwk 列中
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+var (
+	// ErrNoAuditorSwk 表示 CKKS 公钥存在，但尚未注册到监管者的 swk
+	ErrNoAuditorSwk = errors.New("no auditor switching key registered")
+	// ErrEvaluationKeyChanged 表示监管者证明的计算密钥已被替换
+	ErrEvaluationKeyChanged = errors.New("evaluation key was replaced after the auditor certified it")
+)
+
+// PutAuditorSwk 为用户标识符为 keyID 的 CKKS 公钥注册到监管者的 swk，已有的被替换
+// data 为 misc.MarshalCompactSwitchingKey 的结果，evk 为监管者一并证明的计算密钥，
+// 仅当该公钥当前的计算密钥仍为 evk 时写入，否则返回 ErrEvaluationKeyChanged，见 PutEvaluationKey
+func PutAuditorSwk(db *sql.DB, userID, keyID uuid.UUID, data, evk []byte) error {
+	res, err := db.Exec(`UPDATE CKKSKeyChains SET auditorSwk = ? WHERE user = ? AND uuid = ? AND evaluationKey = ?`,
+		data, userID.String(), keyID.String(), evk)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, _, err = GetEvaluationKeyBytes(db, userID, keyID); err != nil {
+			return err
+		}
+		return ErrEvaluationKeyChanged
+	}
+	return nil
+}
+
+// GetAuditorSwk 查询用户标识符为 keyID 的 CKKS 公钥到监管者的 swk，keyID 为零值时为主公钥
+// 同时返回实际的 keyID；公钥存在但没有注册时返回 ErrNoAuditorSwk
+func GetAuditorSwk(db *sql.DB, userID, keyID uuid.UUID) (ckksKeyID uuid.UUID, swk *rlwe.SwitchingKey, err error) {
+	var data []byte
+	row := db.QueryRow(`
+		SELECT uuid, auditorSwk
+		FROM CKKSKeyChains
+		WHERE user = ?1 AND (uuid = ?2 OR ?2 IS NULL)
+		ORDER BY uuid = (SELECT primaryCKKSKeyID FROM Users WHERE uuid = ?1) DESC
+		LIMIT 1;
+		`, userID.String(), nullableUUID(keyID),
+	)
+	if err = row.Scan(&ckksKeyID, &data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil, fmt.Errorf("ckks key %v of user %v not found", keyID, userID)
+		}
+		return uuid.Nil, nil, err
+	}
+	if data == nil {
+		return ckksKeyID, nil, ErrNoAuditorSwk
+	}
+	swk, err = misc.UnmarshalSwitchingKey(data)
+	return ckksKeyID, swk, err
+}
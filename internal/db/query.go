@@ -1,18 +1,20 @@
 package db
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"crypto/x509"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/transaction"
 	"github.com/CamberLoid/Chimata/internal/users"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
@@ -20,7 +22,10 @@ func GetTransaction(db *sql.DB, txUUID uuid.UUID) (tx *transaction.Transaction,
 	stmt, err := db.Prepare(`
 	SELECT confirming_phase, uuid, sender, receipt,
 		ct_sender, ct_receipt, sig_ct_sender, ct_sender_signed_by,
-		sig_ct_receipt, ct_receipt_signed_by, timestamp, is_valid
+		sig_ct_receipt, ct_receipt_signed_by, timestamp, is_valid, assets,
+		range_proof, sig_range_proof, sender_signed_ct,
+		ct_sender_key_id, ct_receipt_key_id, sender_signed_ct_key_id,
+		sig_ct_sender_key_id, sig_ct_receipt_key_id, sig_range_proof_key_id, held_phase
 	FROM Transactions
 	WHERE uuid = ?
 `)
@@ -32,7 +37,17 @@ func GetTransaction(db *sql.DB, txUUID uuid.UUID) (tx *transaction.Transaction,
 	// 执行查询
 	row := stmt.QueryRow(txUUID.String())
 
-	// 将查询结果映射到结构体
+	tx, err = scanTransaction(row)
+	if err != nil {
+		return nil, errors.Wrap(err, "scan row")
+	}
+
+	return tx, nil
+}
+
+// scanTransaction 将查询结果映射到结构体，列的顺序与 GetTransaction 相同
+func scanTransaction(row interface{ Scan(...any) error }) (tx *transaction.Transaction, err error) {
+	var assets, heldPhase sql.NullString
 	tx = &transaction.Transaction{}
 	err = row.Scan(
 		&tx.ConfirmingPhase,
@@ -47,16 +62,73 @@ func GetTransaction(db *sql.DB, txUUID uuid.UUID) (tx *transaction.Transaction,
 		&tx.CTReceiptSignedBy,
 		&tx.TimeStamp,
 		&tx.IsValid,
+		&assets,
+		&tx.RangeProof,
+		&tx.SigRangeProof,
+		&tx.SenderSignedCT,
+		&tx.CTSenderKeyID,
+		&tx.CTReceiptKeyID,
+		&tx.SenderSignedCTKeyID,
+		&tx.SigCTSenderKeyID,
+		&tx.SigCTReceiptKeyID,
+		&tx.SigRangeProofKeyID,
+		&heldPhase,
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "scan row")
+		return nil, err
 	}
-
+	if assets.String != "" {
+		if err = json.Unmarshal([]byte(assets.String), &tx.Assets); err != nil {
+			return nil, err
+		}
+	}
+	tx.HeldPhase = heldPhase.String
 	return tx, nil
 }
 
+// GetTransactionsByUser 查询用户作为发送方或接收方的全部交易，按时间倒序排列
+// asset 不为空时只返回涉及该资产的交易
+func GetTransactionsByUser(db *sql.DB, userUUID uuid.UUID, asset string) (txs []*transaction.Transaction, err error) {
+	rows, err := db.Query(`
+	SELECT confirming_phase, uuid, sender, receipt,
+		ct_sender, ct_receipt, sig_ct_sender, ct_sender_signed_by,
+		sig_ct_receipt, ct_receipt_signed_by, timestamp, is_valid, assets,
+		range_proof, sig_range_proof, sender_signed_ct,
+		ct_sender_key_id, ct_receipt_key_id, sender_signed_ct_key_id,
+		sig_ct_sender_key_id, sig_ct_receipt_key_id, sig_range_proof_key_id, held_phase
+	FROM Transactions
+	WHERE sender = ? OR receipt = ?
+	ORDER BY timestamp DESC
+`, userUUID.String(), userUUID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tx, err := scanTransaction(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan row")
+		}
+		if asset == "" || tx.HasAsset(asset) {
+			txs = append(txs, tx)
+		}
+	}
+	return txs, rows.Err()
+}
+
 // 查询用户余额
 func GetUserBalance(db *sql.DB, UserUUID uuid.UUID) (balance *rlwe.Ciphertext, err error) {
+	balanceBytes, err := GetUserBalanceBytes(db, UserUUID)
+	if err != nil {
+		return nil, err
+	}
+	return misc.UnmarshalCiphertext(balanceBytes)
+}
+
+// GetUserBalanceBytes 查询用户余额的原始字节
+// 余额刷新按原始字节比较余额是否变化，因此返回给用户的余额不应重新编码
+func GetUserBalanceBytes(db *sql.DB, UserUUID uuid.UUID) (balanceBytes []byte, err error) {
 	row := db.QueryRow(`
 		SELECT balance
 		FROM Users
@@ -64,140 +136,214 @@ func GetUserBalance(db *sql.DB, UserUUID uuid.UUID) (balance *rlwe.Ciphertext, e
 		`, UserUUID,
 	)
 
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	balance = rlwe.NewCiphertext(
-		params.Parameters, 1, params.MaxLevel(),
-	)
-	var balanceBytes []byte
-
-	if row.Scan(&balanceBytes) != nil {
+	if err = row.Scan(&balanceBytes); err != nil {
 		return nil, fmt.Errorf("failed to scan balance bytes: %v", err)
 	}
-
-	err = balance.UnmarshalBinary(balanceBytes)
-
 	return
 }
 
+// GetECDSAKeyByUserUUID 查询用户的主 ECDSA 公钥，未设置主密钥时返回任意一个
 func GetECDSAKeyByUserUUID(db *sql.DB, UserUUID uuid.UUID) (keyChain *key.ECDSAKeyChain, err error) {
-	keyChain = new(key.ECDSAKeyChain)
-	row := db.QueryRow(`
-		SELECT uuid, publicKey, privateKey
+	return scanECDSAKey(db.QueryRow(`
+		SELECT uuid, publicKey, algorithm
 		FROM ECDSAKeyChains
-		WHERE user = ?;
-		`, UserUUID,
+		WHERE user = ?
+		ORDER BY uuid = (SELECT primaryECDSAKeyID FROM Users WHERE uuid = ?) DESC
+		LIMIT 1;
+		`, UserUUID, UserUUID,
+	))
+}
+
+// GetECDSAKeyByID 查询用户标识符为 keyID 的 ECDSA 公钥，keyID 为零值时返回主公钥
+// 密钥不属于该用户时返回 sql.ErrNoRows
+func GetECDSAKeyByID(db *sql.DB, UserUUID, keyID uuid.UUID) (keyChain *key.ECDSAKeyChain, err error) {
+	if keyID == uuid.Nil {
+		return GetECDSAKeyByUserUUID(db, UserUUID)
+	}
+	return scanECDSAKey(db.QueryRow(`
+		SELECT uuid, publicKey, algorithm
+		FROM ECDSAKeyChains
+		WHERE user = ? AND uuid = ?;
+		`, UserUUID.String(), keyID.String(),
+	))
+}
+
+// GetECDSAKeysByUserUUID 查询用户的全部签名公钥，主公钥在前
+func GetECDSAKeysByUserUUID(db *sql.DB, UserUUID uuid.UUID) (keyChains []*key.ECDSAKeyChain, err error) {
+	rows, err := db.Query(`
+		SELECT uuid, publicKey, algorithm
+		FROM ECDSAKeyChains
+		WHERE user = ?
+		ORDER BY uuid = (SELECT primaryECDSAKeyID FROM Users WHERE uuid = ?) DESC, rowid;
+		`, UserUUID.String(), UserUUID.String(),
 	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var pubkeyBytes, privateKeyBytes []byte
+	for rows.Next() {
+		keyChain, err := scanECDSAKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keyChains = append(keyChains, keyChain)
+	}
+	return keyChains, rows.Err()
+}
+
+// scanECDSAKey 只读取公钥
+// 客户端的 privateKey 列由 clientlib.Keystore 加密保存，见 GetSealedKeys
+func scanECDSAKey(row interface{ Scan(...any) error }) (keyChain *key.ECDSAKeyChain, err error) {
+	keyChain = new(key.ECDSAKeyChain)
+	var pubkeyBytes []byte
 	var identifier uuid.UUID
+	var algorithm sql.NullString
 
-	err = row.Scan(&identifier, &pubkeyBytes, &privateKeyBytes)
+	err = row.Scan(&identifier, &pubkeyBytes, &algorithm)
 	if err != nil {
 		return nil, err
 	}
 
 	keyChain.Identifier = identifier
 
-	// 处理公钥
-	_pubkey, err := x509.ParsePKIXPublicKey(pubkeyBytes)
+	// 处理公钥，旧数据没有算法列，以公钥类型为准
+	keyChain.PublicKey, keyChain.Algorithm, err = key.UnmarshalSigningPublicKey(pubkeyBytes)
 	if err != nil {
 		return nil, err
 	}
-	switch v := _pubkey.(type) {
-	case *ecdsa.PublicKey:
-		keyChain.ECDSAPublicKey = _pubkey.(*ecdsa.PublicKey)
-	default:
-		return nil, fmt.Errorf("not a ecdsa public key, got %v", v)
+	if algorithm.Valid && algorithm.String != "" && key.SigAlgorithm(algorithm.String) != keyChain.Algorithm {
+		return nil, fmt.Errorf("signing key %v is recorded as %s, got %s", identifier, algorithm.String, keyChain.Algorithm)
 	}
+	return keyChain, nil
+}
 
-	// 处理可能的私钥
-	if len(privateKeyBytes) != 0 {
-		_privkey, err := x509.ParseECPrivateKey(privateKeyBytes)
-		if err == nil {
-			keyChain.ECDSAPrivateKey = _privkey
-		}
-		return keyChain, nil
-	} else {
-		return
+// GetCKKSKeyByUserUUID 查询用户的主 CKKS 公钥，未设置主密钥时返回任意一个
+// 密钥轮换后，旧公钥仍保存在 CKKSKeyChains 中，见 RotateCKKSKey
+func GetCKKSKeyByUserUUID(db *sql.DB, UserUUID uuid.UUID) (keyChain *key.CKKSKeyChain, err error) {
+	return scanCKKSKey(db.QueryRow(`
+		SELECT uuid, publicKey
+		FROM CKKSKeyChains
+		WHERE user = ?
+		ORDER BY uuid = (SELECT primaryCKKSKeyID FROM Users WHERE uuid = ?) DESC
+		LIMIT 1;
+		`, UserUUID, UserUUID,
+	))
+}
+
+// GetCKKSKeyByID 查询用户标识符为 keyID 的 CKKS 公钥，keyID 为零值时返回主公钥
+func GetCKKSKeyByID(db *sql.DB, UserUUID, keyID uuid.UUID) (keyChain *key.CKKSKeyChain, err error) {
+	if keyID == uuid.Nil {
+		return GetCKKSKeyByUserUUID(db, UserUUID)
 	}
+	return scanCKKSKey(db.QueryRow(`
+		SELECT uuid, publicKey
+		FROM CKKSKeyChains
+		WHERE user = ? AND uuid = ?;
+		`, UserUUID.String(), keyID.String(),
+	))
 }
 
-func GetCKKSKeyByUserUUID(db *sql.DB, UserUUID uuid.UUID) (keyChain *key.CKKSKeyChain, err error) {
-	// 初始化
+// scanCKKSKey 只读取公钥，私钥同 scanECDSAKey
+func scanCKKSKey(row *sql.Row) (keyChain *key.CKKSKeyChain, err error) {
 	keyChain = new(key.CKKSKeyChain)
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	privkey := rlwe.NewSecretKey(params.Parameters)
-	var pubkeyBytes, privateKeyBytes []byte
+	var pubkeyBytes []byte
 	var id []byte
 
-	// 查询
-	row, err := db.Query(`
-		SELECT uuid, publicKey, privateKey
-		FROM CKKSKeyChains
-		WHERE user = ?;
-		`, UserUUID,
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer row.Close()
-
-	if row.Scan(&id, &pubkeyBytes, &privateKeyBytes) != nil {
+	if err = row.Scan(&id, &pubkeyBytes); err != nil {
 		return nil, fmt.Errorf("failed to scan CKKS public key bytes: %v", err)
 	}
-	keyChain.Identifier = uuid.MustParse(string(id))
-
-	if err = keyChain.CKKSPublicKey.UnmarshalBinary(pubkeyBytes); err != nil {
+	if keyChain.Identifier, err = uuid.ParseBytes(id); err != nil {
 		return nil, err
 	}
 
-	if len(privateKeyBytes) != 0 {
-		err = privkey.UnmarshalBinary(privateKeyBytes)
-		if err == nil {
-			keyChain.CKKSPrivateKey = privkey
-		} else {
-			return keyChain, err
-		}
+	if keyChain.CKKSPublicKey, err = misc.UnmarshalPublicKey(pubkeyBytes); err != nil {
+		return nil, err
 	}
 	return keyChain, nil
 }
 
+// GetSwitchingKeyPKInPKOut 查询当前有效的 swk，存在多个纪元的 swk 时取最新的
 func GetSwitchingKeyPKInPKOut(db *sql.DB, pkIDIn, pkIDOut uuid.UUID) (swk *rlwe.SwitchingKey, err error) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	swk = rlwe.NewSwitchingKey(params.Parameters, params.RingQ().NewPoly().Level(), params.RingP().NewPoly().Level())
+	swk, _, err = GetValidSwitchingKeyPKInPKOut(db, pkIDIn, pkIDOut)
+	return
+}
 
+// GetValidSwitchingKeyPKInPKOut 同 GetSwitchingKeyPKInPKOut，同时返回 swk 的有效期
+func GetValidSwitchingKeyPKInPKOut(db *sql.DB, pkIDIn, pkIDOut uuid.UUID) (swk *rlwe.SwitchingKey, v *misc.SwkValidity, err error) {
+	now := time.Now().Unix()
 	row := db.QueryRow(`
-		SELECT switchingKey FROM SwitchingKeys
-		WHERE pkIn = ? AND pkOut = ?;
-	`, pkIDIn, pkIDOut)
+		SELECT switchingKey, epoch, notBefore, notAfter FROM SwitchingKeys
+		WHERE pkIn = ? AND pkOut = ?
+			AND notBefore <= ? AND notAfter > ?
+		ORDER BY epoch DESC
+		LIMIT 1;
+	`, pkIDIn, pkIDOut, now, now)
 
 	var swkByte []byte
-	if err = row.Scan(&swkByte); err != nil {
+	v = new(misc.SwkValidity)
+	if err = row.Scan(&swkByte, &v.Epoch, &v.NotBefore, &v.NotAfter); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, err
+			return nil, nil, fmt.Errorf("no valid switching key found from key %v to key %v, it may have expired", pkIDIn, pkIDOut)
 		}
-		return nil, fmt.Errorf("failed to scan switching key: %v", err)
+		return nil, nil, fmt.Errorf("failed to scan switching key: %v", err)
 	}
-	err = swk.UnmarshalBinary(swkByte)
-
-	return
+	if swk, err = misc.UnmarshalSwitchingKey(swkByte); err != nil {
+		return nil, nil, err
+	}
+	return swk, v, nil
 }
 
+// GetSwitchingKeyUserIDInOut 查询当前有效的 swk，过期的 swk 不会被返回
+// 存在多个纪元的 swk 时取最新的
 func GetSwitchingKeyUserIDInOut(db *sql.DB, UserIDIn, UserIDOut uuid.UUID) (swk *rlwe.SwitchingKey, err error) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	swk = rlwe.NewSwitchingKey(params.Parameters, params.RingQ().NewPoly().Level(), params.RingP().NewPoly().Level())
-
+	now := time.Now().Unix()
 	row := db.QueryRow(`
 		SELECT switchingKey FROM SwitchingKeys
-		WHERE userIn = ? AND userOut = ?;
-	`, UserIDIn, UserIDOut)
+		WHERE userIn = ? AND userOut = ?
+			AND notBefore <= ? AND notAfter > ?
+		ORDER BY epoch DESC
+		LIMIT 1;
+	`, UserIDIn, UserIDOut, now, now)
 
 	var swkByte []byte
-	if row.Scan(&swkByte) != nil {
+	if err = row.Scan(&swkByte); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no valid switching key found, it may have expired")
+		}
 		return nil, fmt.Errorf("failed to scan switching key: %v", err)
 	}
-	err = swk.UnmarshalBinary(swkByte)
+	return misc.UnmarshalSwitchingKey(swkByte)
+}
+
+// GetLatestSwkValidityUserIDInOut 查询已注册的最新纪元的 swk 的有效期，用于续期
+// 未注册过有效期的 swk 时返回 sql.ErrNoRows
+func GetLatestSwkValidityUserIDInOut(db *sql.DB, UserIDIn, UserIDOut uuid.UUID) (v *misc.SwkValidity, err error) {
+	row := db.QueryRow(`
+		SELECT epoch, notBefore, notAfter FROM SwitchingKeys
+		WHERE userIn = ? AND userOut = ? AND epoch IS NOT NULL
+		ORDER BY epoch DESC
+		LIMIT 1;
+	`, UserIDIn, UserIDOut)
+
+	v = new(misc.SwkValidity)
+	if err = row.Scan(&v.Epoch, &v.NotBefore, &v.NotAfter); err != nil {
+		return nil, err
+	}
+	return
+}
 
+// GetUserCertificates 读取用户注册时提交的证书链
+func GetUserCertificates(db *sql.DB, userUUID uuid.UUID) (chain []*key.Certificate, err error) {
+	var chainBytes []byte
+	row := db.QueryRow(`SELECT certificates FROM Users WHERE uuid = ?;`, userUUID.String())
+	if err = row.Scan(&chainBytes); err != nil {
+		return nil, err
+	}
+	if len(chainBytes) == 0 {
+		return nil, fmt.Errorf("no certificate found for user %v", userUUID)
+	}
+	err = json.Unmarshal(chainBytes, &chain)
 	return
 }
 
@@ -209,18 +355,13 @@ func GetUser(db *sql.DB, UserUUID uuid.UUID) (user *users.User, err error) {
 	)
 	user = new(users.User)
 
-	row, err := db.Query(`
+	err = db.QueryRow(`
 		SELECT uuid, userName
 		FROM Users
 		WHERE uuid = ?;
 		`, UserUUID,
-	)
+	).Scan(&id, &user.UserName)
 	if err != nil {
-		return nil, err
-	}
-	defer row.Close()
-
-	if row.Scan(&id, &user.UserName) != nil {
 		return nil, fmt.Errorf("failed to scan user: %v", err)
 	}
 	user.UserIdentifier = uuid.MustParse(id)
@@ -248,15 +389,32 @@ func GetUser(db *sql.DB, UserUUID uuid.UUID) (user *users.User, err error) {
 // ref: https://scaleyourapp.com/uuid-guid-oversimplified-are-they-really-unique/
 // note: https://stackoverflow.com/questions/37145935/checking-if-a-value-exists-in-sqlite-db-with-go
 
+// execer 是 *sql.DB 和 *sql.Tx 共有的方法
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
 // WriteTransaction 将交易写入/更新至数据库
 func WriteTransaction(db *sql.DB, tx *transaction.Transaction) (err error) {
-	stmt, err := db.Prepare(`
+	return writeTransaction(db, tx)
+}
+
+func writeTransaction(db execer, tx *transaction.Transaction) (err error) {
+	assets, err := json.Marshal(tx.GetAssets())
+	if err != nil {
+		return err
+	}
+
+	// 将结构体字段映射到 SQL 参数上
+	_, err = db.Exec(`
 		INSERT INTO Transactions (
 			confirming_phase, UUID, Sender, Receipt, ct_sender, ct_receipt,
 			Sig_ct_sender, ct_sender_signed_by, sig_ct_receipt, ct_receipt_signed_by,
-			TimeStamp, is_valid
+			TimeStamp, is_valid, assets, range_proof, sig_range_proof, sender_signed_ct,
+			ct_sender_key_id, ct_receipt_key_id, sender_signed_ct_key_id,
+			sig_ct_sender_key_id, sig_ct_receipt_key_id, sig_range_proof_key_id, held_phase
 		)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT (uuid) DO UPDATE
         SET
             sender = excluded.sender,
@@ -269,18 +427,26 @@ func WriteTransaction(db *sql.DB, tx *transaction.Transaction) (err error) {
             ct_receipt_signed_by = excluded.ct_receipt_signed_by,
             timestamp = excluded.timestamp,
             is_valid = excluded.is_valid,
+            assets = excluded.assets,
+            range_proof = excluded.range_proof,
+            sig_range_proof = excluded.sig_range_proof,
+            sender_signed_ct = excluded.sender_signed_ct,
+            ct_sender_key_id = excluded.ct_sender_key_id,
+            ct_receipt_key_id = excluded.ct_receipt_key_id,
+            sender_signed_ct_key_id = excluded.sender_signed_ct_key_id,
+            sig_ct_sender_key_id = excluded.sig_ct_sender_key_id,
+            sig_ct_receipt_key_id = excluded.sig_ct_receipt_key_id,
+            sig_range_proof_key_id = excluded.sig_range_proof_key_id,
+            held_phase = excluded.held_phase,
             confirming_phase = excluded.confirming_phase
-	`)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	// 将结构体字段映射到 SQL 参数上
-	_, err = stmt.Exec(
-		tx.ConfirmingPhase, tx.UUID.String(), tx.Sender.String(), tx.Receipt.String(),
+	`,
+		tx.ConfirmingPhase, tx.UUID.String(), nullableUUID(tx.Sender), nullableUUID(tx.Receipt),
 		tx.CTSender, tx.CTReceipt, tx.SigCTSender, tx.CTSenderSignedBy.String(),
 		tx.SigCTReceipt, tx.CTReceiptSignedBy.String(), tx.TimeStamp, tx.IsValid,
+		string(assets), tx.RangeProof, tx.SigRangeProof, tx.SenderSignedCT,
+		tx.CTSenderKeyID.String(), tx.CTReceiptKeyID.String(), tx.SenderSignedCTKeyID.String(),
+		tx.SigCTSenderKeyID.String(), tx.SigCTReceiptKeyID.String(), tx.SigRangeProofKeyID.String(),
+		tx.HeldPhase,
 	)
 	if err != nil {
 		return err
@@ -288,15 +454,76 @@ func WriteTransaction(db *sql.DB, tx *transaction.Transaction) (err error) {
 	return
 }
 
-// UpdateBalance 更新数据库中用户余额
+// nullableUUID 将零值的 UUID 写为 NULL，用于计息、收费交易中的运营方，见 serverlib.AccrualProduct
+func nullableUUID(id uuid.UUID) any {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id.String()
+}
+
+// BalanceUpdate 是结算时对一个用户余额的替换，见 SettleBalances
+// OldBalance 为计算前读取的余额原始字节，Balance 为计算后的余额
+type BalanceUpdate struct {
+	User       uuid.UUID
+	OldBalance []byte
+	Balance    *rlwe.Ciphertext
+}
+
+// SettleBalances 在一个事务中替换交易双方的余额，并累加余额的运算次数
+// 仅当每个用户的当前余额都与 OldBalance 一致时才替换，否则返回 swapped = false，调用者可重新读取余额后重试；
+// 同 RefreshBalance、ApplyAccrual 和 RotateCKKSKey，这样并发的写入不会被基于旧余额的结果覆盖
+func SettleBalances(db *sql.DB, updates ...BalanceUpdate) (swapped bool, err error) {
+	seen := make(map[uuid.UUID]bool, len(updates))
+	for _, u := range updates {
+		if seen[u.User] {
+			return false, fmt.Errorf("balance of user %v updated twice in one settlement", u.User)
+		}
+		seen[u.User] = true
+	}
+
+	dbTx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !swapped {
+			dbTx.Rollback()
+		}
+	}()
+
+	for _, u := range updates {
+		balanceBytes, err := misc.MarshalCompactCiphertext(u.Balance)
+		if err != nil {
+			return false, err
+		}
+		res, err := dbTx.Exec(`
+			UPDATE Users SET balance = ?, balanceOps = COALESCE(balanceOps, 0) + 1
+			WHERE uuid = ? AND balance = ?
+		`, balanceBytes, u.User.String(), u.OldBalance)
+		if err != nil {
+			return false, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			return false, err
+		}
+	}
+
+	swapped = true
+	err = dbTx.Commit()
+	return
+}
+
+// UpdateBalance 更新数据库中用户余额，并累加余额的运算次数
+// 不比较原余额，只用于写入新用户的初始余额；结算等其他写入见 SettleBalances
 func UpdateBalance(db *sql.DB, userUUID uuid.UUID, balance *rlwe.Ciphertext) (err error) {
-	balanceByte, err := balance.MarshalBinary()
+	balanceByte, err := misc.MarshalCompactCiphertext(balance)
 	if err != nil {
 		return err
 	}
 
 	stmt, err := db.Prepare(`
-		UPDATE Users SET balance = ? WHERE uuid = ?
+		UPDATE Users SET balance = ?, balanceOps = COALESCE(balanceOps, 0) + 1 WHERE uuid = ?
 	`)
 	if err != nil {
 		return err
@@ -311,6 +538,32 @@ func UpdateBalance(db *sql.DB, userUUID uuid.UUID, balance *rlwe.Ciphertext) (er
 	return nil
 }
 
+// ErrUserExists 表示该 UUID 的用户已经注册
+var ErrUserExists = errors.New("user already registered")
+
+// InsertUserColumn 同 PutUserColumn，但不替换已有的用户：UUID 已存在时返回 ErrUserExists，余额不变
+// 服务端注册用户时使用，避免以他人公开的证书重新注册来重置其余额
+func InsertUserColumn(db *sql.DB, u *users.User, balance *rlwe.Ciphertext) (err error) {
+	balanceByte, err := misc.MarshalCompactCiphertext(balance)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(`
+		INSERT INTO Users (uuid, username, balance, balanceOps)
+		VALUES (?, ?, ?, 0)
+		ON CONFLICT (uuid) DO NOTHING
+	`, u.UserIdentifier, u.UserName, balanceByte)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
 // 添加新的用户
 func PutUserColumn(db *sql.DB, u *users.User, balance *rlwe.Ciphertext) (err error) {
 	stmt, err := db.Prepare(`
@@ -329,15 +582,101 @@ func PutUserColumn(db *sql.DB, u *users.User, balance *rlwe.Ciphertext) (err err
 	_, err = stmt.Exec(u.UserIdentifier, u.UserName, nil)
 
 	if balance != nil {
-		return UpdateBalance(db, u.UserIdentifier, balance)
+		if err = UpdateBalance(db, u.UserIdentifier, balance); err != nil {
+			return err
+		}
+		// 新加密的余额不计入运算次数
+		_, err = db.Exec(`UPDATE Users SET balanceOps = 0 WHERE uuid = ?`, u.UserIdentifier.String())
+	}
+
+	return
+}
+
+// GetUserBalanceOps 查询用户余额自上次加密以来的运算次数
+func GetUserBalanceOps(db *sql.DB, userUUID uuid.UUID) (ops int64, err error) {
+	var n sql.NullInt64
+	if err = db.QueryRow(`SELECT balanceOps FROM Users WHERE uuid = ?`, userUUID).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n.Int64, nil
+}
+
+// RefreshBalance 在一个事务中用刷新后的密文替换余额，并保存刷新声明
+// 仅当当前余额与 r.OldBalance 一致时才替换，否则返回 swapped = false
+func RefreshBalance(db *sql.DB, r *transaction.BalanceRefresh) (swapped bool, err error) {
+	dbTx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !swapped {
+			dbTx.Rollback()
+		}
+	}()
+
+	res, err := dbTx.Exec(`
+		UPDATE Users SET balance = ?, balanceOps = 0
+		WHERE uuid = ? AND balance = ?
+	`, r.NewBalance, r.User.String(), r.OldBalance)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if _, err = dbTx.Exec(`
+		INSERT INTO BalanceRefreshes (uuid, user, oldBalance, newBalance, timestamp, sig)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, r.UUID.String(), r.User.String(), r.OldBalance, r.NewBalance, r.TimeStamp, r.Sig); err != nil {
+		return false, err
 	}
 
+	swapped = true
+	err = dbTx.Commit()
+	return
+}
+
+// GetBalanceRefreshes 查询用户的全部余额刷新声明，按时间顺序排列
+func GetBalanceRefreshes(db *sql.DB, userUUID uuid.UUID) (refreshes []*transaction.BalanceRefresh, err error) {
+	rows, err := db.Query(`
+		SELECT uuid, oldBalance, newBalance, timestamp, sig
+		FROM BalanceRefreshes
+		WHERE user = ?
+		ORDER BY timestamp;
+	`, userUUID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := &transaction.BalanceRefresh{User: userUUID}
+		var id string
+		if err = rows.Scan(&id, &r.OldBalance, &r.NewBalance, &r.TimeStamp, &r.Sig); err != nil {
+			return nil, err
+		}
+		if r.UUID, err = uuid.Parse(id); err != nil {
+			return nil, err
+		}
+		refreshes = append(refreshes, r)
+	}
+	return refreshes, rows.Err()
+}
+
+// PutUserCertificates 保存用户的证书链
+func PutUserCertificates(db *sql.DB, userUUID uuid.UUID, chain []*key.Certificate) (err error) {
+	chainBytes, err := json.Marshal(chain)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE Users SET certificates = ? WHERE uuid = ?`, chainBytes, userUUID.String())
 	return
 }
 
 // PutCKKSPublicKeyColumn 创建新的CKKS公钥行
 func PutCKKSPublicKeyColumn(db *sql.DB, keyID, userID uuid.UUID, pk *rlwe.PublicKey) (err error) {
-	pkBytes, err := pk.MarshalBinary()
+	pkBytes, err := misc.MarshalCompactPublicKey(pk, nil)
 	if err != nil {
 		return err
 	}
@@ -357,8 +696,12 @@ func PutCKKSPublicKeyColumn(db *sql.DB, keyID, userID uuid.UUID, pk *rlwe.Public
 	return
 }
 
-// PutECDSAPublicKeyColumn 创建新的ECDSA公钥行
-func PutECDSAPublicKeyColumn(db *sql.DB, keyID, userID uuid.UUID, pk *ecdsa.PublicKey) (err error) {
+// PutECDSAPublicKeyColumn 创建新的签名公钥行，同时记录公钥的算法
+func PutECDSAPublicKeyColumn(db *sql.DB, keyID, userID uuid.UUID, pk crypto.PublicKey) (err error) {
+	alg, err := key.SigAlgorithmOf(pk)
+	if err != nil {
+		return err
+	}
 	pkBytes, err := x509.MarshalPKIXPublicKey(pk)
 	if err != nil {
 		return err
@@ -366,38 +709,227 @@ func PutECDSAPublicKeyColumn(db *sql.DB, keyID, userID uuid.UUID, pk *ecdsa.Publ
 
 	stmt, err := db.Prepare(`
 		INSERT INTO ECDSAKeyChains 
-		(uuid, user, publicKey)
+		(uuid, user, publicKey, algorithm)
 		VALUES
-		(?, ?, ?)
+		(?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(keyID.String(), userID.String(), pkBytes)
+	_, err = stmt.Exec(keyID.String(), userID.String(), pkBytes, string(alg))
 	return
 }
 
 // PutSwitchingKeyColumnByUserInUserOut 创建新的SwitchingKey行
-func PutSwitchingKeyColumnByUserInUserOut(db *sql.DB, keyID, userIn, userOut uuid.UUID, swk *rlwe.SwitchingKey) (err error) {
-	swkBytes, err := swk.MarshalBinary()
+// pkIn、pkOut 为 swk 两端的 CKKS 公钥 ID，零值时为注册时该用户的主公钥
+// 同一对公钥、同一纪元重复注册时，覆盖原有的 swk
+func PutSwitchingKeyColumnByUserInUserOut(db *sql.DB, keyID, userIn, userOut, pkIn, pkOut uuid.UUID, swk *rlwe.SwitchingKey, validity misc.SwkValidity) (err error) {
+	swkBytes, err := misc.MarshalCompactSwitchingKey(swk, nil)
 	if err != nil {
 		return err
 	}
 
-	stmt, err := db.Prepare(`
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// pkIn、pkOut 用于转账时按密文的公钥 ID 查找 swk，密钥轮换时据此删除 swk
+	for _, pk := range []struct {
+		id   *uuid.UUID
+		user uuid.UUID
+	}{{&pkIn, userIn}, {&pkOut, userOut}} {
+		if *pk.id != uuid.Nil {
+			continue
+		}
+		if err = tx.QueryRow(`SELECT primaryCKKSKeyID FROM Users WHERE uuid = ?`, pk.user.String()).Scan(pk.id); err != nil {
+			return fmt.Errorf("primary ckks key of user %v not found: %v", pk.user, err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM SwitchingKeys
+		WHERE userIn = ? AND userOut = ? AND pkIn = ? AND pkOut = ? AND epoch = ?
+	`, userIn, userOut, pkIn.String(), pkOut.String(), validity.Epoch)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
 		INSERT INTO SwitchingKeys
-		(uuid, userIn, userOut, SwitchingKey)
+		(uuid, userIn, userOut, pkIn, pkOut, SwitchingKey, epoch, notBefore, notAfter)
 		VALUES
-		(?, ?, ?, ?)
-	`)
+		(?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, keyID, userIn, userOut, pkIn.String(), pkOut.String(), swkBytes, validity.Epoch, validity.NotBefore, validity.NotAfter)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(keyID, userIn, userOut, swkBytes)
-	return err
+	return tx.Commit()
+}
+
+// DeleteExpiredSwitchingKeys 删除在 now 之前已过期的 swk
+// 没有有效期的旧 swk 已在 MigrateSwitchingKeyTable 中补全，这里不会删除
+func DeleteExpiredSwitchingKeys(db *sql.DB, now int64) (deleted int64, err error) {
+	res, err := db.Exec(`
+		DELETE FROM SwitchingKeys
+		WHERE notAfter <= ?
+	`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetAssetRegistry 读取资产注册表，按槽位排列
+func GetAssetRegistry(db *sql.DB) (r *misc.AssetRegistry, err error) {
+	rows, err := db.Query(`SELECT id, name, slot FROM Assets ORDER BY slot`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	r = new(misc.AssetRegistry)
+	for rows.Next() {
+		var (
+			a    misc.Asset
+			name sql.NullString
+		)
+		if err = rows.Scan(&a.ID, &name, &a.Slot); err != nil {
+			return nil, err
+		}
+		a.Name = name.String
+		r.Assets = append(r.Assets, a)
+	}
+	return r, rows.Err()
+}
+
+// PutAsset 保存资产，已存在的资产只更新名称，槽位不变
+func PutAsset(db *sql.DB, a misc.Asset) (err error) {
+	_, err = db.Exec(`
+		INSERT INTO Assets (id, name, slot) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name
+	`, a.ID, a.Name, a.Slot)
+	return
+}
+
+// SetPrimaryKeys 设置用户的主 CKKS 公钥和主 ECDSA 公钥
+func SetPrimaryKeys(db *sql.DB, userID, ckksKeyID, ecdsaKeyID uuid.UUID) (err error) {
+	_, err = db.Exec(`UPDATE Users SET primaryCKKSKeyID = ?, primaryECDSAKeyID = ? WHERE uuid = ?`,
+		ckksKeyID.String(), ecdsaKeyID.String(), userID.String())
+	return
+}
+
+// GetPendingTransactionsByUser 查询用户作为发送方或接收方、尚未结束的交易
+func GetPendingTransactionsByUser(db *sql.DB, userUUID uuid.UUID) (txs []*transaction.Transaction, err error) {
+	all, err := GetTransactionsByUser(db, userUUID, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range all {
+		switch tx.ConfirmingPhase {
+		case "confirmed", "rejected", "failed":
+		default:
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
+
+// CKKSKeyRotation 是一次 CKKS 密钥轮换需要写入的内容，见 RotateCKKSKey
+type CKKSKeyRotation struct {
+	User     uuid.UUID
+	OldKeyID uuid.UUID
+	NewKeyID uuid.UUID
+	NewKey   *rlwe.PublicKey
+	// OldBalance 为重加密前的余额原始字节，Balance 为重加密后的余额
+	OldBalance []byte
+	Balance    *rlwe.Ciphertext
+	// Transactions 为已重加密的待处理交易
+	Transactions []*transaction.Transaction
+	Certificates []*key.Certificate
+}
 
+// RotateCKKSKey 在一个事务中完成 CKKS 密钥轮换：
+// 保存新公钥并设为主密钥，替换余额和待处理交易的密文，更新证书链，删除引用旧公钥的 swk
+// 旧公钥保留在 CKKSKeyChains 中；仅当当前余额与 r.OldBalance 一致时才替换，否则返回 swapped = false
+func RotateCKKSKey(db *sql.DB, r *CKKSKeyRotation) (swapped bool, err error) {
+	pkBytes, err := misc.MarshalCompactPublicKey(r.NewKey, nil)
+	if err != nil {
+		return false, err
+	}
+	balanceBytes, err := misc.MarshalCompactCiphertext(r.Balance)
+	if err != nil {
+		return false, err
+	}
+	chainBytes, err := json.Marshal(r.Certificates)
+	if err != nil {
+		return false, err
+	}
+
+	dbTx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !swapped {
+			dbTx.Rollback()
+		}
+	}()
+
+	res, err := dbTx.Exec(`
+		UPDATE Users SET balance = ?, balanceOps = COALESCE(balanceOps, 0) + 1,
+			primaryCKKSKeyID = ?, certificates = ?
+		WHERE uuid = ? AND balance = ?
+	`, balanceBytes, r.NewKeyID.String(), chainBytes, r.User.String(), r.OldBalance)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return false, err
+	}
+
+	if _, err = dbTx.Exec(`INSERT INTO CKKSKeyChains (uuid, user, publicKey) VALUES (?, ?, ?)`,
+		r.NewKeyID.String(), r.User.String(), pkBytes); err != nil {
+		return false, err
+	}
+	for _, tx := range r.Transactions {
+		if err = writeTransaction(dbTx, tx); err != nil {
+			return false, err
+		}
+	}
+
+	// 未记录公钥的旧 swk 一定注册于轮换之前，一并删除
+	if _, err = dbTx.Exec(`
+		DELETE FROM SwitchingKeys
+		WHERE pkIn = ? OR pkOut = ?
+			OR ((userIn = ? OR userOut = ?) AND (pkIn IS NULL OR pkOut IS NULL))
+	`, r.OldKeyID.String(), r.OldKeyID.String(), r.User.String(), r.User.String()); err != nil {
+		return false, err
+	}
+
+	swapped = true
+	err = dbTx.Commit()
+	return
+}
+
+// GetPrimaryKeyIDs 查询用户的主 CKKS 公钥 ID 和主 ECDSA 公钥 ID
+func GetPrimaryKeyIDs(db *sql.DB, userID uuid.UUID) (ckksKeyID, ecdsaKeyID uuid.UUID, err error) {
+	var ckksID, ecdsaID sql.NullString
+	err = db.QueryRow(`SELECT primaryCKKSKeyID, primaryECDSAKeyID FROM Users WHERE uuid = ?`, userID.String()).
+		Scan(&ckksID, &ecdsaID)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	if !ckksID.Valid || !ecdsaID.Valid {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("primary keys of user %v are not set", userID)
+	}
+	if ckksKeyID, err = uuid.Parse(ckksID.String); err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	ecdsaKeyID, err = uuid.Parse(ecdsaID.String)
+	return
 }
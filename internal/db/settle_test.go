@@ -0,0 +1,76 @@
+package db_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/CamberLoid/Chimata/internal/users"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func newTestDatabase(t *testing.T) *sql.DB {
+	database, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	for _, stmt := range []string{db.CreateUserTable(), db.CreateTransactionTable()} {
+		if _, err = database.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.MigrateUserTable(database); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.MigrateTransactionTable(database); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func newTestAccount(t *testing.T, database *sql.DB, pk *rlwe.PublicKey, amount float64) uuid.UUID {
+	u := &users.User{UserIdentifier: uuid.New(), UserName: "test"}
+	if err := db.PutUserColumn(database, u, testutil.MustEncryptAmount(amount, pk)); err != nil {
+		t.Fatal(err)
+	}
+	return u.UserIdentifier
+}
+
+func mustBalanceBytes(t *testing.T, database *sql.DB, user uuid.UUID) []byte {
+	b, err := db.GetUserBalanceBytes(database, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func mustAdd(t *testing.T, balance []byte, amount float64, pk *rlwe.PublicKey) *rlwe.Ciphertext {
+	ct, err := misc.UnmarshalCiphertext(balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, err = misc.GetAmountScheme().Add(ct, testutil.MustEncryptAmount(amount, pk)); err != nil {
+		t.Fatal(err)
+	}
+	return ct
+}
+
+func TestSettleBalancesSameUser(t *testing.T) {
+	database := newTestDatabase(t)
+	_, pk := testutil.NewCKKSKeyPair()
+	user := newTestAccount(t, database, pk, 100)
+	old := mustBalanceBytes(t, database, user)
+
+	if _, err := db.SettleBalances(database,
+		db.BalanceUpdate{User: user, OldBalance: old, Balance: mustAdd(t, old, -30, pk)},
+		db.BalanceUpdate{User: user, OldBalance: old, Balance: mustAdd(t, old, 30, pk)},
+	); err == nil {
+		t.Error("updating one balance twice in a settlement should fail")
+	}
+}
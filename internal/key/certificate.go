@@ -0,0 +1,278 @@
+package key
+
+// certificate.go 定义了 CA 签发的证书
+// 证书将用户 UUID 绑定到其签名公钥以及 CKKS 公钥的指纹
+// CA 也可以为下级 CA 签发证书（IsCA = true），形成证书链
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+type Certificate struct {
+	Serial uuid.UUID `json:"serial"`
+	// Subject 为用户 UUID，CA 证书为 uuid.Nil
+	Subject uuid.UUID `json:"subject"`
+	Name    string    `json:"name"`
+	IsCA    bool      `json:"isCA"`
+	// PKIX 编码的签名公钥，算法见 SupportedSigAlgorithms
+	ECDSAPublicKey []byte `json:"ecdsaPublicKey"`
+	// CKKS 公钥指纹，见 CKKSKeyFingerprint；CA 证书为空
+	CKKSKeyHash string `json:"ckksKeyHash,omitempty"`
+	// 签发者签名公钥的指纹
+	Issuer    string `json:"issuer"`
+	NotBefore int64  `json:"notBefore"` //unix时间戳
+	NotAfter  int64  `json:"notAfter"`  //unix时间戳
+	Sig       []byte `json:"sig"`
+}
+
+// signedPayload 返回参与签名的字节，即去掉签名后的 JSON
+func (c Certificate) signedPayload() ([]byte, error) {
+	c.Sig = nil
+	return json.Marshal(c)
+}
+
+// Sign 由签发者调用，填写 Issuer 并签名
+func (c *Certificate) Sign(issuer crypto.Signer) (err error) {
+	if issuer == nil {
+		return errors.New("no signing key found")
+	}
+	c.Issuer = ECDSAKeyFingerprint(issuer.Public())
+
+	msg, err := c.signedPayload()
+	if err != nil {
+		return err
+	}
+	c.Sig, err = Sign(issuer, msg)
+	return
+}
+
+// Verify 使用签发者公钥验证证书签名
+func (c Certificate) Verify(issuer crypto.PublicKey) error {
+	if issuer == nil {
+		return errors.New("no issuer public key found")
+	}
+	if c.Issuer != ECDSAKeyFingerprint(issuer) {
+		return fmt.Errorf("certificate %v is not issued by key %s", c.Serial, ECDSAKeyFingerprint(issuer))
+	}
+	msg, err := c.signedPayload()
+	if err != nil {
+		return err
+	}
+	if !Verify(issuer, msg, c.Sig) {
+		return fmt.Errorf("certificate %v signature verify failed", c.Serial)
+	}
+	return nil
+}
+
+// PublicKey 返回证书绑定的签名公钥
+func (c Certificate) PublicKey() (crypto.PublicKey, error) {
+	pk, _, err := UnmarshalSigningPublicKey(c.ECDSAPublicKey)
+	return pk, err
+}
+
+// Matches 检查证书是否绑定了给定的用户和密钥
+func (c Certificate) Matches(subject uuid.UUID, signingPK crypto.PublicKey, ckksPK *rlwe.PublicKey) error {
+	switch {
+	case c.IsCA:
+		return fmt.Errorf("certificate %v is a CA certificate", c.Serial)
+	case c.Subject != subject:
+		return fmt.Errorf("certificate subject %v does not match user %v", c.Subject, subject)
+	case signingPK == nil || !bytes.Equal(c.ECDSAPublicKey, MarshalSigningPublicKey(signingPK)):
+		return fmt.Errorf("certificate signing key does not match user %v", subject)
+	case ckksPK == nil || c.CKKSKeyHash != CKKSKeyFingerprint(ckksPK):
+		return fmt.Errorf("certificate ckks key hash does not match user %v", subject)
+	}
+	return nil
+}
+
+// VerifyCertificateChain 验证证书链，chain[0] 为用户证书，其后依次为上级 CA 证书
+// 最后一张证书须由 root 签发；isRevoked 用于检查链上各证书的公钥指纹，可以为 nil
+// 返回用户证书
+func VerifyCertificateChain(chain []*Certificate, root crypto.PublicKey, now time.Time, isRevoked func(keyID string) bool) (*Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	if chain[0].IsCA {
+		return nil, errors.New("leaf certificate is a CA certificate")
+	}
+
+	for i, c := range chain {
+		if i != 0 && !c.IsCA {
+			return nil, fmt.Errorf("certificate %v is not a CA certificate", c.Serial)
+		}
+		if now.Unix() < c.NotBefore || now.Unix() >= c.NotAfter {
+			return nil, fmt.Errorf("certificate %v is expired or not yet valid", c.Serial)
+		}
+		if isRevoked != nil {
+			fp, err := certificateKeyFingerprint(c)
+			if err != nil {
+				return nil, err
+			}
+			if isRevoked(fp) {
+				return nil, fmt.Errorf("key %s of certificate %v has been revoked", fp, c.Serial)
+			}
+		}
+
+		issuer := root
+		if i+1 < len(chain) {
+			var err error
+			if issuer, err = chain[i+1].PublicKey(); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.Verify(issuer); err != nil {
+			return nil, err
+		}
+	}
+	return chain[0], nil
+}
+
+func certificateKeyFingerprint(c *Certificate) (string, error) {
+	pk, err := c.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	return ECDSAKeyFingerprint(pk), nil
+}
+
+// CertificateRequestMessage 返回证书申请中由用户签名的内容
+// 用于向 CA 证明持有对应的签名私钥
+func CertificateRequestMessage(subject uuid.UUID, name string, ecdsaPK, ckksPK []byte) []byte {
+	msg := append([]byte("CertificateRequest+"), subject[:]...)
+	for _, field := range [][]byte{[]byte(name), ecdsaPK, ckksPK} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return msg
+}
+
+// RotateCKKSKeyMessage 返回 CKKS 密钥轮换请求中由用户签名的内容
+// 包含旧公钥的指纹，轮换完成后重放同一请求会因旧公钥不符而被拒绝
+// keyID 为新公钥的 ID，为零值时由服务端分配
+func RotateCKKSKeyMessage(subject, keyID uuid.UUID, oldKeyFingerprint string, ckksPK, swk []byte) []byte {
+	msg := append([]byte("RotateCKKSKey+"), subject[:]...)
+	msg = append(msg, keyID[:]...)
+	for _, field := range [][]byte{[]byte(oldKeyFingerprint), ckksPK, swk} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return msg
+}
+
+// AddECDSAKeyMessage 返回为用户添加 ECDSA 公钥（如设备密钥）的请求中由已有密钥签名的内容
+func AddECDSAKeyMessage(subject, keyID uuid.UUID, ecdsaPK []byte) []byte {
+	msg := append([]byte("AddECDSAKey+"), subject[:]...)
+	msg = append(msg, keyID[:]...)
+	return append(msg, ecdsaPK...)
+}
+
+// RegisterUserMessage 返回注册用户的请求中以证书中的签名公钥签名的内容，证明注册者持有对应的私钥
+// ckksPubkey 和 signingPubkey 为请求中公钥解码后的字节；timestamp（unix 时间）和 nonce 使请求不能被重放
+func RegisterUserMessage(subject uuid.UUID, name string, ckksKeyID, signingKeyID uuid.UUID, ckksPubkey, signingPubkey []byte, timestamp int64, nonce uuid.UUID) []byte {
+	msg := append([]byte("RegisterUser+"), subject[:]...)
+	msg = append(msg, ckksKeyID[:]...)
+	msg = append(msg, signingKeyID[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(timestamp))
+	msg = append(msg, nonce[:]...)
+	for _, field := range [][]byte{[]byte(name), ckksPubkey, signingPubkey} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return msg
+}
+
+// RegisterEvaluationKeyMessage 返回为 CKKS 公钥 keyID 注册计算密钥的请求中签名的内容
+// keyID 为零值时表示主公钥，evk 为 misc.MarshalEvaluationKey 的结果
+func RegisterEvaluationKeyMessage(subject, keyID uuid.UUID, evk []byte) []byte {
+	msg := append([]byte("RegisterEvaluationKey+"), subject[:]...)
+	msg = append(msg, keyID[:]...)
+	return append(msg, evk...)
+}
+
+// RegisterAuditorSwkMessage 返回为 CKKS 公钥 keyID 注册到监管者透支密钥的 swk 的请求中签名的内容
+// keyID 为零值时表示主公钥，swk 为 misc.MarshalCompactSwitchingKey 的结果
+func RegisterAuditorSwkMessage(subject, keyID uuid.UUID, swk []byte) []byte {
+	msg := append([]byte("RegisterAuditorSwk+"), subject[:]...)
+	msg = append(msg, keyID[:]...)
+	return append(msg, swk...)
+}
+
+// EnrollProductMessage 返回用户加入或退出账户产品的请求中签名的内容
+// timestamp（unix 时间）和 nonce 使请求不能被重放
+func EnrollProductMessage(subject uuid.UUID, product string, enrolled bool, timestamp int64, nonce uuid.UUID) []byte {
+	msg := append([]byte("EnrollProduct+"), subject[:]...)
+	if enrolled {
+		msg = append(msg, 1)
+	} else {
+		msg = append(msg, 0)
+	}
+	msg = binary.BigEndian.AppendUint64(msg, uint64(timestamp))
+	msg = append(msg, nonce[:]...)
+	return append(msg, product...)
+}
+
+// AuditorSwkCertMessage 返回监管者为到其透支密钥的 swk 出具证明时签名的内容
+// ckksKeyFingerprint 为 swk 源公钥的指纹，见 CKKSKeyFingerprint；监管者已用该公钥验证 swk 能正确重加密，
+// 且 evk（服务端保存的计算密钥）中的重线性化密钥能正确计算乘法
+func AuditorSwkCertMessage(subject, keyID uuid.UUID, ckksKeyFingerprint string, swk, evk []byte) []byte {
+	msg := append([]byte("AuditorSwkCert+"), subject[:]...)
+	msg = append(msg, keyID[:]...)
+	for _, field := range [][]byte{[]byte(ckksKeyFingerprint), swk, evk} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return msg
+}
+
+// OverdraftCheckMessage 返回服务端请求监管者判断交易是否透支时签名的内容
+// timestamp（unix 时间）和 nonce 使请求不能被重放
+func OverdraftCheckMessage(txUUID, subject uuid.UUID, slots []int, indicator []byte, timestamp int64, nonce uuid.UUID) []byte {
+	msg := append([]byte("OverdraftCheck+"), txUUID[:]...)
+	msg = append(msg, subject[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(timestamp))
+	msg = append(msg, nonce[:]...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(slots)))
+	for _, slot := range slots {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(slot))
+	}
+	return append(msg, indicator...)
+}
+
+// RegisterShareMessage 返回向门限监管者提交私钥份额的请求中由用户签名的内容
+// signingKey 为用户签名公钥的 PKIX 编码，监管者保存它，之后替换份额的请求须由它签名
+// timestamp（unix 时间）和 nonce 使请求不能被重放
+func RegisterShareMessage(subject uuid.UUID, point uint64, threshold int, share, signingKey []byte, timestamp int64, nonce uuid.UUID) []byte {
+	msg := append([]byte("RegisterShare+"), subject[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, point)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(threshold))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(timestamp))
+	msg = append(msg, nonce[:]...)
+	for _, field := range [][]byte{share, signingKey} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(field)))
+		msg = append(msg, field...)
+	}
+	return msg
+}
+
+// PartialDecryptMessage 返回服务端请求门限监管者部分解密时签名的内容
+// ref 为密文所属的交易或余额刷新的 UUID，actives 为参与解密的监管者公开点
+func PartialDecryptMessage(ref, subject uuid.UUID, ct []byte, actives []uint64, timestamp int64, nonce uuid.UUID) []byte {
+	msg := append([]byte("PartialDecrypt+"), ref[:]...)
+	msg = append(msg, subject[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(timestamp))
+	msg = append(msg, nonce[:]...)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(actives)))
+	for _, p := range actives {
+		msg = binary.BigEndian.AppendUint64(msg, p)
+	}
+	return append(msg, ct...)
+}
@@ -0,0 +1,77 @@
+package key
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// 密钥指纹：公钥序列化结果的 SHA-256，十六进制编码
+// 各方（CA、服务端、客户端）都可以独立计算，用作吊销列表中的密钥标识
+
+// ECDSAKeyFingerprint 计算签名公钥的指纹，支持的算法见 SupportedSigAlgorithms
+func ECDSAKeyFingerprint(pk crypto.PublicKey) string {
+	return fingerprint(MarshalSigningPublicKey(pk))
+}
+
+func CKKSKeyFingerprint(pk *rlwe.PublicKey) string {
+	return fingerprint(MarshalCKKSPayload(pk))
+}
+
+func fingerprint(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// LoadOrGenerateECDSAKeyPEM 从 PEM 文件读取 ECDSA 私钥
+// 文件不存在时生成新的私钥，并将公钥写入 path + ".pub"，供其他各方配置
+// 用于 CA、监管者等长期持有的签名密钥
+func LoadOrGenerateECDSAKeyPEM(path string) (sk *ecdsa.PrivateKey, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sk, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	skBytes, err := x509.MarshalECPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: skBytes}), 0600); err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: MarshalECDSAPublicKey(&sk.PublicKey)}), 0644)
+	return
+}
+
+// LoadECDSAPublicKeyPEM 从 PEM 文件读取 ECDSA 公钥
+func LoadECDSAPublicKeyPEM(path string) (*ecdsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+	return UnmarshalECDSAPublicKey(block.Bytes)
+}
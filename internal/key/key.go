@@ -1,69 +1,128 @@
-//lint:ignore U1000 Ignore unused function temporarily for debugging
-
 // 包 Key 包含了方案中可能用到的各种密码学密钥的生成等
 package key
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto"
 
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/google/uuid"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 var (
-	// 预设的 CKKS 安全参数
-	params, _ = ckks.NewParametersFromLiteral(ckks.PN12QP109)
+	// 新生成的用户签名密钥所用的算法，见 SupportedSigAlgorithms
+	UserSigAlgorithm SigAlgorithm = DefaultSigAlgorithm
 )
 
 type CKKSKeyChain struct {
 	Identifier     uuid.UUID
 	CKKSPrivateKey *rlwe.SecretKey
 	CKKSPublicKey  *rlwe.PublicKey
+	// 生成公钥时使用的种子，用于紧凑序列化，未知时为 nil，见 misc.GenSeededPublicKey
+	CKKSPublicKeySeed []byte
+	// 重线性化密钥和旋转密钥，只能由私钥持有者生成，可以为 nil
+	CKKSEvaluationKey *rlwe.EvaluationKey
 }
 
-type ECDSAKeyChain struct {
-	Identifier      uuid.UUID
-	ECDSAPrivateKey *ecdsa.PrivateKey
-	ECDSAPublicKey  *ecdsa.PublicKey
+// SigningKeyChain 为用户的签名密钥链，算法见 signature.go
+type SigningKeyChain struct {
+	Identifier uuid.UUID
+	Algorithm  SigAlgorithm
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
 }
 
+// ECDSAKeyChain 为 SigningKeyChain 的旧名称，签名密钥最初只支持 ECDSA
+type ECDSAKeyChain = SigningKeyChain
+
 type KeyChain struct {
 	CKKSKeyChain  CKKSKeyChain
 	ECDSAKeyChain ECDSAKeyChain
 }
 
+// UserKeyGenerator 生成用户的密钥链，生成的密钥链带有新的标识符
 type UserKeyGenerator interface {
-	GenerateUserCKKSKey()
-	GenerateUserECDSAKey()
+	GenerateUserCKKSKey() (*CKKSKeyChain, error)
+	GenerateUserECDSAKey() (*ECDSAKeyChain, error)
 }
 
-// Generate a key pair for ECDSA and CKKS Scheme
-// Returns
-func genKey() {
-	panic("Not implemented yet!")
+// LocalKeyGenerator 在本地生成用户密钥，实现了 UserKeyGenerator
+type LocalKeyGenerator struct {
+	Params rlwe.Parameters
+	// 签名密钥的算法，为空时使用 UserSigAlgorithm
+	SigAlgorithm SigAlgorithm
+	// 需要生成旋转密钥的步长，为空时只生成重线性化密钥
+	Rotations []int
 }
 
-// Generate a key pair for transaction signing
-func genKeySign() (ecdsa.PrivateKey, ecdsa.PublicKey) {
-	sk, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
-	pk := sk.PublicKey
-	return *sk, pk
+func NewLocalKeyGenerator() *LocalKeyGenerator {
+	return &LocalKeyGenerator{Params: misc.GetRLWEParams()}
 }
 
-func genKeyCKKS() (*rlwe.PublicKey, *rlwe.SecretKey) {
+// GenerateUserCKKSKey 生成 CKKS 密钥对及其重线性化密钥、旋转密钥
+func (g LocalKeyGenerator) GenerateUserCKKSKey() (*CKKSKeyChain, error) {
+	sk := rlwe.NewKeyGenerator(g.Params).GenSecretKey()
+	return g.NewCKKSKeyChainFromSecretKey(sk), nil
+}
 
-	ckksKeyGenerator := ckks.NewKeyGenerator(params)
-	sk, pk := ckksKeyGenerator.GenKeyPair()
+// GenerateUserECDSAKey 生成签名密钥对，算法为 g.SigAlgorithm
+func (g LocalKeyGenerator) GenerateUserECDSAKey() (*ECDSAKeyChain, error) {
+	alg := g.SigAlgorithm
+	if alg == "" {
+		alg = UserSigAlgorithm
+	}
+	sk, err := GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKeyChain(sk)
+}
 
-	return pk, sk
+// NewCKKSKeyChainFromSecretKey 由私钥生成公钥和计算密钥，标识符为新的 UUID
+func (g LocalKeyGenerator) NewCKKSKeyChainFromSecretKey(sk *rlwe.SecretKey) *CKKSKeyChain {
+	// 种子生成失败时退回到不带种子的公钥
+	pk, seed, err := misc.GenSeededPublicKey(sk)
+	if err != nil {
+		pk, seed = rlwe.NewKeyGenerator(g.Params).GenPublicKey(sk), nil
+	}
+	return &CKKSKeyChain{
+		Identifier:        uuid.New(),
+		CKKSPrivateKey:    sk,
+		CKKSPublicKey:     pk,
+		CKKSPublicKeySeed: seed,
+		CKKSEvaluationKey: g.GenEvaluationKey(sk),
+	}
 }
 
-// TO-DO: 从本地文件中读取 CKKS 密钥
-// Consider rlwe.marshal
-func importKeyCKKS() {
-	panic("Not implemented yet!")
+// GenEvaluationKey 由私钥生成重线性化密钥和 g.Rotations 的旋转密钥
+func (g LocalKeyGenerator) GenEvaluationKey(sk *rlwe.SecretKey) *rlwe.EvaluationKey {
+	keygen := rlwe.NewKeyGenerator(g.Params)
+	evk := &rlwe.EvaluationKey{Rlk: keygen.GenRelinearizationKey(sk, 1)}
+	if len(g.Rotations) != 0 {
+		evk.Rtks = keygen.GenRotationKeysForRotations(g.Rotations, false, sk)
+	}
+	return evk
+}
+
+// GenerateUserKeyChain 生成一个完整的用户密钥链
+func GenerateUserKeyChain(g UserKeyGenerator) (kc *KeyChain, err error) {
+	ckksKeyChain, err := g.GenerateUserCKKSKey()
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKeyChain, err := g.GenerateUserECDSAKey()
+	if err != nil {
+		return nil, err
+	}
+	return &KeyChain{*ckksKeyChain, *ecdsaKeyChain}, nil
+}
 
+// ImportCKKSSecretKey 从 rlwe.SecretKey.MarshalBinary 的结果中导入私钥
+// 公钥和计算密钥由私钥重新生成
+func (g LocalKeyGenerator) ImportCKKSSecretKey(data []byte) (*CKKSKeyChain, error) {
+	sk := rlwe.NewSecretKey(g.Params)
+	if err := sk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return g.NewCKKSKeyChainFromSecretKey(sk), nil
 }
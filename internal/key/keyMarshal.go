@@ -5,7 +5,7 @@ import (
 	"crypto/x509"
 	"fmt"
 
-	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
@@ -37,15 +37,15 @@ func MarshalCKKSPayload(pk CKKSPayload) []byte {
 	return data
 }
 
+// MarshalPublicKey 以紧凑格式序列化公钥，已知种子时只保存公钥的一半
+func (kc CKKSKeyChain) MarshalPublicKey() ([]byte, error) {
+	return misc.MarshalCompactPublicKey(kc.CKKSPublicKey, kc.CKKSPublicKeySeed)
+}
+
 func UnmarshalCKKSPublicKey(data []byte) (pk *rlwe.PublicKey, err error) {
-	err = pk.UnmarshalBinary(data)
-	return
+	return misc.UnmarshalPublicKey(data)
 }
 
 func UnmarshalCKKSCipherText(data []byte) (ct *rlwe.Ciphertext, err error) {
-	ct = ckks.NewCiphertext(
-		params, 1, params.MaxLevel(),
-	)
-	err = ct.UnmarshalBinary(data)
-	return
+	return misc.UnmarshalCiphertext(data)
 }
@@ -0,0 +1,100 @@
+package key
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RevokedKey 是吊销列表中的一项，KeyID 为密钥指纹，见 ECDSAKeyFingerprint
+type RevokedKey struct {
+	KeyID     string `json:"keyID"`
+	RevokedAt int64  `json:"revokedAt"` //unix时间戳
+	Reason    string `json:"reason"`
+}
+
+// RevocationList 是由 CA 签名发布的密钥吊销列表
+// Serial 单调递增，各方只接受不低于已知序号的列表，防止回滚
+type RevocationList struct {
+	Serial     int64        `json:"serial"`
+	IssuedAt   int64        `json:"issuedAt"`   //unix时间戳
+	NextUpdate int64        `json:"nextUpdate"` //unix时间戳
+	Revoked    []RevokedKey `json:"revoked"`
+	Sig        []byte       `json:"sig"`
+}
+
+// signedPayload 返回参与签名的字节，即去掉签名后的 JSON
+func (l RevocationList) signedPayload() ([]byte, error) {
+	l.Sig = nil
+	return json.Marshal(l)
+}
+
+// Sign 由 CA 调用，更新签发时间并签名
+func (l *RevocationList) Sign(sk *ecdsa.PrivateKey, validFor time.Duration) (err error) {
+	if sk == nil {
+		return errors.New("no signing key found")
+	}
+	now := time.Now()
+	l.IssuedAt = now.Unix()
+	l.NextUpdate = now.Add(validFor).Unix()
+
+	msg, err := l.signedPayload()
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(msg)
+	l.Sig, err = ecdsa.SignASN1(rand.Reader, sk, hash[:])
+	return
+}
+
+// Verify 使用 CA 公钥验证吊销列表
+func (l RevocationList) Verify(pk *ecdsa.PublicKey) error {
+	if pk == nil {
+		return errors.New("no CA public key found")
+	}
+	msg, err := l.signedPayload()
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(msg)
+	if !ecdsa.VerifyASN1(pk, hash[:], l.Sig) {
+		return fmt.Errorf("revocation list signature verify failed")
+	}
+	return nil
+}
+
+// Add 添加一项吊销，已吊销的密钥不会重复添加
+// 调用后需要重新签名
+func (l *RevocationList) Add(keyID, reason string) bool {
+	if l.IsRevoked(keyID) {
+		return false
+	}
+	l.Serial++
+	l.Revoked = append(l.Revoked, RevokedKey{
+		KeyID:     keyID,
+		RevokedAt: time.Now().Unix(),
+		Reason:    reason,
+	})
+	return true
+}
+
+func (l *RevocationList) IsRevoked(keyID string) bool {
+	if l == nil {
+		return false
+	}
+	for _, r := range l.Revoked {
+		if r.KeyID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStale 判断列表是否已经超过下次更新时间
+func (l RevocationList) IsStale(now time.Time) bool {
+	return now.Unix() > l.NextUpdate
+}
@@ -0,0 +1,197 @@
+package key
+
+// seed.go 由助记词种子确定性地派生用户密钥，用于备份和恢复
+// 助记词为 BIP-39 格式，种子经 HKDF-SHA512 按用途和序号派生子密钥：
+//   - CKKS 私钥：子密钥作为 lattigo KeyedPRNG 的密钥，按 GenSecretKey 相同的分布采样
+//   - 签名私钥：Ed25519 以子密钥为种子，ECDSA 由子密钥归约得到私钥标量
+//   - 密钥标识符：同样由子密钥派生，恢复时无需记录
+//
+// 公钥和计算密钥仍使用随机数生成，只有私钥和标识符是确定的
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/cosmos/go-bip39"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/utils"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// 助记词的熵长度，256 位对应 24 个单词
+	MnemonicEntropyBits = 256
+
+	seedKDFSalt = "Chimata-Seed-v1"
+)
+
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+// NewMnemonic 生成新的助记词
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(MnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// SeedFromMnemonic 由助记词和可选的口令得到种子，助记词校验和错误时返回 ErrInvalidMnemonic
+func SeedFromMnemonic(mnemonic, passphrase string) ([]byte, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMnemonic, err)
+	}
+	return seed, nil
+}
+
+// SeedKeyGenerator 由种子派生用户密钥，实现了 UserKeyGenerator
+// 同一种子、参数集和序号总是得到相同的私钥和标识符
+type SeedKeyGenerator struct {
+	LocalKeyGenerator
+	Seed []byte
+	// 密钥序号，CKKS 密钥和签名密钥分别计数
+	CKKSIndex, SigIndex uint32
+}
+
+func NewSeedKeyGenerator(seed []byte) *SeedKeyGenerator {
+	return &SeedKeyGenerator{LocalKeyGenerator: *NewLocalKeyGenerator(), Seed: seed}
+}
+
+// GenerateUserCKKSKey 派生第 g.CKKSIndex 个 CKKS 密钥
+func (g SeedKeyGenerator) GenerateUserCKKSKey() (*CKKSKeyChain, error) {
+	sk, err := g.CKKSSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	id, err := g.deriveIdentifier("ckks-id", g.CKKSIndex)
+	if err != nil {
+		return nil, err
+	}
+	kc := g.NewCKKSKeyChainFromSecretKey(sk)
+	kc.Identifier = id
+	return kc, nil
+}
+
+// GenerateUserECDSAKey 派生第 g.SigIndex 个签名密钥，算法为 g.SigAlgorithm
+func (g SeedKeyGenerator) GenerateUserECDSAKey() (*ECDSAKeyChain, error) {
+	alg := g.SigAlgorithm
+	if alg == "" {
+		alg = UserSigAlgorithm
+	}
+	sk, err := g.SigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	kc, err := NewSigningKeyChain(sk)
+	if err != nil {
+		return nil, err
+	}
+	if kc.Identifier, err = g.deriveIdentifier("sig-id/"+string(alg), g.SigIndex); err != nil {
+		return nil, err
+	}
+	return kc, nil
+}
+
+// CKKSSecretKey 派生第 g.CKKSIndex 个 CKKS 私钥
+func (g SeedKeyGenerator) CKKSSecretKey() (*rlwe.SecretKey, error) {
+	if g.Params.HammingWeight() <= 0 {
+		return nil, errors.New("parameter set has no secret key hamming weight")
+	}
+	prng, err := utils.NewKeyedPRNG(g.derive("ckks", g.CKKSIndex, 64))
+	if err != nil {
+		return nil, err
+	}
+
+	// 同 rlwe.KeyGenerator.GenSecretKey，只是随机源换为 prng
+	ringQP := g.Params.RingQP()
+	sk := rlwe.NewSecretKey(g.Params)
+	ring.NewTernarySamplerWithHammingWeight(prng, g.Params.RingQ(), g.Params.HammingWeight(), false).Read(sk.Value.Q)
+	levelQ, levelP := sk.LevelQ(), sk.LevelP()
+	if levelP > -1 {
+		ringQP.ExtendBasisSmallNormAndCenter(sk.Value.Q, levelP, nil, sk.Value.P)
+	}
+	ringQP.NTTLvl(levelQ, levelP, sk.Value, sk.Value)
+	ringQP.MFormLvl(levelQ, levelP, sk.Value, sk.Value)
+	return sk, nil
+}
+
+// SigningKey 派生第 g.SigIndex 个 alg 签名私钥
+func (g SeedKeyGenerator) SigningKey(alg SigAlgorithm) (crypto.Signer, error) {
+	label := "sig/" + string(alg)
+	switch alg {
+	case SigEd25519:
+		return ed25519.NewKeyFromSeed(g.derive(label, g.SigIndex, ed25519.SeedSize)), nil
+	case SigECDSAP256:
+		return deriveECDSAKey(elliptic.P256(), g.derive(label, g.SigIndex, 32+16)), nil
+	case SigECDSAP384:
+		return deriveECDSAKey(elliptic.P384(), g.derive(label, g.SigIndex, 48+16)), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedSigAlgorithm, alg)
+}
+
+// deriveECDSAKey 将 b 归约到 [1, N-1] 作为私钥标量，b 比 N 多 16 字节以使偏差可忽略
+func deriveECDSAKey(curve elliptic.Curve, b []byte) *ecdsa.PrivateKey {
+	n := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, n).Add(d, big.NewInt(1))
+
+	sk := &ecdsa.PrivateKey{D: d}
+	sk.PublicKey.Curve = curve
+	sk.PublicKey.X, sk.PublicKey.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, (curve.Params().BitSize+7)/8)))
+	return sk
+}
+
+func (g SeedKeyGenerator) deriveIdentifier(label string, index uint32) (uuid.UUID, error) {
+	return uuid.NewRandomFromReader(bytes.NewReader(g.derive(label, index, 16)))
+}
+
+// derive 以 HKDF-SHA512 派生 label 的第 index 个子密钥
+func (g SeedKeyGenerator) derive(label string, index uint32, n int) []byte {
+	info := fmt.Sprintf("%s/%d", label, index)
+	out := make([]byte, n)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, g.Seed, []byte(seedKDFSalt), []byte(info)), out); err != nil {
+		// HKDF 的输出长度远小于上限，不会出错
+		panic(err)
+	}
+	return out
+}
+
+// 公钥噪声系数的上界，远大于高斯噪声的截断界，远小于模数
+const keyPairNoiseBound = 1 << 16
+
+// CheckCKKSKeyPair 检查私钥与公钥是否匹配
+// 公钥为 (-a·s + e, a)，私钥正确时 pk[0] + pk[1]·s = e 的系数很小，只检查第一个模数
+func CheckCKKSKeyPair(params rlwe.Parameters, sk *rlwe.SecretKey, pk *rlwe.PublicKey) error {
+	ringQ := params.RingQ()
+	e, a := pk.Value[0].Q.CopyNew(), pk.Value[1].Q.CopyNew()
+	if pk.IsMontgomery {
+		ringQ.InvMFormLvl(0, e, e)
+		ringQ.InvMFormLvl(0, a, a)
+	}
+	ringQ.MulCoeffsMontgomeryAndAddLvl(0, a, sk.Value.Q, e)
+	if pk.IsNTT {
+		ringQ.InvNTTLvl(0, e, e)
+	}
+
+	q := ringQ.Modulus[0]
+	for _, c := range e.Coeffs[0] {
+		if c > q/2 {
+			c = q - c
+		}
+		if c > keyPairNoiseBound {
+			return errors.New("secret key does not match the public key")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package key
+
+// signature.go 定义了用户签名密钥的算法
+// 签名密钥链（SigningKeyChain）记录所用的算法，签名和验证按密钥类型分派：
+//   - ECDSA P-256：对 SHA-256 摘要签名，ASN.1 编码
+//   - ECDSA P-384：对 SHA-384 摘要签名，ASN.1 编码
+//   - Ed25519：对原始消息签名
+//
+// 公钥统一以 PKIX 编码，私钥以 PKCS #8 编码
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// SigAlgorithm 为签名算法的标识
+type SigAlgorithm string
+
+const (
+	SigECDSAP256 SigAlgorithm = "ecdsa-p256"
+	SigECDSAP384 SigAlgorithm = "ecdsa-p384"
+	SigEd25519   SigAlgorithm = "ed25519"
+)
+
+// 未指明算法的旧密钥均为 P-256 上的 ECDSA 密钥
+const DefaultSigAlgorithm = SigECDSAP256
+
+// SupportedSigAlgorithms 为方案支持的签名算法
+var SupportedSigAlgorithms = []SigAlgorithm{SigECDSAP256, SigECDSAP384, SigEd25519}
+
+var ErrUnsupportedSigAlgorithm = errors.New("unsupported signature algorithm")
+
+// ParseSigAlgorithm 解析算法标识，空串为 DefaultSigAlgorithm
+func ParseSigAlgorithm(s string) (SigAlgorithm, error) {
+	if s == "" {
+		return DefaultSigAlgorithm, nil
+	}
+	for _, alg := range SupportedSigAlgorithms {
+		if SigAlgorithm(s) == alg {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnsupportedSigAlgorithm, s)
+}
+
+// SigAlgorithmOf 返回公钥所属的签名算法
+func SigAlgorithmOf(pk crypto.PublicKey) (SigAlgorithm, error) {
+	switch pk := pk.(type) {
+	case *ecdsa.PublicKey:
+		switch pk.Curve {
+		case elliptic.P256():
+			return SigECDSAP256, nil
+		case elliptic.P384():
+			return SigECDSAP384, nil
+		}
+		return "", fmt.Errorf("%w: ecdsa over %s", ErrUnsupportedSigAlgorithm, pk.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return SigEd25519, nil
+	}
+	return "", fmt.Errorf("%w: %T", ErrUnsupportedSigAlgorithm, pk)
+}
+
+// GenerateSigningKey 生成 alg 的私钥
+func GenerateSigningKey(alg SigAlgorithm) (crypto.Signer, error) {
+	switch alg {
+	case SigECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case SigECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case SigEd25519:
+		_, sk, err := ed25519.GenerateKey(rand.Reader)
+		return sk, err
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedSigAlgorithm, alg)
+}
+
+// Sign 以私钥 sk 对 msg 签名，摘要算法由密钥类型决定
+func Sign(sk crypto.Signer, msg []byte) ([]byte, error) {
+	if sk == nil {
+		return nil, errors.New("no signing key found")
+	}
+	switch sk := sk.(type) {
+	case *ecdsa.PrivateKey:
+		digest, err := ecdsaDigest(&sk.PublicKey, msg)
+		if err != nil {
+			return nil, err
+		}
+		return ecdsa.SignASN1(rand.Reader, sk, digest)
+	case ed25519.PrivateKey:
+		return ed25519.Sign(sk, msg), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedSigAlgorithm, sk)
+}
+
+// Verify 以公钥 pk 验证 msg 的签名，不支持的密钥类型视为验证失败
+func Verify(pk crypto.PublicKey, msg, sig []byte) bool {
+	switch pk := pk.(type) {
+	case *ecdsa.PublicKey:
+		digest, err := ecdsaDigest(pk, msg)
+		if err != nil {
+			return false
+		}
+		return ecdsa.VerifyASN1(pk, digest, sig)
+	case ed25519.PublicKey:
+		return len(pk) == ed25519.PublicKeySize && ed25519.Verify(pk, msg, sig)
+	}
+	return false
+}
+
+func ecdsaDigest(pk *ecdsa.PublicKey, msg []byte) ([]byte, error) {
+	alg, err := SigAlgorithmOf(pk)
+	if err != nil {
+		return nil, err
+	}
+	if alg == SigECDSAP384 {
+		h := sha512.Sum384(msg)
+		return h[:], nil
+	}
+	h := sha256.Sum256(msg)
+	return h[:], nil
+}
+
+// MarshalSigningPublicKey 以 PKIX 编码签名公钥
+func MarshalSigningPublicKey(pk crypto.PublicKey) []byte {
+	data, _ := x509.MarshalPKIXPublicKey(pk)
+	return data
+}
+
+// UnmarshalSigningPublicKey 解析 PKIX 编码的签名公钥，只接受 SupportedSigAlgorithms 中的算法
+func UnmarshalSigningPublicKey(data []byte) (pk crypto.PublicKey, alg SigAlgorithm, err error) {
+	if pk, err = x509.ParsePKIXPublicKey(data); err != nil {
+		return nil, "", err
+	}
+	if alg, err = SigAlgorithmOf(pk); err != nil {
+		return nil, "", err
+	}
+	return pk, alg, nil
+}
+
+// UnmarshalSigningPublicKeyAs 解析签名公钥，并检查其算法与声明的 claimed 一致，claimed 为空时不检查
+// 用于解析请求中的公钥及其算法字段
+func UnmarshalSigningPublicKeyAs(data []byte, claimed string) (pk crypto.PublicKey, alg SigAlgorithm, err error) {
+	if pk, alg, err = UnmarshalSigningPublicKey(data); err != nil {
+		return nil, "", err
+	}
+	if claimed != "" && SigAlgorithm(claimed) != alg {
+		return nil, "", fmt.Errorf("signing key is %s, declared as %q", alg, claimed)
+	}
+	return pk, alg, nil
+}
+
+// MarshalSigningPrivateKey 以 PKCS #8 编码签名私钥
+func MarshalSigningPrivateKey(sk crypto.Signer) ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(sk)
+}
+
+// UnmarshalSigningPrivateKey 解析 PKCS #8 编码的签名私钥，也接受旧版本使用的 SEC 1 编码的 ECDSA 私钥
+func UnmarshalSigningPrivateKey(data []byte) (crypto.Signer, error) {
+	skAny, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return x509.ParseECPrivateKey(data)
+	}
+	sk, ok := skAny.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedSigAlgorithm, skAny)
+	}
+	if _, err = SigAlgorithmOf(sk.Public()); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// NewSigningKeyChain 由私钥生成签名密钥链，标识符为新的 UUID
+func NewSigningKeyChain(sk crypto.Signer) (*SigningKeyChain, error) {
+	alg, err := SigAlgorithmOf(sk.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKeyChain{
+		Identifier: uuid.New(),
+		Algorithm:  alg,
+		PrivateKey: sk,
+		PublicKey:  sk.Public(),
+	}, nil
+}
@@ -0,0 +1,145 @@
+package misc
+
+// asset.go 定义了资产注册表
+// 每种资产（币种、积分等）占用余额密文的一个槽位，槽位 0 为默认资产
+// 同一密文中各资产的金额互不影响，转账时未涉及的资产槽位为 0
+// 最高的 ReservedSlots 个槽位保留给转账的范围证明，见 transaction.ProveAmounts
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+const (
+	DefaultAssetID   = "default"
+	DefaultAssetSlot = 0
+
+	// ReservedSlots 是密文顶部不分配给资产的槽位数
+	ReservedSlots = 8
+)
+
+var assetIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Asset 是注册表中的一项
+type Asset struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Slot int    `json:"slot"`
+}
+
+// AssetRegistry 是资产到槽位的映射，由服务端维护并在 /assets 公布
+type AssetRegistry struct {
+	Assets []Asset `json:"assets"`
+}
+
+// NewAssetRegistry 返回只包含默认资产的注册表
+func NewAssetRegistry() *AssetRegistry {
+	return &AssetRegistry{Assets: []Asset{{ID: DefaultAssetID, Name: "Default", Slot: DefaultAssetSlot}}}
+}
+
+// Get 按 ID 查找资产
+func (r *AssetRegistry) Get(id string) (Asset, error) {
+	for _, a := range r.Assets {
+		if a.ID == id {
+			return a, nil
+		}
+	}
+	return Asset{}, fmt.Errorf("unknown asset %q", id)
+}
+
+// Add 注册新的资产，占用下一个空闲槽位
+// 已注册的资产直接返回
+func (r *AssetRegistry) Add(id, name string) (Asset, error) {
+	if a, err := r.Get(id); err == nil {
+		return a, nil
+	}
+	if !assetIDPattern.MatchString(id) {
+		return Asset{}, fmt.Errorf("invalid asset id %q", id)
+	}
+	a := Asset{ID: id, Name: name, Slot: r.Len()}
+	if a.Slot >= AssetSlots() {
+		return Asset{}, fmt.Errorf("no free slot for asset %q, parameter set has %d asset slots", id, AssetSlots())
+	}
+	r.Assets = append(r.Assets, a)
+	return a, nil
+}
+
+// AssetSlots 返回当前参数集下可以分配给资产的槽位数
+func AssetSlots() int {
+	return GetAmountScheme().Slots() - ReservedSlots
+}
+
+// Len 返回已占用的槽位数，即加解密时需要处理的金额个数
+func (r *AssetRegistry) Len() int {
+	n := 0
+	for _, a := range r.Assets {
+		if a.Slot+1 > n {
+			n = a.Slot + 1
+		}
+	}
+	return n
+}
+
+// Validate 检查资产 ID 和槽位不重复，且槽位在当前参数集范围内
+func (r *AssetRegistry) Validate() error {
+	ids := make(map[string]bool)
+	slots := make(map[int]bool)
+	for _, a := range r.Assets {
+		if !assetIDPattern.MatchString(a.ID) {
+			return fmt.Errorf("invalid asset id %q", a.ID)
+		}
+		if ids[a.ID] || slots[a.Slot] {
+			return fmt.Errorf("duplicated asset %q or slot %d", a.ID, a.Slot)
+		}
+		if a.Slot < 0 || a.Slot >= AssetSlots() {
+			return fmt.Errorf("slot %d of asset %q is out of range", a.Slot, a.ID)
+		}
+		ids[a.ID], slots[a.Slot] = true, true
+	}
+	if !ids[DefaultAssetID] {
+		return errors.New("default asset is not registered")
+	}
+	return nil
+}
+
+// Vector 将各资产的金额按槽位排列，得到加密用的向量
+func (r *AssetRegistry) Vector(amounts map[string]float64) ([]float64, error) {
+	if len(amounts) == 0 {
+		return nil, errors.New("no amount given")
+	}
+	vec := make([]float64, r.Len())
+	for id, amount := range amounts {
+		a, err := r.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		vec[a.Slot] = amount
+	}
+	return vec, nil
+}
+
+// Amounts 将解密得到的向量还原为各资产的金额
+func (r *AssetRegistry) Amounts(vec []float64) map[string]float64 {
+	amounts := make(map[string]float64, len(r.Assets))
+	for _, a := range r.Assets {
+		if a.Slot < len(vec) {
+			amounts[a.ID] = vec[a.Slot]
+		}
+	}
+	return amounts
+}
+
+// IDs 返回 amounts 中涉及的资产 ID，按槽位排列，用于填写 Transaction.Assets
+func (r *AssetRegistry) IDs(amounts map[string]float64) (ids []string) {
+	for id := range amounts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := r.Get(ids[i])
+		b, _ := r.Get(ids[j])
+		return a.Slot < b.Slot
+	})
+	return
+}
@@ -0,0 +1,92 @@
+package misc_test
+
+import (
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func TestAssetRegistry(t *testing.T) {
+	r := misc.NewAssetRegistry()
+	usd, err := r.Add("USD", "US Dollar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pts, err := r.Add("points", "Points")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usd.Slot != 1 || pts.Slot != 2 || r.Len() != 3 {
+		t.Fatalf("unexpected slots %d, %d, len %d", usd.Slot, pts.Slot, r.Len())
+	}
+	if again, _ := r.Add("USD", "renamed"); again != usd {
+		t.Errorf("re-adding an asset should keep its slot, got %+v", again)
+	}
+	if _, err = r.Add("bad id!", ""); err == nil {
+		t.Error("invalid asset id should be rejected")
+	}
+	if err = r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	vec, err := r.Vector(map[string]float64{"points": 5, misc.DefaultAssetID: 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vec) != 3 || vec[0] != 1.5 || vec[1] != 0 || vec[2] != 5 {
+		t.Errorf("unexpected vector %v", vec)
+	}
+	if ids := r.IDs(map[string]float64{"points": 5, misc.DefaultAssetID: 1.5}); len(ids) != 2 || ids[0] != misc.DefaultAssetID {
+		t.Errorf("unexpected ids %v", ids)
+	}
+	if _, err = r.Vector(map[string]float64{"EUR": 1}); err == nil {
+		t.Error("unknown asset should be rejected")
+	}
+
+	dup := &misc.AssetRegistry{Assets: append(r.Assets, misc.Asset{ID: "EUR", Slot: 1})}
+	if err = dup.Validate(); err == nil {
+		t.Error("duplicated slot should be rejected")
+	}
+}
+
+// 各资产位于不同槽位，同态运算互不影响
+func TestAmountSchemesVector(t *testing.T) {
+	for _, id := range testSchemeParamSets {
+		t.Run(id, func(t *testing.T) {
+			scheme, err := misc.NewAmountScheme(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sk, pk := rlwe.NewKeyGenerator(scheme.Parameters()).GenKeyPair()
+
+			balance, err := scheme.EncryptVector([]float64{100, 2000.5, 30}, pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			amount, err := scheme.EncryptVector([]float64{0, 0.51, 30}, pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diff, err := scheme.Sub(balance, amount)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := scheme.DecryptVector(diff, sk, 4)
+			expected := []float64{100, 1999.99, 0, 0}
+			for i := range expected {
+				if res[i] != expected[i] {
+					t.Errorf("slot %d: got %v, expected %v", i, res[i], expected[i])
+				}
+			}
+			if scheme.Decrypt(diff, sk) != 100 {
+				t.Error("Decrypt should read slot 0")
+			}
+
+			if _, err = scheme.EncryptVector(make([]float64, scheme.Slots()+1), pk); err == nil {
+				t.Error("too many amounts should be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,605 @@
+package misc
+
+// compact.go 定义了密钥与密文的紧凑序列化格式
+// 与 lattigo 的 MarshalBinary 相比：
+//   1. 多项式系数按模数的位数紧凑排列，而不是每个系数固定 8 字节
+//   2. 公钥与 swk 可以只携带种子，均匀分布的一半 (a) 在反序列化时由种子重新生成
+//   3. CKKS 密文可以在序列化前丢弃高层模数，见 CompactLevel
+//
+// 格式：magic "CHM" | version | kind | flags | 各类型的内容
+// UnmarshalCiphertext、UnmarshalPublicKey、UnmarshalSwitchingKey 同时接受紧凑格式与 MarshalBinary 格式
+//
+// BenchmarkCompactSerialization 在 PN13QP218 下测得：swk 5.5MB -> 1.4MB，公钥 918KB -> 226KB，
+// 密文 786KB -> 379KB（丢弃模数后 191KB）；代价是编解码更慢，带种子的密钥反序列化时需要重新生成 a
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe/ringqp"
+	"github.com/tuneinsight/lattigo/v4/utils"
+)
+
+const (
+	compactVersion = 1
+
+	compactKindCiphertext   = 1
+	compactKindPublicKey    = 2
+	compactKindSwitchingKey = 3
+	// 重线性化密钥与旋转密钥，见 MarshalEvaluationKey
+	compactKindEvaluationKey = 4
+
+	compactFlagSeeded = 1
+
+	compactHeaderSize = 6
+
+	// SeedSize 是公钥与 swk 种子的字节数
+	SeedSize = 32
+)
+
+var compactMagic = []byte("CHM")
+
+// ConfigCompactHeadroomBits 是 CompactLevel 为金额和噪声保留的位数
+// 金额的绝对值不超过 2^30 左右，再留出符号位和噪声的余量
+var ConfigCompactHeadroomBits = 40
+
+// IsCompact 判断数据是否为紧凑格式
+func IsCompact(data []byte) bool {
+	return len(data) >= compactHeaderSize && bytes.Equal(data[:len(compactMagic)], compactMagic)
+}
+
+// --- 种子生成 ---
+
+// NewSeed 生成随机种子
+func NewSeed() ([]byte, error) {
+	seed := make([]byte, SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+func seededEncryptor(params rlwe.Parameters, sk *rlwe.SecretKey, seed []byte) (rlwe.PRNGEncryptor, error) {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return nil, err
+	}
+	return rlwe.NewPRNGEncryptor(params, sk).WithPRNG(prng), nil
+}
+
+func seededSampler(params rlwe.Parameters, seed []byte) (ringqp.UniformSampler, error) {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return ringqp.UniformSampler{}, err
+	}
+	return ringqp.NewUniformSampler(prng, *params.RingQP()), nil
+}
+
+// GenSeededPublicKey 生成公钥，其均匀分布的一半由返回的种子决定
+// 与 KeyGenerator.GenPublicKey 得到的公钥在使用上没有区别
+func GenSeededPublicKey(sk *rlwe.SecretKey) (pk *rlwe.PublicKey, seed []byte, err error) {
+	params := GetRLWEParams()
+	if seed, err = NewSeed(); err != nil {
+		return nil, nil, err
+	}
+	enc, err := seededEncryptor(params, sk, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk = rlwe.NewPublicKey(params)
+	enc.EncryptZero(&pk.CiphertextQP)
+	return pk, seed, nil
+}
+
+// GenSeededSwitchingKey 生成从 skIn 到 skOut 的 swk，其均匀分布的一半由返回的种子决定
+// 与 GenerateSwitchingKey 得到的 swk 在使用上没有区别
+func GenSeededSwitchingKey(skIn, skOut *rlwe.SecretKey) (swk *rlwe.SwitchingKey, seed []byte, err error) {
+	params := GetRLWEParams()
+	if seed, err = NewSeed(); err != nil {
+		return nil, nil, err
+	}
+	enc, err := seededEncryptor(params, skOut, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	swk = rlwe.NewSwitchingKey(params, params.QCount()-1, params.PCount()-1)
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			enc.EncryptZero(&swk.Value[i][j])
+		}
+	}
+	rlwe.AddPolyTimesGadgetVectorToGadgetCiphertext(skIn.Value.Q, []rlwe.GadgetCiphertext{swk.GadgetCiphertext},
+		*params.RingQP(), params.Pow2Base(), params.RingQ().NewPoly())
+	return swk, seed, nil
+}
+
+// GenPublicSwitchingKey 生成从 skIn 到 pkOut 对应私钥的 swk，生成时不需要对方的私钥
+// 每个分量为 pkOut 下对 0 的公钥加密，噪声比 GenerateSwitchingKey 得到的 swk 大，且不能只携带种子
+func GenPublicSwitchingKey(skIn *rlwe.SecretKey, pkOut *rlwe.PublicKey) (swk *rlwe.SwitchingKey, err error) {
+	params := GetRLWEParams()
+	if params.PCount() == 0 {
+		return nil, errors.New("public switching keys require a parameter set with the special modulus P")
+	}
+	prng, err := utils.NewPRNG()
+	if err != nil {
+		return nil, err
+	}
+	ringQP := params.RingQP()
+	levelQ, levelP := params.QCount()-1, params.PCount()-1
+	ternary := ring.NewTernarySamplerWithHammingWeight(prng, params.RingQ(), params.HammingWeight(), false)
+	gaussian := ring.NewGaussianSampler(prng, params.RingQ(), params.Sigma(), int(6*params.Sigma()))
+	u, e := ringQP.NewPoly(), ringQP.NewPoly()
+
+	swk = rlwe.NewSwitchingKey(params, levelQ, levelP)
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			ternary.Read(u.Q)
+			ringQP.ExtendBasisSmallNormAndCenter(u.Q, levelP, nil, u.P)
+			ringQP.NTTLvl(levelQ, levelP, u, u)
+			// (u*pk0 + e0, u*pk1 + e1)，与 swk 的其余部分一样保存为 Montgomery 形式
+			for k := range swk.Value[i][j].Value {
+				c := swk.Value[i][j].Value[k]
+				ringQP.MulCoeffsMontgomeryLvl(levelQ, levelP, u, pkOut.Value[k], c)
+				gaussian.Read(e.Q)
+				ringQP.ExtendBasisSmallNormAndCenter(e.Q, levelP, nil, e.P)
+				ringQP.NTTLvl(levelQ, levelP, e, e)
+				ringQP.AddLvl(levelQ, levelP, c, e, c)
+				ringQP.MFormLvl(levelQ, levelP, c, c)
+			}
+		}
+	}
+	rlwe.AddPolyTimesGadgetVectorToGadgetCiphertext(skIn.Value.Q, []rlwe.GadgetCiphertext{swk.GadgetCiphertext},
+		*params.RingQP(), params.Pow2Base(), params.RingQ().NewPoly())
+	return swk, nil
+}
+
+// --- 密文 ---
+
+// CompactLevel 返回在当前参数集下可以安全地丢弃模数的最低层数
+// CKKS 密文保留的模数需要容纳 scale 和 ConfigCompactHeadroomBits；
+// BGV 丢弃模数需要模切换，这里不做处理，返回最高层数
+func CompactLevel() int {
+	params := GetRLWEParams()
+	if GetAmountScheme().Name() != SchemeCKKS {
+		return params.MaxLevel()
+	}
+	need := math.Log2(GetCKKSParams().DefaultScale().Float64()) + float64(ConfigCompactHeadroomBits)
+	logQ := 0.0
+	for level := 0; level <= params.MaxLevel(); level++ {
+		logQ += math.Log2(params.QiFloat64(level))
+		if logQ >= need {
+			return level
+		}
+	}
+	return params.MaxLevel()
+}
+
+// DropLevel 返回丢弃高层模数后的密文副本，仅适用于 CKKS
+// level 不低于密文当前层数时直接返回副本
+func DropLevel(ct *rlwe.Ciphertext, level int) (*rlwe.Ciphertext, error) {
+	if GetAmountScheme().Name() != SchemeCKKS {
+		return nil, errors.New("dropping moduli is only supported for CKKS ciphertexts")
+	}
+	if level < 0 {
+		return nil, fmt.Errorf("invalid level %d", level)
+	}
+	out := ct.CopyNew()
+	if level < out.Level() {
+		out.Resize(out.Degree(), level)
+	}
+	return out, nil
+}
+
+// MarshalCompactCiphertext 以紧凑格式序列化密文
+// 对同一密文的结果是确定的，可以直接用于签名
+func MarshalCompactCiphertext(ct *rlwe.Ciphertext) ([]byte, error) {
+	params := GetRLWEParams()
+	if len(ct.Value) < 1 || len(ct.Value) > 3 {
+		return nil, fmt.Errorf("invalid ciphertext degree %d", ct.Degree())
+	}
+	meta, err := ct.MetaData.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	w := newCompactWriter(compactKindCiphertext, 0)
+	w.buf.WriteByte(byte(params.LogN()))
+	w.buf.WriteByte(byte(ct.Level()))
+	w.buf.WriteByte(byte(len(ct.Value)))
+	w.buf.Write(meta)
+	for _, p := range ct.Value {
+		if err = w.writePoly(p, params.RingQ().Modulus); err != nil {
+			return nil, err
+		}
+	}
+	return w.bytes(), nil
+}
+
+func unmarshalCompactCiphertext(data []byte) (ct *rlwe.Ciphertext, err error) {
+	params := GetRLWEParams()
+	r, err := newCompactReader(data, compactKindCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	h, err := r.next(3)
+	if err != nil {
+		return nil, err
+	}
+	logN, level, count := int(h[0]), int(h[1]), int(h[2])
+	if err = checkPoly(params, "ciphertext", 1<<logN, level, params.MaxLevel()); err != nil {
+		return nil, err
+	}
+	if count < 1 || count > 3 {
+		return nil, fmt.Errorf("invalid ciphertext degree %d", count-1)
+	}
+
+	ct = rlwe.NewCiphertext(params, count-1, level)
+	if err = r.readMetaData(&ct.MetaData); err != nil {
+		return nil, err
+	}
+	for _, p := range ct.Value {
+		if err = r.readPoly(p, params.RingQ().Modulus); err != nil {
+			return nil, err
+		}
+	}
+	return ct, r.done()
+}
+
+// --- 公钥 ---
+
+// MarshalCompactPublicKey 以紧凑格式序列化公钥
+// seed 为 GenSeededPublicKey 返回的种子，为 nil 时完整保存公钥
+func MarshalCompactPublicKey(pk *rlwe.PublicKey, seed []byte) ([]byte, error) {
+	params := GetRLWEParams()
+	w := newCompactWriter(compactKindPublicKey, seedFlag(seed))
+	w.buf.WriteByte(byte(params.LogN()))
+	w.buf.WriteByte(byte(pk.LevelQ()))
+	w.buf.WriteByte(byte(pk.LevelP() + 1))
+	if err := w.writeKeyHeader(pk.MetaData, seed); err != nil {
+		return nil, err
+	}
+	if err := w.writeSeededQP(&pk.CiphertextQP, seed != nil); err != nil {
+		return nil, err
+	}
+	return w.bytes(), nil
+}
+
+func unmarshalCompactPublicKey(data []byte) (pk *rlwe.PublicKey, err error) {
+	params := GetRLWEParams()
+	r, err := newCompactReader(data, compactKindPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.checkRing(params, "public key"); err != nil {
+		return nil, err
+	}
+	var sampler *ringqp.UniformSampler
+	if sampler, err = r.sampler(params); err != nil {
+		return nil, err
+	}
+	pk = rlwe.NewPublicKey(params)
+	if err = r.readSeededQP(&pk.CiphertextQP, sampler); err != nil {
+		return nil, err
+	}
+	return pk, r.done()
+}
+
+// --- swk ---
+
+// MarshalCompactSwitchingKey 以紧凑格式序列化 swk
+// seed 为 GenSeededSwitchingKey 返回的种子，为 nil 时完整保存 swk
+func MarshalCompactSwitchingKey(swk *rlwe.SwitchingKey, seed []byte) ([]byte, error) {
+	params := GetRLWEParams()
+	if len(swk.Value) == 0 || len(swk.Value[0]) == 0 {
+		return nil, errors.New("invalid switching key")
+	}
+	w := newCompactWriter(compactKindSwitchingKey, seedFlag(seed))
+	w.buf.WriteByte(byte(params.LogN()))
+	w.buf.WriteByte(byte(swk.LevelQ()))
+	w.buf.WriteByte(byte(swk.LevelP() + 1))
+	w.buf.WriteByte(byte(len(swk.Value)))
+	w.buf.WriteByte(byte(len(swk.Value[0])))
+	// swk 的各元素共用元数据和种子，按生成时的顺序排列
+	if err := w.writeKeyHeader(swk.Value[0][0].MetaData, seed); err != nil {
+		return nil, err
+	}
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			if err := w.writeSeededQP(&swk.Value[i][j], seed != nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w.bytes(), nil
+}
+
+func unmarshalCompactSwitchingKey(data []byte) (swk *rlwe.SwitchingKey, err error) {
+	params := GetRLWEParams()
+	r, err := newCompactReader(data, compactKindSwitchingKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.checkRing(params, "switching key"); err != nil {
+		return nil, err
+	}
+	levelQ, levelP := params.QCount()-1, params.PCount()-1
+	h, err := r.next(2)
+	if err != nil {
+		return nil, err
+	}
+	if int(h[0]) != params.DecompRNS(levelQ, levelP) || int(h[1]) != params.DecompPw2(levelQ, levelP) {
+		return nil, fmt.Errorf("%w: switching key decomposition does not match parameter set %s", ErrParamsMismatch, ParamSetID())
+	}
+	var sampler *ringqp.UniformSampler
+	if sampler, err = r.sampler(params); err != nil {
+		return nil, err
+	}
+	swk = rlwe.NewSwitchingKey(params, levelQ, levelP)
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			if err = r.readSeededQP(&swk.Value[i][j], sampler); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return swk, r.done()
+}
+
+// UnmarshalSwitchingKey 反序列化 swk 并检查参数，接受紧凑格式与 MarshalBinary 格式
+func UnmarshalSwitchingKey(data []byte) (swk *rlwe.SwitchingKey, err error) {
+	if IsCompact(data) {
+		return unmarshalCompactSwitchingKey(data)
+	}
+	swk = new(rlwe.SwitchingKey)
+	if err = swk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	if err = CheckSwitchingKey(swk); err != nil {
+		return nil, err
+	}
+	return swk, nil
+}
+
+func seedFlag(seed []byte) byte {
+	if seed != nil {
+		return compactFlagSeeded
+	}
+	return 0
+}
+
+// --- 编码 ---
+
+type compactWriter struct {
+	buf bytes.Buffer
+}
+
+func newCompactWriter(kind, flags byte) *compactWriter {
+	w := new(compactWriter)
+	w.buf.Write(compactMagic)
+	w.buf.Write([]byte{compactVersion, kind, flags})
+	return w
+}
+
+func (w *compactWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// writePoly 按各模数的位数紧凑写入多项式的系数
+func (w *compactWriter) writePoly(p *ring.Poly, moduli []uint64) error {
+	var acc uint64
+	var n uint
+	for i, coeffs := range p.Coeffs {
+		q := moduli[i]
+		width := uint(bits.Len64(q - 1))
+		for _, c := range coeffs {
+			if c >= q {
+				return errors.New("coefficient is not reduced")
+			}
+			// 每次最多写入 64 位，分两段放入累加器
+			for rem := width; rem > 0; {
+				take := 64 - n
+				if take > rem {
+					take = rem
+				}
+				acc |= ((c >> (width - rem)) & (1<<take - 1)) << n
+				n += take
+				rem -= take
+				for n >= 8 {
+					w.buf.WriteByte(byte(acc))
+					acc >>= 8
+					n -= 8
+				}
+			}
+		}
+	}
+	if n > 0 {
+		w.buf.WriteByte(byte(acc))
+	}
+	return nil
+}
+
+// writeKeyHeader 写入公钥与 swk 共用的元数据和种子
+func (w *compactWriter) writeKeyHeader(meta rlwe.MetaData, seed []byte) error {
+	b, err := meta.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.buf.Write(b)
+	if seed != nil {
+		if len(seed) == 0 || len(seed) > math.MaxUint8 {
+			return fmt.Errorf("invalid seed length %d", len(seed))
+		}
+		w.buf.WriteByte(byte(len(seed)))
+		w.buf.Write(seed)
+	}
+	return nil
+}
+
+// writeSeededQP 写入 CiphertextQP，seeded 为 true 时只写入 b，a 由种子重新生成
+func (w *compactWriter) writeSeededQP(ct *rlwe.CiphertextQP, seeded bool) error {
+	params := GetRLWEParams()
+	values := ct.Value[:]
+	if seeded {
+		values = values[:1]
+	}
+	for _, v := range values {
+		if err := w.writePoly(v.Q, params.RingQ().Modulus); err != nil {
+			return err
+		}
+		if v.P != nil {
+			if err := w.writePoly(v.P, params.RingP().Modulus); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// --- 解码 ---
+
+type compactReader struct {
+	data   []byte
+	ptr    int
+	seeded bool
+	meta   *rlwe.MetaData
+}
+
+func newCompactReader(data []byte, kind byte) (*compactReader, error) {
+	if !IsCompact(data) {
+		return nil, errors.New("not in compact format")
+	}
+	if data[3] != compactVersion {
+		return nil, fmt.Errorf("unsupported compact format version %d", data[3])
+	}
+	if data[4] != kind {
+		return nil, fmt.Errorf("unexpected object kind %d, expects %d", data[4], kind)
+	}
+	return &compactReader{data: data, ptr: compactHeaderSize, seeded: data[5]&compactFlagSeeded != 0}, nil
+}
+
+func (r *compactReader) next(n int) ([]byte, error) {
+	if n < 0 || r.ptr+n > len(r.data) {
+		return nil, errors.New("unexpected end of data")
+	}
+	b := r.data[r.ptr : r.ptr+n]
+	r.ptr += n
+	return b, nil
+}
+
+func (r *compactReader) done() error {
+	if r.ptr != len(r.data) {
+		return errors.New("remaining unparsed data")
+	}
+	return nil
+}
+
+func (r *compactReader) readMetaData(m *rlwe.MetaData) error {
+	b, err := r.next(m.MarshalBinarySize())
+	if err != nil {
+		return err
+	}
+	return m.UnmarshalBinary(b)
+}
+
+// checkRing 读取并检查公钥与 swk 共有的环维数和层数
+func (r *compactReader) checkRing(params rlwe.Parameters, what string) error {
+	h, err := r.next(3)
+	if err != nil {
+		return err
+	}
+	if err = checkPoly(params, what, 1<<int(h[0]), int(h[1]), params.QCount()-1); err != nil {
+		return err
+	}
+	if int(h[1]) != params.QCount()-1 || int(h[2])-1 != params.PCount()-1 {
+		return fmt.Errorf("%w: %s levels do not match parameter set %s", ErrParamsMismatch, what, ParamSetID())
+	}
+	return nil
+}
+
+// sampler 读取元数据和种子，返回由种子构造的均匀分布采样器，未使用种子时返回 nil
+func (r *compactReader) sampler(params rlwe.Parameters) (*ringqp.UniformSampler, error) {
+	r.meta = new(rlwe.MetaData)
+	if err := r.readMetaData(r.meta); err != nil {
+		return nil, err
+	}
+	if !r.seeded {
+		return nil, nil
+	}
+	l, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := r.next(int(l[0]))
+	if err != nil {
+		return nil, err
+	}
+	s, err := seededSampler(params, seed)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *compactReader) readPoly(p *ring.Poly, moduli []uint64) error {
+	var acc uint64
+	var n uint
+	for i, coeffs := range p.Coeffs {
+		q := moduli[i]
+		width := uint(bits.Len64(q - 1))
+		for j := range coeffs {
+			var c uint64
+			for got := uint(0); got < width; {
+				if n == 0 {
+					b, err := r.next(1)
+					if err != nil {
+						return err
+					}
+					acc, n = uint64(b[0]), 8
+				}
+				take := width - got
+				if take > n {
+					take = n
+				}
+				c |= (acc & (1<<take - 1)) << got
+				acc >>= take
+				n -= take
+				got += take
+			}
+			if c >= q {
+				return errors.New("coefficient is not reduced")
+			}
+			coeffs[j] = c
+		}
+	}
+	return nil
+}
+
+// readSeededQP 读取 CiphertextQP，sampler 不为 nil 时由种子重新生成 a
+func (r *compactReader) readSeededQP(ct *rlwe.CiphertextQP, sampler *ringqp.UniformSampler) error {
+	params := GetRLWEParams()
+	ct.MetaData = *r.meta
+	values := ct.Value[:]
+	if sampler != nil {
+		values = values[:1]
+	}
+	for _, v := range values {
+		if err := r.readPoly(v.Q, params.RingQ().Modulus); err != nil {
+			return err
+		}
+		if v.P != nil {
+			if err := r.readPoly(v.P, params.RingP().Modulus); err != nil {
+				return err
+			}
+		}
+	}
+	if sampler != nil {
+		sampler.ReadLvl(ct.Value[1].LevelQ(), ct.Value[1].LevelP(), ct.Value[1])
+	}
+	return nil
+}
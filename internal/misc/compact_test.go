@@ -0,0 +1,214 @@
+package misc_test
+
+import (
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func useParamSet(tb testing.TB, id string) misc.AmountScheme {
+	prev := misc.ParamSetID()
+	if err := misc.SetParamSet(id); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { misc.SetParamSet(prev) })
+	return misc.GetAmountScheme()
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, id := range testSchemeParamSets {
+		t.Run(id, func(t *testing.T) {
+			scheme := useParamSet(t, id)
+			kgen := rlwe.NewKeyGenerator(scheme.Parameters())
+			sk1, sk2 := kgen.GenSecretKey(), kgen.GenSecretKey()
+
+			// 带种子的公钥展开后与原公钥相同，且可以正常加密
+			pk, seed, err := misc.GenSeededPublicKey(sk1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkBytes, err := misc.MarshalCompactPublicKey(pk, seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pk2, err := misc.UnmarshalPublicKey(pkBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pk.Equals(pk2) {
+				t.Fatal("seeded public key changed after round trip")
+			}
+
+			ct, err := scheme.Encrypt(1234.56, pk2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctBytes, err := misc.MarshalCompactCiphertext(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct2, err := misc.UnmarshalCiphertext(ctBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := misc.MarshalCompactCiphertext(ct2); string(again) != string(ctBytes) {
+				t.Fatal("compact ciphertext encoding is not deterministic")
+			}
+
+			swk, seed, err := misc.GenSeededSwitchingKey(sk1, sk2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			swkBytes, err := misc.MarshalCompactSwitchingKey(swk, seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			swk2, err := misc.UnmarshalSwitchingKey(swkBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !swk.Equals(swk2) {
+				t.Fatal("seeded switching key changed after round trip")
+			}
+			switched, err := scheme.KeySwitch(ct2, swk2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := scheme.Decrypt(switched, sk2); res != 1234.56 {
+				t.Errorf("got %v, expected 1234.56", res)
+			}
+
+			// 不带种子时完整保存
+			full, err := misc.MarshalCompactSwitchingKey(swk, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if swk3, err := misc.UnmarshalSwitchingKey(full); err != nil || !swk.Equals(swk3) {
+				t.Fatalf("unseeded switching key changed after round trip: %v", err)
+			}
+			if len(swkBytes) >= len(full) {
+				t.Errorf("seeded switching key (%d bytes) should be smaller than unseeded one (%d bytes)", len(swkBytes), len(full))
+			}
+		})
+	}
+}
+
+func TestCompactDropLevel(t *testing.T) {
+	scheme := useParamSet(t, "PN13QP218")
+	sk, pk := rlwe.NewKeyGenerator(scheme.Parameters()).GenKeyPair()
+
+	ct, err := scheme.Encrypt(-98765.43, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level := misc.CompactLevel()
+	if level >= ct.Level() {
+		t.Fatalf("expected compact level below %d, got %d", ct.Level(), level)
+	}
+	dropped, err := misc.DropLevel(ct, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := misc.MarshalCompactCiphertext(dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct2, err := misc.UnmarshalCiphertext(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct2.Level() != level {
+		t.Errorf("got level %d, expected %d", ct2.Level(), level)
+	}
+	if res := scheme.Decrypt(ct2, sk); res != -98765.43 {
+		t.Errorf("got %v, expected -98765.43", res)
+	}
+	full, _ := ct.MarshalBinary()
+	t.Logf("ciphertext: MarshalBinary %d bytes, compact at level %d %d bytes", len(full), level, len(data))
+}
+
+func TestCompactRejectsMismatch(t *testing.T) {
+	scheme := useParamSet(t, "PN13QP218")
+	_, pk := rlwe.NewKeyGenerator(scheme.Parameters()).GenKeyPair()
+	ct, _ := scheme.Encrypt(1, pk)
+	ctBytes, _ := misc.MarshalCompactCiphertext(ct)
+	pkBytes, _ := misc.MarshalCompactPublicKey(pk, nil)
+
+	useParamSet(t, "PN12QP109")
+	if _, err := misc.UnmarshalCiphertext(ctBytes); err == nil {
+		t.Error("ciphertext of another parameter set should not unmarshal")
+	}
+	if _, err := misc.UnmarshalPublicKey(pkBytes); err == nil {
+		t.Error("public key of another parameter set should not unmarshal")
+	}
+	if _, err := misc.UnmarshalCiphertext(ctBytes[:len(ctBytes)-1]); err == nil {
+		t.Error("truncated ciphertext should not unmarshal")
+	}
+}
+
+// --- 与 MarshalBinary 比较大小与耗时 ---
+
+func BenchmarkCompactSerialization(b *testing.B) {
+	for _, id := range []string{"PN12QP109", "PN13QP218", "BGV-PN12QP109"} {
+		scheme := useParamSet(b, id)
+		kgen := rlwe.NewKeyGenerator(scheme.Parameters())
+		skIn, skOut := kgen.GenSecretKey(), kgen.GenSecretKey()
+		pk, pkSeed, _ := misc.GenSeededPublicKey(skIn)
+		swk, swkSeed, _ := misc.GenSeededSwitchingKey(skIn, skOut)
+		ct, _ := scheme.Encrypt(1234.56, pk)
+
+		compactCT := func() ([]byte, error) { return misc.MarshalCompactCiphertext(ct) }
+		droppedCT := func() ([]byte, error) {
+			dropped, err := misc.DropLevel(ct, misc.CompactLevel())
+			if err != nil {
+				return nil, err
+			}
+			return misc.MarshalCompactCiphertext(dropped)
+		}
+		cases := []struct {
+			name      string
+			marshal   func() ([]byte, error)
+			unmarshal func([]byte) error
+		}{
+			{"ciphertext/binary", ct.MarshalBinary, func(d []byte) error { _, err := misc.UnmarshalCiphertext(d); return err }},
+			{"ciphertext/compact", compactCT, func(d []byte) error { _, err := misc.UnmarshalCiphertext(d); return err }},
+			{"public-key/binary", pk.MarshalBinary, func(d []byte) error { _, err := misc.UnmarshalPublicKey(d); return err }},
+			{"public-key/compact", func() ([]byte, error) { return misc.MarshalCompactPublicKey(pk, pkSeed) },
+				func(d []byte) error { _, err := misc.UnmarshalPublicKey(d); return err }},
+			{"switching-key/binary", swk.MarshalBinary, func(d []byte) error { _, err := misc.UnmarshalSwitchingKey(d); return err }},
+			{"switching-key/compact", func() ([]byte, error) { return misc.MarshalCompactSwitchingKey(swk, swkSeed) },
+				func(d []byte) error { _, err := misc.UnmarshalSwitchingKey(d); return err }},
+		}
+		if scheme.Name() == misc.SchemeCKKS {
+			cases = append(cases, struct {
+				name      string
+				marshal   func() ([]byte, error)
+				unmarshal func([]byte) error
+			}{"ciphertext/compact-dropped", droppedCT, func(d []byte) error { _, err := misc.UnmarshalCiphertext(d); return err }})
+		}
+
+		for _, c := range cases {
+			data, err := c.marshal()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(id+"/"+c.name+"/marshal", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := c.marshal(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes")
+			})
+			b.Run(id+"/"+c.name+"/unmarshal", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := c.unmarshal(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes")
+			})
+		}
+	}
+}
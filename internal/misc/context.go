@@ -0,0 +1,51 @@
+package misc
+
+// context.go 定义了进程共享的密码学上下文
+// 参数集及其编码器、求值器只在 SetParamSet 时构造一次，之后各处通过 GetCryptoContext 取用，
+// 避免在每次运算时重新构造
+// lattigo 的编码器、求值器不能并发使用，方案内部以 Pool 复用，见 scheme.go
+
+import (
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// CryptoContext 为一个参数集及其金额加密方案
+type CryptoContext struct {
+	ID     string
+	Scheme AmountScheme
+}
+
+// NewCryptoContext 按参数集 ID 构造上下文
+func NewCryptoContext(id string) (*CryptoContext, error) {
+	scheme, err := NewAmountScheme(id)
+	if err != nil {
+		return nil, err
+	}
+	return &CryptoContext{ID: id, Scheme: scheme}, nil
+}
+
+// Params 返回 RLWE 参数，用于密钥生成、密文分配等与方案无关的操作
+func (c *CryptoContext) Params() rlwe.Parameters {
+	return c.Scheme.Parameters()
+}
+
+// CKKS 返回 CKKS 方案，参数集不是 CKKS 时返回 nil
+func (c *CryptoContext) CKKS() *CKKSScheme {
+	s, _ := c.Scheme.(*CKKSScheme)
+	return s
+}
+
+// BGV 返回 BGV 方案，参数集不是 BGV 时返回 nil
+func (c *CryptoContext) BGV() *BGVScheme {
+	s, _ := c.Scheme.(*BGVScheme)
+	return s
+}
+
+// CKKSParams 返回 CKKS 参数，参数集不是 CKKS 时返回零值
+func (c *CryptoContext) CKKSParams() ckks.Parameters {
+	if s := c.CKKS(); s != nil {
+		return s.Params
+	}
+	return ckks.Parameters{}
+}
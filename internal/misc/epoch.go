@@ -0,0 +1,33 @@
+package misc
+
+import "time"
+
+// SwkValidity 表示一把重加密密钥（swk）的有效期
+// 时间轴按 EpochDuration 划分为若干纪元（epoch），每把 swk 属于一个纪元，
+// 有效期为 [纪元开始, 纪元结束 + GracePeriod)，相邻纪元的 swk 有重叠，
+// 轮换时不会中断正在进行的转账
+type SwkValidity struct {
+	Epoch     int64 `json:"epoch"`
+	NotBefore int64 `json:"notBefore"` //unix时间戳
+	NotAfter  int64 `json:"notAfter"`  //unix时间戳
+}
+
+// SwkEpoch 计算时刻 t 所在的纪元
+func SwkEpoch(t time.Time, epochDuration time.Duration) int64 {
+	return t.Unix() / int64(epochDuration/time.Second)
+}
+
+// NewSwkValidity 计算纪元 epoch 对应的有效期
+func NewSwkValidity(epoch int64, epochDuration, gracePeriod time.Duration) SwkValidity {
+	d := int64(epochDuration / time.Second)
+	return SwkValidity{
+		Epoch:     epoch,
+		NotBefore: epoch * d,
+		NotAfter:  (epoch+1)*d + int64(gracePeriod/time.Second),
+	}
+}
+
+// IsValidAt 判断时刻 t 是否在有效期内
+func (v SwkValidity) IsValidAt(t time.Time) bool {
+	return v.NotBefore <= t.Unix() && t.Unix() < v.NotAfter
+}
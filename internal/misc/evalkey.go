@@ -0,0 +1,147 @@
+package misc
+
+// evalkey.go 定义了用户计算密钥（重线性化密钥与旋转密钥）的序列化格式
+// 服务端持有用户的计算密钥后，可以对该用户的密文做密文乘法和槽位旋转，见 serverlib.NewUserEvaluator
+// 格式：紧凑格式的头部 | hasRlk | [rlk] | 旋转密钥个数 | 按 Galois 元素升序排列的 (galEl, 旋转密钥)
+// 其中每个密钥为带 4 字节长度前缀的紧凑格式 swk，见 MarshalCompactSwitchingKey
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// MarshalEvaluationKey 以紧凑格式序列化计算密钥，Rlk 与 Rtks 均可为空
+// 重线性化密钥只支持二次，即 Rlk.Keys 只有一个
+func MarshalEvaluationKey(evk rlwe.EvaluationKey) ([]byte, error) {
+	w := newCompactWriter(compactKindEvaluationKey, 0)
+	writeKey := func(swk *rlwe.SwitchingKey) error {
+		b, err := MarshalCompactSwitchingKey(swk, nil)
+		if err != nil {
+			return err
+		}
+		w.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+		w.buf.Write(b)
+		return nil
+	}
+
+	if evk.Rlk == nil {
+		w.buf.WriteByte(0)
+	} else {
+		if len(evk.Rlk.Keys) != 1 {
+			return nil, errors.New("only relinearization keys of degree 2 are supported")
+		}
+		w.buf.WriteByte(1)
+		if err := writeKey(evk.Rlk.Keys[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	galEls := EvaluationKeyGaloisElements(evk)
+	w.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(galEls))))
+	for _, galEl := range galEls {
+		w.buf.Write(binary.BigEndian.AppendUint64(nil, galEl))
+		if err := writeKey(evk.Rtks.Keys[galEl]); err != nil {
+			return nil, err
+		}
+	}
+	return w.bytes(), nil
+}
+
+// UnmarshalEvaluationKey 反序列化计算密钥，并检查各密钥与当前参数集一致
+func UnmarshalEvaluationKey(data []byte) (evk rlwe.EvaluationKey, err error) {
+	r, err := newCompactReader(data, compactKindEvaluationKey)
+	if err != nil {
+		return evk, err
+	}
+	readKey := func() (*rlwe.SwitchingKey, error) {
+		n, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.next(int(binary.BigEndian.Uint32(n)))
+		if err != nil {
+			return nil, err
+		}
+		return unmarshalCompactSwitchingKey(b)
+	}
+
+	hasRlk, err := r.next(1)
+	if err != nil {
+		return evk, err
+	}
+	switch hasRlk[0] {
+	case 0:
+	case 1:
+		swk, err := readKey()
+		if err != nil {
+			return evk, fmt.Errorf("relinearization key: %w", err)
+		}
+		evk.Rlk = &rlwe.RelinearizationKey{Keys: []*rlwe.SwitchingKey{swk}}
+	default:
+		return evk, errors.New("invalid evaluation key")
+	}
+
+	count, err := r.next(4)
+	if err != nil {
+		return evk, err
+	}
+	n := int(binary.BigEndian.Uint32(count))
+	twoN := uint64(2 * GetRLWEParams().N())
+	if n > 0 {
+		evk.Rtks = &rlwe.RotationKeySet{Keys: make(map[uint64]*rlwe.SwitchingKey, n)}
+	}
+	var prev uint64
+	for i := 0; i < n; i++ {
+		b, err := r.next(8)
+		if err != nil {
+			return evk, err
+		}
+		galEl := binary.BigEndian.Uint64(b)
+		if galEl&1 == 0 || galEl >= twoN || galEl <= prev {
+			return evk, fmt.Errorf("invalid galois element %d", galEl)
+		}
+		prev = galEl
+		if evk.Rtks.Keys[galEl], err = readKey(); err != nil {
+			return evk, fmt.Errorf("rotation key %d: %w", galEl, err)
+		}
+	}
+	return evk, r.done()
+}
+
+// EvaluationKeyGaloisElements 返回计算密钥中旋转密钥的 Galois 元素，按升序排列
+func EvaluationKeyGaloisElements(evk rlwe.EvaluationKey) (galEls []uint64) {
+	if evk.Rtks == nil {
+		return nil
+	}
+	for galEl := range evk.Rtks.Keys {
+		galEls = append(galEls, galEl)
+	}
+	sort.Slice(galEls, func(i, j int) bool { return galEls[i] < galEls[j] })
+	return
+}
+
+// CheckEvaluationKey 检查计算密钥与公钥 pk 的环维数和层数一致
+// 无法在没有私钥的情况下验证两者来自同一私钥，须由注册请求的签名保证
+func CheckEvaluationKey(evk rlwe.EvaluationKey, pk *rlwe.PublicKey) error {
+	keys := make([]*rlwe.SwitchingKey, 0, 1)
+	if evk.Rlk != nil {
+		keys = append(keys, evk.Rlk.Keys...)
+	}
+	for _, galEl := range EvaluationKeyGaloisElements(evk) {
+		keys = append(keys, evk.Rtks.Keys[galEl])
+	}
+	if len(keys) == 0 {
+		return errors.New("evaluation key is empty")
+	}
+	n := pk.Value[0].Q.N()
+	for _, swk := range keys {
+		if swk.Value[0][0].Value[0].Q.N() != n || swk.LevelQ() != pk.LevelQ() || swk.LevelP() != pk.LevelP() {
+			return fmt.Errorf("%w: evaluation key does not match the public key", ErrParamsMismatch)
+		}
+	}
+	return nil
+}
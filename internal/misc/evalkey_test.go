@@ -0,0 +1,63 @@
+package misc_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func TestEvaluationKeyRoundTrip(t *testing.T) {
+	for _, id := range testSchemeParamSets {
+		t.Run(id, func(t *testing.T) {
+			scheme := useParamSet(t, id)
+			kgen := rlwe.NewKeyGenerator(scheme.Parameters())
+			sk, pk := kgen.GenKeyPair()
+			evk := rlwe.EvaluationKey{
+				Rlk:  kgen.GenRelinearizationKey(sk, 1),
+				Rtks: kgen.GenRotationKeysForRotations([]int{1, -1, 4}, false, sk),
+			}
+
+			data, err := misc.MarshalEvaluationKey(evk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			evk2, err := misc.UnmarshalEvaluationKey(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !evk.Rlk.Equals(evk2.Rlk) || !evk.Rtks.Equals(evk2.Rtks) {
+				t.Fatal("evaluation key changed after round trip")
+			}
+			if err = misc.CheckEvaluationKey(evk2, pk); err != nil {
+				t.Error(err)
+			}
+
+			// 只有旋转密钥
+			data, err = misc.MarshalEvaluationKey(rlwe.EvaluationKey{Rtks: evk.Rtks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if evk2, err = misc.UnmarshalEvaluationKey(data); err != nil || evk2.Rlk != nil || len(evk2.Rtks.Keys) != 3 {
+				t.Errorf("rotation-only evaluation key: %v, %+v", err, evk2)
+			}
+
+			if _, err = misc.UnmarshalEvaluationKey(data[:len(data)-1]); err == nil {
+				t.Error("truncated evaluation key should be rejected")
+			}
+			if err = misc.CheckEvaluationKey(rlwe.EvaluationKey{}, pk); err == nil {
+				t.Error("empty evaluation key should be rejected")
+			}
+			// 公钥丢弃了高层模数，与计算密钥不一致
+			if pk.LevelQ() > 0 {
+				low := rlwe.NewPublicKey(scheme.Parameters())
+				low.Value[0].Q.Resize(0)
+				low.Value[1].Q.Resize(0)
+				if err = misc.CheckEvaluationKey(evk, low); !errors.Is(err, misc.ErrParamsMismatch) {
+					t.Errorf("expected ErrParamsMismatch, got %v", err)
+				}
+			}
+		})
+	}
+}
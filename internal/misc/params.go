@@ -0,0 +1,353 @@
+package misc
+
+// params.go 是参数集的注册表
+// 参数集同时决定了金额加密方案（CKKS 或 BGV），见 scheme.go
+// 进程内只使用一个参数集，由 SetParamSet 选择，默认为 PN12QP109
+// 服务端在 /params 公布其参数集，客户端据此校验本地参数
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/tuneinsight/lattigo/v4/bgv"
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	DefaultParamSetID = "PN12QP109"
+
+	// rlwe.MetaData 序列化后的长度：scale(48) + IsNTT + IsMontgomery
+	metaDataSize = 50
+)
+
+// ErrParamsMismatch 表示密文或密钥与当前参数集不匹配
+var ErrParamsMismatch = errors.New("parameter set mismatch")
+
+// paramSetLiteral 是注册表中的一项，ckks 和 bgv 只使用与 scheme 对应的一个
+type paramSetLiteral struct {
+	scheme string
+	ckks   ckks.ParametersLiteral
+	bgv    bgv.ParametersLiteral
+}
+
+// BGV 参数集沿用 lattigo 的模数链，但把明文模数 T 换成更大的 NTT 友好素数
+// 默认的 T = 65537 只能表示 ±327.68，不够存放以分为单位的余额
+func bgvLiteral(lit bgv.ParametersLiteral, t uint64) bgv.ParametersLiteral {
+	lit.T = t
+	return lit
+}
+
+var (
+	paramSets = map[string]paramSetLiteral{
+		"PN12QP109": {scheme: SchemeCKKS, ckks: ckks.PN12QP109},
+		"PN13QP218": {scheme: SchemeCKKS, ckks: ckks.PN13QP218},
+		"PN14QP438": {scheme: SchemeCKKS, ckks: ckks.PN14QP438},
+		"PN15QP880": {scheme: SchemeCKKS, ckks: ckks.PN15QP880},
+		// T 约 2^33，金额上限约 4294 万
+		"BGV-PN12QP109": {scheme: SchemeBGV, bgv: bgvLiteral(bgv.PN12QP109, 8589852673)},
+		// T 约 2^40，金额上限约 54 亿
+		"BGV-PN13QP218": {scheme: SchemeBGV, bgv: bgvLiteral(bgv.PN13QP218, 1099511480321)},
+	}
+
+	paramsMu      sync.RWMutex
+	cryptoContext *CryptoContext
+)
+
+func init() {
+	if err := SetParamSet(DefaultParamSetID); err != nil {
+		panic(err)
+	}
+}
+
+// ParamSetInfo 描述一个参数集，用于 /params 接口
+type ParamSetInfo struct {
+	ID       string   `json:"id"`
+	Scheme   string   `json:"scheme"`
+	LogN     int      `json:"logN"`
+	LogSlots int      `json:"logSlots"`
+	Q        []uint64 `json:"q"`
+	P        []uint64 `json:"p"`
+	// 仅 CKKS
+	LogScale float64 `json:"logScale,omitempty"`
+	// 仅 BGV，明文模数
+	T uint64 `json:"t,omitempty"`
+}
+
+// ParamSetIDs 返回已注册的参数集
+func ParamSetIDs() (ids []string) {
+	for id := range paramSets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return
+}
+
+// NewAmountScheme 按参数集 ID 构造金额加密方案
+func NewAmountScheme(id string) (AmountScheme, error) {
+	lit, ok := paramSets[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown parameter set %q, supported: %v", id, ParamSetIDs())
+	}
+	switch lit.scheme {
+	case SchemeCKKS:
+		params, err := ckks.NewParametersFromLiteral(lit.ckks)
+		if err != nil {
+			return nil, err
+		}
+		return NewCKKSScheme(params), nil
+	case SchemeBGV:
+		params, err := bgv.NewParametersFromLiteral(lit.bgv)
+		if err != nil {
+			return nil, err
+		}
+		return NewBGVScheme(params), nil
+	}
+	return nil, fmt.Errorf("unknown scheme %q", lit.scheme)
+}
+
+// SetParamSet 选择进程使用的参数集，并构造其 CryptoContext
+// 服务端和客户端在启动时调用一次
+func SetParamSet(id string) error {
+	c, err := NewCryptoContext(id)
+	if err != nil {
+		return err
+	}
+	paramsMu.Lock()
+	defer paramsMu.Unlock()
+	cryptoContext = c
+	return nil
+}
+
+// GetCryptoContext 返回当前参数集的上下文
+func GetCryptoContext() *CryptoContext {
+	paramsMu.RLock()
+	defer paramsMu.RUnlock()
+	return cryptoContext
+}
+
+// ParamSetID 返回当前参数集的 ID
+func ParamSetID() string {
+	return GetCryptoContext().ID
+}
+
+// GetAmountScheme 返回当前参数集的金额加密方案
+func GetAmountScheme() AmountScheme {
+	return GetCryptoContext().Scheme
+}
+
+// GetRLWEParams 返回当前参数集的 RLWE 参数，用于密钥生成、密文分配等与方案无关的操作
+func GetRLWEParams() rlwe.Parameters {
+	return GetAmountScheme().Parameters()
+}
+
+// GetCKKSParams 返回当前的 CKKS 参数集
+// 仅用于 CKKS 特有的操作，当前参数集不是 CKKS 时返回零值
+func GetCKKSParams() ckks.Parameters {
+	return GetCryptoContext().CKKSParams()
+}
+
+// GetParamSetInfo 返回当前参数集的描述
+func GetParamSetInfo() ParamSetInfo {
+	c := GetCryptoContext()
+	return newParamSetInfo(c.ID, c.Scheme)
+}
+
+func newParamSetInfo(id string, scheme AmountScheme) ParamSetInfo {
+	params := scheme.Parameters()
+	info := ParamSetInfo{
+		ID:     id,
+		Scheme: scheme.Name(),
+		LogN:   params.LogN(),
+		Q:      params.Q(),
+		P:      params.P(),
+	}
+	switch s := scheme.(type) {
+	case *CKKSScheme:
+		info.LogSlots = s.Params.LogSlots()
+		info.LogScale = math.Log2(s.Params.DefaultScale().Float64())
+	case *BGVScheme:
+		info.LogSlots = params.LogN()
+		info.T = s.Params.T()
+	}
+	return info
+}
+
+// Validate 检查描述是否与本地注册的同名参数集完全一致
+func (info ParamSetInfo) Validate() error {
+	scheme, err := NewAmountScheme(info.ID)
+	if err != nil {
+		return err
+	}
+	local := newParamSetInfo(info.ID, scheme)
+	if info.Scheme != local.Scheme || info.LogN != local.LogN || info.LogSlots != local.LogSlots ||
+		info.LogScale != local.LogScale || info.T != local.T ||
+		!equalModuli(info.Q, local.Q) || !equalModuli(info.P, local.P) {
+		return fmt.Errorf("%w: %s differs from the local definition", ErrParamsMismatch, info.ID)
+	}
+	return nil
+}
+
+func equalModuli(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// --- 反序列化前的检查 ---
+// lattigo 在反序列化时按数据中的环维数分配内存，参数不符时只会得到含糊的错误
+// 因此先读取各多项式的头部（N 和 level），与当前参数集比较
+
+// readPolyHeader 读取 ring.Poly 序列化结果的头部，返回下一个多项式的位置
+func readPolyHeader(data []byte, ptr int) (n, level, next int, err error) {
+	if len(data) < ptr+5 {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	n = int(binary.BigEndian.Uint32(data[ptr:]))
+	level = int(data[ptr+4])
+	next = ptr + 5 + n*(level+1)*8
+	if next > len(data) || next < ptr {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	return
+}
+
+func checkPoly(params rlwe.Parameters, what string, n, level, maxLevel int) error {
+	if n != params.N() {
+		return fmt.Errorf("%w: %s has ring degree %d, parameter set %s expects %d",
+			ErrParamsMismatch, what, n, ParamSetID(), params.N())
+	}
+	if level > maxLevel {
+		return fmt.Errorf("%w: %s has level %d, parameter set %s allows at most %d",
+			ErrParamsMismatch, what, level, ParamSetID(), maxLevel)
+	}
+	return nil
+}
+
+// CheckCiphertext 检查序列化的密文是否属于当前参数集
+func CheckCiphertext(data []byte) error {
+	if IsCompact(data) {
+		_, err := unmarshalCompactCiphertext(data)
+		return err
+	}
+	params := GetRLWEParams()
+	if len(data) < metaDataSize+1 {
+		return errors.New("ciphertext is too short")
+	}
+	ptr := metaDataSize
+	degree := int(data[ptr])
+	ptr++
+	if degree < 1 || degree > 3 {
+		return fmt.Errorf("invalid ciphertext degree %d", degree)
+	}
+
+	for i := 0; i < degree; i++ {
+		n, level, next, err := readPolyHeader(data, ptr)
+		if err != nil {
+			return fmt.Errorf("invalid ciphertext: %v", err)
+		}
+		if err = checkPoly(params, "ciphertext", n, level, params.MaxLevel()); err != nil {
+			return err
+		}
+		ptr = next
+	}
+	if ptr != len(data) {
+		return errors.New("invalid ciphertext: remaining unparsed data")
+	}
+	return nil
+}
+
+// UnmarshalCiphertext 检查参数后反序列化密文，接受紧凑格式与 MarshalBinary 格式
+func UnmarshalCiphertext(data []byte) (ct *rlwe.Ciphertext, err error) {
+	if IsCompact(data) {
+		return unmarshalCompactCiphertext(data)
+	}
+	if err = CheckCiphertext(data); err != nil {
+		return nil, err
+	}
+	ct = new(rlwe.Ciphertext)
+	err = ct.UnmarshalBinary(data)
+	return
+}
+
+// CheckPublicKey 检查序列化的公钥是否属于当前参数集
+func CheckPublicKey(data []byte) error {
+	if IsCompact(data) {
+		_, err := unmarshalCompactPublicKey(data)
+		return err
+	}
+	params := GetRLWEParams()
+	ptr := metaDataSize
+	for i := 0; i < 2; i++ {
+		if len(data) < ptr+2 {
+			return errors.New("public key is too short")
+		}
+		hasQ, hasP := data[ptr] == 1, data[ptr+1] == 1
+		ptr += 2
+		if !hasQ || hasP != (params.PCount() != 0) {
+			return fmt.Errorf("%w: public key moduli do not match parameter set %s", ErrParamsMismatch, ParamSetID())
+		}
+
+		n, level, next, err := readPolyHeader(data, ptr)
+		if err != nil {
+			return fmt.Errorf("invalid public key: %v", err)
+		}
+		if err = checkPoly(params, "public key", n, level, params.QCount()-1); err != nil {
+			return err
+		}
+		ptr = next
+
+		if hasP {
+			if n, level, next, err = readPolyHeader(data, ptr); err != nil {
+				return fmt.Errorf("invalid public key: %v", err)
+			}
+			if err = checkPoly(params, "public key", n, level, params.PCount()-1); err != nil {
+				return err
+			}
+			ptr = next
+		}
+	}
+	if ptr != len(data) {
+		return errors.New("invalid public key: remaining unparsed data")
+	}
+	return nil
+}
+
+// UnmarshalPublicKey 检查参数后反序列化公钥，接受紧凑格式与 MarshalBinary 格式
+func UnmarshalPublicKey(data []byte) (pk *rlwe.PublicKey, err error) {
+	if IsCompact(data) {
+		return unmarshalCompactPublicKey(data)
+	}
+	if err = CheckPublicKey(data); err != nil {
+		return nil, err
+	}
+	pk = rlwe.NewPublicKey(GetRLWEParams())
+	err = pk.UnmarshalBinary(data)
+	return
+}
+
+// CheckSwitchingKey 检查已反序列化的 swk 是否属于当前参数集
+func CheckSwitchingKey(swk *rlwe.SwitchingKey) error {
+	params := GetRLWEParams()
+	if len(swk.Value) == 0 || len(swk.Value[0]) == 0 {
+		return errors.New("invalid switching key")
+	}
+	n := swk.Value[0][0].Value[0].Q.N()
+	if err := checkPoly(params, "switching key", n, swk.LevelQ(), params.QCount()-1); err != nil {
+		return err
+	}
+	if swk.LevelQ() != params.QCount()-1 || swk.LevelP() != params.PCount()-1 {
+		return fmt.Errorf("%w: switching key levels do not match parameter set %s", ErrParamsMismatch, ParamSetID())
+	}
+	return nil
+}
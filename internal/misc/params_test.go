@@ -0,0 +1,62 @@
+package misc_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func TestCKKSParamsMismatch(t *testing.T) {
+	if misc.ParamSetID() != misc.DefaultParamSetID {
+		t.Fatalf("unexpected default parameter set %s", misc.ParamSetID())
+	}
+
+	for _, id := range []string{"PN12QP109", "PN13QP218"} {
+		scheme, err := misc.NewAmountScheme(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, pk := rlwe.NewKeyGenerator(scheme.Parameters()).GenKeyPair()
+		ct, err := scheme.Encrypt(1.23, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctBytes, _ := ct.MarshalBinary()
+		pkBytes, _ := pk.MarshalBinary()
+
+		expectMismatch := id != misc.DefaultParamSetID
+		if _, err = misc.UnmarshalCiphertext(ctBytes); errors.Is(err, misc.ErrParamsMismatch) != expectMismatch {
+			t.Errorf("%s ciphertext: unexpected error %v", id, err)
+		}
+		if _, err = misc.UnmarshalPublicKey(pkBytes); errors.Is(err, misc.ErrParamsMismatch) != expectMismatch {
+			t.Errorf("%s public key: unexpected error %v", id, err)
+		}
+	}
+
+	if _, err := misc.UnmarshalCiphertext([]byte("not a ciphertext")); err == nil {
+		t.Error("garbage should not unmarshal")
+	}
+}
+
+func TestParamSetInfoValidate(t *testing.T) {
+	info := misc.GetParamSetInfo()
+	if err := info.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	info.Q = append([]uint64{}, info.Q...)
+	info.Q[0]++
+	if err := info.Validate(); !errors.Is(err, misc.ErrParamsMismatch) {
+		t.Errorf("tampered moduli should not validate, got %v", err)
+	}
+
+	info.ID = "PN99"
+	if err := info.Validate(); err == nil {
+		t.Error("unknown parameter set should not validate")
+	}
+	if err := misc.SetParamSet("PN99"); err == nil {
+		t.Error("unknown parameter set should not be selected")
+	}
+}
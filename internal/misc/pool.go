@@ -0,0 +1,32 @@
+package misc
+
+// pool.go 为不能并发使用的 lattigo 对象（编码器、求值器、加密器）提供对象池
+// 这些对象的预计算数据是只读的，可以由 ShallowCopy 共享，只有临时缓冲区需要各自一份
+
+import "sync"
+
+// Pool 是并发安全的对象池，池为空时以 new 创建新对象
+type Pool[T any] struct {
+	pool sync.Pool
+}
+
+func NewPool[T any](new func() T) *Pool[T] {
+	return &Pool[T]{pool: sync.Pool{New: func() any { return new() }}}
+}
+
+// Get 取出一个对象，用完后须以 Put 放回，或者直接丢弃
+func (p *Pool[T]) Get() T {
+	return p.pool.Get().(T)
+}
+
+func (p *Pool[T]) Put(x T) {
+	p.pool.Put(x)
+}
+
+// With 取出一个对象供 f 使用，f 返回后放回
+// f 发生 panic 时对象的缓冲区状态未知，不再放回
+func (p *Pool[T]) With(f func(T)) {
+	x := p.Get()
+	f(x)
+	p.Put(x)
+}
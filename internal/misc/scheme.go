@@ -0,0 +1,337 @@
+package misc
+
+// scheme.go 定义了金额加密方案的抽象
+// CKKS 为近似计算，解密后需要取整到分，大量同态运算后误差可能累积
+// BGV 以最小货币单位（分）的整数进行精确计算，但金额范围受明文模数 T 限制
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tuneinsight/lattigo/v4/bgv"
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	SchemeCKKS = "ckks"
+	SchemeBGV  = "bgv"
+
+	// 每单位货币包含的最小单位数，即精确到分
+	AmountMinorUnits = 100
+)
+
+// AmountScheme 是对金额进行加密、解密和同态运算的方案
+// 密钥和密文都是 rlwe 结构体，因此密钥生成、序列化与方案无关
+// 一个密文的各个槽位分别存放一种资产的金额，见 AssetRegistry；加减和重加密按槽位进行
+type AmountScheme interface {
+	Name() string
+	Parameters() rlwe.Parameters
+	// Slots 返回一个密文可以存放的金额个数
+	Slots() int
+	// Encrypt 将金额加密到槽位 0
+	Encrypt(amount float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error)
+	// EncryptVector 将 amounts[i] 加密到槽位 i，其余槽位为 0
+	EncryptVector(amounts []float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error)
+	// Decrypt 解密槽位 0 的金额
+	Decrypt(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) float64
+	// DecryptVector 解密前 n 个槽位的金额
+	DecryptVector(ct *rlwe.Ciphertext, sk *rlwe.SecretKey, n int) []float64
+	Add(ct0, ct1 *rlwe.Ciphertext) (*rlwe.Ciphertext, error)
+	// Sub 计算 ct0 - ct1
+	Sub(ct0, ct1 *rlwe.Ciphertext) (*rlwe.Ciphertext, error)
+	KeySwitch(ct *rlwe.Ciphertext, swk *rlwe.SwitchingKey) (*rlwe.Ciphertext, error)
+}
+
+func checkVectorLength(s AmountScheme, n int) error {
+	if n < 1 || n > s.Slots() {
+		return fmt.Errorf("cannot encrypt %d amounts, parameter set has %d slots", n, s.Slots())
+	}
+	return nil
+}
+
+// rlweTools 为与方案无关的加密器、解密器
+// 加密器以池复用，解密器的 WithKey 会分配新的缓冲区，因此只保留一个模板
+type rlweTools struct {
+	params     rlwe.Parameters
+	encryptors *Pool[rlwe.Encryptor]
+	decryptor  rlwe.Decryptor
+}
+
+func newRLWETools(params rlwe.Parameters) rlweTools {
+	encryptor := rlwe.NewEncryptor(params, rlwe.NewPublicKey(params))
+	return rlweTools{
+		params:     params,
+		encryptors: NewPool(encryptor.ShallowCopy),
+		decryptor:  rlwe.NewDecryptor(params, rlwe.NewSecretKey(params)),
+	}
+}
+
+func (t rlweTools) encrypt(pt *rlwe.Plaintext, pk *rlwe.PublicKey) (ct *rlwe.Ciphertext) {
+	t.encryptors.With(func(enc rlwe.Encryptor) {
+		ct = enc.WithKey(pk).EncryptNew(pt)
+	})
+	return
+}
+
+// decrypt 自行分配明文：lattigo 的 decryptor.WithKey 不保留参数，其 DecryptNew 不可用
+func (t rlweTools) decrypt(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) *rlwe.Plaintext {
+	pt := rlwe.NewPlaintext(t.params, ct.Level())
+	t.decryptor.WithKey(sk).Decrypt(ct, pt)
+	return pt
+}
+
+// evaluate 将 lattigo 运算中的 panic 转换为错误
+func evaluate(op string, f func() *rlwe.Ciphertext) (ct *rlwe.Ciphertext, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			ct = nil
+			err = fmt.Errorf("%s failed, got panic: %v", op, p)
+		}
+	}()
+	return f(), nil
+}
+
+// --- CKKS ---
+
+// CKKSScheme 的编码器、求值器由模板 ShallowCopy 得到并以池复用，可以并发使用
+type CKKSScheme struct {
+	Params ckks.Parameters
+	rlweTools
+
+	encoder    ckks.Encoder
+	evaluator  ckks.Evaluator
+	encoders   *Pool[ckks.Encoder]
+	evaluators *Pool[ckks.Evaluator]
+}
+
+func NewCKKSScheme(params ckks.Parameters) *CKKSScheme {
+	s := &CKKSScheme{
+		Params:    params,
+		rlweTools: newRLWETools(params.Parameters),
+		encoder:   ckks.NewEncoder(params),
+		evaluator: ckks.NewEvaluator(params, rlwe.EvaluationKey{}),
+	}
+	s.encoders = NewPool(s.encoder.ShallowCopy)
+	s.evaluators = NewPool(s.evaluator.ShallowCopy)
+	return s
+}
+
+// NewEncoder 返回调用者独占的编码器，与模板共享预计算数据
+func (s *CKKSScheme) NewEncoder() ckks.Encoder { return s.encoder.ShallowCopy() }
+
+// NewEvaluator 返回调用者独占的、带有计算密钥 evk 的求值器
+func (s *CKKSScheme) NewEvaluator(evk rlwe.EvaluationKey) ckks.Evaluator {
+	return s.evaluator.ShallowCopy().WithKey(evk)
+}
+
+// WithEvaluator 从池中取出一个不带计算密钥的求值器供 f 使用
+func (s *CKKSScheme) WithEvaluator(f func(ckks.Evaluator)) { s.evaluators.With(f) }
+
+// WithEncoder 从池中取出一个编码器供 f 使用
+func (s *CKKSScheme) WithEncoder(f func(ckks.Encoder)) { s.encoders.With(f) }
+
+func (s *CKKSScheme) Name() string { return SchemeCKKS }
+
+func (s *CKKSScheme) Parameters() rlwe.Parameters { return s.Params.Parameters }
+
+func (s *CKKSScheme) Slots() int { return s.Params.Slots() }
+
+func (s *CKKSScheme) Encrypt(amount float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error) {
+	return s.EncryptVector([]float64{amount}, pk)
+}
+
+func (s *CKKSScheme) EncryptVector(amounts []float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error) {
+	if err := checkVectorLength(s, len(amounts)); err != nil {
+		return nil, err
+	}
+	var pt *rlwe.Plaintext
+	s.encoders.With(func(enc ckks.Encoder) {
+		pt = enc.EncodeNew(amounts, s.Params.MaxLevel(), s.Params.DefaultScale(), s.Params.LogSlots())
+	})
+	return evaluate("encrypt", func() *rlwe.Ciphertext {
+		return s.encrypt(pt, pk)
+	})
+}
+
+func (s *CKKSScheme) Decrypt(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) float64 {
+	return s.DecryptVector(ct, sk, 1)[0]
+}
+
+// DecryptVector 解密并取整到分
+func (s *CKKSScheme) DecryptVector(ct *rlwe.Ciphertext, sk *rlwe.SecretKey, n int) []float64 {
+	amounts := s.DecryptValues(ct, sk, n)
+	for i := range amounts {
+		amounts[i] = CKKSMsgRound(amounts[i])
+	}
+	return amounts
+}
+
+// DecryptValues 解密前 n 个槽位的实部，不取整，用于金额以外的结果（如 serverlib.OverdraftIndicator）
+func (s *CKKSScheme) DecryptValues(ct *rlwe.Ciphertext, sk *rlwe.SecretKey, n int) []float64 {
+	pt := s.decrypt(ct, sk)
+	var values []complex128
+	s.encoders.With(func(enc ckks.Encoder) {
+		values = enc.Decode(pt, s.Params.LogSlots())
+	})
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = real(values[i])
+	}
+	return out
+}
+
+func (s *CKKSScheme) Add(ct0, ct1 *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	return evaluate("add", func() (ct *rlwe.Ciphertext) {
+		s.WithEvaluator(func(eval ckks.Evaluator) { ct = eval.AddNew(ct0, ct1) })
+		return
+	})
+}
+
+func (s *CKKSScheme) Sub(ct0, ct1 *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	return evaluate("sub", func() (ct *rlwe.Ciphertext) {
+		s.WithEvaluator(func(eval ckks.Evaluator) { ct = eval.SubNew(ct0, ct1) })
+		return
+	})
+}
+
+func (s *CKKSScheme) KeySwitch(ct *rlwe.Ciphertext, swk *rlwe.SwitchingKey) (*rlwe.Ciphertext, error) {
+	return evaluate("key switch", func() (out *rlwe.Ciphertext) {
+		s.WithEvaluator(func(eval ckks.Evaluator) { out = eval.SwitchKeysNew(ct, swk) })
+		return
+	})
+}
+
+// KeySwitchScaled 用于 GenPublicSwitchingKey 生成的噪声较大的 swk：
+// 重加密前将密文乘以 2^k 并同样放大尺度，只为明文和噪声保留 headroomBits 位，用尽当前层的模数，解密得到的值不变
+func (s *CKKSScheme) KeySwitchScaled(ct *rlwe.Ciphertext, swk *rlwe.SwitchingKey, headroomBits int) (*rlwe.Ciphertext, error) {
+	logQ := 0.0
+	for i := 0; i <= ct.Level(); i++ {
+		logQ += math.Log2(s.Params.QiFloat64(i))
+	}
+	k := int(logQ-math.Log2(ct.Scale.Float64())) - headroomBits
+	if k > 52 {
+		k = 52
+	}
+	if k > 0 {
+		ct = ct.CopyNew()
+		s.WithEvaluator(func(eval ckks.Evaluator) { eval.MultByConst(ct, uint64(1)<<k, ct) })
+		ct.Scale = ct.Scale.Mul(rlwe.NewScale(math.Ldexp(1, k)))
+	}
+	return s.KeySwitch(ct, swk)
+}
+
+// --- BGV ---
+
+// BGVScheme 将金额按分编码为整数，加减和重加密的结果是精确的
+// 超出 ±T/2 分的金额会按模 T 回绕，因此加密时拒绝超出范围的金额
+// 编码器、求值器的复用同 CKKSScheme
+type BGVScheme struct {
+	Params bgv.Parameters
+	rlweTools
+
+	encoder    bgv.Encoder
+	evaluator  bgv.Evaluator
+	encoders   *Pool[bgv.Encoder]
+	evaluators *Pool[bgv.Evaluator]
+}
+
+func NewBGVScheme(params bgv.Parameters) *BGVScheme {
+	s := &BGVScheme{
+		Params:    params,
+		rlweTools: newRLWETools(params.Parameters),
+		encoder:   bgv.NewEncoder(params),
+		evaluator: bgv.NewEvaluator(params, rlwe.EvaluationKey{}),
+	}
+	s.encoders = NewPool(s.encoder.ShallowCopy)
+	s.evaluators = NewPool(s.evaluator.ShallowCopy)
+	return s
+}
+
+// NewEncoder 返回调用者独占的编码器，与模板共享预计算数据
+func (s *BGVScheme) NewEncoder() bgv.Encoder { return s.encoder.ShallowCopy() }
+
+// NewEvaluator 返回调用者独占的、带有计算密钥 evk 的求值器
+func (s *BGVScheme) NewEvaluator(evk rlwe.EvaluationKey) bgv.Evaluator {
+	return s.evaluator.ShallowCopy().WithKey(evk)
+}
+
+// WithEvaluator 从池中取出一个不带计算密钥的求值器供 f 使用
+func (s *BGVScheme) WithEvaluator(f func(bgv.Evaluator)) { s.evaluators.With(f) }
+
+// WithEncoder 从池中取出一个编码器供 f 使用
+func (s *BGVScheme) WithEncoder(f func(bgv.Encoder)) { s.encoders.With(f) }
+
+func (s *BGVScheme) Name() string { return SchemeBGV }
+
+func (s *BGVScheme) Parameters() rlwe.Parameters { return s.Params.Parameters }
+
+// MaxAmount 返回可以表示的最大金额
+func (s *BGVScheme) MaxAmount() float64 {
+	return float64((s.Params.T()-1)/2) / AmountMinorUnits
+}
+
+// Slots 返回 BGV 批处理的槽位数，即环维数
+func (s *BGVScheme) Slots() int { return s.Params.N() }
+
+func (s *BGVScheme) Encrypt(amount float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error) {
+	return s.EncryptVector([]float64{amount}, pk)
+}
+
+func (s *BGVScheme) EncryptVector(amounts []float64, pk *rlwe.PublicKey) (*rlwe.Ciphertext, error) {
+	if err := checkVectorLength(s, len(amounts)); err != nil {
+		return nil, err
+	}
+	minor := make([]int64, len(amounts))
+	for i, amount := range amounts {
+		if math.IsNaN(amount) || math.Abs(amount) > s.MaxAmount() {
+			return nil, fmt.Errorf("amount %v is out of range, bgv parameter set allows at most %.2f", amount, s.MaxAmount())
+		}
+		minor[i] = int64(math.Round(amount * AmountMinorUnits))
+	}
+	var pt *rlwe.Plaintext
+	s.encoders.With(func(enc bgv.Encoder) {
+		pt = enc.EncodeNew(minor, s.Params.MaxLevel(), s.Params.DefaultScale())
+	})
+	return evaluate("encrypt", func() *rlwe.Ciphertext {
+		return s.encrypt(pt, pk)
+	})
+}
+
+func (s *BGVScheme) Decrypt(ct *rlwe.Ciphertext, sk *rlwe.SecretKey) float64 {
+	return s.DecryptVector(ct, sk, 1)[0]
+}
+
+func (s *BGVScheme) DecryptVector(ct *rlwe.Ciphertext, sk *rlwe.SecretKey, n int) []float64 {
+	pt := s.decrypt(ct, sk)
+	var values []int64
+	s.encoders.With(func(enc bgv.Encoder) {
+		values = enc.DecodeIntNew(pt)
+	})
+	amounts := make([]float64, n)
+	for i := range amounts {
+		amounts[i] = float64(values[i]) / AmountMinorUnits
+	}
+	return amounts
+}
+
+func (s *BGVScheme) Add(ct0, ct1 *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	return evaluate("add", func() (ct *rlwe.Ciphertext) {
+		s.WithEvaluator(func(eval bgv.Evaluator) { ct = eval.AddNew(ct0, ct1) })
+		return
+	})
+}
+
+func (s *BGVScheme) Sub(ct0, ct1 *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	return evaluate("sub", func() (ct *rlwe.Ciphertext) {
+		s.WithEvaluator(func(eval bgv.Evaluator) { ct = eval.SubNew(ct0, ct1) })
+		return
+	})
+}
+
+func (s *BGVScheme) KeySwitch(ct *rlwe.Ciphertext, swk *rlwe.SwitchingKey) (*rlwe.Ciphertext, error) {
+	return evaluate("key switch", func() (out *rlwe.Ciphertext) {
+		s.WithEvaluator(func(eval bgv.Evaluator) { out = eval.SwitchKeysNew(ct, swk) })
+		return
+	})
+}
@@ -0,0 +1,204 @@
+package misc_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+var testSchemeParamSets = []string{"PN12QP109", "BGV-PN12QP109"}
+
+func TestAmountSchemes(t *testing.T) {
+	for _, id := range testSchemeParamSets {
+		t.Run(id, func(t *testing.T) {
+			scheme, err := misc.NewAmountScheme(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kgen := rlwe.NewKeyGenerator(scheme.Parameters())
+			sk1, pk1 := kgen.GenKeyPair()
+			sk2 := kgen.GenSecretKey()
+			swk := kgen.GenSwitchingKey(sk1, sk2)
+
+			balance, err := scheme.Encrypt(1234.56, pk1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			amount, err := scheme.Encrypt(-34.57, pk1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum, err := scheme.Add(balance, amount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := scheme.Decrypt(sum, sk1); res != 1199.99 {
+				t.Errorf("add: got %v, expected 1199.99", res)
+			}
+
+			diff, err := scheme.Sub(balance, amount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switched, err := scheme.KeySwitch(diff, swk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := scheme.Decrypt(switched, sk2); res != 1269.13 {
+				t.Errorf("sub and key switch: got %v, expected 1269.13", res)
+			}
+		})
+	}
+}
+
+// BGV 下大量加法后的结果仍然是精确的
+func TestBGVSchemeIsExact(t *testing.T) {
+	scheme, err := misc.NewAmountScheme("BGV-PN12QP109")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk, pk := rlwe.NewKeyGenerator(scheme.Parameters()).GenKeyPair()
+
+	cent, _ := scheme.Encrypt(0.01, pk)
+	acc, _ := scheme.Encrypt(0, pk)
+	for i := 0; i < 1000; i++ {
+		if acc, err = scheme.Add(acc, cent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res := scheme.Decrypt(acc, sk); res != 10 {
+		t.Errorf("got %v, expected exactly 10", res)
+	}
+
+	max := scheme.(*misc.BGVScheme).MaxAmount()
+	if _, err = scheme.Encrypt(max+1, pk); err == nil {
+		t.Error("out of range amount should be rejected")
+	}
+	ct, err := scheme.Encrypt(-max, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := scheme.Decrypt(ct, sk); res != -max {
+		t.Errorf("got %v, expected %v", res, -max)
+	}
+}
+
+// 同一方案的编码器、求值器由池复用，可以并发使用
+func TestAmountSchemeConcurrent(t *testing.T) {
+	for _, id := range testSchemeParamSets {
+		t.Run(id, func(t *testing.T) {
+			scheme, err := misc.NewAmountScheme(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kgen := rlwe.NewKeyGenerator(scheme.Parameters())
+			sk1, pk1 := kgen.GenKeyPair()
+			sk2 := kgen.GenSecretKey()
+			swk := kgen.GenSwitchingKey(sk1, sk2)
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					amount := float64(g) + 0.25
+					ct, err := scheme.Encrypt(amount, pk1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ct, err = scheme.Add(ct, ct); err != nil {
+						t.Error(err)
+						return
+					}
+					if ct, err = scheme.KeySwitch(ct, swk); err != nil {
+						t.Error(err)
+						return
+					}
+					if res := scheme.Decrypt(ct, sk2); res != 2*amount {
+						t.Errorf("goroutine %d: got %v, expected %v", g, res, 2*amount)
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkAmountScheme 测量服务端和客户端热路径上的各个运算
+// Parallel 子项在多个 goroutine 中同时运算，模拟服务端并发处理请求
+type benchmarkSchemeOp struct {
+	name string
+	f    func(s misc.AmountScheme) error
+}
+
+// benchmarkSchemeOps 返回参数集 id 下基准测试的各项运算及其使用的方案
+func benchmarkSchemeOps(b *testing.B, id string) (misc.AmountScheme, []benchmarkSchemeOp) {
+	scheme, err := misc.NewAmountScheme(id)
+	if err != nil {
+		b.Fatal(err)
+	}
+	kgen := rlwe.NewKeyGenerator(scheme.Parameters())
+	sk1, pk1 := kgen.GenKeyPair()
+	swk := kgen.GenSwitchingKey(sk1, kgen.GenSecretKey())
+	ct, _ := scheme.Encrypt(12.34, pk1)
+
+	return scheme, []benchmarkSchemeOp{
+		{"Encrypt", func(s misc.AmountScheme) error { _, err := s.Encrypt(12.34, pk1); return err }},
+		{"Decrypt", func(s misc.AmountScheme) error { s.Decrypt(ct, sk1); return nil }},
+		{"Add", func(s misc.AmountScheme) error { _, err := s.Add(ct, ct); return err }},
+		{"KeySwitch", func(s misc.AmountScheme) error { _, err := s.KeySwitch(ct, swk); return err }},
+	}
+}
+
+func BenchmarkAmountScheme(b *testing.B) {
+	for _, id := range testSchemeParamSets {
+		scheme, ops := benchmarkSchemeOps(b, id)
+		for _, op := range ops {
+			b.Run(id+"/"+op.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := op.f(scheme); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run(id+"/"+op.name+"/Parallel", func(b *testing.B) {
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if err := op.f(scheme); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkAmountSchemeUnpooled 每次运算都重新构造参数、编码器和求值器，
+// 即共享 CryptoContext 之前的做法，用于与 BenchmarkAmountScheme 对比
+func BenchmarkAmountSchemeUnpooled(b *testing.B) {
+	for _, id := range testSchemeParamSets {
+		_, ops := benchmarkSchemeOps(b, id)
+		for _, op := range ops {
+			b.Run(id+"/"+op.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					scheme, err := misc.NewAmountScheme(id)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err = op.f(scheme); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
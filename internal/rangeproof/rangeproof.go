@@ -0,0 +1,332 @@
+// 包 rangeproof 实现了基于 Pedersen 承诺的范围证明
+// 承诺 C = v·G + r·H 位于 P-256 上，H 由哈希得到，其相对 G 的离散对数未知
+//
+// 证明 v ∈ [0, 2^n) 的方法是按位分解：
+//   - 对每一位 b_i 给出承诺 C_i = b_i·G + r_i·H，且 Σ 2^i·C_i = C
+//   - 对每个 C_i 给出 OR 证明（CDS），证明其承诺的是 0 或 1
+//
+// 挑战值由 Fiat-Shamir 变换得到，其中包含调用者给出的 context，
+// 因此证明只对该 context（如密文的哈希）有效，不能移用到其他密文上
+package rangeproof
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	// MaxBits 是支持的最大位数
+	MaxBits = 64
+
+	pointSize  = 33
+	scalarSize = 32
+	bitSize    = pointSize + 4*scalarSize
+
+	domainH     = "Chimata/rangeproof/H"
+	domainBit   = "Chimata/rangeproof/bit"
+	domainBlind = "Chimata/rangeproof/blinding"
+)
+
+var (
+	curve = elliptic.P256()
+	order = curve.Params().N
+
+	// H 为第二个生成元
+	hx, hy = hashToCurve([]byte(domainH))
+
+	ErrInvalidProof = errors.New("invalid range proof")
+)
+
+type point struct {
+	x, y *big.Int
+}
+
+func (p point) add(q point) point {
+	x, y := curve.Add(p.x, p.y, q.x, q.y)
+	return point{x, y}
+}
+
+func (p point) neg() point {
+	return point{new(big.Int).Set(p.x), new(big.Int).Sub(curve.Params().P, p.y)}
+}
+
+func (p point) mul(k *big.Int) point {
+	x, y := curve.ScalarMult(p.x, p.y, new(big.Int).Mod(k, order).Bytes())
+	return point{x, y}
+}
+
+func (p point) equal(q point) bool {
+	return p.x.Cmp(q.x) == 0 && p.y.Cmp(q.y) == 0
+}
+
+func (p point) bytes() []byte {
+	return elliptic.MarshalCompressed(curve, p.x, p.y)
+}
+
+func parsePoint(b []byte) (point, error) {
+	x, y := elliptic.UnmarshalCompressed(curve, b)
+	if x == nil {
+		return point{}, errors.New("invalid curve point")
+	}
+	return point{x, y}, nil
+}
+
+func baseG() point {
+	return point{curve.Params().Gx, curve.Params().Gy}
+}
+
+func baseH() point {
+	return point{hx, hy}
+}
+
+// mulG 计算 k·G
+func mulG(k *big.Int) point {
+	x, y := curve.ScalarBaseMult(new(big.Int).Mod(k, order).Bytes())
+	return point{x, y}
+}
+
+// hashToCurve 以 try-and-increment 方式将 seed 映射到曲线上的点
+func hashToCurve(seed []byte) (*big.Int, *big.Int) {
+	params := curve.Params()
+	three := big.NewInt(3)
+	for ctr := uint32(0); ; ctr++ {
+		h := sha256.New()
+		h.Write(seed)
+		binary.Write(h, binary.BigEndian, ctr)
+		x := new(big.Int).SetBytes(h.Sum(nil))
+		if x.Cmp(params.P) >= 0 {
+			continue
+		}
+		// y^2 = x^3 - 3x + b
+		rhs := new(big.Int).Exp(x, three, params.P)
+		rhs.Sub(rhs, new(big.Int).Mul(three, x))
+		rhs.Add(rhs, params.B)
+		rhs.Mod(rhs, params.P)
+		if y := new(big.Int).ModSqrt(rhs, params.P); y != nil {
+			return x, y
+		}
+	}
+}
+
+func randScalar() (*big.Int, error) {
+	for {
+		k, err := rand.Int(rand.Reader, order)
+		if err != nil {
+			return nil, err
+		}
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
+
+func scalarBytes(k *big.Int) []byte {
+	b := make([]byte, scalarSize)
+	return new(big.Int).Mod(k, order).FillBytes(b)
+}
+
+// Blinding 由种子和序号确定性地导出承诺的盲化因子
+// 知道种子的一方可以据此重新计算承诺，检查其与密文中的金额是否一致
+func Blinding(seed []byte, index int) *big.Int {
+	h := sha256.New()
+	h.Write([]byte(domainBlind))
+	binary.Write(h, binary.BigEndian, uint32(index))
+	h.Write(seed)
+	return new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), order)
+}
+
+// Commit 计算 v·G + r·H 并序列化
+func Commit(v uint64, r *big.Int) []byte {
+	return commit(v, r).bytes()
+}
+
+func commit(v uint64, r *big.Int) point {
+	return mulG(new(big.Int).SetUint64(v)).add(baseH().mul(r))
+}
+
+// Proof 是对单个值的范围证明
+type Proof struct {
+	// Commitment 为 v·G + r·H
+	Commitment []byte
+	bits       []bitProof
+}
+
+// bitProof 证明 C 承诺的是 0 或 1
+// P0 = C, P1 = C - G；A_j 由 z_j·H - e_j·P_j 重新计算，不需要传输
+type bitProof struct {
+	c              point
+	e0, e1, z0, z1 *big.Int
+}
+
+// Bits 返回证明的位数，即证明了 v < 2^Bits
+func (p *Proof) Bits() int {
+	return len(p.bits)
+}
+
+// Prove 证明 v·G + r·H 承诺的 v 满足 0 <= v < 2^bits
+func Prove(v uint64, r *big.Int, bits int, context []byte) (*Proof, error) {
+	if bits < 1 || bits > MaxBits {
+		return nil, fmt.Errorf("invalid number of bits %d", bits)
+	}
+	if bits < 64 && v>>uint(bits) != 0 {
+		return nil, fmt.Errorf("value is out of range [0, 2^%d)", bits)
+	}
+
+	C := commit(v, r)
+	proof := &Proof{Commitment: C.bytes(), bits: make([]bitProof, bits)}
+
+	// 各位的盲化因子满足 Σ 2^i·r_i = r，最高位的由其余位确定
+	rs := make([]*big.Int, bits)
+	acc := new(big.Int)
+	for i := 0; i < bits-1; i++ {
+		ri, err := randScalar()
+		if err != nil {
+			return nil, err
+		}
+		rs[i] = ri
+		acc.Add(acc, new(big.Int).Lsh(ri, uint(i)))
+	}
+	last := new(big.Int).Sub(r, acc)
+	inv := new(big.Int).ModInverse(new(big.Int).Lsh(big.NewInt(1), uint(bits-1)), order)
+	rs[bits-1] = last.Mul(last, inv).Mod(last, order)
+
+	for i := 0; i < bits; i++ {
+		bp, err := proveBit(v>>uint(i)&1, rs[i], proof.Commitment, i, context)
+		if err != nil {
+			return nil, err
+		}
+		proof.bits[i] = bp
+	}
+	return proof, nil
+}
+
+func proveBit(b uint64, r *big.Int, commitment []byte, index int, context []byte) (bp bitProof, err error) {
+	bp.c = commit(b, r)
+	P := [2]point{bp.c, bp.c.add(baseG().neg())}
+	var A [2]point
+	var e, z [2]*big.Int
+
+	// 模拟另一分支
+	other := 1 - b
+	if e[other], err = randScalar(); err != nil {
+		return
+	}
+	if z[other], err = randScalar(); err != nil {
+		return
+	}
+	A[other] = baseH().mul(z[other]).add(P[other].mul(e[other]).neg())
+
+	// 真实分支
+	k, err := randScalar()
+	if err != nil {
+		return
+	}
+	A[b] = baseH().mul(k)
+
+	c := challenge(context, commitment, index, bp.c, A[0], A[1])
+	e[b] = new(big.Int).Sub(c, e[other])
+	e[b].Mod(e[b], order)
+	z[b] = new(big.Int).Mul(e[b], r)
+	z[b].Add(z[b], k).Mod(z[b], order)
+
+	bp.e0, bp.e1, bp.z0, bp.z1 = e[0], e[1], z[0], z[1]
+	return bp, nil
+}
+
+func challenge(context, commitment []byte, index int, c, a0, a1 point) *big.Int {
+	h := sha256.New()
+	h.Write([]byte(domainBit))
+	binary.Write(h, binary.BigEndian, uint32(len(context)))
+	h.Write(context)
+	h.Write(commitment)
+	binary.Write(h, binary.BigEndian, uint32(index))
+	h.Write(c.bytes())
+	h.Write(a0.bytes())
+	h.Write(a1.bytes())
+	return new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), order)
+}
+
+// Verify 验证证明在 context 下有效
+func (p *Proof) Verify(context []byte) error {
+	if len(p.bits) < 1 || len(p.bits) > MaxBits {
+		return ErrInvalidProof
+	}
+	C, err := parsePoint(p.Commitment)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+
+	var sum point
+	for i, bp := range p.bits {
+		P := [2]point{bp.c, bp.c.add(baseG().neg())}
+		A0 := baseH().mul(bp.z0).add(P[0].mul(bp.e0).neg())
+		A1 := baseH().mul(bp.z1).add(P[1].mul(bp.e1).neg())
+		c := challenge(context, p.Commitment, i, bp.c, A0, A1)
+		e := new(big.Int).Add(bp.e0, bp.e1)
+		if e.Mod(e, order).Cmp(c) != 0 {
+			return fmt.Errorf("%w: bit %d", ErrInvalidProof, i)
+		}
+
+		term := bp.c.mul(new(big.Int).Lsh(big.NewInt(1), uint(i)))
+		if i == 0 {
+			sum = term
+		} else {
+			sum = sum.add(term)
+		}
+	}
+	if !sum.equal(C) {
+		return fmt.Errorf("%w: bit commitments do not add up", ErrInvalidProof)
+	}
+	return nil
+}
+
+// MarshalBinary 序列化证明：commitment | bits | 各位的 (C_i, e0, e1, z0, z1)
+func (p *Proof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(p.Commitment)
+	buf.WriteByte(byte(len(p.bits)))
+	for _, bp := range p.bits {
+		buf.Write(bp.c.bytes())
+		for _, k := range []*big.Int{bp.e0, bp.e1, bp.z0, bp.z1} {
+			buf.Write(scalarBytes(k))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary 反序列化证明
+func (p *Proof) UnmarshalBinary(data []byte) error {
+	if len(data) < pointSize+1 {
+		return fmt.Errorf("%w: too short", ErrInvalidProof)
+	}
+	n := int(data[pointSize])
+	if n < 1 || n > MaxBits || len(data) != pointSize+1+n*bitSize {
+		return fmt.Errorf("%w: unexpected length", ErrInvalidProof)
+	}
+	p.Commitment = append([]byte{}, data[:pointSize]...)
+	p.bits = make([]bitProof, n)
+	ptr := pointSize + 1
+	for i := range p.bits {
+		c, err := parsePoint(data[ptr : ptr+pointSize])
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+		}
+		ptr += pointSize
+		var ks [4]*big.Int
+		for j := range ks {
+			ks[j] = new(big.Int).SetBytes(data[ptr : ptr+scalarSize])
+			if ks[j].Cmp(order) >= 0 {
+				return fmt.Errorf("%w: scalar out of range", ErrInvalidProof)
+			}
+			ptr += scalarSize
+		}
+		p.bits[i] = bitProof{c, ks[0], ks[1], ks[2], ks[3]}
+	}
+	return nil
+}
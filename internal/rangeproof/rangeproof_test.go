@@ -0,0 +1,105 @@
+package rangeproof_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/rangeproof"
+)
+
+func TestRangeProof(t *testing.T) {
+	seed := []byte("seed")
+	ctx := []byte("ciphertext hash")
+
+	for _, v := range []uint64{0, 1, 123456, 1<<40 - 1} {
+		r := rangeproof.Blinding(seed, 0)
+		proof, err := rangeproof.Prove(v, r, 40, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(proof.Commitment, rangeproof.Commit(v, r)) {
+			t.Fatalf("%d: commitment does not match the opening", v)
+		}
+
+		data, err := proof.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := new(rangeproof.Proof)
+		if err = decoded.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err = decoded.Verify(ctx); err != nil {
+			t.Errorf("%d: valid proof rejected: %v", v, err)
+		}
+		if decoded.Bits() != 40 {
+			t.Errorf("got %d bits, expected 40", decoded.Bits())
+		}
+
+		// 证明不能移用到其他 context
+		if err = decoded.Verify([]byte("another ciphertext")); !errors.Is(err, rangeproof.ErrInvalidProof) {
+			t.Errorf("%d: proof should be bound to its context, got %v", v, err)
+		}
+	}
+
+	if _, err := rangeproof.Prove(1<<40, rangeproof.Blinding(seed, 0), 40, ctx); err == nil {
+		t.Error("out of range value should not be proven")
+	}
+}
+
+func TestRangeProofTampered(t *testing.T) {
+	ctx := []byte("ctx")
+	proof, err := rangeproof.Prove(42, rangeproof.Blinding([]byte("a"), 0), 16, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := proof.MarshalBinary()
+
+	// 替换为另一个承诺
+	other := rangeproof.Commit(42, rangeproof.Blinding([]byte("b"), 0))
+	tampered := append(append([]byte{}, other...), data[len(other):]...)
+	p := new(rangeproof.Proof)
+	if err = p.UnmarshalBinary(tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Verify(ctx); err == nil {
+		t.Error("proof with a swapped commitment should be rejected")
+	}
+
+	// 修改某一位的响应
+	tampered = append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 1
+	if err = p.UnmarshalBinary(tampered); err == nil {
+		if err = p.Verify(ctx); err == nil {
+			t.Error("tampered proof should be rejected")
+		}
+	}
+
+	if err = p.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("truncated proof should not unmarshal")
+	}
+}
+
+func BenchmarkRangeProof(b *testing.B) {
+	ctx := []byte("ctx")
+	r := rangeproof.Blinding([]byte("seed"), 0)
+	proof, _ := rangeproof.Prove(123456, r, 40, ctx)
+	data, _ := proof.MarshalBinary()
+
+	b.Run("prove", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := rangeproof.Prove(123456, r, 40, ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(len(data)), "bytes")
+	})
+	b.Run("verify", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := proof.Verify(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -1,27 +1,143 @@
 package restfulpayload
 
-import "github.com/google/uuid"
+import (
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/google/uuid"
+)
 
 // RegisterUserReq 结构体表示了通信中的用户注册请求
 // 其中 pubkeys 部分使用 base64 编码
+// ckks_pubkey 可以为紧凑格式（见 misc.MarshalCompactPublicKey）或 MarshalBinary 格式
+// certificates 为 CA 签发的证书链，第一张为该用户的证书
+// {ckks, ecdsa}KeyID 为客户端为公钥选定的 ID，交易中以此指明所用的密钥，为零值时由服务端分配
+// ecdsa_pubkey 为 PKIX 编码的签名公钥，ecdsaAlgorithm 为其算法（见 key.SigAlgorithm），为空时由公钥类型得出
+// sig 为该签名公钥对应的私钥对 key.RegisterUserMessage 的签名，使用 base64 编码；
+// 证书和公钥是公开的，签名证明注册者持有私钥，timestamp 和 nonce 同 EnrollProductReq
 type RegisterUserReq struct {
-	UUID         uuid.UUID `json:"uuid"`
-	Name         string    `json:"name"`
-	CKKS_pubkey  string    `json:"ckks_pubkey"`
-	ECDSA_pubkey string    `json:"ecdsa_pubkey"`
+	UUID           uuid.UUID          `json:"uuid"`
+	Name           string             `json:"name"`
+	CKKS_pubkey    string             `json:"ckks_pubkey"`
+	ECDSA_pubkey   string             `json:"ecdsa_pubkey"`
+	ECDSAAlgorithm string             `json:"ecdsaAlgorithm,omitempty"`
+	Certificates   []*key.Certificate `json:"certificates"`
+	CKKSKeyID      uuid.UUID          `json:"ckksKeyID"`
+	ECDSAKeyID     uuid.UUID          `json:"ecdsaKeyID"`
+	TimeStamp      int64              `json:"timestamp"`
+	Nonce          uuid.UUID          `json:"nonce"`
+	Sig            string             `json:"sig"`
+}
+
+// UserGetTransactionsReq 结构体表示了查询用户交易记录的请求
+// asset 为空时返回全部资产的交易
+type UserGetTransactionsReq struct {
+	UUID  uuid.UUID `json:"uuid"`
+	Asset string    `json:"asset,omitempty"`
+}
+
+// CertificateReq 结构体表示了向 CA 申请证书的请求
+// sig 为用户签名私钥对 key.CertificateRequestMessage 的签名，ecdsaAlgorithm 同 RegisterUserReq
+// 其中 pubkeys 和 sig 部分使用 base64 编码
+type CertificateReq struct {
+	UUID           uuid.UUID `json:"uuid"`
+	Name           string    `json:"name"`
+	CKKS_pubkey    string    `json:"ckks_pubkey"`
+	ECDSA_pubkey   string    `json:"ecdsa_pubkey"`
+	ECDSAAlgorithm string    `json:"ecdsaAlgorithm,omitempty"`
+	Sig            string    `json:"sig"`
 }
 
 // RegisterSwkReq 结构体表示了通信中提交 swk 注册请求
 // 其中 swk 部分使用 base64 编码
+// swk 可以为紧凑格式（见 misc.MarshalCompactSwitchingKey，带种子时只有一半大小）或 MarshalBinary 格式
+// epoch 为该 swk 所属的纪元，为 0 时由服务端使用当前纪元
+// pkIn、pkOut 为 swk 两端的 CKKS 公钥 ID，为零值时为双方当前的主公钥
 type RegisterSwkReq struct {
 	UserIn  uuid.UUID `json:"userIn"`
 	UserOut uuid.UUID `json:"userOut"`
 	Swk     string    `json:"swk"`
+	Epoch   int64     `json:"epoch,omitempty"`
+	PKIn    uuid.UUID `json:"pkIn"`
+	PKOut   uuid.UUID `json:"pkOut"`
+}
+
+// RotateCKKSKeyReq 结构体表示了 CKKS 密钥轮换请求
+// swk 为旧私钥到新私钥的重加密密钥，格式同 RegisterSwkReq
+// certificates 为 CA 为新公钥签发的证书链
+// sig 为用户 ECDSA 私钥对 key.RotateCKKSKeyMessage 的签名
+// keyID 为新公钥的 ID，为零值时由服务端分配
+// 其中 pubkey、swk 和 sig 部分使用 base64 编码
+type RotateCKKSKeyReq struct {
+	UUID         uuid.UUID          `json:"uuid"`
+	KeyID        uuid.UUID          `json:"keyID"`
+	CKKS_pubkey  string             `json:"ckks_pubkey"`
+	Swk          string             `json:"swk"`
+	Certificates []*key.Certificate `json:"certificates"`
+	Sig          string             `json:"sig"`
+}
+
+// AddECDSAKeyReq 结构体表示了为用户添加签名公钥（如设备密钥）的请求
+// 新密钥的算法可以与已有密钥不同，ecdsaAlgorithm 同 RegisterUserReq
+// sig 为 signedBy 指明的已有签名私钥对 key.AddECDSAKeyMessage 的签名
+// 其中 pubkey 和 sig 部分使用 base64 编码
+type AddECDSAKeyReq struct {
+	UUID           uuid.UUID `json:"uuid"`
+	KeyID          uuid.UUID `json:"keyID"`
+	ECDSA_pubkey   string    `json:"ecdsa_pubkey"`
+	ECDSAAlgorithm string    `json:"ecdsaAlgorithm,omitempty"`
+	SignedBy       uuid.UUID `json:"signedBy"`
+	Sig            string    `json:"sig"`
+}
+
+// RegisterEvaluationKeyReq 结构体表示了为 CKKS 公钥注册或替换计算密钥（重线性化与旋转密钥）的请求
+// keyID 为 CKKS 公钥的 ID，为零值时为主公钥
+// evaluationKey 为 misc.MarshalEvaluationKey 的结果
+// sig 为 signedBy 指明的签名私钥对 key.RegisterEvaluationKeyMessage 的签名
+// 其中 evaluationKey 和 sig 部分使用 base64 编码
+type RegisterEvaluationKeyReq struct {
+	UUID          uuid.UUID `json:"uuid"`
+	KeyID         uuid.UUID `json:"keyID"`
+	EvaluationKey string    `json:"evaluationKey"`
+	SignedBy      uuid.UUID `json:"signedBy"`
+	Sig           string    `json:"sig"`
+}
+
+// GetEvaluationKeyReq 结构体表示了查询计算密钥的请求，keyID 同 RegisterEvaluationKeyReq
+type GetEvaluationKeyReq struct {
+	UUID  uuid.UUID `json:"uuid"`
+	KeyID uuid.UUID `json:"keyID"`
+}
+
+// RegisterAuditorSwkReq 结构体表示了为 CKKS 公钥注册到监管者透支密钥的 swk 的请求，见 serverlib.SwitchToAuditor
+// keyID 同 RegisterEvaluationKeyReq；swk 为 misc.GenPublicSwitchingKey 生成后 misc.MarshalCompactSwitchingKey 的结果
+// sig 为 signedBy 指明的签名私钥对 key.RegisterAuditorSwkMessage 的签名
+// auditorSig 为监管者对 key.AuditorSwkCertMessage 的签名，见 AuditorCertifySwkReq
+// 其中 swk、sig 和 auditorSig 部分使用 base64 编码
+type RegisterAuditorSwkReq struct {
+	UUID       uuid.UUID `json:"uuid"`
+	KeyID      uuid.UUID `json:"keyID"`
+	Swk        string    `json:"swk"`
+	SignedBy   uuid.UUID `json:"signedBy"`
+	Sig        string    `json:"sig"`
+	AuditorSig string    `json:"auditorSig"`
+}
+
+// EnrollProductReq 结构体表示了用户加入（enrolled 为 true）或退出账户产品的请求
+// sig 为 signedBy 指明的签名私钥对 key.EnrollProductMessage 的签名，使用 base64 编码
+// timestamp 为签名时的 unix 时间，nonce 每次请求随机生成，服务端据此拒绝重放的请求
+type EnrollProductReq struct {
+	UUID      uuid.UUID `json:"uuid"`
+	Product   string    `json:"product"`
+	Enrolled  bool      `json:"enrolled"`
+	TimeStamp int64     `json:"timestamp"`
+	Nonce     uuid.UUID `json:"nonce"`
+	SignedBy  uuid.UUID `json:"signedBy"`
+	Sig       string    `json:"sig"`
 }
 
 // AuditorRegisterUserReq 结构体表示了通信中的用户注册请求
 // 和前面不同，这个是用于向监管者提交注册请求的
 // 本文假设监管者是绝对可信的
+// 多监管者部署时应使用 AuditorRegisterShareReq，避免单个监管者持有完整私钥
 // 其中 pubkeys 和 privkey 部分使用 base64 编码
 type AuditorRegisterUserReq struct {
 	UUID         uuid.UUID `json:"uuid"`
@@ -29,3 +145,68 @@ type AuditorRegisterUserReq struct {
 	CKKS_privkey string    `json:"ckks_privkey"`
 	ECDSA_pubkey string    `json:"ecdsa_pubkey"`
 }
+
+// AuditorRegisterShareReq 结构体表示了向门限监管者提交私钥份额的请求
+// 每个监管者只拿到用户 CKKS 私钥的一份 Shamir 份额
+// ecdsa_pubkey 为用户的签名公钥，sig 为对应私钥对 key.RegisterShareMessage 的签名；
+// 用户已有份额时，sig 须由首次提交时的签名公钥生成，否则请求被拒绝
+// 其中 share、ecdsa_pubkey 和 sig 部分使用 base64 编码
+type AuditorRegisterShareReq struct {
+	UUID         uuid.UUID `json:"uuid"`
+	Point        uint64    `json:"point"`
+	Threshold    int       `json:"threshold"`
+	Share        string    `json:"share"`
+	ECDSA_pubkey string    `json:"ecdsa_pubkey"`
+	TimeStamp    int64     `json:"timestamp"`
+	Nonce        uuid.UUID `json:"nonce"`
+	Sig          string    `json:"sig"`
+}
+
+// AuditorPartialDecryptReq 结构体表示了服务端向门限监管者请求部分解密的请求
+// actives 为本次参与解密的监管者公开点；ref 为密文所属的交易或余额刷新的 UUID
+// sig 为服务端签名私钥对 key.PartialDecryptMessage 的签名，timestamp 和 nonce 同 AuditorOverdraftCheckReq
+// 其中 ct 和 sig 部分使用 base64 编码，ct 格式同 UnmarshalCiphertext 所接受的格式
+type AuditorPartialDecryptReq struct {
+	UUID      uuid.UUID `json:"uuid"`
+	Ref       uuid.UUID `json:"ref"`
+	CT        string    `json:"ct"`
+	Actives   []uint64  `json:"actives"`
+	TimeStamp int64     `json:"timestamp"`
+	Nonce     uuid.UUID `json:"nonce"`
+	Sig       string    `json:"sig"`
+}
+
+// AuditorOverdraftCheckReq 结构体表示了服务端请求监管者判断交易是否透支的请求
+// indicator 为已重加密到监管者透支密钥下的指示值，见 serverlib.OverdraftIndicator；slots 为需要判断的槽位
+// timestamp 为签名时的 unix 时间，nonce 每次请求随机生成；sig 为服务端签名私钥对 key.OverdraftCheckMessage 的签名
+// 其中 indicator 和 sig 部分使用 base64 编码，indicator 格式同 UnmarshalCiphertext 所接受的格式
+type AuditorOverdraftCheckReq struct {
+	TxUUID    uuid.UUID `json:"txUUID"`
+	UUID      uuid.UUID `json:"uuid"`
+	Slots     []int     `json:"slots"`
+	Indicator string    `json:"indicator"`
+	TimeStamp int64     `json:"timestamp"`
+	Nonce     uuid.UUID `json:"nonce"`
+	Sig       string    `json:"sig"`
+}
+
+// AuditorCertifySwkReq 结构体表示了请求监管者为到其透支密钥的 swk 出具证明的请求
+// 监管者用 pubkey 加密随机向量并以 swk 重加密，再以 evaluationKey 中的重线性化密钥计算其平方后重加密，
+// 都能正确解密时对 key.AuditorSwkCertMessage 签名
+// 其中 pubkey、swk 和 evaluationKey 部分使用 base64 编码，swk 同 RegisterAuditorSwkReq，
+// evaluationKey 为服务端 /user/getEvaluationKey 返回的计算密钥
+type AuditorCertifySwkReq struct {
+	UUID          uuid.UUID `json:"uuid"`
+	KeyID         uuid.UUID `json:"keyID"`
+	Pubkey        string    `json:"pubkey"`
+	Swk           string    `json:"swk"`
+	EvaluationKey string    `json:"evaluationKey"`
+}
+
+// SigningPublicKey 为 /user/getPublicKeys 返回的签名公钥
+// ecdsa_pubkey 为 base64 编码的 PKIX 公钥
+type SigningPublicKey struct {
+	KeyID          uuid.UUID `json:"keyID"`
+	ECDSA_pubkey   string    `json:"ecdsa_pubkey"`
+	ECDSAAlgorithm string    `json:"ecdsaAlgorithm"`
+}
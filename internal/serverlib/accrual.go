@@ -0,0 +1,174 @@
+package serverlib
+
+// accrual.go 实现了对加密余额的周期性计息和收费
+// 服务端不解密余额：
+//   - 利息为余额乘以每期利率并重缩放，见 transaction.CalcRatedFeeVector；仅适用于 CKKS，且每次消耗余额密文的一层，
+//     余额到达第 0 层后需由用户刷新才能继续计息
+//   - 费用以用户公钥加密后从余额中减去，适用于 CKKS 和 BGV
+// 每期的利息和费用各记为一笔账本交易，交易 ID 由用户、产品、类型和期数确定，因此重复执行不会重复计息
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+type AccrualKind string
+
+const (
+	AccrualInterest AccrualKind = "interest"
+	AccrualFee      AccrualKind = "fee"
+)
+
+var (
+	productIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+	accrualNamespace = uuid.NewSHA1(uuid.NameSpaceOID, []byte("Chimata-Accrual-v1"))
+)
+
+// AccrualProduct 是一种账户产品，用户加入后每期按 InterestRate 计息并收取 Fee
+type AccrualProduct struct {
+	ID string `json:"id"`
+	// 每期利率，如 0.001 表示每期 0.1%
+	InterestRate float64 `json:"interestRate,omitempty"`
+	// 每期的固定费用
+	Fee float64 `json:"fee,omitempty"`
+	// 计息和收费的资产，为空时为默认资产
+	Asset  string        `json:"asset,omitempty"`
+	Period time.Duration `json:"period"`
+}
+
+// ParseAccrualProduct 解析形如 id:interest=0.001,fee=1.5,asset=points,period=720h 的产品定义
+// 未指定 period 时使用 defaultPeriod
+func ParseAccrualProduct(s string, defaultPeriod time.Duration) (p AccrualProduct, err error) {
+	id, opts, _ := strings.Cut(s, ":")
+	if !productIDPattern.MatchString(id) {
+		return p, fmt.Errorf("invalid product id %q", id)
+	}
+	p = AccrualProduct{ID: id, Period: defaultPeriod}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(opt, "=")
+		switch k {
+		case "interest":
+			p.InterestRate, err = strconv.ParseFloat(v, 64)
+		case "fee":
+			p.Fee, err = strconv.ParseFloat(v, 64)
+		case "asset":
+			p.Asset = v
+		case "period":
+			p.Period, err = time.ParseDuration(v)
+		default:
+			err = fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return p, fmt.Errorf("product %s: %v", id, err)
+		}
+	}
+	switch {
+	case p.Period < time.Second:
+		return p, fmt.Errorf("product %s: period %v is too short", id, p.Period)
+	case math.IsNaN(p.InterestRate) || p.InterestRate < 0 || math.IsNaN(p.Fee) || p.Fee < 0:
+		return p, fmt.Errorf("product %s: interest rate and fee must be non-negative", id)
+	case p.InterestRate == 0 && p.Fee == 0:
+		return p, fmt.Errorf("product %s has neither interest nor fee", id)
+	}
+	return p, nil
+}
+
+// Kinds 返回产品每期需要执行的操作
+func (p AccrualProduct) Kinds() (kinds []AccrualKind) {
+	if p.InterestRate != 0 {
+		kinds = append(kinds, AccrualInterest)
+	}
+	if p.Fee != 0 {
+		kinds = append(kinds, AccrualFee)
+	}
+	return
+}
+
+// PeriodAt 返回时刻 t 所在的期数
+func (p AccrualProduct) PeriodAt(t time.Time) int64 {
+	return t.Unix() / int64(p.Period/time.Second)
+}
+
+// AccrualTransactionID 返回用户 user 在产品 product 第 period 期的 kind 账本交易的 ID
+func AccrualTransactionID(user uuid.UUID, product string, kind AccrualKind, period int64) uuid.UUID {
+	return uuid.NewSHA1(accrualNamespace, []byte(fmt.Sprintf("%s/%s/%s/%d", user, product, kind, period)))
+}
+
+// Accrue 计算用户 user 第 period 期的 kind，返回账本交易和更新后的余额
+// balance 以用户的 CKKS 公钥 pk（ID 为 ckksKeyID）加密，slot 为产品资产的槽位
+// 利息交易由运营方（uuid.Nil）转给用户，费用交易由用户转给运营方，金额密文均以 pk 加密
+func (p AccrualProduct) Accrue(kind AccrualKind, user, ckksKeyID uuid.UUID, pk *rlwe.PublicKey,
+	balance *rlwe.Ciphertext, slot int, period int64) (tx *transaction.Transaction, updated *rlwe.Ciphertext, err error) {
+	var amount *rlwe.Ciphertext
+	switch kind {
+	case AccrualInterest:
+		amount, updated, err = AccrueInterest(balance, slot, p.InterestRate)
+	case AccrualFee:
+		amount, updated, err = ChargeFee(balance, pk, slot, p.Fee)
+	default:
+		err = fmt.Errorf("unknown accrual kind %q", kind)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	amountBytes, err := misc.MarshalCompactCiphertext(amount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx = &transaction.Transaction{
+		ConfirmingPhase: "confirmed",
+		UUID:            AccrualTransactionID(user, p.ID, kind, period),
+		TimeStamp:       time.Now().Unix(),
+		IsValid:         true,
+	}
+	if p.Asset != "" && p.Asset != misc.DefaultAssetID {
+		tx.Assets = []string{p.Asset}
+	}
+	if kind == AccrualInterest {
+		tx.Receipt, tx.CTReceipt, tx.CTReceiptKeyID = user, amountBytes, ckksKeyID
+	} else {
+		tx.Sender, tx.CTSender, tx.CTSenderKeyID = user, amountBytes, ckksKeyID
+	}
+	return tx, updated, nil
+}
+
+// AccrueInterest 计算余额 slot 槽位按利率 rate 产生的利息，返回利息和计息后的余额
+// 仅适用于 CKKS，余额在第 0 层时返回 transaction.ErrNoLevelLeft
+func AccrueInterest(balance *rlwe.Ciphertext, slot int, rate float64) (interest, updated *rlwe.Ciphertext, err error) {
+	rates := make([]float64, slot+1)
+	rates[slot] = rate
+	if interest, err = transaction.CalcRatedFeeVector(balance, rates); err != nil {
+		return nil, nil, err
+	}
+	if updated, err = misc.GetAmountScheme().Add(balance, interest); err != nil {
+		return nil, nil, err
+	}
+	return interest, updated, nil
+}
+
+// ChargeFee 以公钥 pk 加密 slot 槽位的费用 fee，返回费用密文和扣费后的余额
+func ChargeFee(balance *rlwe.Ciphertext, pk *rlwe.PublicKey, slot int, fee float64) (feeCT, updated *rlwe.Ciphertext, err error) {
+	amounts := make([]float64, slot+1)
+	amounts[slot] = fee
+	scheme := misc.GetAmountScheme()
+	if feeCT, err = scheme.EncryptVector(amounts, pk); err != nil {
+		return nil, nil, err
+	}
+	if updated, err = scheme.Sub(balance, feeCT); err != nil {
+		return nil, nil, err
+	}
+	return feeCT, updated, nil
+}
@@ -0,0 +1,112 @@
+package serverlib_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+)
+
+func TestParseAccrualProduct(t *testing.T) {
+	p, err := serverlib.ParseAccrualProduct("savings:interest=0.001,fee=1.5,asset=points,period=24h", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := serverlib.AccrualProduct{ID: "savings", InterestRate: 0.001, Fee: 1.5, Asset: "points", Period: 24 * time.Hour}
+	if p != want {
+		t.Errorf("got %+v, expected %+v", p, want)
+	}
+	if p, _ = serverlib.ParseAccrualProduct("basic:fee=2", time.Hour); p.Period != time.Hour || len(p.Kinds()) != 1 {
+		t.Errorf("default period or kinds not applied: %+v", p)
+	}
+
+	for _, s := range []string{"", "bad id:fee=1", "p", "p:fee=-1", "p:interest=NaN", "p:fee=1,period=1ms", "p:rate=1"} {
+		if _, err := serverlib.ParseAccrualProduct(s, time.Hour); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
+
+func TestAccrualTransactionID(t *testing.T) {
+	user := uuid.New()
+	id := serverlib.AccrualTransactionID(user, "savings", serverlib.AccrualInterest, 7)
+	if id != serverlib.AccrualTransactionID(user, "savings", serverlib.AccrualInterest, 7) {
+		t.Error("transaction id is not deterministic")
+	}
+	for _, other := range []uuid.UUID{
+		serverlib.AccrualTransactionID(uuid.New(), "savings", serverlib.AccrualInterest, 7),
+		serverlib.AccrualTransactionID(user, "basic", serverlib.AccrualInterest, 7),
+		serverlib.AccrualTransactionID(user, "savings", serverlib.AccrualFee, 7),
+		serverlib.AccrualTransactionID(user, "savings", serverlib.AccrualInterest, 8),
+	} {
+		if other == id {
+			t.Error("transaction ids of different accruals collide")
+		}
+	}
+}
+
+func TestAccrue(t *testing.T) {
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		const balancePT = 1000.0
+		p := serverlib.AccrualProduct{ID: "savings", InterestRate: 0.01, Fee: 3, Period: time.Hour}
+		user, keyID := uuid.New(), uuid.New()
+		sk, pk := testutil.NewCKKSKeyPair()
+		balance := testutil.MustEncryptAmount(balancePT, pk)
+
+		if misc.GetCryptoContext().CKKS() == nil {
+			if _, _, err := p.Accrue(serverlib.AccrualInterest, user, keyID, pk, balance, misc.DefaultAssetSlot, 1); !errors.Is(err, transaction.ErrRequiresCKKS) {
+				t.Errorf("interest under %s should fail with ErrRequiresCKKS, got %v", misc.ParamSetID(), err)
+			}
+		} else {
+			tx, updated, err := p.Accrue(serverlib.AccrualInterest, user, keyID, pk, balance, misc.DefaultAssetSlot, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Level() != balance.Level()-1 {
+				t.Errorf("expected level %d after interest, got %d", balance.Level()-1, updated.Level())
+			}
+			if got := clientlib.DecryptAmount(updated, sk); math.Abs(got-balancePT*1.01) > 0.01 {
+				t.Errorf("balance after interest: got %v, expected %v", got, balancePT*1.01)
+			}
+			interest, err := tx.GetReceiptCT()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := clientlib.DecryptAmount(interest, sk); math.Abs(got-balancePT*0.01) > 0.01 {
+				t.Errorf("interest: got %v, expected %v", got, balancePT*0.01)
+			}
+			if tx.Receipt != user || tx.Sender != uuid.Nil || tx.CTReceiptKeyID != keyID ||
+				tx.UUID != serverlib.AccrualTransactionID(user, p.ID, serverlib.AccrualInterest, 1) {
+				t.Errorf("unexpected interest transaction %+v", tx)
+			}
+
+			// 用尽层数后需要刷新
+			for updated.Level() > 0 {
+				if _, updated, err = serverlib.AccrueInterest(updated, misc.DefaultAssetSlot, p.InterestRate); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err = serverlib.AccrueInterest(updated, misc.DefaultAssetSlot, p.InterestRate); !errors.Is(err, transaction.ErrNoLevelLeft) {
+				t.Errorf("expected ErrNoLevelLeft at level 0, got %v", err)
+			}
+		}
+
+		tx, updated, err := p.Accrue(serverlib.AccrualFee, user, keyID, pk, balance, misc.DefaultAssetSlot, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := clientlib.DecryptAmount(updated, sk); math.Abs(got-(balancePT-p.Fee)) > 0.01 {
+			t.Errorf("balance after fee: got %v, expected %v", got, balancePT-p.Fee)
+		}
+		if tx.Sender != user || tx.Receipt != uuid.Nil || tx.CTSenderKeyID != keyID {
+			t.Errorf("unexpected fee transaction %+v", tx)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+package serverlib_test
+
+// batch_test.go 评估按槽位打包的批量重加密，服务端未采用该方案
+// 同一对 (发送方, 接收方) 的多笔转账，各占用打包密文中连续的 stride 个槽位：
+//   1. 打包：用发送方的旋转密钥将第 j 笔转账旋转到槽位 j*stride，乘以掩码后相加
+//   2. 用 swk 对打包密文重加密一次
+//   3. 拆包：用接收方的旋转密钥（hoisted）将第 j 段旋转回槽位 0，乘以掩码去掉其他转账
+//
+// 打包时每个密文仍需一次旋转，而旋转本身就是一次密钥切换，
+// 因此对互相独立的密文，批量重加密的密钥切换次数并不少于逐笔重加密。
+// BenchmarkBatchKeySwitch 在 PN13QP218 下测得的单笔开销约为逐笔重加密的 1.5 倍；
+// 此外两次掩码各消耗一层，默认参数集 PN12QP109 无法使用，所以服务端逐笔重加密
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// 批量重加密需要更多层数，测试中临时切换到 PN13QP218
+const batchTestParamSet = "PN13QP218"
+
+type batchKeySwitcher struct {
+	params       ckks.Parameters
+	stride       int
+	swk          *rlwe.SwitchingKey
+	senderEval   ckks.Evaluator
+	receiverEval ckks.Evaluator
+	encoder      ckks.Encoder
+}
+
+func newBatchKeySwitcher(stride, n int) (b *batchKeySwitcher, pk1 *rlwe.PublicKey, sk2 *rlwe.SecretKey) {
+	kgen := rlwe.NewKeyGenerator(misc.GetRLWEParams())
+	sk1, pk1 := kgen.GenKeyPair()
+	sk2 = kgen.GenSecretKey()
+	var senderRots, receiverRots []int
+	for j := 1; j < n; j++ {
+		senderRots, receiverRots = append(senderRots, -j*stride), append(receiverRots, j*stride)
+	}
+	scheme := misc.GetCryptoContext().CKKS()
+	b = &batchKeySwitcher{
+		params:       scheme.Params,
+		stride:       stride,
+		swk:          kgen.GenSwitchingKey(sk1, sk2),
+		senderEval:   scheme.NewEvaluator(rlwe.EvaluationKey{Rtks: kgen.GenRotationKeysForRotations(senderRots, false, sk1)}),
+		receiverEval: scheme.NewEvaluator(rlwe.EvaluationKey{Rtks: kgen.GenRotationKeysForRotations(receiverRots, false, sk2)}),
+		encoder:      scheme.NewEncoder(),
+	}
+	return b, pk1, sk2
+}
+
+// keySwitch 对同一层的 cts 批量重加密，len(cts) 不超过 newBatchKeySwitcher 的 n
+func (b *batchKeySwitcher) keySwitch(tb testing.TB, cts []*rlwe.Ciphertext) []*rlwe.Ciphertext {
+	// 打包
+	mask := b.mask(cts[0].Level())
+	var packed *rlwe.Ciphertext
+	for j, ct := range cts {
+		masked := b.applyMask(tb, b.senderEval, ct, mask)
+		if j != 0 {
+			masked = b.senderEval.RotateNew(masked, -j*b.stride)
+		}
+		if packed == nil {
+			packed = masked
+		} else {
+			b.senderEval.Add(packed, masked, packed)
+		}
+	}
+
+	// 重加密一次
+	switched := b.receiverEval.SwitchKeysNew(packed, b.swk)
+
+	// 拆包
+	var rots []int
+	for j := 1; j < len(cts); j++ {
+		rots = append(rots, j*b.stride)
+	}
+	rotated := b.receiverEval.RotateHoistedNew(switched, rots)
+	rotated[0] = switched
+	mask = b.mask(switched.Level())
+	out := make([]*rlwe.Ciphertext, len(cts))
+	for j := range cts {
+		out[j] = b.applyMask(tb, b.receiverEval, rotated[j*b.stride], mask)
+	}
+	return out
+}
+
+// mask 返回前 stride 个槽位为 1、其余为 0 的明文
+// 明文的 scale 取当前层的模数，乘法后 rescale 可以恰好恢复密文原来的 scale
+func (b *batchKeySwitcher) mask(level int) *rlwe.Plaintext {
+	values := make([]float64, b.params.Slots())
+	for i := 0; i < b.stride; i++ {
+		values[i] = 1
+	}
+	return b.encoder.EncodeNew(values, level, rlwe.NewScale(b.params.QiFloat64(level)), b.params.LogSlots())
+}
+
+func (b *batchKeySwitcher) applyMask(tb testing.TB, eval ckks.Evaluator, ct *rlwe.Ciphertext, mask *rlwe.Plaintext) *rlwe.Ciphertext {
+	masked := eval.MulNew(ct, mask)
+	if err := eval.Rescale(masked, b.params.DefaultScale(), masked); err != nil {
+		tb.Fatal(err)
+	}
+	return masked
+}
+
+// 检查基准测试中的打包实现是正确的
+func TestBatchKeySwitch(t *testing.T) {
+	testutil.UseParamSet(t, batchTestParamSet)
+	scheme := misc.GetAmountScheme()
+	const stride, n = 2, 5
+	b, pk1, sk2 := newBatchKeySwitcher(stride, n)
+
+	var (
+		cts      []*rlwe.Ciphertext
+		expected [][]float64
+	)
+	for j := 0; j < n; j++ {
+		amounts := []float64{misc.GenRandFloat(), float64(j) + 0.25}
+		ct, err := scheme.EncryptVector(amounts, pk1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts, expected = append(cts, ct), append(expected, amounts)
+	}
+
+	out := b.keySwitch(t, cts)
+	for j, ct := range out {
+		res := scheme.DecryptVector(ct, sk2, stride+2)
+		want := append(expected[j], 0, 0)
+		for i := range want {
+			if res[i] != want[i] {
+				t.Errorf("transfer %d slot %d: got %v, expected %v", j, i, res[i], want[i])
+			}
+		}
+	}
+}
+
+// 比较逐笔重加密与批量重加密的单笔开销
+func BenchmarkBatchKeySwitch(b *testing.B) {
+	testutil.UseParamSet(b, batchTestParamSet)
+	const stride = 1
+	for _, n := range []int{1, 8, 32} {
+		switcher, pk1, _ := newBatchKeySwitcher(stride, n)
+		cts := make([]*rlwe.Ciphertext, n)
+		for j := range cts {
+			cts[j] = testutil.MustEncryptAmount(misc.GenRandFloat(), pk1)
+		}
+
+		b.Run(fmt.Sprintf("sequential/n=%d", n), func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				for _, ct := range cts {
+					if _, err := serverlib.ReEncryptCTWithSwk(ct, switcher.swk); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*n), "ns/transfer")
+		})
+		b.Run(fmt.Sprintf("packed/n=%d", n), func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				switcher.keySwitch(b, cts)
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*n), "ns/transfer")
+		})
+	}
+}
@@ -1,32 +1,48 @@
 package serverlib_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"fmt"
 	"math"
+	"os"
 	"testing"
 
 	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/key"
 	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
 	"github.com/CamberLoid/Chimata/internal/transaction"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
+// 与方案相关的测试默认在 testutil.DefaultSchemeParamSets 的每个参数集下以子测试运行，见 testutil.ForEachScheme
+// 设置 CHIMATA_TEST_PARAMS 时只在该参数集（如 BGV-PN12QP109）下运行，其他测试也使用该参数集
+func TestMain(m *testing.M) {
+	if id := os.Getenv("CHIMATA_TEST_PARAMS"); id != "" {
+		if err := misc.SetParamSet(id); err != nil {
+			panic(err)
+		}
+	}
+	os.Exit(m.Run())
+}
+
 func BenchmarkReEncryptCTWithSwk(B *testing.B) {
 	var (
 		ctIn, ctOut *rlwe.Ciphertext
 		res         float64
 		err         error
 	)
-	keyGen := ckks.NewKeyGenerator(misc.GetCKKSParams())
-	sk1, pk := keyGen.GenKeyPair()
+	keyGen := rlwe.NewKeyGenerator(misc.GetRLWEParams())
+	sk1, pk := testutil.NewCKKSKeyPair()
 	sk2 := keyGen.GenSecretKey()
 	swk := keyGen.GenSwitchingKey(sk1, sk2)
 	for i := 0; i < B.N; i++ {
 		B.StopTimer()
 		randAmount := misc.GenRandFloat()
-		ctIn = clientlib.CKKSEncryptAmount(randAmount, pk)
+		ctIn = testutil.MustEncryptAmount(randAmount, pk)
 		B.StartTimer()
 		ctOut, err = serverlib.ReEncryptCTWithSwk(ctIn, swk)
 		B.StopTimer()
@@ -34,7 +50,7 @@ func BenchmarkReEncryptCTWithSwk(B *testing.B) {
 			B.Fail()
 			continue
 		}
-		res = clientlib.CKKSDecryptAmountFromCT(ctOut, sk2)
+		res = clientlib.DecryptAmount(ctOut, sk2)
 		if math.Abs(res-randAmount) > 0.01 {
 			B.Errorf("decrypted amount is not equal to the original amount, got %f, expected %f", res, randAmount)
 			continue
@@ -57,7 +73,7 @@ func testGetUpdatedSenderBalance(
 	}
 
 	if isTest {
-		updatedPT := clientlib.CKKSDecryptAmountFromCT(updated, sk)
+		updatedPT := clientlib.DecryptAmount(updated, sk)
 		if math.Abs((balancePT-amount)-updatedPT) < 0.01 {
 			return nil
 		} else {
@@ -69,38 +85,38 @@ func testGetUpdatedSenderBalance(
 }
 
 func TestGetUpdatedSenderBalance(t *testing.T) {
-	var err error
-	tx := new(transaction.Transaction)
-	keyGen := ckks.NewKeyGenerator(misc.GetCKKSParams())
-	sk, pk := keyGen.GenKeyPair()
-	randBalance := misc.GenRandFloat()
-	randAmount := misc.GenRandFloat()
-	BalanceCT := clientlib.CKKSEncryptAmount(randBalance, pk)
-	AmountCT := clientlib.CKKSEncryptAmount(randAmount, pk)
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		var err error
+		tx := new(transaction.Transaction)
+		sk, pk := testutil.NewCKKSKeyPair()
+		randBalance := misc.GenRandFloat()
+		randAmount := misc.GenRandFloat()
+		BalanceCT := testutil.MustEncryptAmount(randBalance, pk)
+		AmountCT := testutil.MustEncryptAmount(randAmount, pk)
 
-	tx.CTSender, err = AmountCT.MarshalBinary()
-	if err != nil {
-		t.Error(err)
-	}
+		tx.CTSender, err = AmountCT.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
 
-	//tx.CTReceipt = tx.CTSender
+		//tx.CTReceipt = tx.CTSender
 
-	if err = testGetUpdatedSenderBalance(
-		tx, BalanceCT, randBalance, randAmount, sk,
-		true); err != nil {
-		t.Error(err)
-	}
+		if err = testGetUpdatedSenderBalance(
+			tx, BalanceCT, randBalance, randAmount, sk,
+			true); err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 func BenchmarkGetUpdatedSenderBalance(b *testing.B) {
 	var err error
 	tx := new(transaction.Transaction)
-	keyGen := ckks.NewKeyGenerator(misc.GetCKKSParams())
-	sk, pk := keyGen.GenKeyPair()
+	sk, pk := testutil.NewCKKSKeyPair()
 	randBalance := misc.GenRandFloat()
 	randAmount := misc.GenRandFloat()
-	BalanceCT := clientlib.CKKSEncryptAmount(randBalance, pk)
-	AmountCT := clientlib.CKKSEncryptAmount(randAmount, pk)
+	BalanceCT := testutil.MustEncryptAmount(randBalance, pk)
+	AmountCT := testutil.MustEncryptAmount(randAmount, pk)
 
 	tx.CTSender, err = AmountCT.MarshalBinary()
 	if err != nil {
@@ -130,7 +146,7 @@ func testGetUpdatedReceiptBalance(
 	}
 
 	if isTest {
-		updatedPT := clientlib.CKKSDecryptAmountFromCT(updated, sk)
+		updatedPT := clientlib.DecryptAmount(updated, sk)
 		if math.Abs((balancePT+amount)-updatedPT) < 0.01 {
 			return nil
 		} else {
@@ -142,36 +158,36 @@ func testGetUpdatedReceiptBalance(
 }
 
 func TestGetUpdatedReceiptBalance(t *testing.T) {
-	var err error
-	tx := new(transaction.Transaction)
-	keyGen := ckks.NewKeyGenerator(misc.GetCKKSParams())
-	sk, pk := keyGen.GenKeyPair()
-	randBalance := misc.GenRandFloat()
-	randAmount := misc.GenRandFloat()
-	BalanceCT := clientlib.CKKSEncryptAmount(randBalance, pk)
-	AmountCT := clientlib.CKKSEncryptAmount(randAmount, pk)
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		var err error
+		tx := new(transaction.Transaction)
+		sk, pk := testutil.NewCKKSKeyPair()
+		randBalance := misc.GenRandFloat()
+		randAmount := misc.GenRandFloat()
+		BalanceCT := testutil.MustEncryptAmount(randBalance, pk)
+		AmountCT := testutil.MustEncryptAmount(randAmount, pk)
 
-	tx.CTReceipt, err = AmountCT.MarshalBinary()
-	if err != nil {
-		t.Error(err)
-	}
+		tx.CTReceipt, err = AmountCT.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
 
-	if err = testGetUpdatedReceiptBalance(
-		tx, BalanceCT, randBalance, randAmount, sk,
-		true); err != nil {
-		t.Error(err)
-	}
+		if err = testGetUpdatedReceiptBalance(
+			tx, BalanceCT, randBalance, randAmount, sk,
+			true); err != nil {
+			t.Error(err)
+		}
+	})
 }
 
 func BenchmarkGetUpdatedReceiptBalance(b *testing.B) {
 	var err error
 	tx := new(transaction.Transaction)
-	keyGen := ckks.NewKeyGenerator(misc.GetCKKSParams())
-	sk, pk := keyGen.GenKeyPair()
+	sk, pk := testutil.NewCKKSKeyPair()
 	randBalance := misc.GenRandFloat()
 	randAmount := misc.GenRandFloat()
-	BalanceCT := clientlib.CKKSEncryptAmount(randBalance, pk)
-	AmountCT := clientlib.CKKSEncryptAmount(randAmount, pk)
+	BalanceCT := testutil.MustEncryptAmount(randBalance, pk)
+	AmountCT := testutil.MustEncryptAmount(randAmount, pk)
 
 	tx.CTReceipt, err = AmountCT.MarshalBinary()
 	if err != nil {
@@ -191,16 +207,15 @@ func BenchmarkGetUpdatedReceiptBalance(b *testing.B) {
 func BenchmarkGetUpdatedBalance(b *testing.B) {
 	var err error
 	tx := new(transaction.Transaction)
-	keyGen := ckks.NewKeyGenerator(misc.GetCKKSParams())
-	_, pk_S := keyGen.GenKeyPair()
-	_, pk_R := keyGen.GenKeyPair()
+	_, pk_S := testutil.NewCKKSKeyPair()
+	_, pk_R := testutil.NewCKKSKeyPair()
 	randBalance_S := misc.GenRandFloat()
 	randBalance_R := misc.GenRandFloat()
 	randAmount := misc.GenRandFloat()
-	BalanceCT_S := clientlib.CKKSEncryptAmount(randBalance_S, pk_S)
-	BalanceCT_R := clientlib.CKKSEncryptAmount(randBalance_R, pk_R)
-	AmountCT_S := clientlib.CKKSEncryptAmount(randAmount, pk_S)
-	AmountCT_R := clientlib.CKKSEncryptAmount(randAmount, pk_R)
+	BalanceCT_S := testutil.MustEncryptAmount(randBalance_S, pk_S)
+	BalanceCT_R := testutil.MustEncryptAmount(randBalance_R, pk_R)
+	AmountCT_S := testutil.MustEncryptAmount(randAmount, pk_S)
+	AmountCT_R := testutil.MustEncryptAmount(randAmount, pk_R)
 
 	if tx.CTReceipt, err = AmountCT_R.MarshalBinary(); err != nil {
 		b.Error(err)
@@ -218,3 +233,45 @@ func BenchmarkGetUpdatedBalance(b *testing.B) {
 		}
 	}
 }
+
+func TestValidateSignatureBase(t *testing.T) {
+	msg := []byte("Chimata")
+	for _, alg := range key.SupportedSigAlgorithms {
+		sk, err := key.GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := key.Sign(sk, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !serverlib.ValidateSignatureBase(msg, sig, sk.Public()) {
+			t.Errorf("%s: valid signature rejected", alg)
+		}
+		if serverlib.ValidateSignatureBase([]byte("Chimata+"), sig, sk.Public()) {
+			t.Errorf("%s: signature of another message accepted", alg)
+		}
+
+		// 公钥经 PKIX 编码后算法不变
+		pk, got, err := key.UnmarshalSigningPublicKey(key.MarshalSigningPublicKey(sk.Public()))
+		if err != nil || got != alg || !serverlib.ValidateSignatureBase(msg, sig, pk) {
+			t.Errorf("%s: public key round trip failed, got %s, %v", alg, got, err)
+		}
+		der, err := key.MarshalSigningPrivateKey(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = key.UnmarshalSigningPrivateKey(der); err != nil {
+			t.Errorf("%s: private key round trip failed: %v", alg, err)
+		}
+	}
+
+	// 不支持的曲线
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if _, err := key.Sign(p521, msg); err == nil {
+		t.Error("P-521 key should be rejected")
+	}
+	if _, _, err := key.UnmarshalSigningPublicKey(key.MarshalSigningPublicKey(&p521.PublicKey)); err == nil {
+		t.Error("P-521 public key should be rejected")
+	}
+}
@@ -0,0 +1,136 @@
+package serverlib
+
+// evaluator.go 使用用户注册的计算密钥，对该用户的密文做密文乘法和槽位旋转
+// 计算密钥的注册见 misc.MarshalEvaluationKey；没有计算密钥时服务端只能做加减和重加密
+//
+// BGV 以分为单位的整数表示金额，两个金额的乘积单位为分的平方，即解密得到 a*b*100，
+// 因此 BGV 下的乘法适用于与 0/1 掩码等整数相乘；明文模数较大，BGV-PN12QP109 的模数不足以容纳一次乘法的噪声
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/tuneinsight/lattigo/v4/bgv"
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+var (
+	ErrNoRelinearizationKey = errors.New("evaluation key has no relinearization key")
+	ErrNoRotationKey        = errors.New("evaluation key has no key for this rotation")
+)
+
+// mulNoiseMarginBits 是 BGV 乘法在 2*log(T) + log(N) 之外为噪声保留的位数
+const mulNoiseMarginBits = 20
+
+// CheckMulParams 检查当前参数集是否支持密文乘法
+func CheckMulParams() error {
+	ctx := misc.GetCryptoContext()
+	if s := ctx.CKKS(); s != nil {
+		if s.Params.MaxLevel() < 1 {
+			return fmt.Errorf("multiplication requires at least 1 level, parameter set %s has none", misc.ParamSetID())
+		}
+		return nil
+	}
+	params := ctx.BGV().Params
+	if need := 2*params.LogT() + params.LogN() + mulNoiseMarginBits; params.LogQ() < need {
+		return fmt.Errorf("multiplication requires a modulus of at least %d bits, parameter set %s has %d",
+			need, misc.ParamSetID(), params.LogQ())
+	}
+	return nil
+}
+
+// UserEvaluator 带有某一用户的计算密钥，只能用于以该用户对应公钥加密的密文，可以并发使用
+type UserEvaluator struct {
+	evk  rlwe.EvaluationKey
+	ckks *misc.Pool[ckks.Evaluator]
+	bgv  *misc.Pool[bgv.Evaluator]
+}
+
+// NewUserEvaluator 以计算密钥 evk 构造求值器，evk 应已由 misc.CheckEvaluationKey 检查
+func NewUserEvaluator(evk rlwe.EvaluationKey) *UserEvaluator {
+	e := &UserEvaluator{evk: evk}
+	ctx := misc.GetCryptoContext()
+	if s := ctx.CKKS(); s != nil {
+		e.ckks = misc.NewPool(func() ckks.Evaluator { return s.NewEvaluator(evk) })
+	} else {
+		s := ctx.BGV()
+		e.bgv = misc.NewPool(func() bgv.Evaluator { return s.NewEvaluator(evk) })
+	}
+	return e
+}
+
+// EvaluationKey 返回求值器使用的计算密钥
+func (e *UserEvaluator) EvaluationKey() rlwe.EvaluationKey { return e.evk }
+
+// CanMul 判断是否可以做密文乘法
+func (e *UserEvaluator) CanMul() bool { return e.evk.Rlk != nil }
+
+// CanRotate 判断是否可以将槽位左移 k 位
+func (e *UserEvaluator) CanRotate(k int) bool {
+	if e.evk.Rtks == nil {
+		return false
+	}
+	_, ok := e.evk.Rtks.Keys[misc.GetRLWEParams().GaloisElementForColumnRotationBy(k)]
+	return ok
+}
+
+// Mul 计算 ct0 与 ct1 按槽位的乘积并重线性化
+// CKKS 下乘积重缩放到默认尺度，结果比两者中较低的层数再低一层，已在第 0 层时返回 transaction.ErrNoLevelLeft
+func (e *UserEvaluator) Mul(ct0, ct1 *rlwe.Ciphertext) (ct *rlwe.Ciphertext, err error) {
+	if !e.CanMul() {
+		return nil, ErrNoRelinearizationKey
+	}
+	if err = CheckMulParams(); err != nil {
+		return nil, err
+	}
+	if e.ckks != nil {
+		if ct0.Level() == 0 || ct1.Level() == 0 {
+			return nil, transaction.ErrNoLevelLeft
+		}
+		params := misc.GetCKKSParams()
+		e.ckks.With(func(eval ckks.Evaluator) {
+			ct, err = evaluate("multiplication", func() (*rlwe.Ciphertext, error) {
+				ct := eval.MulRelinNew(ct0, ct1)
+				return ct, eval.Rescale(ct, params.DefaultScale(), ct)
+			})
+		})
+		return
+	}
+	e.bgv.With(func(eval bgv.Evaluator) {
+		ct, err = evaluate("multiplication", func() (*rlwe.Ciphertext, error) {
+			return eval.MulRelinNew(ct0, ct1), nil
+		})
+	})
+	return
+}
+
+// Rotate 将 ct 的槽位左移 k 位，k 为负时右移
+// BGV 的槽位排列为两行，只在行内旋转
+func (e *UserEvaluator) Rotate(ct *rlwe.Ciphertext, k int) (out *rlwe.Ciphertext, err error) {
+	if !e.CanRotate(k) {
+		return nil, fmt.Errorf("%w: %d", ErrNoRotationKey, k)
+	}
+	if e.ckks != nil {
+		e.ckks.With(func(eval ckks.Evaluator) {
+			out, err = evaluate("rotation", func() (*rlwe.Ciphertext, error) { return eval.RotateNew(ct, k), nil })
+		})
+		return
+	}
+	e.bgv.With(func(eval bgv.Evaluator) {
+		out, err = evaluate("rotation", func() (*rlwe.Ciphertext, error) { return eval.RotateColumnsNew(ct, k), nil })
+	})
+	return
+}
+
+// evaluate 将 lattigo 运算中的 panic（如密文与密钥不匹配）转换为错误
+func evaluate(op string, f func() (*rlwe.Ciphertext, error)) (ct *rlwe.Ciphertext, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			ct, err = nil, fmt.Errorf("%s failed, got panic: %v", op, p)
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,64 @@
+package serverlib_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func TestUserEvaluator(t *testing.T) {
+	testutil.ForEachScheme(t, func(t *testing.T) {
+		sk, pk := testutil.NewCKKSKeyPair()
+		scheme := misc.GetAmountScheme()
+		eval := serverlib.NewUserEvaluator(clientlib.GenEvaluationKey(sk, true, []int{1}))
+
+		ct0 := testutil.MustEncryptAmount(12, pk)
+		ct1 := testutil.MustEncryptAmount(-3.5, pk)
+		// BGV 的乘积以分的平方为单位
+		want := 12 * -3.5
+		if scheme.Name() == misc.SchemeBGV {
+			want *= misc.AmountMinorUnits
+		}
+		prod, err := eval.Mul(ct0, ct1)
+		switch {
+		case serverlib.CheckMulParams() != nil:
+			if err == nil {
+				t.Errorf("%s should not support multiplication", misc.ParamSetID())
+			}
+		case err != nil:
+			t.Fatal(err)
+		default:
+			if got := clientlib.DecryptAmount(prod, sk); math.Abs(got-want) > 0.01 {
+				t.Errorf("product: got %v, expected %v", got, want)
+			}
+		}
+
+		vec, err := scheme.EncryptVector([]float64{1, 2, 3}, pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated, err := eval.Rotate(vec, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := scheme.DecryptVector(rotated, sk, 2); math.Abs(got[0]-2) > 0.01 || math.Abs(got[1]-3) > 0.01 {
+			t.Errorf("rotated by 1: got %v, expected [2 3]", got)
+		}
+
+		if eval.CanRotate(2) {
+			t.Error("rotation by 2 has no key")
+		}
+		if _, err = eval.Rotate(vec, 2); !errors.Is(err, serverlib.ErrNoRotationKey) {
+			t.Errorf("expected ErrNoRotationKey, got %v", err)
+		}
+		if _, err = serverlib.NewUserEvaluator(rlwe.EvaluationKey{}).Mul(ct0, ct1); !errors.Is(err, serverlib.ErrNoRelinearizationKey) {
+			t.Errorf("expected ErrNoRelinearizationKey, got %v", err)
+		}
+	})
+}
@@ -1,21 +1,19 @@
 package serverlib
 
 import (
+	"bytes"
 	"fmt"
 
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/CamberLoid/Chimata/internal/transaction"
 	"github.com/google/uuid"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 // --- 高层次进行重加密的函数 ---
 
 func KeySwitchSenderToReceipt(t *transaction.Transaction, swk *rlwe.SwitchingKey) (err error) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	ctIn := ckks.NewCiphertext(params, 1, params.MaxLevel())
-
-	err = ctIn.UnmarshalBinary(t.CTSender)
+	ctIn, err := misc.UnmarshalCiphertext(t.CTSender)
 	if err != nil {
 		return fmt.Errorf("unmarshal ct failed: " + err.Error())
 	}
@@ -25,16 +23,14 @@ func KeySwitchSenderToReceipt(t *transaction.Transaction, swk *rlwe.SwitchingKey
 		return err
 	}
 
-	ctOutByte, _ := ctOut.MarshalBinary()
-	t.CTReceipt = ctOutByte
+	if t.CTReceipt, err = misc.MarshalCompactCiphertext(ctOut); err != nil {
+		return err
+	}
 	return
 }
 
 func KeySwitchReceiptToSender(t *transaction.Transaction, swk *rlwe.SwitchingKey) (err error) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	ctIn := ckks.NewCiphertext(params, 1, params.MaxLevel())
-
-	err = ctIn.UnmarshalBinary(t.CTReceipt)
+	ctIn, err := misc.UnmarshalCiphertext(t.CTReceipt)
 	if err != nil {
 		return fmt.Errorf("unmarshal ct failed: " + err.Error())
 	}
@@ -44,8 +40,9 @@ func KeySwitchReceiptToSender(t *transaction.Transaction, swk *rlwe.SwitchingKey
 		return err
 	}
 
-	ctOutByte, _ := ctOut.MarshalBinary()
-	t.CTSender = ctOutByte
+	if t.CTSender, err = misc.MarshalCompactCiphertext(ctOut); err != nil {
+		return err
+	}
 	return
 }
 
@@ -55,3 +52,39 @@ func KeySwitchReceiptToSender(t *transaction.Transaction, swk *rlwe.SwitchingKey
 func RequestSwitchingKey(uIn, uOut *uuid.UUID, caUrl string) (swk *rlwe.SwitchingKey, err error) {
 	return nil, fmt.Errorf("todo")
 }
+
+// RotateTransactionCT 用 swk 重加密交易中以 user 的旧公钥 oldKeyID 加密的密文，用于 CKKS 密钥轮换
+// 重加密后的密文的密钥 ID 为 newKeyID
+// 被重加密的若是发送方签名的密文，原始密文保存在 SenderSignedCT 中，以便继续验证签名和范围证明
+func RotateTransactionCT(t *transaction.Transaction, user uuid.UUID, swk *rlwe.SwitchingKey, oldKeyID, newKeyID uuid.UUID) (err error) {
+	signed := t.RangeProofCT()
+	rotate := func(ct []byte) ([]byte, error) {
+		ctIn, err := misc.UnmarshalCiphertext(ct)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal ct failed: " + err.Error())
+		}
+		ctOut, err := ReEncryptCTWithSwk(ctIn, swk)
+		if err != nil {
+			return nil, err
+		}
+		return misc.MarshalCompactCiphertext(ctOut)
+	}
+
+	if t.Sender == user && len(t.CTSender) != 0 {
+		if t.CTSender, err = rotate(t.CTSender); err != nil {
+			return err
+		}
+		t.CTSenderKeyID = newKeyID
+	}
+	if t.Receipt == user && len(t.CTReceipt) != 0 {
+		if t.CTReceipt, err = rotate(t.CTReceipt); err != nil {
+			return err
+		}
+		t.CTReceiptKeyID = newKeyID
+	}
+	if len(t.SenderSignedCT) == 0 && !bytes.Equal(signed, t.RangeProofCT()) {
+		t.SenderSignedCT = signed
+		t.SenderSignedCTKeyID = oldKeyID
+	}
+	return nil
+}
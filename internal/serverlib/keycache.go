@@ -0,0 +1,276 @@
+package serverlib
+
+// keycache.go 在内存中缓存反序列化后的 swk、签名公钥和用户的求值器
+// 每笔转账都要从数据库读取并反序列化数 MB 的 swk，以及验证签名所需的公钥，缓存后可省去这部分开销
+// 缓存按 LRU 淘汰，总大小有上限；密钥在数据库中变化时由调用者使缓存失效：
+//   - 注册 swk：InvalidateSwitchingKey；注册到监管者的 swk 时 pkOut 为零值
+//   - 注册或替换计算密钥：InvalidateEvaluators，到监管者的 swk 随之删除，同样 InvalidateSwitchingKey
+//   - 轮换 CKKS 密钥：InvalidateCKKSKey，引用旧公钥的 swk 已从数据库删除，主公钥的求值器随之变化
+//   - 新增签名公钥或更换主密钥：InvalidateSigningKeys
+//   - 吊销列表更新：InvalidateRevoked
+// swk 在有效期结束后自动失效
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// KeyCache 缓存 swk 和签名公钥，可被并发使用
+type KeyCache struct {
+	swk        *lruCache[swkCacheKey, *rlwe.SwitchingKey]
+	signing    *lruCache[signingCacheKey, *key.ECDSAKeyChain]
+	evaluators *lruCache[evaluatorCacheKey, *UserEvaluator]
+}
+
+// pkOut 为零值时表示监管者的透支密钥，见 AuditorSwk
+type swkCacheKey struct{ pkIn, pkOut uuid.UUID }
+
+// keyID 为零值时表示用户的主签名公钥
+type signingCacheKey struct{ user, keyID uuid.UUID }
+
+// keyID 为零值时表示用户的主 CKKS 公钥
+type evaluatorCacheKey struct{ user, keyID uuid.UUID }
+
+// NewKeyCache 创建缓存，swk 与计算密钥的总大小各不超过 swkBytes 字节，签名公钥不超过 signingKeys 个
+// 上限为 0 时不缓存
+func NewKeyCache(swkBytes int64, signingKeys int) *KeyCache {
+	return &KeyCache{
+		swk:        newLRUCache[swkCacheKey, *rlwe.SwitchingKey](swkBytes),
+		signing:    newLRUCache[signingCacheKey, *key.ECDSAKeyChain](int64(signingKeys)),
+		evaluators: newLRUCache[evaluatorCacheKey, *UserEvaluator](swkBytes),
+	}
+}
+
+// SwitchingKey 返回从公钥 pkIn 到 pkOut 的 swk，未命中时由 load 读取，缓存至有效期结束
+func (c *KeyCache) SwitchingKey(pkIn, pkOut uuid.UUID, load func() (*rlwe.SwitchingKey, *misc.SwkValidity, error)) (*rlwe.SwitchingKey, error) {
+	k := swkCacheKey{pkIn, pkOut}
+	swk, gen, ok := c.swk.get(k)
+	if ok {
+		return swk, nil
+	}
+	swk, v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.swk.put(gen, k, swk, int64(swk.MarshalBinarySize()), time.Unix(v.NotAfter, 0))
+	return swk, nil
+}
+
+// AuditorSwk 返回从公钥 pkIn 到监管者透支密钥的 swk，未命中时由 load 读取
+func (c *KeyCache) AuditorSwk(pkIn uuid.UUID, load func() (*rlwe.SwitchingKey, error)) (*rlwe.SwitchingKey, error) {
+	k := swkCacheKey{pkIn, uuid.Nil}
+	swk, gen, ok := c.swk.get(k)
+	if ok {
+		return swk, nil
+	}
+	swk, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.swk.put(gen, k, swk, int64(swk.MarshalBinarySize()), time.Time{})
+	return swk, nil
+}
+
+// SigningKey 返回用户 user 标识符为 keyID 的签名公钥，keyID 为零值时为主公钥，未命中时由 load 读取
+func (c *KeyCache) SigningKey(user, keyID uuid.UUID, load func() (*key.ECDSAKeyChain, error)) (*key.ECDSAKeyChain, error) {
+	k := signingCacheKey{user, keyID}
+	kc, gen, ok := c.signing.get(k)
+	if ok {
+		return kc, nil
+	}
+	kc, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.signing.put(gen, k, kc, 1, time.Time{})
+	return kc, nil
+}
+
+// UserEvaluator 返回用户以标识符为 keyID 的 CKKS 公钥（零值时为主公钥）的计算密钥构造的求值器
+// 未命中时由 load 读取计算密钥
+func (c *KeyCache) UserEvaluator(user, keyID uuid.UUID, load func() (rlwe.EvaluationKey, error)) (*UserEvaluator, error) {
+	k := evaluatorCacheKey{user, keyID}
+	e, gen, ok := c.evaluators.get(k)
+	if ok {
+		return e, nil
+	}
+	evk, err := load()
+	if err != nil {
+		return nil, err
+	}
+	e = NewUserEvaluator(evk)
+	c.evaluators.put(gen, k, e, int64(evaluationKeySize(evk)), time.Time{})
+	return e, nil
+}
+
+func evaluationKeySize(evk rlwe.EvaluationKey) (size int) {
+	if evk.Rlk != nil {
+		size += evk.Rlk.MarshalBinarySize()
+	}
+	if evk.Rtks != nil {
+		size += evk.Rtks.MarshalBinarySize()
+	}
+	return
+}
+
+// InvalidateSwitchingKey 使从公钥 pkIn 到 pkOut 的 swk 失效
+func (c *KeyCache) InvalidateSwitchingKey(pkIn, pkOut uuid.UUID) {
+	c.swk.remove(swkCacheKey{pkIn, pkOut})
+}
+
+// InvalidateCKKSKey 使用户 user 的 CKKS 公钥 keyID 轮换后失效的 swk 和求值器失效
+func (c *KeyCache) InvalidateCKKSKey(user, keyID uuid.UUID) {
+	c.swk.removeIf(func(k swkCacheKey, _ *rlwe.SwitchingKey) bool {
+		return k.pkIn == keyID || k.pkOut == keyID
+	})
+	c.InvalidateEvaluators(user)
+}
+
+// InvalidateEvaluators 使用户的全部求值器失效
+func (c *KeyCache) InvalidateEvaluators(user uuid.UUID) {
+	c.evaluators.removeIf(func(k evaluatorCacheKey, _ *UserEvaluator) bool {
+		return k.user == user
+	})
+}
+
+// InvalidateSigningKeys 使用户的全部签名公钥失效
+func (c *KeyCache) InvalidateSigningKeys(user uuid.UUID) {
+	c.signing.removeIf(func(k signingCacheKey, _ *key.ECDSAKeyChain) bool {
+		return k.user == user
+	})
+}
+
+// InvalidateRevoked 使已吊销的签名公钥失效
+// 吊销列表以公钥指纹标识 CKKS 公钥，缓存中的 swk 和求值器不记录公钥，因此全部清除
+func (c *KeyCache) InvalidateRevoked(isRevoked func(fingerprint string) bool) {
+	c.signing.removeIf(func(_ signingCacheKey, kc *key.ECDSAKeyChain) bool {
+		return isRevoked(key.ECDSAKeyFingerprint(kc.PublicKey))
+	})
+	c.swk.removeIf(func(swkCacheKey, *rlwe.SwitchingKey) bool { return true })
+	c.evaluators.removeIf(func(evaluatorCacheKey, *UserEvaluator) bool { return true })
+}
+
+// KeyCacheStats 为缓存的命中统计，Size 对 swk 和求值器为字节数，对签名公钥为个数
+type KeyCacheStats struct {
+	SwitchingKeys CacheStats `json:"switchingKeys"`
+	SigningKeys   CacheStats `json:"signingKeys"`
+	Evaluators    CacheStats `json:"evaluators"`
+}
+
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Size      int64 `json:"size"`
+	Capacity  int64 `json:"capacity"`
+}
+
+func (c *KeyCache) Stats() KeyCacheStats {
+	return KeyCacheStats{SwitchingKeys: c.swk.stats(), SigningKeys: c.signing.stats(), Evaluators: c.evaluators.stats()}
+}
+
+// lruCache 是按代价计算容量的 LRU 缓存，过期的项在读取时移除
+type lruCache[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List // 最近使用的在前
+	items    map[K]*list.Element
+	// gen 在每次失效时递增，未命中后读取期间发生失效的，读到的值可能已过时，不再缓存
+	gen uint64
+
+	hits, misses, evictions int64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int64
+	expires time.Time // 零值表示不过期
+}
+
+func newLRUCache[K comparable, V any](capacity int64) *lruCache[K, V] {
+	return &lruCache[K, V]{capacity: capacity, order: list.New(), items: make(map[K]*list.Element)}
+}
+
+// get 查找一项，同时返回当前的 gen，供未命中时调用 put
+func (c *lruCache[K, V]) get(k K) (v V, gen uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[k]
+	if ok {
+		if ent := e.Value.(*lruEntry[K, V]); ent.expires.IsZero() || time.Now().Before(ent.expires) {
+			c.hits++
+			c.order.MoveToFront(e)
+			return ent.value, c.gen, true
+		}
+		c.removeElement(e)
+	}
+	c.misses++
+	return v, c.gen, false
+}
+
+// put 加入或替换一项，代价超过容量的项不缓存，gen 已变化时不缓存
+func (c *lruCache[K, V]) put(gen uint64, k K, v V, cost int64, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.items[k]; ok {
+		c.removeElement(e)
+	}
+	if cost > c.capacity {
+		return
+	}
+	for c.size+cost > c.capacity {
+		c.removeElement(c.order.Back())
+		c.evictions++
+	}
+	c.items[k] = c.order.PushFront(&lruEntry[K, V]{key: k, value: v, cost: cost, expires: expires})
+	c.size += cost
+}
+
+func (c *lruCache[K, V]) remove(k K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.items[k]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *lruCache[K, V]) removeIf(pred func(K, V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if ent := e.Value.(*lruEntry[K, V]); pred(ent.key, ent.value) {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+func (c *lruCache[K, V]) removeElement(e *list.Element) {
+	ent := c.order.Remove(e).(*lruEntry[K, V])
+	delete(c.items, ent.key)
+	c.size -= ent.cost
+}
+
+func (c *lruCache[K, V]) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits: c.hits, Misses: c.misses, Evictions: c.evictions,
+		Entries: len(c.items), Size: c.size, Capacity: c.capacity,
+	}
+}
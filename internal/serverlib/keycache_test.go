@@ -0,0 +1,224 @@
+package serverlib_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/db"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+func newTestSwk() *rlwe.SwitchingKey {
+	kgen := rlwe.NewKeyGenerator(misc.GetRLWEParams())
+	return kgen.GenSwitchingKey(kgen.GenSecretKey(), kgen.GenSecretKey())
+}
+
+func TestKeyCache(t *testing.T) {
+	swk := newTestSwk()
+	size := int64(swk.MarshalBinarySize())
+	validity := &misc.SwkValidity{NotAfter: time.Now().Add(time.Hour).Unix()}
+	loads := 0
+	load := func() (*rlwe.SwitchingKey, *misc.SwkValidity, error) {
+		loads++
+		return swk, validity, nil
+	}
+
+	t.Run("SwitchingKey", func(t *testing.T) {
+		// 只能容纳两个 swk
+		cache := serverlib.NewKeyCache(2*size, 0)
+		a, b, c := uuid.New(), uuid.New(), uuid.New()
+		loads = 0
+		for _, pair := range [][2]uuid.UUID{{a, b}, {b, c}, {a, b}, {c, a}, {b, c}} {
+			if _, err := cache.SwitchingKey(pair[0], pair[1], load); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// (c, a) 淘汰了最久未使用的 (b, c)
+		stats := cache.Stats().SwitchingKeys
+		if loads != 4 || stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 2 || stats.Entries != 2 || stats.Size != 2*size {
+			t.Errorf("unexpected stats after %d loads: %+v", loads, stats)
+		}
+
+		cache.InvalidateCKKSKey(uuid.Nil, a)
+		if stats = cache.Stats().SwitchingKeys; stats.Entries != 1 {
+			t.Errorf("expected 1 entry after invalidating key a, got %+v", stats)
+		}
+		cache.InvalidateSwitchingKey(b, c)
+		if stats = cache.Stats().SwitchingKeys; stats.Entries != 0 || stats.Size != 0 {
+			t.Errorf("expected empty cache, got %+v", stats)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		cache := serverlib.NewKeyCache(size, 0)
+		expired := &misc.SwkValidity{NotAfter: time.Now().Add(-time.Second).Unix()}
+		loads = 0
+		for i := 0; i < 2; i++ {
+			cache.SwitchingKey(uuid.Nil, uuid.Nil, func() (*rlwe.SwitchingKey, *misc.SwkValidity, error) {
+				loads++
+				return swk, expired, nil
+			})
+		}
+		if loads != 2 {
+			t.Errorf("expired swk was served from cache")
+		}
+	})
+
+	t.Run("InvalidateDuringLoad", func(t *testing.T) {
+		cache := serverlib.NewKeyCache(size, 0)
+		a, b := uuid.New(), uuid.New()
+		// 读取期间 swk 被重新注册，读到的旧 swk 不应被缓存
+		cache.SwitchingKey(a, b, func() (*rlwe.SwitchingKey, *misc.SwkValidity, error) {
+			cache.InvalidateSwitchingKey(a, b)
+			return swk, validity, nil
+		})
+		if stats := cache.Stats().SwitchingKeys; stats.Entries != 0 {
+			t.Errorf("stale swk was cached: %+v", stats)
+		}
+	})
+
+	t.Run("Evaluator", func(t *testing.T) {
+		sk, _ := testutil.NewCKKSKeyPair()
+		evk := clientlib.GenEvaluationKey(sk, true, nil)
+		cache := serverlib.NewKeyCache(1<<30, 0)
+		user := uuid.New()
+		loadEvk := func() (rlwe.EvaluationKey, error) { loads++; return evk, nil }
+
+		loads = 0
+		e1, _ := cache.UserEvaluator(user, uuid.Nil, loadEvk)
+		e2, _ := cache.UserEvaluator(user, uuid.Nil, loadEvk)
+		if loads != 1 || e1 != e2 {
+			t.Errorf("evaluator was not cached, %d loads", loads)
+		}
+		if stats := cache.Stats().Evaluators; stats.Size != int64(evk.Rlk.MarshalBinarySize()) {
+			t.Errorf("unexpected evaluator cache size: %+v", stats)
+		}
+
+		// 注册新的计算密钥、轮换 CKKS 密钥后须重新读取
+		cache.InvalidateEvaluators(user)
+		cache.UserEvaluator(user, uuid.Nil, loadEvk)
+		cache.InvalidateCKKSKey(user, uuid.New())
+		cache.UserEvaluator(user, uuid.Nil, loadEvk)
+		if loads != 3 {
+			t.Errorf("expected 3 loads, got %d", loads)
+		}
+	})
+
+	t.Run("SigningKey", func(t *testing.T) {
+		cache := serverlib.NewKeyCache(0, 8)
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kc, err := key.NewSigningKeyChain(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := uuid.New()
+		loadKey := func() (*key.ECDSAKeyChain, error) { loads++; return kc, nil }
+
+		loads = 0
+		cache.SigningKey(user, uuid.Nil, loadKey)
+		cache.SigningKey(user, kc.Identifier, loadKey)
+		cache.SigningKey(user, uuid.Nil, loadKey)
+		if loads != 2 {
+			t.Errorf("expected 2 loads, got %d", loads)
+		}
+
+		cache.InvalidateRevoked(func(string) bool { return false })
+		if stats := cache.Stats().SigningKeys; stats.Entries != 2 {
+			t.Errorf("unrevoked keys were invalidated: %+v", stats)
+		}
+		fingerprint := key.ECDSAKeyFingerprint(kc.PublicKey)
+		cache.InvalidateRevoked(func(id string) bool { return id == fingerprint })
+		if stats := cache.Stats().SigningKeys; stats.Entries != 0 {
+			t.Errorf("revoked keys were not invalidated: %+v", stats)
+		}
+
+		cache.SigningKey(user, uuid.Nil, loadKey)
+		cache.InvalidateSigningKeys(user)
+		if stats := cache.Stats().SigningKeys; stats.Entries != 0 {
+			t.Errorf("keys of user were not invalidated: %+v", stats)
+		}
+	})
+}
+
+// BenchmarkSettlement 测量一笔转账的结算：读取 swk、重加密、更新双方余额
+// Cold 每次都从数据库读取并反序列化 swk，Warm 命中缓存
+func BenchmarkSettlement(b *testing.B) {
+	database, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer database.Close()
+	// 内存数据库只在同一连接内可见
+	database.SetMaxOpenConns(1)
+	if _, err = database.Exec(db.CreateSwitchingKeyTable()); err != nil {
+		b.Fatal(err)
+	}
+
+	kgen := rlwe.NewKeyGenerator(misc.GetRLWEParams())
+	skS, pkS := testutil.NewCKKSKeyPair()
+	skR, pkR := kgen.GenKeyPair()
+	swk := kgen.GenSwitchingKey(skS, skR)
+	pkIn, pkOut := uuid.New(), uuid.New()
+	validity := misc.NewSwkValidity(misc.SwkEpoch(time.Now(), time.Hour), time.Hour, time.Hour)
+	if err = db.PutSwitchingKeyColumnByUserInUserOut(database, uuid.New(), uuid.New(), uuid.New(), pkIn, pkOut, swk, validity); err != nil {
+		b.Fatal(err)
+	}
+
+	amount := testutil.MustEncryptAmount(misc.GenRandFloat(), pkS)
+	balanceS := testutil.MustEncryptAmount(misc.GenRandFloat(), pkS)
+	balanceR := testutil.MustEncryptAmount(misc.GenRandFloat(), pkR)
+	ctSender, err := misc.MarshalCompactCiphertext(amount)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	load := func() (*rlwe.SwitchingKey, *misc.SwkValidity, error) {
+		return db.GetValidSwitchingKeyPKInPKOut(database, pkIn, pkOut)
+	}
+	settle := func(b *testing.B, cache *serverlib.KeyCache) {
+		swk, err := cache.SwitchingKey(pkIn, pkOut, load)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tx := &transaction.Transaction{CTSender: ctSender}
+		if err = serverlib.KeySwitchSenderToReceipt(tx, swk); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err = serverlib.GetUpdatedBalance(tx, balanceS, balanceR); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("Cold", func(b *testing.B) {
+		cache := serverlib.NewKeyCache(0, 0)
+		for i := 0; i < b.N; i++ {
+			settle(b, cache)
+		}
+	})
+	b.Run("Warm", func(b *testing.B) {
+		cache := serverlib.NewKeyCache(1<<30, 0)
+		settle(b, cache)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			settle(b, cache)
+		}
+		if stats := cache.Stats().SwitchingKeys; stats.Misses != 1 {
+			b.Errorf("expected a single miss, got %+v", stats)
+		}
+	})
+}
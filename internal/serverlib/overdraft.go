@@ -0,0 +1,150 @@
+package serverlib
+
+// overdraft.go 在密文上计算透支指示值：对 (余额 - 金额) 做符号函数的多项式近似，
+// 再重加密到监管者的 CKKS 公钥下，监管者只解密指示值即可判断是否透支，看不到余额本身
+//
+// 差值先加上半个最小单位（使恰好用尽余额时不为 0），除以 bound 归一化到 [-1, 1]，
+// 之后迭代 f(x) = (3x - x^3) / 2，最后一轮只保留资产所在槽位。f 在 [-1, 1] 上为奇函数且单调，迭代不改变符号，
+// 只将 |x| 推向 1，因此解密结果的符号即为是否透支，绝对值只泄露差值的大致量级；|差值| 超过 bound 时结果没有意义
+// 归一化消耗 1 层，每轮迭代消耗 2 层，重加密前保留 1 层（见 SwitchToAuditor），其余的层都用于迭代
+//
+// 在余额为新鲜密文时测得（1 CPU，含重加密）：
+//   - PN13QP218：1 轮，指示值的噪声不超过 2e-5，约 10ms；差值小于约 1.5e-5 * bound 时无法判断符号，
+//     bound = 1e4 时约为 0.15，bound = 1e6 时约为 15
+//   - PN14QP438：3 轮，噪声不超过 4e-7，约 70ms；bound = 1e6 时约为 0.1
+// 默认参数集 PN12QP109 只有 1 层，无法计算
+
+import (
+	"fmt"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+const (
+	// OverdraftMinLevel 是计算透支指示值所需的最少层数：归一化 1 层，1 轮迭代 2 层，重加密前保留 1 层
+	OverdraftMinLevel = 4
+	// 重加密前放大指示值时为指示值和噪声保留的位数
+	overdraftHeadroomBits = 10
+)
+
+// CheckOverdraftParams 检查当前参数集是否支持计算透支指示值
+func CheckOverdraftParams() error {
+	s := misc.GetCryptoContext().CKKS()
+	if s == nil {
+		return fmt.Errorf("overdraft indicators require a CKKS parameter set, got %s", misc.ParamSetID())
+	}
+	if s.Params.MaxLevel() < OverdraftMinLevel {
+		return fmt.Errorf("overdraft indicators require at least %d levels, parameter set %s has %d",
+			OverdraftMinLevel, misc.ParamSetID(), s.Params.MaxLevel())
+	}
+	return nil
+}
+
+// SignApproximation 是 OverdraftIndicator 在明文上的对应，对 x 迭代 rounds 轮 f(x) = (3x - x^3) / 2
+func SignApproximation(x float64, rounds int) float64 {
+	for i := 0; i < rounds; i++ {
+		x = (3*x - x*x*x) / 2
+	}
+	return x
+}
+
+// OverdraftIndicator 计算 balance - amount 在 slots 各槽位上的透支指示值，其余槽位为 0
+// 某一槽位的值为负表示该资产透支；rounds 为迭代轮数，由 balance 与 amount 中较低的层数决定
+// 层数不足 OverdraftMinLevel 时返回 transaction.ErrNoLevelLeft，余额需要先由用户刷新
+func (e *UserEvaluator) OverdraftIndicator(balance, amount *rlwe.Ciphertext, slots []int, bound float64) (ind *rlwe.Ciphertext, rounds int, err error) {
+	if err = CheckOverdraftParams(); err != nil {
+		return nil, 0, err
+	}
+	if !e.CanMul() {
+		return nil, 0, ErrNoRelinearizationKey
+	}
+	if bound <= 0 {
+		return nil, 0, fmt.Errorf("overdraft bound must be positive, got %v", bound)
+	}
+	scheme := misc.GetCryptoContext().CKKS()
+	mask := make([]float64, scheme.Slots())
+	for _, slot := range slots {
+		if slot < 0 || slot >= len(mask) {
+			return nil, 0, fmt.Errorf("slot %d out of range", slot)
+		}
+		mask[slot] = 0.5
+	}
+	level := balance.Level()
+	if amount.Level() < level {
+		level = amount.Level()
+	}
+	if level < OverdraftMinLevel {
+		return nil, 0, transaction.ErrNoLevelLeft
+	}
+
+	diff, err := scheme.Sub(balance, amount)
+	if err != nil {
+		return nil, 0, err
+	}
+	scheme.WithEvaluator(func(eval ckks.Evaluator) {
+		eval.AddConst(diff, 0.5/misc.AmountMinorUnits, diff)
+	})
+	// 1/bound 很小，按向量编码时会被取整为 0，因此先按常数归一化，在最后一轮迭代中再只保留 slots
+	if ind, err = transaction.CalcRatedFee(diff, 1/bound); err != nil {
+		return nil, 0, err
+	}
+
+	for ind.Level() >= 3 {
+		last := ind.Level() < 5
+		if ind, err = e.signRound(ind, mask, last); err != nil {
+			return nil, rounds, err
+		}
+		rounds++
+		if last {
+			break
+		}
+	}
+	return ind, rounds, nil
+}
+
+// signRound 计算 (3x - x^3) / 2 = (x / 2) * (3 - x^2)，x / 2 与 x^2 各消耗一层，之后的乘法再消耗一层
+// masked 为 true 时 x / 2 改为与 mask 按槽位相乘，mask 在需要保留的槽位上为 1/2，其余为 0
+func (e *UserEvaluator) signRound(x *rlwe.Ciphertext, mask []float64, masked bool) (y *rlwe.Ciphertext, err error) {
+	x2, err := e.Mul(x, x)
+	if err != nil {
+		return nil, err
+	}
+	s := misc.GetCryptoContext().CKKS()
+	scale := s.Params.DefaultScale()
+	e.ckks.With(func(eval ckks.Evaluator) {
+		y, err = evaluate("sign approximation", func() (*rlwe.Ciphertext, error) {
+			var half *rlwe.Ciphertext
+			if masked {
+				level := x.Level()
+				var pt *rlwe.Plaintext
+				s.WithEncoder(func(enc ckks.Encoder) {
+					pt = enc.EncodeNew(mask, level, rlwe.NewScale(s.Params.QiFloat64(level)), s.Params.LogSlots())
+				})
+				half = eval.MulNew(x, pt)
+			} else {
+				half = eval.MultByConstNew(x, 0.5)
+			}
+			if err := eval.Rescale(half, scale, half); err != nil {
+				return nil, err
+			}
+			t := eval.NegNew(x2)
+			eval.AddConst(t, 3, t)
+			y := eval.MulRelinNew(half, t)
+			return y, eval.Rescale(y, scale, y)
+		})
+	})
+	return
+}
+
+// SwitchToAuditor 将指示值重加密到监管者的公钥下，swk 由用户以 misc.GenPublicSwitchingKey 生成
+// 这种 swk 的噪声较大，因此以 misc.CKKSScheme.KeySwitchScaled 重加密，解密得到的值不变
+func SwitchToAuditor(ind *rlwe.Ciphertext, swk *rlwe.SwitchingKey) (*rlwe.Ciphertext, error) {
+	s := misc.GetCryptoContext().CKKS()
+	if s == nil {
+		return nil, transaction.ErrRequiresCKKS
+	}
+	return s.KeySwitchScaled(ind, swk, overdraftHeadroomBits)
+}
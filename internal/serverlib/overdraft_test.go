@@ -0,0 +1,139 @@
+package serverlib_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/clientlib"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/testutil"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+type overdraftTestKeys struct {
+	sk, auditorSk *rlwe.SecretKey
+	pk            *rlwe.PublicKey
+	eval          *serverlib.UserEvaluator
+	swk           *rlwe.SwitchingKey
+}
+
+func newOverdraftTestKeys(tb testing.TB) *overdraftTestKeys {
+	k := new(overdraftTestKeys)
+	k.sk, k.pk = testutil.NewCKKSKeyPair()
+	var auditorPk *rlwe.PublicKey
+	k.auditorSk, auditorPk = testutil.NewCKKSKeyPair()
+	k.eval = serverlib.NewUserEvaluator(clientlib.GenEvaluationKey(k.sk, true, nil))
+	var err error
+	if k.swk, err = misc.GenPublicSwitchingKey(k.sk, auditorPk); err != nil {
+		tb.Fatal(err)
+	}
+	return k
+}
+
+func TestOverdraftIndicator(t *testing.T) {
+	t.Run("Unsupported", func(t *testing.T) {
+		testutil.UseParamSet(t, "PN12QP109")
+		if serverlib.CheckOverdraftParams() == nil {
+			t.Fatal("PN12QP109 should not support overdraft indicators")
+		}
+	})
+
+	testutil.UseParamSet(t, "PN13QP218")
+	k := newOverdraftTestKeys(t)
+	scheme := misc.GetCryptoContext().CKKS()
+	const (
+		bound = 1e4
+		// 实测噪声不超过 2e-5
+		noise = 1e-4
+	)
+
+	tests := []struct {
+		balance, amount []float64
+		slots           []int
+	}{
+		{[]float64{100}, []float64{30}, []int{0}},
+		{[]float64{100}, []float64{100}, []int{0}},
+		{[]float64{100}, []float64{101}, []int{0}},
+		{[]float64{0}, []float64{250}, []int{0}},
+		{[]float64{9000}, []float64{1}, []int{0}},
+		{[]float64{5000, 20}, []float64{0, 60}, []int{1}},
+		{[]float64{20, 5000, 7}, []float64{10, 6000}, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		balance, err := scheme.EncryptVector(tt.balance, k.pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount, err := scheme.EncryptVector(tt.amount, k.pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ind, rounds, err := k.eval.OverdraftIndicator(balance, amount, tt.slots, bound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ind, err = serverlib.SwitchToAuditor(ind, k.swk); err != nil {
+			t.Fatal(err)
+		}
+		got := scheme.DecryptValues(ind, k.auditorSk, len(tt.balance))
+
+		masked := make([]bool, len(got))
+		for _, slot := range tt.slots {
+			masked[slot] = true
+			diff := tt.balance[slot]
+			if slot < len(tt.amount) {
+				diff -= tt.amount[slot]
+			}
+			want := serverlib.SignApproximation((diff+0.5/misc.AmountMinorUnits)/bound, rounds)
+			if math.Abs(got[slot]-want) > noise {
+				t.Errorf("balance - amount = %v: indicator %v, expected %v", diff, got[slot], want)
+			}
+			if math.Abs(want) > noise && (got[slot] < 0) != (diff < 0) {
+				t.Errorf("balance - amount = %v: indicator %v has the wrong sign", diff, got[slot])
+			}
+		}
+		for i, v := range got {
+			if !masked[i] && math.Abs(v) > noise {
+				t.Errorf("slot %d should be masked, got %v", i, v)
+			}
+		}
+	}
+
+	// 计息两次后只剩 3 层
+	low := testutil.MustEncryptAmount(100, k.pk)
+	var err error
+	if low, err = transaction.CalcRatedFee(low, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if low, err = transaction.CalcRatedFee(low, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = k.eval.OverdraftIndicator(low, low, []int{0}, bound); !errors.Is(err, transaction.ErrNoLevelLeft) {
+		t.Errorf("expected ErrNoLevelLeft at level %d, got %v", low.Level(), err)
+	}
+	if _, _, err = serverlib.NewUserEvaluator(rlwe.EvaluationKey{}).OverdraftIndicator(low, low, []int{0}, bound); !errors.Is(err, serverlib.ErrNoRelinearizationKey) {
+		t.Errorf("expected ErrNoRelinearizationKey, got %v", err)
+	}
+}
+
+func BenchmarkOverdraftIndicator(b *testing.B) {
+	testutil.UseParamSet(b, "PN13QP218")
+	k := newOverdraftTestKeys(b)
+	balance := testutil.MustEncryptAmount(100, k.pk)
+	amount := testutil.MustEncryptAmount(30, k.pk)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ind, _, err := k.eval.OverdraftIndicator(balance, amount, []int{0}, 1e4)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = serverlib.SwitchToAuditor(ind, k.swk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package serverlib
+
+// revocation.go 维护服务端从 CA 同步的密钥吊销列表
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"fmt"
+	"sync"
+
+	"github.com/CamberLoid/Chimata/internal/calib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// RevocationStore 保存最近一次同步成功的吊销列表
+// CA 不可达时继续使用旧列表
+type RevocationStore struct {
+	mu   sync.RWMutex
+	list *key.RevocationList
+}
+
+func NewRevocationStore() *RevocationStore {
+	return new(RevocationStore)
+}
+
+// Serial 返回当前列表的序号，没有列表时为 0
+func (s *RevocationStore) Serial() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.list == nil {
+		return 0
+	}
+	return s.list.Serial
+}
+
+// Update 替换吊销列表，调用方需先验证签名
+// 序号低于当前列表的会被拒绝
+func (s *RevocationStore) Update(l *key.RevocationList) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.list != nil && l.Serial < s.list.Serial {
+		return fmt.Errorf("revocation list serial %d is older than known serial %d", l.Serial, s.list.Serial)
+	}
+	s.list = l
+	return nil
+}
+
+// Sync 从 CA 获取并验证吊销列表
+func (s *RevocationStore) Sync(caURL string, caPubkey *ecdsa.PublicKey) error {
+	l, err := calib.FetchRevocationList(caURL, caPubkey, s.Serial())
+	if err != nil {
+		return err
+	}
+	return s.Update(l)
+}
+
+func (s *RevocationStore) IsRevoked(keyID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list.IsRevoked(keyID)
+}
+
+// CheckECDSAKey 签名密钥已被吊销时返回错误
+func (s *RevocationStore) CheckECDSAKey(pk crypto.PublicKey) error {
+	if id := key.ECDSAKeyFingerprint(pk); s.IsRevoked(id) {
+		return fmt.Errorf("signing key %s has been revoked", id)
+	}
+	return nil
+}
+
+// CheckCKKSKey 密钥已被吊销时返回错误
+func (s *RevocationStore) CheckCKKSKey(pk *rlwe.PublicKey) error {
+	if id := key.CKKSKeyFingerprint(pk); s.IsRevoked(id) {
+		return fmt.Errorf("ckks key %s has been revoked", id)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package serverlib_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/calib"
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+)
+
+func TestRevocationStore(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	userKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := calib.NewCA(caKey, filepath.Join(t.TempDir(), "crl.json"))
+	store := serverlib.NewRevocationStore()
+
+	old, err := ca.CurrentRevocationList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Update(old); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CheckECDSAKey(&userKey.PublicKey); err != nil {
+		t.Fatalf("key should not be revoked yet: %v", err)
+	}
+
+	l, err := ca.Revoke(key.ECDSAKeyFingerprint(&userKey.PublicKey), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Verify(&caKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Update(l); err != nil {
+		t.Fatal(err)
+	}
+	if store.CheckECDSAKey(&userKey.PublicKey) == nil {
+		t.Error("revoked key accepted")
+	}
+
+	// 不接受回滚到旧列表
+	if store.Update(old) == nil {
+		t.Error("older revocation list accepted")
+	}
+
+	// 篡改后签名失效
+	l.Revoked = nil
+	if l.Verify(&caKey.PublicKey) == nil {
+		t.Error("tampered revocation list should not verify")
+	}
+}
@@ -39,6 +39,56 @@ func InitializeNewSenderPKTransaction(t *transaction.Transaction) (err error) {
 	return
 }
 
+// IsSenderPKTransaction 判断交易是否由发送方以自己的公钥加密（bySenderPK）
+func IsSenderPKTransaction(t *transaction.Transaction) bool {
+	return t.CTSenderSignedBy == t.Sender
+}
+
+// AwaitReceiptAcceptance 使 bySenderPK 交易等待接收方确认后再记账
+// 接收方解密 CTReceipt，检查范围证明中的承诺与金额一致后对 CTReceipt 签名
+func AwaitReceiptAcceptance(t *transaction.Transaction) {
+	t.ConfirmingPhase = "unconfirmed"
+}
+
+// CheckConfirmable 检查交易是否可以由接收方确认
+// 被挂起的交易在放行前不能确认，已结束的交易不能重复确认
+func CheckConfirmable(t *transaction.Transaction) error {
+	switch t.ConfirmingPhase {
+	case "unconfirmed", "waiting", "processing":
+		return nil
+	case "review":
+		return fmt.Errorf("transaction is under review")
+	default:
+		return fmt.Errorf("transaction is already %s, cannot confirm", t.ConfirmingPhase)
+	}
+}
+
+// HoldTransaction 将交易挂起至 "review" 阶段，等待监管者审查，挂起前的阶段记录在 HeldPhase 中
+// 已完成或已挂起的交易无法挂起
+func HoldTransaction(t *transaction.Transaction) (err error) {
+	switch t.ConfirmingPhase {
+	case "confirmed", "rejected", "failed", "review":
+		return fmt.Errorf("transaction is already %s, cannot hold", t.ConfirmingPhase)
+	}
+	t.HeldPhase = t.ConfirmingPhase
+	t.ConfirmingPhase = "review"
+	return
+}
+
+// ReleaseTransaction 放行被挂起的交易，使其回到挂起前的阶段
+// 旧版本挂起的交易没有记录挂起前的阶段，回到 "processing"
+func ReleaseTransaction(t *transaction.Transaction) (err error) {
+	if t.ConfirmingPhase != "review" {
+		return fmt.Errorf("transaction is %s, not under review", t.ConfirmingPhase)
+	}
+	t.ConfirmingPhase = t.HeldPhase
+	if t.ConfirmingPhase == "" {
+		t.ConfirmingPhase = "processing"
+	}
+	t.HeldPhase = ""
+	return
+}
+
 // FinishTransaction 将交易标记为已完成
 // 该方法应该在交易完成，签名验证后，且更新交易双方账户后使用
 func FinishTransaction(t *transaction.Transaction) (err error) {
@@ -0,0 +1,50 @@
+package serverlib_test
+
+import (
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+	"github.com/CamberLoid/Chimata/internal/transaction"
+)
+
+func TestHoldReleaseTransaction(t *testing.T) {
+	for _, phase := range []string{"unconfirmed", "waiting", "processing"} {
+		tx := &transaction.Transaction{ConfirmingPhase: phase}
+		if err := serverlib.HoldTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		if tx.ConfirmingPhase != "review" {
+			t.Fatalf("expected review after hold, got %s", tx.ConfirmingPhase)
+		}
+		if err := serverlib.HoldTransaction(tx); err == nil {
+			t.Error("holding a held transaction should fail")
+		}
+		if err := serverlib.ReleaseTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+		if tx.ConfirmingPhase != phase || tx.HeldPhase != "" {
+			t.Errorf("expected %s after release, got %s (held %q)", phase, tx.ConfirmingPhase, tx.HeldPhase)
+		}
+		if err := serverlib.ReleaseTransaction(tx); err == nil {
+			t.Error("releasing a transaction not under review should fail")
+		}
+	}
+
+	if err := serverlib.HoldTransaction(&transaction.Transaction{ConfirmingPhase: "confirmed"}); err == nil {
+		t.Error("holding a confirmed transaction should fail")
+	}
+}
+
+func TestCheckConfirmable(t *testing.T) {
+	tx := &transaction.Transaction{}
+	serverlib.AwaitReceiptAcceptance(tx)
+	if err := serverlib.CheckConfirmable(tx); err != nil {
+		t.Error(err)
+	}
+	for _, phase := range []string{"review", "confirmed", "rejected", "failed"} {
+		tx.ConfirmingPhase = phase
+		if err := serverlib.CheckConfirmable(tx); err == nil {
+			t.Errorf("%s transaction should not be confirmable", phase)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package serverlib
+
+// workerpool.go 实现了执行同态运算（重加密、余额加减）的有界工作池
+// 同态运算占用大量 CPU 和内存，在每个 HTTP 请求的 goroutine 中直接执行时，突发的转账会耗尽服务端资源
+// 工作池只用固定数量的 worker 执行运算，排队的任务数有上限：
+//   - 队列已满时立即返回 ErrPoolBusy，由调用者返回 503，客户端稍后重试
+//   - 任务超过时限时返回 ErrJobTimeout；仍在排队的任务不再执行，已在执行的任务无法中断，其结果被丢弃
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrPoolBusy   = errors.New("crypto worker pool is busy")
+	ErrJobTimeout = errors.New("crypto job timed out")
+	ErrPoolClosed = errors.New("crypto worker pool is closed")
+)
+
+// WorkerPoolLatencyBuckets 为任务延迟（排队 + 执行）直方图的上界
+var WorkerPoolLatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// WorkerPool 是有界的同态运算工作池
+type WorkerPool struct {
+	workers int
+	timeout time.Duration
+	jobs    chan *poolJob
+
+	// mu 保证入队与 Close 关闭 jobs 互斥：Do 持读锁检查 closed 并入队，Close 持写锁关闭
+	mu        sync.RWMutex
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+
+	queued, running     atomic.Int64
+	completed, failed   atomic.Int64
+	rejected, timedOut  atomic.Int64
+	waitNanos, runNanos atomic.Int64
+	latency             []atomic.Int64 // len(WorkerPoolLatencyBuckets) + 1，最后一项为超出全部上界的任务
+}
+
+type poolJob struct {
+	ctx      context.Context
+	f        func() error
+	done     chan error
+	enqueued time.Time
+}
+
+// NewWorkerPool 启动 workers 个 worker，队列最多容纳 queue 个任务，每个任务的时限为 timeout
+// workers 不大于 0 时使用 CPU 核数，timeout 为 0 时不限时
+func NewWorkerPool(workers, queue int, timeout time.Duration) *WorkerPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	p := &WorkerPool{
+		workers: workers,
+		timeout: timeout,
+		jobs:    make(chan *poolJob, queue),
+		closed:  make(chan struct{}),
+		latency: make([]atomic.Int64, len(WorkerPoolLatencyBuckets)+1),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Do 在工作池中执行 f 并等待其结果
+// 队列已满时返回 ErrPoolBusy，超时或 ctx 取消时返回包装了 ErrJobTimeout 的错误，f 发生 panic 时返回错误
+func (p *WorkerPool) Do(ctx context.Context, f func() error) error {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	job := &poolJob{ctx: ctx, f: f, done: make(chan error, 1), enqueued: time.Now()}
+
+	if err := p.enqueue(job); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		p.timedOut.Add(1)
+		return fmt.Errorf("%w: %v", ErrJobTimeout, ctx.Err())
+	}
+}
+
+// enqueue 将任务放入队列，不阻塞
+func (p *WorkerPool) enqueue(job *poolJob) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	select {
+	case <-p.closed:
+		return ErrPoolClosed
+	default:
+	}
+	// 先计数再入队，避免 worker 取出任务后计数短暂为负
+	p.queued.Add(1)
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		p.queued.Add(-1)
+		p.rejected.Add(1)
+		return ErrPoolBusy
+	}
+}
+
+// Close 停止接受新任务，等待队列中的任务处理完毕
+func (p *WorkerPool) Close() {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		close(p.closed)
+		close(p.jobs)
+	})
+	p.wg.Wait()
+}
+
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		p.queued.Add(-1)
+		// 等待期间已超时的任务不再执行
+		if err := job.ctx.Err(); err != nil {
+			job.done <- err
+			continue
+		}
+
+		start := time.Now()
+		p.running.Add(1)
+		err := runJob(job.f)
+		p.running.Add(-1)
+		end := time.Now()
+
+		p.waitNanos.Add(int64(start.Sub(job.enqueued)))
+		p.runNanos.Add(int64(end.Sub(start)))
+		p.observe(end.Sub(job.enqueued))
+		if err != nil {
+			p.failed.Add(1)
+		}
+		p.completed.Add(1)
+		job.done <- err
+	}
+}
+
+func runJob(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("crypto job panicked: %v", r)
+		}
+	}()
+	return f()
+}
+
+func (p *WorkerPool) observe(d time.Duration) {
+	for i, le := range WorkerPoolLatencyBuckets {
+		if d <= le {
+			p.latency[i].Add(1)
+			return
+		}
+	}
+	p.latency[len(WorkerPoolLatencyBuckets)].Add(1)
+}
+
+// WorkerPoolStats 为工作池的运行指标
+// 延迟直方图为累计计数，键为上界，如 "le_10ms"，"le_inf" 为全部任务
+type WorkerPoolStats struct {
+	Workers       int              `json:"workers"`
+	QueueCapacity int              `json:"queueCapacity"`
+	QueueDepth    int64            `json:"queueDepth"`
+	Running       int64            `json:"running"`
+	Completed     int64            `json:"completed"`
+	Failed        int64            `json:"failed"`
+	Rejected      int64            `json:"rejected"`
+	TimedOut      int64            `json:"timedOut"`
+	WaitSeconds   float64          `json:"waitSeconds"`
+	RunSeconds    float64          `json:"runSeconds"`
+	Latency       map[string]int64 `json:"latency"`
+}
+
+// Stats 返回工作池当前的指标
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	s := WorkerPoolStats{
+		Workers:       p.workers,
+		QueueCapacity: cap(p.jobs),
+		QueueDepth:    p.queued.Load(),
+		Running:       p.running.Load(),
+		Completed:     p.completed.Load(),
+		Failed:        p.failed.Load(),
+		Rejected:      p.rejected.Load(),
+		TimedOut:      p.timedOut.Load(),
+		WaitSeconds:   time.Duration(p.waitNanos.Load()).Seconds(),
+		RunSeconds:    time.Duration(p.runNanos.Load()).Seconds(),
+		Latency:       make(map[string]int64, len(p.latency)),
+	}
+	var cumulative int64
+	for i, le := range WorkerPoolLatencyBuckets {
+		cumulative += p.latency[i].Load()
+		s.Latency["le_"+le.String()] = cumulative
+	}
+	s.Latency["le_inf"] = cumulative + p.latency[len(WorkerPoolLatencyBuckets)].Load()
+	return s
+}
@@ -0,0 +1,151 @@
+package serverlib_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/serverlib"
+)
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("Run", func(t *testing.T) {
+		pool := serverlib.NewWorkerPool(2, 4, time.Minute)
+		defer pool.Close()
+
+		scheme := misc.GetAmountScheme()
+		var wg sync.WaitGroup
+		errs := make([]error, 4)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = pool.Do(context.Background(), func() error {
+					_, err := scheme.Encrypt(float64(i), nil)
+					return err
+				})
+			}(i)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			// 公钥为 nil 时 Encrypt 应返回错误或 panic，两者都应作为错误返回而不使 worker 退出
+			if err == nil {
+				t.Errorf("job %d: expected error for nil public key", i)
+			}
+		}
+
+		if err := pool.Do(context.Background(), func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		stats := pool.Stats()
+		if stats.Completed != 5 || stats.Failed != 4 || stats.Latency["le_inf"] != 5 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("Busy", func(t *testing.T) {
+		pool := serverlib.NewWorkerPool(1, 1, time.Minute)
+		defer pool.Close()
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+		go pool.Do(context.Background(), func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		<-started
+		// 唯一的 worker 正忙，第一个任务进入队列，第二个任务被拒绝
+		queued := make(chan error)
+		go func() { queued <- pool.Do(context.Background(), func() error { return nil }) }()
+		waitFor(t, func() bool { return pool.Stats().QueueDepth == 1 })
+
+		if err := pool.Do(context.Background(), func() error { return nil }); !errors.Is(err, serverlib.ErrPoolBusy) {
+			t.Fatalf("expected ErrPoolBusy, got %v", err)
+		}
+		close(release)
+		if err := <-queued; err != nil {
+			t.Fatal(err)
+		}
+		if stats := pool.Stats(); stats.Rejected != 1 || stats.QueueDepth != 0 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		pool := serverlib.NewWorkerPool(1, 1, 50*time.Millisecond)
+		defer pool.Close()
+
+		release := make(chan struct{})
+		defer close(release)
+		err := pool.Do(context.Background(), func() error {
+			<-release
+			return nil
+		})
+		if !errors.Is(err, serverlib.ErrJobTimeout) {
+			t.Fatalf("expected ErrJobTimeout, got %v", err)
+		}
+
+		// 排队期间超时的任务不会执行
+		var ran atomic.Bool
+		err = pool.Do(context.Background(), func() error {
+			ran.Store(true)
+			return nil
+		})
+		if !errors.Is(err, serverlib.ErrJobTimeout) {
+			t.Fatalf("expected ErrJobTimeout, got %v", err)
+		}
+		release <- struct{}{}
+		// 只有一个 worker，队列清空后再执行的任务完成时，过期任务一定已被处理
+		waitFor(t, func() bool { return pool.Stats().QueueDepth == 0 })
+		if err = pool.Do(context.Background(), func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if ran.Load() {
+			t.Error("expired job was executed")
+		}
+		if stats := pool.Stats(); stats.TimedOut != 2 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("CloseRace", func(t *testing.T) {
+		// 与 Close 并发的 Do 返回 ErrPoolClosed 或正常执行，不应向已关闭的队列发送而 panic
+		for i := 0; i < 100; i++ {
+			pool := serverlib.NewWorkerPool(2, 16, time.Minute)
+			var wg sync.WaitGroup
+			for j := 0; j < 8; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						err := pool.Do(context.Background(), func() error { return nil })
+						if errors.Is(err, serverlib.ErrPoolClosed) {
+							return
+						}
+						if err != nil && !errors.Is(err, serverlib.ErrPoolBusy) {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			time.Sleep(time.Millisecond)
+			pool.Close()
+			wg.Wait()
+		}
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// 包 testutil 包含各包测试共用的辅助函数，只应在测试中使用
+package testutil
+
+import (
+	"os"
+	"testing"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// NewCKKSKeyPair 使用 key.LocalKeyGenerator 生成测试用的 CKKS 密钥对
+func NewCKKSKeyPair() (*rlwe.SecretKey, *rlwe.PublicKey) {
+	kc, err := key.NewLocalKeyGenerator().GenerateUserCKKSKey()
+	if err != nil {
+		panic(err)
+	}
+	return kc.CKKSPrivateKey, kc.CKKSPublicKey
+}
+
+// MustEncryptAmount 使用当前参数集的方案加密金额
+func MustEncryptAmount(amount float64, pk *rlwe.PublicKey) *rlwe.Ciphertext {
+	ct, err := misc.GetAmountScheme().Encrypt(amount, pk)
+	if err != nil {
+		panic(err)
+	}
+	return ct
+}
+
+// DefaultSchemeParamSets 为默认运行测试的参数集，覆盖 CKKS 和 BGV 两种方案
+var DefaultSchemeParamSets = []string{"PN12QP109", "BGV-PN12QP109"}
+
+// SchemeParamSets 返回与方案相关的测试应当覆盖的参数集
+// 设置 CHIMATA_TEST_PARAMS 时只使用该参数集，需要服务端的测试要求服务端以相同的 -params 启动
+func SchemeParamSets() []string {
+	if id := os.Getenv("CHIMATA_TEST_PARAMS"); id != "" {
+		return []string{id}
+	}
+	return DefaultSchemeParamSets
+}
+
+// UseParamSet 在测试期间切换到参数集 id，测试结束后恢复
+func UseParamSet(tb testing.TB, id string) {
+	prev := misc.ParamSetID()
+	if err := misc.SetParamSet(id); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { misc.SetParamSet(prev) })
+}
+
+// ForEachScheme 在 SchemeParamSets 的每个参数集下以子测试运行 f
+func ForEachScheme(t *testing.T, f func(t *testing.T)) {
+	for _, id := range SchemeParamSets() {
+		t.Run(id, func(t *testing.T) {
+			UseParamSet(t, id)
+			f(t)
+		})
+	}
+}
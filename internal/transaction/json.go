@@ -12,7 +12,8 @@ import (
 type TransactionJSON struct {
 	// ConfirmingPhase 可能是
 	// "unconfirmed", "waiting", "processing",
-	// "rejected", "confirmed", "failed"
+	// "rejected", "confirmed", "failed",
+	// "review"（被监管者挂起，等待放行）
 	ConfirmingPhase   string    `json:"confirmingPhase"`
 	UUID              uuid.UUID `json:"uuid"`
 	Sender            uuid.UUID `json:"sender"`
@@ -25,6 +26,17 @@ type TransactionJSON struct {
 	CTReceiptSignedBy uuid.UUID `json:"ctReceiptSignedBy"`
 	TimeStamp         int64     `json:"timestamp"` //unix时间戳
 	IsValid           bool      `json:"isValid"`
+	Assets            []string  `json:"assets,omitempty"`
+	RangeProof        string    `json:"rangeProof,omitempty"`
+	SigRangeProof     string    `json:"sigRangeProof,omitempty"`
+	SenderSignedCT    string    `json:"senderSignedCt,omitempty"`
+
+	CTSenderKeyID       uuid.UUID `json:"ctSenderKeyID"`
+	CTReceiptKeyID      uuid.UUID `json:"ctReceiptKeyID"`
+	SenderSignedCTKeyID uuid.UUID `json:"senderSignedCtKeyID"`
+	SigCTSenderKeyID    uuid.UUID `json:"sigCtSenderKeyID"`
+	SigCTReceiptKeyID   uuid.UUID `json:"sigCtReceiptKeyID"`
+	SigRangeProofKeyID  uuid.UUID `json:"sigRangeProofKeyID"`
 }
 
 func (t Transaction) CopyToJSONStruct() (res *TransactionJSON) {
@@ -38,12 +50,22 @@ func (t Transaction) CopyToJSONStruct() (res *TransactionJSON) {
 	res.CTReceiptSignedBy = t.CTReceiptSignedBy
 	res.TimeStamp = t.TimeStamp
 	res.IsValid = t.IsValid
+	res.Assets = t.Assets
+	res.CTSenderKeyID = t.CTSenderKeyID
+	res.CTReceiptKeyID = t.CTReceiptKeyID
+	res.SenderSignedCTKeyID = t.SenderSignedCTKeyID
+	res.SigCTSenderKeyID = t.SigCTSenderKeyID
+	res.SigCTReceiptKeyID = t.SigCTReceiptKeyID
+	res.SigRangeProofKeyID = t.SigRangeProofKeyID
 
 	// Encode []byte fields to base64
 	res.SigCTReceipt = base64.StdEncoding.EncodeToString(t.SigCTReceipt)
 	res.SigCTSender = base64.StdEncoding.EncodeToString(t.SigCTSender)
 	res.CTReceipt = base64.StdEncoding.EncodeToString(t.CTReceipt)
 	res.CTSender = base64.StdEncoding.EncodeToString(t.CTSender)
+	res.RangeProof = base64.StdEncoding.EncodeToString(t.RangeProof)
+	res.SigRangeProof = base64.StdEncoding.EncodeToString(t.SigRangeProof)
+	res.SenderSignedCT = base64.StdEncoding.EncodeToString(t.SenderSignedCT)
 
 	return
 }
@@ -59,6 +81,13 @@ func (tj TransactionJSON) CopyToStruct() (res *Transaction, err error) {
 	res.CTReceiptSignedBy = tj.CTReceiptSignedBy
 	res.TimeStamp = tj.TimeStamp
 	res.IsValid = tj.IsValid
+	res.Assets = tj.Assets
+	res.CTSenderKeyID = tj.CTSenderKeyID
+	res.CTReceiptKeyID = tj.CTReceiptKeyID
+	res.SenderSignedCTKeyID = tj.SenderSignedCTKeyID
+	res.SigCTSenderKeyID = tj.SigCTSenderKeyID
+	res.SigCTReceiptKeyID = tj.SigCTReceiptKeyID
+	res.SigRangeProofKeyID = tj.SigRangeProofKeyID
 
 	// Decode base64 fields to []byte
 	res.SigCTReceipt, err = base64.StdEncoding.DecodeString(tj.SigCTReceipt)
@@ -77,6 +106,18 @@ func (tj TransactionJSON) CopyToStruct() (res *Transaction, err error) {
 	if err != nil {
 		return
 	}
+	res.RangeProof, err = base64.StdEncoding.DecodeString(tj.RangeProof)
+	if err != nil {
+		return
+	}
+	res.SigRangeProof, err = base64.StdEncoding.DecodeString(tj.SigRangeProof)
+	if err != nil {
+		return
+	}
+	res.SenderSignedCT, err = base64.StdEncoding.DecodeString(tj.SenderSignedCT)
+	if err != nil {
+		return
+	}
 
 	return
 }
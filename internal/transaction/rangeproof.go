@@ -0,0 +1,228 @@
+package transaction
+
+// rangeproof.go 定义了转账金额的范围证明
+// 发送方对密文中每个资产槽位的金额（以分计）给出 Pedersen 承诺及其范围证明，证明金额在 [0, 2^RangeProofBits()) 内，
+// 从而不能通过转出负数金额凭空增加自己的余额
+//
+// 与密文的绑定：
+//   - 证明的 Fiat-Shamir context 为密文（紧凑格式）的哈希，换用其他密文后证明无效
+//   - 承诺的盲化因子由随机数 nonce 导出，nonce 按 16 位分块加密在密文顶部的保留槽位中，
+//     能解密密文的一方（接收方、监管者）可以据此检查承诺与密文中的金额一致，见 CheckRangeProofOpening
+//
+// 服务端无法解密，只能检查证明本身；承诺与密文是否一致由接收方在接受转账前检查。
+// 发送方可以加密负数金额却对正数金额给出有效的证明，因此两种交易都要等接收方检查并确认后才记账：
+// bySenderPK 交易由服务端重加密为 CTReceipt 后等待接收方确认，见 serverlib.AwaitReceiptAcceptance。
+// 服务端以 -sender-pk-direct-settle 直接记账时，不一致只能在事后由接收方或监管者发现，发送方签名的证明即为凭据。
+// 保留槽位中的 nonce 会随转账累加到余额中，不影响资产槽位，余额刷新时被清除
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/CamberLoid/Chimata/internal/rangeproof"
+)
+
+const (
+	// RangeProofNonceSize 为 nonce 的字节数，每个保留槽位存放 16 位
+	RangeProofNonceSize = misc.ReservedSlots * 2
+
+	// 证明的最大位数，即单笔转账的金额不超过 2^40 分
+	maxRangeProofBits = 40
+)
+
+var ErrRangeProofMismatch = errors.New("range proof does not match the ciphertext")
+
+// RangeProofBits 返回当前参数集下证明的位数
+// BGV 的金额按模 T 计算，位数不超过 log2(T/2)，保证证明范围内的金额不会回绕
+func RangeProofBits() int {
+	if s, ok := misc.GetAmountScheme().(*misc.BGVScheme); ok {
+		if b := bits.Len64((s.Params.T()-1)/2) - 1; b < maxRangeProofBits {
+			return b
+		}
+	}
+	return maxRangeProofBits
+}
+
+// RangeProofCT 返回范围证明所针对的密文，即由发送方签名的密文
+func (t Transaction) RangeProofCT() []byte {
+	if len(t.SenderSignedCT) != 0 {
+		return t.SenderSignedCT
+	}
+	if t.CTReceiptSignedBy == t.Sender && len(t.CTReceipt) != 0 {
+		return t.CTReceipt
+	}
+	return t.CTSender
+}
+
+// NewRangeProofNonce 生成随机的 nonce
+func NewRangeProofNonce() ([]byte, error) {
+	nonce := make([]byte, RangeProofNonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// WithRangeProofNonce 将 nonce 写入保留槽位，返回加密用的完整向量
+// 每个槽位的值为 16 位整数，按分编码
+func WithRangeProofNonce(vec []float64, nonce []byte) ([]float64, error) {
+	slots := misc.GetAmountScheme().Slots()
+	if len(nonce) != RangeProofNonceSize {
+		return nil, fmt.Errorf("invalid nonce size %d", len(nonce))
+	}
+	if len(vec) > misc.AssetSlots() {
+		return nil, fmt.Errorf("too many amounts: %d", len(vec))
+	}
+	full := make([]float64, slots)
+	copy(full, vec)
+	for i := 0; i < misc.ReservedSlots; i++ {
+		chunk := binary.BigEndian.Uint16(nonce[2*i:])
+		full[slots-misc.ReservedSlots+i] = float64(chunk) / misc.AmountMinorUnits
+	}
+	return full, nil
+}
+
+// RangeProofNonceFromVector 从解密得到的完整向量中还原 nonce
+func RangeProofNonceFromVector(vec []float64) ([]byte, error) {
+	slots := misc.GetAmountScheme().Slots()
+	if len(vec) != slots {
+		return nil, fmt.Errorf("expected %d slots, got %d", slots, len(vec))
+	}
+	nonce := make([]byte, RangeProofNonceSize)
+	for i := 0; i < misc.ReservedSlots; i++ {
+		chunk := math.Round(vec[slots-misc.ReservedSlots+i] * misc.AmountMinorUnits)
+		if chunk < 0 || chunk > math.MaxUint16 {
+			return nil, fmt.Errorf("%w: invalid nonce in slot %d", ErrRangeProofMismatch, slots-misc.ReservedSlots+i)
+		}
+		binary.BigEndian.PutUint16(nonce[2*i:], uint16(chunk))
+	}
+	return nonce, nil
+}
+
+// rangeProofContext 将证明绑定到密文及槽位
+func rangeProofContext(ct []byte, slot int) []byte {
+	h := sha256.Sum256(ct)
+	return binary.BigEndian.AppendUint32(h[:], uint32(slot))
+}
+
+func minorUnits(amount float64) (uint64, error) {
+	if math.IsNaN(amount) || amount < 0 {
+		return 0, fmt.Errorf("amount %v is negative", amount)
+	}
+	v := math.Round(amount * misc.AmountMinorUnits)
+	if v >= math.Ldexp(1, RangeProofBits()) {
+		return 0, fmt.Errorf("amount %v is out of range", amount)
+	}
+	return uint64(v), nil
+}
+
+// ProveAmounts 对 amounts[i]（槽位 i 的金额）给出范围证明
+// ct 为加密 amounts 及 nonce 的密文（紧凑格式），输出为序列化的证明集合
+func ProveAmounts(ct []byte, amounts []float64, nonce []byte) ([]byte, error) {
+	if len(amounts) == 0 || len(amounts) > misc.AssetSlots() {
+		return nil, fmt.Errorf("invalid number of amounts %d", len(amounts))
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(amounts)))
+	for slot, amount := range amounts {
+		v, err := minorUnits(amount)
+		if err != nil {
+			return nil, err
+		}
+		proof, err := rangeproof.Prove(v, rangeproof.Blinding(nonce, slot), RangeProofBits(), rangeProofContext(ct, slot))
+		if err != nil {
+			return nil, err
+		}
+		data, err := proof.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalRangeProofs(data []byte) (proofs []*rangeproof.Proof, err error) {
+	r := bytes.NewReader(data)
+	var n uint16
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, rangeproof.ErrInvalidProof
+	}
+	if n == 0 || int(n) > misc.AssetSlots() {
+		return nil, fmt.Errorf("%w: invalid number of proofs %d", rangeproof.ErrInvalidProof, n)
+	}
+	for i := 0; i < int(n); i++ {
+		var size uint32
+		if err = binary.Read(r, binary.BigEndian, &size); err != nil || int(size) > r.Len() {
+			return nil, fmt.Errorf("%w: truncated", rangeproof.ErrInvalidProof)
+		}
+		b := make([]byte, size)
+		r.Read(b)
+		proof := new(rangeproof.Proof)
+		if err = proof.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, proof)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data", rangeproof.ErrInvalidProof)
+	}
+	return proofs, nil
+}
+
+// VerifyRangeProof 验证密文 ct 的证明集合，要求至少覆盖前 n 个槽位
+// 服务端以资产注册表的槽位数作为 n
+func VerifyRangeProof(ct, data []byte, n int) error {
+	proofs, err := unmarshalRangeProofs(data)
+	if err != nil {
+		return err
+	}
+	if len(proofs) < n {
+		return fmt.Errorf("%w: %d slots proven, %d required", rangeproof.ErrInvalidProof, len(proofs), n)
+	}
+	for slot, proof := range proofs {
+		if proof.Bits() > RangeProofBits() {
+			return fmt.Errorf("%w: slot %d proves %d bits, at most %d allowed",
+				rangeproof.ErrInvalidProof, slot, proof.Bits(), RangeProofBits())
+		}
+		if err = proof.Verify(rangeProofContext(ct, slot)); err != nil {
+			return fmt.Errorf("slot %d: %w", slot, err)
+		}
+	}
+	return nil
+}
+
+// CheckRangeProofOpening 检查证明中的承诺与解密得到的完整向量一致
+// vec 为密文全部槽位的解密结果，包含保留槽位中的 nonce
+// 没有证明的资产槽位必须为 0，否则发送方可以在证明范围之外转出负数金额
+func CheckRangeProofOpening(data []byte, vec []float64) error {
+	proofs, err := unmarshalRangeProofs(data)
+	if err != nil {
+		return err
+	}
+	nonce, err := RangeProofNonceFromVector(vec)
+	if err != nil {
+		return err
+	}
+	for slot, proof := range proofs {
+		v, err := minorUnits(vec[slot])
+		if err != nil {
+			return fmt.Errorf("%w: slot %d: %v", ErrRangeProofMismatch, slot, err)
+		}
+		if !bytes.Equal(proof.Commitment, rangeproof.Commit(v, rangeproof.Blinding(nonce, slot))) {
+			return fmt.Errorf("%w: slot %d", ErrRangeProofMismatch, slot)
+		}
+	}
+	for slot := len(proofs); slot < misc.AssetSlots(); slot++ {
+		if math.Round(vec[slot]*misc.AmountMinorUnits) != 0 {
+			return fmt.Errorf("%w: unproven slot %d is not zero", ErrRangeProofMismatch, slot)
+		}
+	}
+	return nil
+}
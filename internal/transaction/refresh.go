@@ -0,0 +1,76 @@
+package transaction
+
+// refresh.go 定义了余额刷新声明
+// 余额密文每次结算都会累积噪声，运算次数超过阈值后，由用户解密并重新加密得到新的密文，
+// 同时签名声明新旧密文对应的金额相同；服务端据此替换余额，监管者可以事后核对
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
+	"github.com/google/uuid"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// BalanceRefresh 是用户对余额刷新的签名声明
+// OldBalance 为用户解密时服务端保存的余额密文，NewBalance 为重新加密的余额密文
+type BalanceRefresh struct {
+	UUID       uuid.UUID `json:"uuid"`
+	User       uuid.UUID `json:"user"`
+	OldBalance []byte    `json:"oldBalance"`
+	NewBalance []byte    `json:"newBalance"`
+	TimeStamp  int64     `json:"timestamp"` //unix时间戳
+	Sig        []byte    `json:"sig"`
+}
+
+func NewBalanceRefresh(user uuid.UUID, oldBalance []byte, newBalance *rlwe.Ciphertext) (r *BalanceRefresh, err error) {
+	r = &BalanceRefresh{
+		UUID:       uuid.New(),
+		User:       user,
+		OldBalance: oldBalance,
+		TimeStamp:  time.Now().Unix(),
+	}
+	r.NewBalance, err = misc.MarshalCompactCiphertext(newBalance)
+	return
+}
+
+// signedPayload 返回参与签名的字节，即去掉签名后的 JSON
+func (r BalanceRefresh) signedPayload() ([]byte, error) {
+	r.Sig = nil
+	return json.Marshal(r)
+}
+
+func (r *BalanceRefresh) Sign(sk crypto.Signer) (err error) {
+	if sk == nil {
+		return errors.New("no signing key found")
+	}
+	msg, err := r.signedPayload()
+	if err != nil {
+		return err
+	}
+	r.Sig, err = key.Sign(sk, msg)
+	return
+}
+
+func (r BalanceRefresh) Verify(pk crypto.PublicKey) bool {
+	if pk == nil || len(r.Sig) == 0 {
+		return false
+	}
+	msg, err := r.signedPayload()
+	if err != nil {
+		return false
+	}
+	return key.Verify(pk, msg, r.Sig)
+}
+
+func (r BalanceRefresh) GetOldBalanceCT() (*rlwe.Ciphertext, error) {
+	return misc.UnmarshalCiphertext(r.OldBalance)
+}
+
+func (r BalanceRefresh) GetNewBalanceCT() (*rlwe.Ciphertext, error) {
+	return misc.UnmarshalCiphertext(r.NewBalance)
+}
@@ -3,6 +3,7 @@ package transaction
 import (
 	"errors"
 
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/google/uuid"
 	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
@@ -11,12 +12,13 @@ import (
 // Transaction 是单笔转账的抽象，
 // 一个 Transaction 包含了转账的发起者、接收者、金额、时间戳等信息。具体如下：
 // sender, receipt, CT{Sender,Receipt}SignedBy: []byte, UUID
-// CTSender,CTReceipt: []byte <- rlwe.CipherText.MarshalBinary()
+// CTSender,CTReceipt: []byte <- misc.MarshalCompactCiphertext()，签名的对象即为这些字节
 // sig(略): []byte，签名，只会有三种可能的签名方：CA、发送者和接受者
 type Transaction struct {
 	// ConfirmingPhase 可能是
 	// "unconfirmed", "waiting", "processing",
-	// "rejected", "confirmed", "failed"
+	// "rejected", "confirmed", "failed",
+	// "review"（被监管者挂起，等待放行）
 	ConfirmingPhase   string    `json:"confirmingPhase"`
 	UUID              uuid.UUID `json:"uuid"`
 	Sender            uuid.UUID `json:"sender"`
@@ -29,57 +31,117 @@ type Transaction struct {
 	CTReceiptSignedBy uuid.UUID `json:"ctReceiptSignedBy"`
 	TimeStamp         int64     `json:"timestamp"` //unix时间戳
 	IsValid           bool      `json:"isValid"`
+	// Assets 为交易涉及的资产 ID，各资产的金额位于密文的对应槽位，见 misc.AssetRegistry
+	// 为空时表示默认资产
+	Assets []string `json:"assets,omitempty"`
+	// RangeProof 为发送方签名密文中各槽位金额的范围证明，SigRangeProof 为发送方对其的签名，见 ProveAmounts
+	RangeProof    []byte `json:"rangeProof,omitempty"`
+	SigRangeProof []byte `json:"sigRangeProof,omitempty"`
+	// SenderSignedCT 为发送方签名的原始密文，仅在该密文因接收方轮换 CKKS 密钥被重加密后保存
+	// SigCTReceipt 和 RangeProof 针对的是这份密文
+	SenderSignedCT []byte `json:"senderSignedCt,omitempty"`
+	// HeldPhase 为交易被监管者挂起前的阶段，放行时恢复，见 serverlib.ReleaseTransaction
+	HeldPhase string `json:"heldPhase,omitempty"`
+
+	// 以下为各密文和签名所用密钥的 ID，即 CKKSKeyChains / ECDSAKeyChains 中的 uuid
+	// 零值表示该用户的主密钥（旧版本客户端不填写）
+	CTSenderKeyID       uuid.UUID `json:"ctSenderKeyID"`
+	CTReceiptKeyID      uuid.UUID `json:"ctReceiptKeyID"`
+	SenderSignedCTKeyID uuid.UUID `json:"senderSignedCtKeyID"`
+	SigCTSenderKeyID    uuid.UUID `json:"sigCtSenderKeyID"`
+	SigCTReceiptKeyID   uuid.UUID `json:"sigCtReceiptKeyID"`
+	SigRangeProofKeyID  uuid.UUID `json:"sigRangeProofKeyID"`
 }
 
 func (t Transaction) GetSenderCT() (ct *rlwe.Ciphertext, err error) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	ct = ckks.NewCiphertext(
-		params, 1, params.MaxLevel(),
-	)
-
 	if t.CTSender == nil {
 		err = errors.New("no sender ciphertext found")
 	} else {
-		err = ct.UnmarshalBinary(t.CTSender)
+		ct, err = misc.UnmarshalCiphertext(t.CTSender)
 	}
 
 	return
 }
 
 func (t Transaction) GetReceiptCT() (ct *rlwe.Ciphertext, err error) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	ct = ckks.NewCiphertext(
-		params, 1, params.MaxLevel(),
-	)
-
 	if t.CTReceipt == nil {
 		err = errors.New("no receipt ciphertext found")
 	} else {
-		err = ct.UnmarshalBinary(t.CTReceipt)
+		ct, err = misc.UnmarshalCiphertext(t.CTReceipt)
 	}
 
 	return
 }
 
-// --- 手续费计算，预留 --- //
+// GetAssets 返回交易涉及的资产，未填写时为默认资产
+func (t Transaction) GetAssets() []string {
+	if len(t.Assets) == 0 {
+		return []string{misc.DefaultAssetID}
+	}
+	return t.Assets
+}
+
+// HasAsset 判断交易是否涉及资产 id
+func (t Transaction) HasAsset(id string) bool {
+	for _, a := range t.GetAssets() {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// --- 手续费与利息计算 --- //
+// 以下函数仅适用于 CKKS 参数集，BGV 以整数计算，无法乘以小数费率
+
+var (
+	ErrRequiresCKKS = errors.New("rated fees require a CKKS parameter set")
+	// 重缩放需要消耗一层，第 0 层的密文需要先由用户刷新，见 BalanceRefresh
+	ErrNoLevelLeft = errors.New("cannot apply a rate to a ciphertext at level 0, it needs to be refreshed")
+)
 
 // CalcFixedFee 计算固定费率的手续费
 // ... 返回加了手续费的密文
 func CalcFixedFee(ct *rlwe.Ciphertext, rate float64) (fee *rlwe.Ciphertext) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	evaluator := ckks.NewEvaluator(params, rlwe.EvaluationKey{})
-
-	fee = evaluator.AddConstNew(ct, rate)
-
+	misc.GetCryptoContext().CKKS().WithEvaluator(func(evaluator ckks.Evaluator) {
+		fee = evaluator.AddConstNew(ct, rate)
+	})
 	return
 }
 
-// CalcRatedFee 计算按比例计算的手续费
-func CalcRatedFee(ct *rlwe.Ciphertext, rate float64) (fee *rlwe.Ciphertext) {
-	params, _ := ckks.NewParametersFromLiteral(ckks.PN12QP109)
-	evaluator := ckks.NewEvaluator(params, rlwe.EvaluationKey{})
+// CalcRatedFee 计算按比例 rate 计算的手续费（或利息），各槽位使用同一比例
+// 乘法后重缩放回默认尺度，结果比 ct 低一层，ct 已在第 0 层时返回错误
+func CalcRatedFee(ct *rlwe.Ciphertext, rate float64) (fee *rlwe.Ciphertext, err error) {
+	return calcRated(ct, func(s *misc.CKKSScheme, evaluator ckks.Evaluator) *rlwe.Ciphertext {
+		return evaluator.MultByConstNew(ct, rate)
+	})
+}
 
-	fee = evaluator.MultByConstNew(ct, rate)
+// CalcRatedFeeVector 同 CalcRatedFee，槽位 i 的比例为 rates[i]，其余槽位为 0
+func CalcRatedFeeVector(ct *rlwe.Ciphertext, rates []float64) (fee *rlwe.Ciphertext, err error) {
+	return calcRated(ct, func(s *misc.CKKSScheme, evaluator ckks.Evaluator) *rlwe.Ciphertext {
+		// 比例以当前层的模数为尺度编码，与 MultByConst 相同，重缩放后恰好回到 ct 的尺度
+		level := ct.Level()
+		var pt *rlwe.Plaintext
+		s.WithEncoder(func(enc ckks.Encoder) {
+			pt = enc.EncodeNew(rates, level, rlwe.NewScale(s.Params.QiFloat64(level)), s.Params.LogSlots())
+		})
+		return evaluator.MulNew(ct, pt)
+	})
+}
 
+// calcRated 计算 mul 的乘积并重缩放到默认尺度
+func calcRated(ct *rlwe.Ciphertext, mul func(*misc.CKKSScheme, ckks.Evaluator) *rlwe.Ciphertext) (fee *rlwe.Ciphertext, err error) {
+	s := misc.GetCryptoContext().CKKS()
+	if s == nil {
+		return nil, ErrRequiresCKKS
+	}
+	if ct.Level() == 0 {
+		return nil, ErrNoLevelLeft
+	}
+	s.WithEvaluator(func(evaluator ckks.Evaluator) {
+		fee = mul(s, evaluator)
+		err = evaluator.Rescale(fee, s.Params.DefaultScale(), fee)
+	})
 	return
 }
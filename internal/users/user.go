@@ -2,11 +2,11 @@
 package users
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 
 	"github.com/CamberLoid/Chimata/internal/key"
+	"github.com/CamberLoid/Chimata/internal/misc"
 	"github.com/google/uuid"
-	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
@@ -20,11 +20,6 @@ type User struct {
 	UserECDSAKeyChain []key.ECDSAKeyChain
 }
 
-var (
-	// 预设的 CKKS 安全参数
-	ckksParams, _ = ckks.NewParametersFromLiteral(ckks.PN12QP109)
-)
-
 // 生成一个新的空值用户
 func NewUser() *User {
 	user := new(User)
@@ -39,27 +34,43 @@ func NewUserWithUserName(userName string) *User {
 	return user
 }
 
+// ImportKeyChain 向 User 类型导入完整的密钥链，见 key.GenerateUserKeyChain
+func (user *User) ImportKeyChain(kc *key.KeyChain) {
+	user.UserCKKSKeyChain = append(user.UserCKKSKeyChain, kc.CKKSKeyChain)
+	user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, kc.ECDSAKeyChain)
+}
+
 // ImportWithCKKS{Secret, Public}Key9
 // 方法用于向 User 类型导入 CKKS 密钥对
 func (user *User) ImportWithCKKSSecretKey(sk *rlwe.SecretKey) error {
-	keyGenerator := ckks.NewKeyGenerator(ckksParams)
-	pk := keyGenerator.GenPublicKey(sk)
-	user.UserCKKSKeyChain = append(user.UserCKKSKeyChain, key.CKKSKeyChain{CKKSPrivateKey: sk, CKKSPublicKey: pk})
+	keyChain := key.LocalKeyGenerator{Params: misc.GetRLWEParams()}.NewCKKSKeyChainFromSecretKey(sk)
+	user.UserCKKSKeyChain = append(user.UserCKKSKeyChain, *keyChain)
 	return nil
 }
 
-func (user *User) ImportWithCKKSPublicKey(pk *rlwe.PublicKey) error {
-	user.UserCKKSKeyChain = append(user.UserCKKSKeyChain, key.CKKSKeyChain{CKKSPublicKey: pk, CKKSPrivateKey: nil})
+// ImportWithCKKSPublicKey 导入他人的 CKKS 公钥，id 为服务端登记的密钥 ID
+func (user *User) ImportWithCKKSPublicKey(id uuid.UUID, pk *rlwe.PublicKey) error {
+	user.UserCKKSKeyChain = append(user.UserCKKSKeyChain, key.CKKSKeyChain{Identifier: id, CKKSPublicKey: pk, CKKSPrivateKey: nil})
 	return nil
 }
 
-func (user *User) ImportECDSAPublicKey(pk *ecdsa.PublicKey) error {
-	user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, key.ECDSAKeyChain{ECDSAPublicKey: pk, ECDSAPrivateKey: nil})
+// ImportECDSA{Public, Private}Key
+// 方法用于向 User 类型导入签名密钥，算法见 key.SupportedSigAlgorithms
+// 导入公钥时 id 为服务端登记的密钥 ID
+func (user *User) ImportECDSAPublicKey(id uuid.UUID, pk crypto.PublicKey) error {
+	alg, err := key.SigAlgorithmOf(pk)
+	if err != nil {
+		return err
+	}
+	user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, key.ECDSAKeyChain{Identifier: id, Algorithm: alg, PublicKey: pk, PrivateKey: nil})
 	return nil
 }
 
-func (user *User) ImportECDSAPrivateKey(sk *ecdsa.PrivateKey) error {
-	pk := sk.PublicKey
-	user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, key.ECDSAKeyChain{ECDSAPrivateKey: sk, ECDSAPublicKey: &pk})
+func (user *User) ImportECDSAPrivateKey(sk crypto.Signer) error {
+	kc, err := key.NewSigningKeyChain(sk)
+	if err != nil {
+		return err
+	}
+	user.UserECDSAKeyChain = append(user.UserECDSAKeyChain, *kc)
 	return nil
 }